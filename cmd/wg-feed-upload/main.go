@@ -2,20 +2,34 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/joho/godotenv"
 
+	"github.com/exeteres/wg-feed/internal/atrest"
+	"github.com/exeteres/wg-feed/internal/boltstore"
 	"github.com/exeteres/wg-feed/internal/etcd"
+	"github.com/exeteres/wg-feed/internal/feedkey"
+	"github.com/exeteres/wg-feed/internal/history"
+	"github.com/exeteres/wg-feed/internal/server/httpapi"
+	"github.com/exeteres/wg-feed/internal/setuplink"
 	"github.com/exeteres/wg-feed/internal/upload"
 )
 
+const usage = "usage: %s [--ttl 900] [--recipient age1...]... [--warn-after time] [--not-after time] [--expiry-warning text] [--sign-key file] [--uploader name] [--comment text] [--keep 10] <feedPath> | policy <feedPath> | revoke <feedPath> <message> | alias <feedPath> <targetFeedPath> | history <feedPath> | [--sign-key file] rollback <feedPath> <revision> | [--link-ttl 24h] [--link-uses 1] [--base-url url] link <feedPath> | [--keep-legacy] migrate-keys | reencrypt"
+
 func main() {
 	_ = godotenv.Load()
 	logger := log.New(os.Stdout, "wg-feed-upload ", log.LstdFlags|log.LUTC)
@@ -23,27 +37,112 @@ func main() {
 	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
 	fs.SetOutput(io.Discard)
 	ttlSeconds := fs.Int("ttl", 15*60, "ttl_seconds for the success response")
-	if err := fs.Parse(os.Args[1:]); err != nil {
-		logger.Fatalf("usage: %s [--ttl 900] <feedPath>", os.Args[0])
+	var opts entryOptions
+	fs.Func("recipient", "age recipient for server-side encryption (repeatable)", func(v string) error {
+		opts.recipients = append(opts.recipients, strings.TrimSpace(v))
+		return nil
+	})
+	fs.Func("warn-after", "RFC 3339 time from which the served document carries an expiry warning", func(v string) (err error) {
+		opts.warnAfter, err = upload.ParseTimestamp(v)
+		return err
+	})
+	fs.Func("not-after", "RFC 3339 time from which the feed is no longer served", func(v string) (err error) {
+		opts.notAfter, err = upload.ParseTimestamp(v)
+		return err
+	})
+	fs.StringVar(&opts.expiryWarning, "expiry-warning", "", "warning_message served after --warn-after (default: the expiry date)")
+	fs.StringVar(&opts.signKey, "sign-key", "", "Ed25519 private key (PKCS #8 PEM) to sign the feed document with")
+	uploader := fs.String("uploader", defaultUploader(), "uploader recorded in the feed history")
+	comment := fs.String("comment", "", "comment recorded in the feed history")
+	keep := fs.Int("keep", history.DefaultKeep, "number of revisions kept in the feed history")
+	linkTTL := fs.Duration("link-ttl", 24*time.Hour, "link: validity of the setup link (0 = no expiry)")
+	linkUses := fs.Int("link-uses", 1, "link: number of fetches allowed (0 = unlimited)")
+	baseURL := fs.String("base-url", "", "link: server URL to print the setup link with")
+	keepLegacy := fs.Bool("keep-legacy", false, "migrate-keys: copy keys without deleting the plain ones")
+	if err := fs.Parse(os.Args[1:]); err != nil || *keep <= 0 {
+		logger.Fatalf(usage, os.Args[0])
 	}
 	args := fs.Args()
+	meta := history.Meta{Uploader: *uploader, Comment: *comment}
+
+	keys, err := feedkey.FromEnv()
+	if err != nil {
+		logger.Fatalf("config error: %v", err)
+	}
+	atRest, err := atrest.FromEnv()
+	if err != nil {
+		logger.Fatalf("config error: %v", err)
+	}
 
+	if len(args) == 2 && args[0] == "policy" {
+		uploadPolicy(logger, keys, args[1])
+		return
+	}
+	if len(args) == 3 && args[0] == "revoke" {
+		revokeFeed(logger, keys, args[1], args[2], meta, *keep)
+		return
+	}
+	if len(args) == 3 && args[0] == "alias" {
+		aliasFeed(logger, keys, args[1], args[2], meta, *keep)
+		return
+	}
+	if len(args) == 2 && args[0] == "history" {
+		showHistory(logger, keys, args[1])
+		return
+	}
+	if len(args) == 3 && args[0] == "rollback" {
+		rollbackFeed(logger, keys, atRest, args[1], args[2], opts.signKey, meta, *keep)
+		return
+	}
+	if len(args) == 2 && args[0] == "link" {
+		createLink(logger, keys, args[1], *linkTTL, *linkUses, *baseURL)
+		return
+	}
+	if len(args) == 1 && args[0] == "migrate-keys" {
+		migrateKeys(logger, keys, *keepLegacy)
+		return
+	}
+	if len(args) == 1 && args[0] == "reencrypt" {
+		reencrypt(logger, atRest)
+		return
+	}
 	if len(args) != 1 {
-		logger.Fatalf("usage: %s [--ttl 900] <feedPath>", os.Args[0])
+		logger.Fatalf(usage, os.Args[0])
+	}
+	uploadFeed(logger, keys, atRest, args[0], *ttlSeconds, opts, meta, *keep)
+}
+
+// defaultUploader identifies the local user, for the feed history.
+func defaultUploader() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
 	}
+	return os.Getenv("USER")
+}
+
+// entryOptions are the flags applied to an uploaded feed entry.
+type entryOptions struct {
+	recipients    []string
+	warnAfter     *time.Time
+	notAfter      *time.Time
+	expiryWarning string
+	signKey       string
+}
 
-	feedPath, err := upload.ParseFeedPath(args[0])
+func uploadFeed(logger *log.Logger, keys *feedkey.Deriver, atRest *atrest.Keyring, rawFeedPath string, ttlSeconds int, opts entryOptions, meta history.Meta, keep int) {
+	feedPath, err := upload.ParseFeedPath(rawFeedPath)
 	if err != nil {
 		logger.Fatalf("feedPath error: %v", err)
 	}
-	if err := upload.ValidateTTLSeconds(*ttlSeconds); err != nil {
+	if err := upload.ValidateTTLSeconds(ttlSeconds); err != nil {
 		logger.Fatalf("ttl error: %v", err)
 	}
 
-	endpoints, err := etcd.EndpointsFromEnv()
+	st, closeStore, err := openStore()
 	if err != nil {
-		logger.Fatalf("config error: %v", err)
+		logger.Fatalf("%v", err)
 	}
+	defer closeStore()
 
 	body, err := io.ReadAll(os.Stdin)
 	if err != nil {
@@ -54,25 +153,353 @@ func main() {
 	if err != nil {
 		logger.Fatalf("input error: %v", err)
 	}
-	storeBody, revision, err := upload.BuildStoreBodyJSON(*ttlSeconds, parsed)
+	parsed.Recipients = opts.recipients
+	parsed.WarnAfter = opts.warnAfter
+	parsed.NotAfter = opts.notAfter
+	parsed.ExpiryWarning = strings.TrimSpace(opts.expiryWarning)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if parsed.Sequence, err = history.NextSequence(ctx, st, keys.ID(feedPath), atRest.Open); err != nil {
+		logger.Fatalf("read sequence of %q: %v", feedPath, err)
+	}
+	if priv := loadSigningKey(logger, opts.signKey); priv != nil {
+		if err := upload.Sign(&parsed, priv); err != nil {
+			logger.Fatalf("sign feed document: %v", err)
+		}
+	}
+	storeBody, revision, err := upload.BuildStoreBodyJSON(ttlSeconds, parsed)
 	if err != nil {
 		logger.Fatalf("encode feed entry: %v", err)
 	}
+	if storeBody, err = atRest.Seal(storeBody); err != nil {
+		logger.Fatalf("seal feed entry: %v", err)
+	}
+
+	key := keys.FeedKey(feedPath)
+	if err := history.Put(ctx, st, keys.ID(feedPath), storeBody, meta, keep); err != nil {
+		logger.Fatalf("put key %q: %v", key, err)
+	}
+
+	if parsed.Signature != nil {
+		_, _ = fmt.Fprintf(os.Stdout, "Uploaded feed to %s (revision=%s sequence=%d signer=%s)\n", key, revision, parsed.Sequence, parsed.Signature.PublicKey)
+		return
+	}
+	_, _ = fmt.Fprintf(os.Stdout, "Uploaded feed to %s (revision=%s sequence=%d)\n", key, revision, parsed.Sequence)
+}
+
+// loadSigningKey reads the --sign-key file, if set.
+func loadSigningKey(logger *log.Logger, path string) ed25519.PrivateKey {
+	if path == "" {
+		return nil
+	}
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		logger.Fatalf("read signing key: %v", err)
+	}
+	priv, err := upload.ParseSigningKey(pemBytes)
+	if err != nil {
+		logger.Fatalf("signing key error: %v", err)
+	}
+	return priv
+}
+
+func uploadPolicy(logger *log.Logger, keys *feedkey.Deriver, rawFeedPath string) {
+	feedPath, err := upload.ParseFeedPath(rawFeedPath)
+	if err != nil {
+		logger.Fatalf("feedPath error: %v", err)
+	}
+
+	st, closeStore, err := openStore()
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+	defer closeStore()
+
+	body, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		logger.Fatalf("read stdin: %v", err)
+	}
+	storeBody, err := upload.BuildPolicyBodyJSON(string(body))
+	if err != nil {
+		logger.Fatalf("input error: %v", err)
+	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	cli, err := etcd.NewClient(endpoints)
+	key := keys.PolicyKey(feedPath)
+	if err := st.Put(ctx, key, storeBody); err != nil {
+		logger.Fatalf("put key %q: %v", key, err)
+	}
+
+	_, _ = fmt.Fprintf(os.Stdout, "Uploaded access policy to %s\n", key)
+}
+
+func revokeFeed(logger *log.Logger, keys *feedkey.Deriver, rawFeedPath, message string, meta history.Meta, keep int) {
+	feedPath, err := upload.ParseFeedPath(rawFeedPath)
+	if err != nil {
+		logger.Fatalf("feedPath error: %v", err)
+	}
+	storeBody, revision, err := upload.BuildTombstoneBodyJSON(message)
+	if err != nil {
+		logger.Fatalf("input error: %v", err)
+	}
+
+	st, closeStore, err := openStore()
 	if err != nil {
-		logger.Fatalf("create etcd client: %v", err)
+		logger.Fatalf("%v", err)
 	}
-	defer cli.Close()
+	defer closeStore()
 
-	st := etcd.NewStore(cli)
-	key := "wg-feed/feeds/" + feedPath
-	if err := st.Put(ctx, key, storeBody); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	key := keys.FeedKey(feedPath)
+	if err := history.Put(ctx, st, keys.ID(feedPath), storeBody, meta, keep); err != nil {
+		logger.Fatalf("put key %q: %v", key, err)
+	}
+
+	_, _ = fmt.Fprintf(os.Stdout, "Revoked feed %s (revision=%s)\n", key, revision)
+}
+
+func aliasFeed(logger *log.Logger, keys *feedkey.Deriver, rawFeedPath, rawTargetPath string, meta history.Meta, keep int) {
+	feedPath, err := upload.ParseFeedPath(rawFeedPath)
+	if err != nil {
+		logger.Fatalf("feedPath error: %v", err)
+	}
+	targetPath, err := upload.ParseFeedPath(rawTargetPath)
+	if err != nil {
+		logger.Fatalf("targetFeedPath error: %v", err)
+	}
+	if targetPath == feedPath {
+		logger.Fatalf("input error: a feed cannot be an alias of itself")
+	}
+	storeBody, revision, err := upload.BuildAliasBodyJSON(keys.ID(targetPath))
+	if err != nil {
+		logger.Fatalf("input error: %v", err)
+	}
+
+	st, closeStore, err := openStore()
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+	defer closeStore()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	targetKey := keys.FeedKey(targetPath)
+	target, found, err := st.Get(ctx, targetKey)
+	if err != nil {
+		logger.Fatalf("get key %q: %v", targetKey, err)
+	}
+	if err := upload.ValidateAliasTarget(target, found); err != nil {
+		logger.Fatalf("input error: %v", err)
+	}
+
+	key := keys.FeedKey(feedPath)
+	if err := history.Put(ctx, st, keys.ID(feedPath), storeBody, meta, keep); err != nil {
 		logger.Fatalf("put key %q: %v", key, err)
 	}
 
-	_, _ = fmt.Fprintf(os.Stdout, "Uploaded feed to %s (revision=%s)\n", key, revision)
+	_, _ = fmt.Fprintf(os.Stdout, "Aliased feed %s to %s (revision=%s)\n", key, targetKey, revision)
+}
+
+func showHistory(logger *log.Logger, keys *feedkey.Deriver, rawFeedPath string) {
+	feedPath, err := upload.ParseFeedPath(rawFeedPath)
+	if err != nil {
+		logger.Fatalf("feedPath error: %v", err)
+	}
+
+	st, closeStore, err := openStore()
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+	defer closeStore()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	records, err := history.List(ctx, st, keys.ID(feedPath))
+	if err != nil {
+		logger.Fatalf("read history of %q: %v", feedPath, err)
+	}
+	if len(records) == 0 {
+		_, _ = fmt.Fprintf(os.Stdout, "No history for %s\n", keys.FeedKey(feedPath))
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "REVISION\tUPLOADED AT\tUPLOADER\tCOMMENT")
+	for _, rec := range records {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", rec.Revision, rec.UploadedAt.Format(time.RFC3339), rec.Uploader, rec.Comment)
+	}
+	_ = tw.Flush()
+}
+
+func rollbackFeed(logger *log.Logger, keys *feedkey.Deriver, atRest *atrest.Keyring, rawFeedPath, revision, signKey string, meta history.Meta, keep int) {
+	feedPath, err := upload.ParseFeedPath(rawFeedPath)
+	if err != nil {
+		logger.Fatalf("feedPath error: %v", err)
+	}
+	priv := loadSigningKey(logger, signKey)
+
+	st, closeStore, err := openStore()
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+	defer closeStore()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// The entry is published with a new sequence, so that clients that have
+	// seen a later entry accept it.
+	id := keys.ID(feedPath)
+	rec, err := history.Rollback(ctx, st, id, strings.TrimSpace(revision), meta, keep, func(entry []byte) ([]byte, error) {
+		seq, err := history.NextSequence(ctx, st, id, atRest.Open)
+		if err != nil {
+			return nil, err
+		}
+		body, err := atRest.Open(entry)
+		if err != nil {
+			return nil, err
+		}
+		if body, err = upload.Resequence(body, seq, priv); err != nil {
+			return nil, err
+		}
+		return atRest.Seal(body)
+	})
+	if err != nil {
+		logger.Fatalf("rollback %q: %v", feedPath, err)
+	}
+
+	_, _ = fmt.Fprintf(os.Stdout, "Rolled back %s to revision=%s (uploaded %s by %s)\n", keys.FeedKey(feedPath), rec.Revision, rec.UploadedAt.Format(time.RFC3339), rec.Uploader)
+}
+
+func createLink(logger *log.Logger, keys *feedkey.Deriver, rawFeedPath string, ttl time.Duration, maxUses int, baseURL string) {
+	feedPath, err := upload.ParseFeedPath(rawFeedPath)
+	if err != nil {
+		logger.Fatalf("feedPath error: %v", err)
+	}
+
+	st, closeStore, err := openStore()
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+	defer closeStore()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	key := keys.FeedKey(feedPath)
+	if _, found, err := st.Get(ctx, key); err != nil {
+		logger.Fatalf("get key %q: %v", key, err)
+	} else if !found {
+		logger.Fatalf("feed %s does not exist", key)
+	}
+
+	token, rec, err := setuplink.Create(ctx, st, keys.ID(feedPath), ttl, maxUses)
+	if err != nil {
+		logger.Fatalf("create setup link: %v", err)
+	}
+
+	link := "/" + setuplink.PathPrefix + token
+	if baseURL != "" {
+		link = strings.TrimRight(baseURL, "/") + link
+	}
+	expires, uses := "never", "unlimited"
+	if rec.ExpiresAt != nil {
+		expires = rec.ExpiresAt.Format(time.RFC3339)
+	}
+	if rec.MaxUses > 0 {
+		uses = strconv.Itoa(rec.MaxUses)
+	}
+	_, _ = fmt.Fprintf(os.Stdout, "Setup link for %s (expires %s, uses %s):\n%s\n", key, expires, uses, link)
+}
+
+func migrateKeys(logger *log.Logger, keys *feedkey.Deriver, keepLegacy bool) {
+	if !keys.Enabled() {
+		logger.Fatalf("config error: FEED_KEY_SECRET is required to migrate keys")
+	}
+
+	st, closeStore, err := openStore()
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+	defer closeStore()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	stats, err := feedkey.Migrate(ctx, st, keys, keepLegacy)
+	if err != nil {
+		logger.Fatalf("migrate keys: %v", err)
+	}
+
+	_, _ = fmt.Fprintf(os.Stdout, "Migrated keys: copied=%d removed=%d changed=%d aliases=%d\n", stats.Copied, stats.Removed, stats.Changed, stats.Aliases)
+	if stats.Changed > 0 {
+		_, _ = fmt.Fprintln(os.Stdout, "Some plain keys changed during the migration and were kept; run migrate-keys again.")
+	}
+}
+
+func reencrypt(logger *log.Logger, atRest *atrest.Keyring) {
+	if !atRest.Enabled() {
+		logger.Fatalf("config error: AT_REST_KEYS or AT_REST_KEYS_FILE is required to re-encrypt entries")
+	}
+
+	st, closeStore, err := openStore()
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+	defer closeStore()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	stats, err := atrest.Reencrypt(ctx, st, atRest)
+	if err != nil {
+		logger.Fatalf("reencrypt: %v", err)
+	}
+
+	_, _ = fmt.Fprintf(os.Stdout, "Re-encrypted with key %s: resealed=%d changed=%d\n", atRest.ActiveKeyID(), stats.Resealed, stats.Changed)
+	if stats.Changed > 0 {
+		_, _ = fmt.Fprintln(os.Stdout, "Some entries changed during re-encryption and were kept; run reencrypt again.")
+	}
+
+	if dir := strings.TrimSpace(os.Getenv("SNAPSHOT_DIR")); dir != "" {
+		n, err := httpapi.ReencryptSnapshots(dir, atRest)
+		if err != nil {
+			logger.Fatalf("reencrypt snapshots: %v", err)
+		}
+		_, _ = fmt.Fprintf(os.Stdout, "Re-encrypted snapshots in %s: resealed=%d\n", dir, n)
+	}
+}
+
+type store interface {
+	history.Store
+	feedkey.MigrateStore
+	Put(ctx context.Context, key string, value []byte) error
+}
+
+// openStore writes into the local bolt database at BOLT_PATH when set, otherwise into etcd.
+func openStore() (store, func(), error) {
+	if path := strings.TrimSpace(os.Getenv("BOLT_PATH")); path != "" {
+		st, err := boltstore.NewStore(path, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		return st, func() {}, nil
+	}
+
+	cfg, err := etcd.ConfigFromEnv()
+	if err != nil {
+		return nil, nil, fmt.Errorf("config error: %w", err)
+	}
+	cli, err := etcd.NewClient(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create etcd client: %w", err)
+	}
+	return etcd.NewStore(cli), func() { _ = cli.Close() }, nil
 }
@@ -71,14 +71,14 @@ func startEtcd(t *testing.T) (endpoint string, cleanup func()) {
 func startServer(t *testing.T, etcdEndpoints []string) (baseURL string, shutdown func()) {
 	t.Helper()
 
-	etcdClient, err := etcd.NewClient(etcdEndpoints)
+	etcdClient, err := etcd.NewClient(etcd.Config{Endpoints: etcdEndpoints})
 	if err != nil {
 		t.Fatalf("create etcd client: %v", err)
 	}
 
 	logger := log.New(io.Discard, "test ", log.LstdFlags)
 	st := etcd.NewStore(etcdClient)
-	h := httpapi.NewHandler(st, logger)
+	h := httpapi.NewHandler(st, logger, httpapi.Options{})
 
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -105,7 +105,7 @@ func startServer(t *testing.T, etcdEndpoints []string) (baseURL string, shutdown
 func putKey(t *testing.T, endpoint, key string, value []byte) {
 	t.Helper()
 
-	cli, err := etcd.NewClient([]string{endpoint})
+	cli, err := etcd.NewClient(etcd.Config{Endpoints: []string{endpoint}})
 	if err != nil {
 		t.Fatalf("create etcd client: %v", err)
 	}
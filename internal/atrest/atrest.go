@@ -0,0 +1,311 @@
+// Package atrest seals plaintext feed entries before they are written to the
+// store and opens them after they are read, so that wg-quick configurations
+// (and the client private keys in them) are not kept in the store in the clear.
+//
+// Sealing is envelope encryption: the entry is encrypted with a fresh
+// AES-256-GCM data key, and the data key is encrypted with a master key. The
+// sealed value keeps the revision readable and names the master key by its ID:
+//
+//	{"revision":"...","sealed":{"key_id":"2026-10","data_key":"...","ciphertext":"..."}}
+//
+// New entries are sealed with the active (first) key of a Keyring; the other
+// keys only open existing entries until Reencrypt has sealed them again, which
+// is how master keys are rotated. Age-encrypted entries and tombstones carry
+// no plaintext configuration and are stored as they are.
+package atrest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	keySize = 32
+	// dataKeyAAD binds wrapped data keys to their purpose and master key ID.
+	dataKeyAAD = "wg-feed/at-rest\x00"
+)
+
+var (
+	ErrNoKeys     = errors.New("entry is sealed but no at-rest keys are configured")
+	ErrUnknownKey = errors.New("entry is sealed with an unknown at-rest key")
+
+	keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+)
+
+// Keyring holds the master keys. A nil *Keyring seals nothing and only opens
+// entries that are not sealed.
+type Keyring struct {
+	active string
+	keys   map[string][]byte
+}
+
+// envelope is the stored form of a sealed entry.
+type envelope struct {
+	Revision string  `json:"revision"`
+	Sealed   *sealed `json:"sealed,omitempty"`
+}
+
+type sealed struct {
+	KeyID      string `json:"key_id"`
+	DataKey    []byte `json:"data_key"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// ParseKeyring parses master keys written as "<key id>:<base64 key>", separated
+// by commas or whitespace. Keys are 32 bytes (standard base64); the first one
+// is the active key.
+func ParseKeyring(raw string) (*Keyring, error) {
+	fields := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	if len(fields) == 0 {
+		return nil, errors.New("must contain at least one key")
+	}
+	k := &Keyring{keys: make(map[string][]byte, len(fields))}
+	for _, field := range fields {
+		id, encoded, ok := strings.Cut(field, ":")
+		if !ok || !keyIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("entries must be <key id>:<base64 key> with a key id of [A-Za-z0-9._-], got %q", id)
+		}
+		if _, dup := k.keys[id]; dup {
+			return nil, fmt.Errorf("duplicate key id %q", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("key %q must be %d bytes of base64", id, keySize)
+		}
+		k.keys[id] = key
+		if k.active == "" {
+			k.active = id
+		}
+	}
+	return k, nil
+}
+
+// FromEnv returns the Keyring configured by AT_REST_KEYS or AT_REST_KEYS_FILE
+// (a file with the same contents), or nil when neither is set.
+func FromEnv() (*Keyring, error) {
+	raw := strings.TrimSpace(os.Getenv("AT_REST_KEYS"))
+	path := strings.TrimSpace(os.Getenv("AT_REST_KEYS_FILE"))
+	switch {
+	case raw != "" && path != "":
+		return nil, errors.New("AT_REST_KEYS and AT_REST_KEYS_FILE are mutually exclusive")
+	case path != "":
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("AT_REST_KEYS_FILE: %w", err)
+		}
+		k, err := ParseKeyring(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("AT_REST_KEYS_FILE %w", err)
+		}
+		return k, nil
+	case raw != "":
+		k, err := ParseKeyring(raw)
+		if err != nil {
+			return nil, fmt.Errorf("AT_REST_KEYS %w", err)
+		}
+		return k, nil
+	}
+	return nil, nil
+}
+
+// Enabled reports whether entries are sealed.
+func (k *Keyring) Enabled() bool {
+	return k != nil
+}
+
+// ActiveKeyID returns the ID of the key new entries are sealed with.
+func (k *Keyring) ActiveKeyID() string {
+	if k == nil {
+		return ""
+	}
+	return k.active
+}
+
+// SealedWith returns the key ID a stored value is sealed with, or false when
+// it is not sealed.
+func SealedWith(value []byte) (string, bool) {
+	var env envelope
+	if err := json.Unmarshal(value, &env); err != nil || env.Sealed == nil {
+		return "", false
+	}
+	return env.Sealed.KeyID, true
+}
+
+// Seal returns the stored form of a plaintext feed entry. Entries without
+// plaintext data are returned unchanged, as is everything when k is nil.
+func (k *Keyring) Seal(entry []byte) ([]byte, error) {
+	if k == nil {
+		return entry, nil
+	}
+	var e struct {
+		Revision string          `json:"revision"`
+		Data     json.RawMessage `json:"data"`
+		Sealed   json.RawMessage `json:"sealed"`
+	}
+	if err := json.Unmarshal(entry, &e); err != nil {
+		return nil, fmt.Errorf("decode entry: %w", err)
+	}
+	if e.Sealed != nil {
+		return nil, errors.New("entry is already sealed")
+	}
+	if len(e.Data) == 0 || bytes.Equal(e.Data, []byte("null")) {
+		return entry, nil
+	}
+
+	s, err := k.seal(entry, []byte(e.Revision))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope{Revision: e.Revision, Sealed: s})
+}
+
+// SealValue seals an arbitrary value with the active key, unlike Seal without
+// looking into it. aad binds the sealed value to where it is kept; OpenValue
+// needs the same aad.
+func (k *Keyring) SealValue(value, aad []byte) ([]byte, error) {
+	if k == nil {
+		return nil, ErrNoKeys
+	}
+	s, err := k.seal(value, aad)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(s)
+}
+
+// OpenValue returns the value sealed by SealValue.
+func (k *Keyring) OpenValue(value, aad []byte) ([]byte, error) {
+	var s sealed
+	if err := json.Unmarshal(value, &s); err != nil {
+		return nil, fmt.Errorf("decode sealed value: %w", err)
+	}
+	return k.open(&s, aad)
+}
+
+// ResealValue seals a value sealed by SealValue with the active key unless it
+// already is, reporting whether it changed.
+func (k *Keyring) ResealValue(value, aad []byte) ([]byte, bool, error) {
+	var s sealed
+	if err := json.Unmarshal(value, &s); err != nil {
+		return nil, false, fmt.Errorf("decode sealed value: %w", err)
+	}
+	if k != nil && s.KeyID == k.active {
+		return value, false, nil
+	}
+	plaintext, err := k.open(&s, aad)
+	if err != nil {
+		return nil, false, err
+	}
+	next, err := k.SealValue(plaintext, aad)
+	if err != nil {
+		return nil, false, err
+	}
+	return next, true, nil
+}
+
+// seal encrypts plaintext with a fresh data key wrapped by the active key.
+func (k *Keyring) seal(plaintext, aad []byte) (*sealed, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	ciphertext, err := seal(dataKey, plaintext, aad)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := seal(k.keys[k.active], dataKey, []byte(dataKeyAAD+k.active))
+	if err != nil {
+		return nil, err
+	}
+	return &sealed{KeyID: k.active, DataKey: wrapped, Ciphertext: ciphertext}, nil
+}
+
+// Open returns the feed entry of a stored value. Values that are not sealed
+// are returned unchanged.
+func (k *Keyring) Open(value []byte) ([]byte, error) {
+	var env envelope
+	if err := json.Unmarshal(value, &env); err != nil || env.Sealed == nil {
+		// Not sealed; undecodable values are left to the entry validation.
+		return value, nil
+	}
+	return k.open(env.Sealed, []byte(env.Revision))
+}
+
+func (k *Keyring) open(s *sealed, aad []byte) ([]byte, error) {
+	if k == nil {
+		return nil, ErrNoKeys
+	}
+	master, ok := k.keys[s.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, s.KeyID)
+	}
+	dataKey, err := open(master, s.DataKey, []byte(dataKeyAAD+s.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key: %w", err)
+	}
+	plaintext, err := open(dataKey, s.Ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+	return plaintext, nil
+}
+
+// reseal seals value with the active key unless it already is, reporting
+// whether it changed.
+func (k *Keyring) reseal(value []byte) ([]byte, bool, error) {
+	if id, ok := SealedWith(value); ok && id == k.active {
+		return value, false, nil
+	}
+	entry, err := k.Open(value)
+	if err != nil {
+		return nil, false, err
+	}
+	next, err := k.Seal(entry)
+	if err != nil {
+		return nil, false, err
+	}
+	return next, !bytes.Equal(next, value), nil
+}
+
+func seal(key, plaintext, aad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(key, ciphertext, aad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, rest := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, rest, aad)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,203 @@
+package atrest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+const (
+	key1 = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	key2 = "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+
+	plainEntry = `{"revision":"rev-1","ttl_seconds":60,"encrypted":false,"data":{"tunnels":[{"wg_quick_config":"PrivateKey = secret"}]}}`
+)
+
+func mustKeyring(t *testing.T, raw string) *Keyring {
+	t.Helper()
+	k, err := ParseKeyring(raw)
+	if err != nil {
+		t.Fatalf("ParseKeyring(%q): %v", raw, err)
+	}
+	return k
+}
+
+func TestParseKeyring(t *testing.T) {
+	k := mustKeyring(t, "new:"+key2+",\nold:"+key1+"\n")
+	if k.ActiveKeyID() != "new" || len(k.keys) != 2 {
+		t.Fatalf("unexpected keyring: active=%q keys=%d", k.ActiveKeyID(), len(k.keys))
+	}
+	for _, raw := range []string{"", key1, "a b:" + key1, "k1:c2hvcnQ=", "k1:" + key1 + ",k1:" + key2} {
+		if _, err := ParseKeyring(raw); err == nil {
+			t.Fatalf("ParseKeyring(%q): expected error", raw)
+		}
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	k := mustKeyring(t, "k1:"+key1)
+
+	sealed, err := k.Seal([]byte(plainEntry))
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if bytes.Contains(sealed, []byte("PrivateKey")) {
+		t.Fatalf("sealed value contains plaintext: %s", sealed)
+	}
+	if id, ok := SealedWith(sealed); !ok || id != "k1" {
+		t.Fatalf("SealedWith = %q, %v", id, ok)
+	}
+	var env envelope
+	if err := json.Unmarshal(sealed, &env); err != nil || env.Revision != "rev-1" {
+		t.Fatalf("revision not readable: %s", sealed)
+	}
+
+	opened, err := k.Open(sealed)
+	if err != nil || string(opened) != plainEntry {
+		t.Fatalf("Open = %s, %v", opened, err)
+	}
+
+	// A different revision must not open the ciphertext of another one.
+	tampered := bytes.Replace(sealed, []byte(`"rev-1"`), []byte(`"rev-2"`), 1)
+	if _, err := k.Open(tampered); err == nil {
+		t.Fatalf("expected error for tampered revision")
+	}
+
+	if _, err := (*Keyring)(nil).Open(sealed); !errors.Is(err, ErrNoKeys) {
+		t.Fatalf("expected ErrNoKeys, got %v", err)
+	}
+	if _, err := mustKeyring(t, "k2:"+key2).Open(sealed); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected ErrUnknownKey, got %v", err)
+	}
+	if _, err := mustKeyring(t, "k1:"+key2).Open(sealed); err == nil {
+		t.Fatalf("expected error for wrong key material")
+	}
+}
+
+func TestSealValue(t *testing.T) {
+	old := mustKeyring(t, "k1:"+key1)
+	sealed, err := old.SealValue([]byte(`{"secret":1}`), []byte("aad"))
+	if err != nil {
+		t.Fatalf("SealValue: %v", err)
+	}
+	if bytes.Contains(sealed, []byte("secret")) {
+		t.Fatalf("sealed value contains plaintext: %s", sealed)
+	}
+	if _, err := old.OpenValue(sealed, []byte("other")); err == nil {
+		t.Fatalf("expected error for a different aad")
+	}
+
+	rotated := mustKeyring(t, "k2:"+key2+",k1:"+key1)
+	resealed, changed, err := rotated.ResealValue(sealed, []byte("aad"))
+	if err != nil || !changed {
+		t.Fatalf("ResealValue: changed=%v err=%v", changed, err)
+	}
+	if _, changed, _ := rotated.ResealValue(resealed, []byte("aad")); changed {
+		t.Fatalf("expected a value sealed with the active key to stay")
+	}
+	opened, err := mustKeyring(t, "k2:"+key2).OpenValue(resealed, []byte("aad"))
+	if err != nil || string(opened) != `{"secret":1}` {
+		t.Fatalf("OpenValue = %s, %v", opened, err)
+	}
+}
+
+func TestSealLeavesEntriesWithoutData(t *testing.T) {
+	k := mustKeyring(t, "k1:"+key1)
+	for _, entry := range []string{
+		`{"revision":"r","ttl_seconds":60,"encrypted":true,"encrypted_data":"-----BEGIN AGE ENCRYPTED FILE-----"}`,
+		`{"revision":"r","ttl_seconds":60,"revoked":true,"message":"gone"}`,
+	} {
+		got, err := k.Seal([]byte(entry))
+		if err != nil || string(got) != entry {
+			t.Fatalf("Seal(%s) = %s, %v", entry, got, err)
+		}
+	}
+	if got, err := (*Keyring)(nil).Seal([]byte(plainEntry)); err != nil || string(got) != plainEntry {
+		t.Fatalf("nil Keyring sealed the entry: %s, %v", got, err)
+	}
+	if got, err := (*Keyring)(nil).Open([]byte(plainEntry)); err != nil || string(got) != plainEntry {
+		t.Fatalf("nil Keyring changed a plain entry: %s, %v", got, err)
+	}
+}
+
+type memStore struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func (s *memStore) List(_ context.Context, prefix string) ([]*mvccpb.KeyValue, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kvs []*mvccpb.KeyValue
+	for k, v := range s.values {
+		if strings.HasPrefix(k, prefix) {
+			kvs = append(kvs, &mvccpb.KeyValue{Key: []byte(k), Value: v})
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return bytes.Compare(kvs[i].Key, kvs[j].Key) < 0 })
+	return kvs, nil
+}
+
+func (s *memStore) CompareAndPut(_ context.Context, key string, expected, value []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cur, ok := s.values[key]; !ok || !bytes.Equal(cur, expected) {
+		return false, nil
+	}
+	s.values[key] = value
+	return true, nil
+}
+
+func TestReencrypt(t *testing.T) {
+	old := mustKeyring(t, "old:"+key1)
+	sealedOld, err := old.Seal([]byte(plainEntry))
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	historyDoc, _ := json.Marshal(map[string]any{"records": []map[string]any{
+		{"revision": "rev-1", "uploaded_at": "2026-01-01T00:00:00Z", "entry": json.RawMessage(plainEntry)},
+	}})
+	tombstone := `{"revision":"r","ttl_seconds":60,"revoked":true,"message":"gone"}`
+	st := &memStore{values: map[string][]byte{
+		"wg-feed/feeds/a":   []byte(plainEntry),
+		"wg-feed/feeds/b":   sealedOld,
+		"wg-feed/feeds/c":   []byte(tombstone),
+		"wg-feed/history/a": historyDoc,
+	}}
+
+	rotated := mustKeyring(t, "new:"+key2+",old:"+key1)
+	stats, err := Reencrypt(context.Background(), st, rotated)
+	if err != nil || stats.Resealed != 3 || stats.Changed != 0 {
+		t.Fatalf("Reencrypt: stats=%+v err=%v", stats, err)
+	}
+	for _, key := range []string{"wg-feed/feeds/a", "wg-feed/feeds/b"} {
+		if id, ok := SealedWith(st.values[key]); !ok || id != "new" {
+			t.Fatalf("%s not sealed with the new key: %s", key, st.values[key])
+		}
+	}
+	if string(st.values["wg-feed/feeds/c"]) != tombstone {
+		t.Fatalf("tombstone was changed: %s", st.values["wg-feed/feeds/c"])
+	}
+	if bytes.Contains(st.values["wg-feed/history/a"], []byte("PrivateKey")) {
+		t.Fatalf("history still holds plaintext: %s", st.values["wg-feed/history/a"])
+	}
+
+	// Only the new key is needed from now on, and a second run changes nothing.
+	current := mustKeyring(t, "new:"+key2)
+	if opened, err := current.Open(st.values["wg-feed/feeds/b"]); err != nil || string(opened) != plainEntry {
+		t.Fatalf("Open after rotation = %s, %v", opened, err)
+	}
+	if stats, err := Reencrypt(context.Background(), st, current); err != nil || stats.Resealed != 0 {
+		t.Fatalf("second Reencrypt: stats=%+v err=%v", stats, err)
+	}
+	if _, err := Reencrypt(context.Background(), st, nil); err == nil {
+		t.Fatalf("expected error without keys")
+	}
+}
@@ -0,0 +1,67 @@
+package atrest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/exeteres/wg-feed/internal/feedkey"
+	"github.com/exeteres/wg-feed/internal/history"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+// ReencryptStore is the subset of store operations used by Reencrypt.
+type ReencryptStore interface {
+	List(ctx context.Context, prefix string) ([]*mvccpb.KeyValue, error)
+	CompareAndPut(ctx context.Context, key string, expected, value []byte) (bool, error)
+}
+
+// ReencryptStats counts the keys handled by Reencrypt.
+type ReencryptStats struct {
+	// Resealed keys were written sealed with the active key.
+	Resealed int
+	// Changed keys were modified while being re-encrypted and were left in place.
+	Changed int
+}
+
+// Reencrypt seals every plaintext feed entry, and every entry sealed with a
+// key other than the active one, with the active key. Entries recorded in the
+// feed history are resealed as well, so that retired keys can be removed from
+// the Keyring afterwards.
+func Reencrypt(ctx context.Context, st ReencryptStore, k *Keyring) (ReencryptStats, error) {
+	var stats ReencryptStats
+	if k == nil {
+		return stats, errors.New("at-rest keys are required to re-encrypt entries")
+	}
+	rewrites := map[string]func([]byte) ([]byte, bool, error){
+		feedkey.FeedsPrefix: k.reseal,
+		feedkey.HistoryPrefix: func(doc []byte) ([]byte, bool, error) {
+			return history.Rewrite(doc, k.reseal)
+		},
+	}
+	for _, prefix := range []string{feedkey.FeedsPrefix, feedkey.HistoryPrefix} {
+		kvs, err := st.List(ctx, prefix)
+		if err != nil {
+			return stats, err
+		}
+		for _, kv := range kvs {
+			next, changed, err := rewrites[prefix](kv.Value)
+			if err != nil {
+				return stats, fmt.Errorf("%s: %w", kv.Key, err)
+			}
+			if !changed {
+				continue
+			}
+			ok, err := st.CompareAndPut(ctx, string(kv.Key), kv.Value, next)
+			if err != nil {
+				return stats, err
+			}
+			if ok {
+				stats.Resealed++
+			} else {
+				stats.Changed++
+			}
+		}
+	}
+	return stats, nil
+}
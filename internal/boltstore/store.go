@@ -0,0 +1,477 @@
+package boltstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	bucketKV   = []byte("kv")
+	bucketRevs = []byte("revs")
+	// bucketChanges indexes the keys of bucketRevs by their revision
+	// (revision+key), so that watchers seek to the changes they have not seen.
+	bucketChanges = []byte("changes")
+	// bucketDeleted holds the changes entries of deleted keys until they have
+	// been dispatched to watchers.
+	bucketDeleted = []byte("deleted")
+	bucketMeta    = []byte("meta")
+	keyRevision   = []byte("revision")
+)
+
+// Store is a single-file embedded store backed by bbolt.
+//
+// The database file is opened only for the duration of each operation, so
+// several processes (e.g. wg-feed-server and wg-feed-upload) can share it.
+// Every Put bumps a store-wide revision in the same transaction; watchers are
+// notified immediately for writes made through this Store and within
+// pollInterval for writes made by other processes. Deleted keys are forgotten
+// once a watching Store has dispatched them.
+type Store struct {
+	path         string
+	pollInterval time.Duration
+
+	mu      sync.Mutex
+	watches map[string]map[*watch]struct{}
+	lastRev uint64
+	running bool
+	kick    chan struct{}
+}
+
+type watch struct {
+	notify chan struct{}
+
+	mu      sync.Mutex
+	pending *mvccpb.KeyValue
+}
+
+// NewStore opens (creating if needed) the database at path.
+func NewStore(path string, pollInterval time.Duration) (*Store, error) {
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+	s := &Store{
+		path:         path,
+		pollInterval: pollInterval,
+		watches:      map[string]map[*watch]struct{}{},
+		kick:         make(chan struct{}, 1),
+	}
+	err := s.update(func(tx *bolt.Tx) error {
+		indexed := tx.Bucket(bucketChanges) != nil
+		for _, name := range [][]byte{bucketKV, bucketRevs, bucketChanges, bucketDeleted, bucketMeta} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if indexed {
+			return nil
+		}
+		// Databases written before the changes index existed.
+		kv, changes, deleted := tx.Bucket(bucketKV), tx.Bucket(bucketChanges), tx.Bucket(bucketDeleted)
+		return tx.Bucket(bucketRevs).ForEach(func(k, v []byte) error {
+			ck := changeKey(decodeRevision(v), k)
+			if err := changes.Put(ck, []byte{}); err != nil {
+				return err
+			}
+			if kv.Get(k) == nil {
+				return deleted.Put(ck, []byte{})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("open bolt store %q: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *Store) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	var out []byte
+	err := s.view(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(bucketKV).Get([]byte(key)); v != nil {
+			out = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return out, out != nil, nil
+}
+
+func (s *Store) Put(ctx context.Context, key string, value []byte) error {
+	_, err := s.write(ctx, change{key: key, value: value})
+	return err
+}
+
+// CompareAndPut sets key to value if its current value equals expected; a nil
+// expected requires the key to be absent. It reports whether the write happened.
+func (s *Store) CompareAndPut(ctx context.Context, key string, expected, value []byte) (bool, error) {
+	return s.write(ctx, change{key: key, value: value, cond: valueEquals(expected)})
+}
+
+// CompareAndPutAll sets keys[i] to values[i] for every i in a single
+// transaction, if each key's current value equals expected[i] (nil requires
+// the key to be absent). It reports whether the writes happened.
+func (s *Store) CompareAndPutAll(ctx context.Context, keys []string, expected, values [][]byte) (bool, error) {
+	if len(expected) != len(keys) || len(values) != len(keys) {
+		return false, fmt.Errorf("keys, expected and values must have the same length")
+	}
+	changes := make([]change, 0, len(keys))
+	for i, key := range keys {
+		changes = append(changes, change{key: key, value: values[i], cond: valueEquals(expected[i])})
+	}
+	return s.write(ctx, changes...)
+}
+
+// CompareAndDelete deletes key if its current value equals expected.
+func (s *Store) CompareAndDelete(ctx context.Context, key string, expected []byte) (bool, error) {
+	return s.write(ctx, change{key: key, cond: func(cur []byte) bool {
+		return cur != nil && bytes.Equal(cur, expected)
+	}})
+}
+
+func valueEquals(expected []byte) func(cur []byte) bool {
+	return func(cur []byte) bool {
+		if expected == nil {
+			return cur == nil
+		}
+		return cur != nil && bytes.Equal(cur, expected)
+	}
+}
+
+// List returns all keys under prefix, sorted by key.
+func (s *Store) List(ctx context.Context, prefix string) ([]*mvccpb.KeyValue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var kvs []*mvccpb.KeyValue
+	err := s.view(func(tx *bolt.Tx) error {
+		revs := tx.Bucket(bucketRevs)
+		c := tx.Bucket(bucketKV).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			kvs = append(kvs, &mvccpb.KeyValue{
+				Key:         append([]byte(nil), k...),
+				Value:       append([]byte(nil), v...),
+				ModRevision: int64(decodeRevision(revs.Get(k))),
+			})
+		}
+		return nil
+	})
+	return kvs, err
+}
+
+// change stores value under key, deleting it when value is nil, if cond
+// (when set) accepts the current value.
+type change struct {
+	key   string
+	value []byte
+	cond  func(cur []byte) bool
+}
+
+// write applies changes in one transaction at one new store revision, or none
+// of them if any condition fails. Deleted keys keep their revision entry until
+// pruneDeleted, so that watchers observe the deletion.
+func (s *Store) write(ctx context.Context, changes ...change) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	written := false
+	err := s.update(func(tx *bolt.Tx) error {
+		kv := tx.Bucket(bucketKV)
+		for _, c := range changes {
+			if c.cond != nil && !c.cond(kv.Get([]byte(c.key))) {
+				return nil
+			}
+		}
+		meta := tx.Bucket(bucketMeta)
+		revs, index, deleted := tx.Bucket(bucketRevs), tx.Bucket(bucketChanges), tx.Bucket(bucketDeleted)
+		rev := decodeRevision(meta.Get(keyRevision)) + 1
+		for _, c := range changes {
+			key := []byte(c.key)
+			var err error
+			if c.value == nil {
+				err = kv.Delete(key)
+			} else {
+				err = kv.Put(key, c.value)
+			}
+			if err != nil {
+				return err
+			}
+			if prev := revs.Get(key); prev != nil {
+				ck := changeKey(decodeRevision(prev), key)
+				if err := index.Delete(ck); err != nil {
+					return err
+				}
+				if err := deleted.Delete(ck); err != nil {
+					return err
+				}
+			}
+			ck := changeKey(rev, key)
+			if err := revs.Put(key, encodeRevision(rev)); err != nil {
+				return err
+			}
+			if err := index.Put(ck, []byte{}); err != nil {
+				return err
+			}
+			if c.value == nil {
+				if err := deleted.Put(ck, []byte{}); err != nil {
+					return err
+				}
+			}
+		}
+		written = true
+		return meta.Put(keyRevision, encodeRevision(rev))
+	})
+	if err != nil || !written {
+		return false, err
+	}
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// Watch reports PUTs and DELETEs of key made after the call. Rapid successive
+// changes may be coalesced into a single event carrying the latest state.
+func (s *Store) Watch(ctx context.Context, key string) clientv3.WatchChan {
+	w := &watch{notify: make(chan struct{}, 1)}
+
+	s.mu.Lock()
+	if !s.running {
+		// Establish the baseline synchronously so that writes racing with the
+		// caller after Watch returns are reported.
+		rev, err := s.currentRevision()
+		if err != nil {
+			s.mu.Unlock()
+			failed := make(chan clientv3.WatchResponse, 1)
+			failed <- clientv3.WatchResponse{Canceled: true}
+			close(failed)
+			return failed
+		}
+		s.lastRev = rev
+		s.running = true
+		go s.run()
+	}
+	if s.watches[key] == nil {
+		s.watches[key] = map[*watch]struct{}{}
+	}
+	s.watches[key][w] = struct{}{}
+	s.mu.Unlock()
+
+	out := make(chan clientv3.WatchResponse)
+	go func() {
+		defer close(out)
+		defer s.unwatch(key, w)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-w.notify:
+			}
+			w.mu.Lock()
+			kv := w.pending
+			w.pending = nil
+			w.mu.Unlock()
+			if kv == nil {
+				continue
+			}
+			ev := &clientv3.Event{Type: mvccpb.PUT, Kv: kv}
+			if kv.Value == nil {
+				ev.Type = mvccpb.DELETE
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case out <- clientv3.WatchResponse{Events: []*clientv3.Event{ev}}:
+			}
+		}
+	}()
+	return out
+}
+
+func (s *Store) unwatch(key string, w *watch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.watches[key], w)
+	if len(s.watches[key]) == 0 {
+		delete(s.watches, key)
+	}
+}
+
+// run dispatches changes to watchers until no watchers remain.
+func (s *Store) run() {
+	t := time.NewTicker(s.pollInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.kick:
+		case <-t.C:
+		}
+
+		s.mu.Lock()
+		if len(s.watches) == 0 {
+			s.running = false
+			s.mu.Unlock()
+			return
+		}
+		since := s.lastRev
+		s.mu.Unlock()
+
+		kvs, rev, prune, err := s.changedSince(since)
+		if err != nil {
+			// The file may be briefly locked by another writer; retry on the next tick.
+			continue
+		}
+
+		s.mu.Lock()
+		s.lastRev = rev
+		for _, kv := range kvs {
+			for w := range s.watches[string(kv.Key)] {
+				w.mu.Lock()
+				w.pending = kv
+				w.mu.Unlock()
+				select {
+				case w.notify <- struct{}{}:
+				default:
+				}
+			}
+		}
+		s.mu.Unlock()
+
+		if prune {
+			// Retried on the next tick if the file is locked.
+			_ = s.pruneDeleted(rev)
+		}
+	}
+}
+
+// Ready reports whether the database can be opened and read.
+func (s *Store) Ready(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := s.currentRevision()
+	return err
+}
+
+func (s *Store) currentRevision() (uint64, error) {
+	var rev uint64
+	err := s.view(func(tx *bolt.Tx) error {
+		rev = decodeRevision(tx.Bucket(bucketMeta).Get(keyRevision))
+		return nil
+	})
+	return rev, err
+}
+
+// changedSince returns the keys changed after revision since, up to the
+// current revision rev, and whether deleted keys up to rev await pruning.
+func (s *Store) changedSince(since uint64) ([]*mvccpb.KeyValue, uint64, bool, error) {
+	var kvs []*mvccpb.KeyValue
+	var rev uint64
+	var prune bool
+	err := s.view(func(tx *bolt.Tx) error {
+		rev = decodeRevision(tx.Bucket(bucketMeta).Get(keyRevision))
+		if k, _ := tx.Bucket(bucketDeleted).Cursor().First(); k != nil && decodeRevision(k[:8]) <= rev {
+			prune = true
+		}
+		if rev == since {
+			return nil
+		}
+		kv := tx.Bucket(bucketKV)
+		c := tx.Bucket(bucketChanges).Cursor()
+		for k, _ := c.Seek(encodeRevision(since + 1)); k != nil; k, _ = c.Next() {
+			key := k[8:]
+			var value []byte
+			if v := kv.Get(key); v != nil {
+				value = append([]byte{}, v...)
+			}
+			kvs = append(kvs, &mvccpb.KeyValue{
+				Key:         append([]byte(nil), key...),
+				Value:       value,
+				ModRevision: int64(decodeRevision(k[:8])),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, false, err
+	}
+	return kvs, rev, prune, nil
+}
+
+// pruneDeleted forgets the keys deleted at or before revision upTo.
+func (s *Store) pruneDeleted(upTo uint64) error {
+	return s.update(func(tx *bolt.Tx) error {
+		revs, index, deleted := tx.Bucket(bucketRevs), tx.Bucket(bucketChanges), tx.Bucket(bucketDeleted)
+		var pruned [][]byte
+		c := deleted.Cursor()
+		for k, _ := c.First(); k != nil && decodeRevision(k[:8]) <= upTo; k, _ = c.Next() {
+			pruned = append(pruned, append([]byte(nil), k...))
+		}
+		for _, ck := range pruned {
+			for _, err := range []error{deleted.Delete(ck), index.Delete(ck), revs.Delete(ck[8:])} {
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Store) view(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(s.path, 0o600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketKV, bucketRevs, bucketChanges, bucketDeleted, bucketMeta} {
+			if tx.Bucket(name) == nil {
+				return errors.New("bolt store is not initialized")
+			}
+		}
+		return fn(tx)
+	})
+}
+
+func (s *Store) update(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(s.path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+// changeKey is the bucketChanges key of key changed at revision rev.
+func changeKey(rev uint64, key []byte) []byte {
+	return append(encodeRevision(rev), key...)
+}
+
+func encodeRevision(rev uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, rev)
+	return b
+}
+
+func decodeRevision(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
@@ -0,0 +1,202 @@
+package boltstore
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+func TestStore_PutGet(t *testing.T) {
+	st, err := NewStore(filepath.Join(t.TempDir(), "feeds.db"), time.Second)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	ctx := context.Background()
+
+	if _, ok, err := st.Get(ctx, "wg-feed/feeds/a"); err != nil || ok {
+		t.Fatalf("expected not found, got ok=%v err=%v", ok, err)
+	}
+	if err := st.Put(ctx, "wg-feed/feeds/a", []byte(`{"v":1}`)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	got, ok, err := st.Get(ctx, "wg-feed/feeds/a")
+	if err != nil || !ok || string(got) != `{"v":1}` {
+		t.Fatalf("unexpected get: value=%q ok=%v err=%v", got, ok, err)
+	}
+}
+
+func TestStore_WatchReportsLocalPut(t *testing.T) {
+	// A long poll interval proves local writes are delivered without polling.
+	st, err := NewStore(filepath.Join(t.TempDir(), "feeds.db"), time.Hour)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	watchCh := st.Watch(ctx, "wg-feed/feeds/a")
+	if err := st.Put(ctx, "wg-feed/feeds/other", []byte(`{}`)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := st.Put(ctx, "wg-feed/feeds/a", []byte(`{"v":2}`)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	wr, ok := <-watchCh
+	if !ok {
+		t.Fatalf("watch closed: %v", ctx.Err())
+	}
+	if len(wr.Events) != 1 || wr.Events[0].Type != mvccpb.PUT || string(wr.Events[0].Kv.Value) != `{"v":2}` {
+		t.Fatalf("unexpected watch response: %#v", wr.Events)
+	}
+	if wr.Events[0].Kv.ModRevision != 2 {
+		t.Fatalf("unexpected mod revision: %d", wr.Events[0].Kv.ModRevision)
+	}
+}
+
+func TestStore_WatchReportsPutFromAnotherHandle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feeds.db")
+	server, err := NewStore(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	uploader, err := NewStore(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	watchCh := server.Watch(ctx, "wg-feed/feeds/a")
+	if err := uploader.Put(ctx, "wg-feed/feeds/a", []byte(`{"v":3}`)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	wr, ok := <-watchCh
+	if !ok {
+		t.Fatalf("watch closed: %v", ctx.Err())
+	}
+	if len(wr.Events) != 1 || string(wr.Events[0].Kv.Value) != `{"v":3}` {
+		t.Fatalf("unexpected watch response: %#v", wr.Events)
+	}
+}
+
+func TestStore_PrunesDispatchedDeletes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feeds.db")
+	server, err := NewStore(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	uploader, err := NewStore(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Deleted before any watch: forgotten without being dispatched.
+	if err := uploader.Put(ctx, "wg-feed/feeds/old", []byte(`{}`)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if ok, err := uploader.CompareAndDelete(ctx, "wg-feed/feeds/old", []byte(`{}`)); err != nil || !ok {
+		t.Fatalf("delete: ok=%v err=%v", ok, err)
+	}
+	if err := uploader.Put(ctx, "wg-feed/feeds/a", []byte(`{}`)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	watchCh := server.Watch(ctx, "wg-feed/feeds/a")
+	if ok, err := uploader.CompareAndDelete(ctx, "wg-feed/feeds/a", []byte(`{}`)); err != nil || !ok {
+		t.Fatalf("delete: ok=%v err=%v", ok, err)
+	}
+	if wr := <-watchCh; len(wr.Events) != 1 || wr.Events[0].Type != mvccpb.DELETE {
+		t.Fatalf("unexpected watch response: %#v", wr.Events)
+	}
+
+	for {
+		var left int
+		err := server.view(func(tx *bolt.Tx) error {
+			left = tx.Bucket(bucketRevs).Stats().KeyN + tx.Bucket(bucketChanges).Stats().KeyN + tx.Bucket(bucketDeleted).Stats().KeyN
+			return nil
+		})
+		if err == nil && left == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("deleted keys not pruned: %d entries left", left)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestStore_CompareAndSwapListAndDelete(t *testing.T) {
+	st, err := NewStore(filepath.Join(t.TempDir(), "feeds.db"), time.Hour)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if ok, err := st.CompareAndPut(ctx, "wg-feed/feeds/a", nil, []byte(`{"v":1}`)); err != nil || !ok {
+		t.Fatalf("create: ok=%v err=%v", ok, err)
+	}
+	if ok, err := st.CompareAndPut(ctx, "wg-feed/feeds/a", nil, []byte(`{"v":2}`)); err != nil || ok {
+		t.Fatalf("create existing: ok=%v err=%v", ok, err)
+	}
+	if ok, err := st.CompareAndPut(ctx, "wg-feed/feeds/a", []byte(`{"v":0}`), []byte(`{"v":2}`)); err != nil || ok {
+		t.Fatalf("stale swap: ok=%v err=%v", ok, err)
+	}
+	if err := st.Put(ctx, "wg-feed/feeds/b", []byte(`{}`)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := st.Put(ctx, "wg-feed/policies/a", []byte(`{}`)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	kvs, err := st.List(ctx, "wg-feed/feeds/")
+	if err != nil || len(kvs) != 2 || string(kvs[0].Key) != "wg-feed/feeds/a" || string(kvs[1].Key) != "wg-feed/feeds/b" {
+		t.Fatalf("unexpected list: %v err=%v", kvs, err)
+	}
+
+	watchCh := st.Watch(ctx, "wg-feed/feeds/a")
+	if ok, err := st.CompareAndDelete(ctx, "wg-feed/feeds/a", []byte(`{"v":1}`)); err != nil || !ok {
+		t.Fatalf("delete: ok=%v err=%v", ok, err)
+	}
+	wr := <-watchCh
+	if len(wr.Events) != 1 || wr.Events[0].Type != mvccpb.DELETE {
+		t.Fatalf("unexpected watch response: %#v", wr.Events)
+	}
+	if _, ok, err := st.Get(ctx, "wg-feed/feeds/a"); err != nil || ok {
+		t.Fatalf("expected deleted key, got ok=%v err=%v", ok, err)
+	}
+}
+
+func TestStore_CompareAndPutAll(t *testing.T) {
+	st, err := NewStore(filepath.Join(t.TempDir(), "feeds.db"), time.Hour)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	ctx := context.Background()
+
+	keys := []string{"wg-feed/feeds/a", "wg-feed/history/a"}
+	if ok, err := st.CompareAndPutAll(ctx, keys, [][]byte{nil, nil}, [][]byte{[]byte("f1"), []byte("h1")}); err != nil || !ok {
+		t.Fatalf("create: ok=%v err=%v", ok, err)
+	}
+	if ok, err := st.CompareAndPutAll(ctx, keys, [][]byte{[]byte("f1"), nil}, [][]byte{[]byte("f2"), []byte("h2")}); err != nil || ok {
+		t.Fatalf("partially stale swap: ok=%v err=%v", ok, err)
+	}
+	if v, _, _ := st.Get(ctx, "wg-feed/feeds/a"); string(v) != "f1" {
+		t.Fatalf("failed swap wrote %q", v)
+	}
+	if ok, err := st.CompareAndPutAll(ctx, keys, [][]byte{[]byte("f1"), []byte("h1")}, [][]byte{[]byte("f2"), []byte("h2")}); err != nil || !ok {
+		t.Fatalf("swap: ok=%v err=%v", ok, err)
+	}
+	if v, _, _ := st.Get(ctx, "wg-feed/history/a"); string(v) != "h2" {
+		t.Fatalf("unexpected value %q", v)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/exeteres/wg-feed/internal/client/backend/networkmanager"
 	"github.com/exeteres/wg-feed/internal/client/backend/wgquick"
@@ -17,6 +18,12 @@ type Backend interface {
 	Remove(ctx context.Context, name string) error
 }
 
+// HandshakeReader is implemented by backends that can read the latest
+// WireGuard handshake of a tunnel; the zero time means there was none.
+type HandshakeReader interface {
+	LatestHandshake(ctx context.Context, name string) (time.Time, error)
+}
+
 func New(cfg config.Config, logger *log.Logger) (Backend, error) {
 	runner := execx.Runner{}
 	switch cfg.Backend {
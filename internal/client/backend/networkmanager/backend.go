@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/exeteres/wg-feed/internal/client/backend/networkmanager/nmconfig"
 	"github.com/exeteres/wg-feed/internal/client/execx"
@@ -93,6 +94,16 @@ func (b *Backend) Remove(ctx context.Context, name string) error {
 	return nil
 }
 
+// LatestHandshake reads the handshakes of the interface NetworkManager
+// creates for the connection, which is named after it.
+func (b *Backend) LatestHandshake(ctx context.Context, name string) (time.Time, error) {
+	res, err := b.runner.Run(ctx, "wg", "show", strings.TrimSpace(name), "latest-handshakes")
+	if err != nil {
+		return time.Time{}, err
+	}
+	return wgquick.ParseLatestHandshakes(res.Stdout)
+}
+
 func buildNMConnection(existing []byte, name string, parsed wgquick.Config, uuidGen func() string) ([]byte, error) {
 	kf := nmconfig.NewEmpty()
 	if len(existing) > 0 {
@@ -8,8 +8,10 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/exeteres/wg-feed/internal/client/execx"
+	"github.com/exeteres/wg-feed/internal/client/wgquick"
 )
 
 type Runner interface {
@@ -71,6 +73,14 @@ func (b *Backend) Remove(ctx context.Context, name string) error {
 	return nil
 }
 
+func (b *Backend) LatestHandshake(ctx context.Context, name string) (time.Time, error) {
+	res, err := b.runner.Run(ctx, "wg", "show", strings.TrimSpace(name), "latest-handshakes")
+	if err != nil {
+		return time.Time{}, err
+	}
+	return wgquick.ParseLatestHandshakes(res.Stdout)
+}
+
 func isUp(ctx context.Context, runner Runner, iface string) bool {
 	_, err := runner.Run(ctx, "wg", "show", iface)
 	return err == nil
@@ -4,11 +4,13 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"slices"
 	"strings"
 
 	"github.com/exeteres/wg-feed/internal/client/backend"
 	"github.com/exeteres/wg-feed/internal/client/config"
 	"github.com/exeteres/wg-feed/internal/client/feed"
+	"github.com/exeteres/wg-feed/internal/client/keystore"
 	"github.com/exeteres/wg-feed/internal/client/state"
 	"github.com/exeteres/wg-feed/internal/model"
 )
@@ -47,9 +49,11 @@ func applyOne(ctx context.Context, cfg config.Config, b backend.Backend, st *sta
 	}
 	var endpoints []string
 	var cachedFeedID string
+	var learnedSigner string
 	if feedID := strings.TrimSpace(st.SetupURLMap[key]); feedID != "" {
 		cachedFeedID = feedID
 		if fs, ok := st.Feeds[feedID]; ok {
+			learnedSigner = fs.SignerKey
 			if strings.TrimSpace(fs.CachedEncryptedData) != "" {
 				doc, err := feed.DecryptFeedDocumentForSetupURL(setupURL, fs.CachedEncryptedData)
 				if err != nil {
@@ -60,11 +64,16 @@ func applyOne(ctx context.Context, cfg config.Config, b backend.Backend, st *sta
 		}
 	}
 
+	signer, err := feed.PinnedSigner(setupURL, learnedSigner)
+	if err != nil {
+		return fmt.Errorf("feed %s: %w", feed.RedactURL(setupURL), err)
+	}
+
 	// One-shot apply is always a forced reconciliation: it MUST fetch a full document.
 	// If endpoints are known, do not use the Setup URL for network requests.
 	var res feed.FetchResult
 	if len(endpoints) != 0 {
-		fetched, usedEndpoint, err := feed.FetchAnyEndpoints(ctx, endpoints, setupURL, "")
+		fetched, usedEndpoint, err := feed.FetchAnyEndpoints(ctx, endpoints, setupURL, signer, "")
 		if err != nil {
 			return fmt.Errorf("feed %s: %w", feed.RedactURL(setupURL), err)
 		}
@@ -74,7 +83,7 @@ func applyOne(ctx context.Context, cfg config.Config, b backend.Backend, st *sta
 			st.ReconcileEndpointOrder(cachedFeedID, res.Feed.Endpoints, usedEndpoint)
 		}
 	} else {
-		fetched, err := feed.FetchWithDecryptURL(ctx, setupURL, setupURL, "")
+		fetched, err := feed.FetchWithDecryptURL(ctx, setupURL, setupURL, signer, "")
 		if err != nil {
 			return fmt.Errorf("feed %s: %w", feed.RedactURL(setupURL), err)
 		}
@@ -85,6 +94,9 @@ func applyOne(ctx context.Context, cfg config.Config, b backend.Backend, st *sta
 	if feedID == "" {
 		return fmt.Errorf("feed %s: missing id", feed.RedactURL(setupURL))
 	}
+	if err := st.Feeds[feedID].CheckSequence(res.Sequence); err != nil {
+		return fmt.Errorf("feed %s: %w", feed.RedactURL(setupURL), err)
+	}
 	if msg := strings.TrimSpace(res.Feed.Warning); msg != "" {
 		logger.Printf("feed warning: feed=%q message=%q", feed.RedactURL(setupURL), msg)
 	}
@@ -107,6 +119,11 @@ func applyOne(ctx context.Context, cfg config.Config, b backend.Backend, st *sta
 	} else {
 		fs.CachedEncryptedData = ""
 	}
+	fs.CachedSequence = res.Sequence
+	fs.Sequence = res.Sequence
+	if res.Signer != "" {
+		fs.SignerKey = res.Signer
+	}
 	st.Feeds[feedID] = fs
 
 	if err := ApplyFeed(ctx, cfg, b, st, setupURL, res.Feed, logger); err != nil {
@@ -118,7 +135,20 @@ func applyOne(ctx context.Context, cfg config.Config, b backend.Backend, st *sta
 	return nil
 }
 
-func ApplyFeed(ctx context.Context, _ config.Config, b backend.Backend, st *state.State, sourceURL string, f model.FeedDocument, logger *log.Logger) error {
+// TunnelError is returned by ApplyFeed when the backend fails to apply a
+// tunnel; the tunnels after it in the feed are not applied.
+type TunnelError struct {
+	TunnelID string
+	Err      error
+}
+
+func (e *TunnelError) Error() string {
+	return fmt.Sprintf("tunnel %s: %v", e.TunnelID, e.Err)
+}
+
+func (e *TunnelError) Unwrap() error { return e.Err }
+
+func ApplyFeed(ctx context.Context, cfg config.Config, b backend.Backend, st *state.State, sourceURL string, f model.FeedDocument, logger *log.Logger) error {
 	feedID := strings.TrimSpace(f.ID)
 	if feedID == "" {
 		return fmt.Errorf("feed %s: missing id", feed.RedactURL(sourceURL))
@@ -128,6 +158,19 @@ func ApplyFeed(ctx context.Context, _ config.Config, b backend.Backend, st *stat
 		prev.Tunnels = map[string]state.TunnelState{}
 	}
 
+	// Tunnels using the client key placeholder get the locally generated key,
+	// whose public key must be enrolled first.
+	var clientKey keystore.Key
+	if slices.ContainsFunc(f.Tunnels, model.Tunnel.UsesClientKey) {
+		key, err := enroll(ctx, cfg, st, feedID, f, prev.EnrolledPublicKey)
+		if err != nil {
+			logger.Printf("enrollment failed source=%q err=%v", feed.RedactURL(sourceURL), err)
+			return fmt.Errorf("feed %s: enrollment: %w", feed.RedactURL(sourceURL), err)
+		}
+		clientKey = key
+		prev.EnrolledPublicKey = key.Public
+	}
+
 	currentTunnelIDs := make(map[string]struct{}, len(f.Tunnels))
 	for _, t := range f.Tunnels {
 		currentTunnelIDs[t.ID] = struct{}{}
@@ -147,9 +190,13 @@ func ApplyFeed(ctx context.Context, _ config.Config, b backend.Backend, st *stat
 			hadPrev = false
 		}
 
-		if err := b.Apply(ctx, t.Name, t.WGQuickConfig, enabled); err != nil {
+		wgQuickConfig := t.WGQuickConfig
+		if t.UsesClientKey() {
+			wgQuickConfig = t.WithClientKey(clientKey.Private)
+		}
+		if err := b.Apply(ctx, t.Name, wgQuickConfig, enabled); err != nil {
 			logger.Printf("apply failed source=%q tunnel=%q name=%q enabled=%v err=%v", feed.RedactURL(sourceURL), t.ID, t.Name, enabled, err)
-			return err
+			return &TunnelError{TunnelID: t.ID, Err: err}
 		}
 		prev.Tunnels[t.ID] = state.TunnelState{Name: t.Name, Enabled: enabled}
 	}
@@ -168,3 +215,33 @@ func ApplyFeed(ctx context.Context, _ config.Config, b backend.Backend, st *stat
 	st.Feeds[feedID] = prev
 	return nil
 }
+
+// enroll returns the client key of the feed, registering its public key at
+// the feed's enrollment_url unless enrolled is already that key.
+func enroll(ctx context.Context, cfg config.Config, st *state.State, feedID string, f model.FeedDocument, enrolled string) (keystore.Key, error) {
+	key, err := keystore.New(cfg.KeyDir).LoadOrCreate(feedID)
+	if err != nil {
+		return keystore.Key{}, err
+	}
+	if enrolled == key.Public {
+		return key, nil
+	}
+	url := strings.TrimSpace(f.EnrollmentURL)
+	if url == "" {
+		return keystore.Key{}, fmt.Errorf("feed uses %s without enrollment_url", model.ClientPrivateKeyPlaceholder)
+	}
+	deviceID, err := st.EnsureDeviceID()
+	if err != nil {
+		return keystore.Key{}, err
+	}
+	err = feed.Enroll(ctx, url, model.EnrollmentRequest{
+		Version:   "wg-feed-00",
+		DeviceID:  deviceID,
+		FeedID:    feedID,
+		PublicKey: key.Public,
+	})
+	if err != nil {
+		return keystore.Key{}, err
+	}
+	return key, nil
+}
@@ -2,12 +2,18 @@ package client
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/exeteres/wg-feed/internal/client/config"
+	"github.com/exeteres/wg-feed/internal/client/feed"
+	"github.com/exeteres/wg-feed/internal/client/keystore"
 	"github.com/exeteres/wg-feed/internal/client/state"
 	"github.com/exeteres/wg-feed/internal/model"
 )
@@ -223,7 +229,99 @@ func TestApplyFeed_BackendApplyError_Propagates(t *testing.T) {
 	b := &fakeBackend{applyErr: errors.New("boom")}
 	logger := log.New(io.Discard, "", 0)
 
-	if err := ApplyFeed(context.Background(), config.Config{}, b, st, setupURL, doc, logger); err == nil {
-		t.Fatalf("expected error")
+	err := ApplyFeed(context.Background(), config.Config{}, b, st, setupURL, doc, logger)
+	var te *TunnelError
+	if !errors.As(err, &te) || te.TunnelID != "t1" || !errors.Is(err, b.applyErr) {
+		t.Fatalf("expected tunnel error for t1, got %v", err)
+	}
+}
+
+func TestApplyFeed_ClientKey_EnrollsAndFillsPlaceholder(t *testing.T) {
+	t.Parallel()
+
+	var enrollments []model.EnrollmentRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req model.EnrollmentRequest
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&req) != nil || req.Validate() != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		enrollments = append(enrollments, req)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	feedID := "11111111-1111-4111-8111-111111111111"
+	cfg := config.Config{KeyDir: t.TempDir()}
+	st := &state.State{Feeds: map[string]state.FeedState{}}
+	doc := model.FeedDocument{
+		ID:            feedID,
+		Endpoints:     []string{"https://example.test/feed"},
+		DisplayInfo:   model.DisplayInfo{Title: "Example"},
+		EnrollmentURL: srv.URL,
+		Tunnels: []model.Tunnel{{
+			ID:            "t1",
+			Name:          "home",
+			DisplayInfo:   model.DisplayInfo{Title: "Home"},
+			Enabled:       true,
+			WGQuickConfig: "[Interface]\nPrivateKey = {{client_private_key}}\n\n[Peer]\nPublicKey = y\nAllowedIPs = 0.0.0.0/0\n",
+		}},
+	}
+
+	b := &fakeBackend{}
+	logger := log.New(io.Discard, "", 0)
+	for range 2 {
+		if err := ApplyFeed(context.Background(), cfg, b, st, "https://example.test/feed", doc, logger); err != nil {
+			t.Fatalf("ApplyFeed: %v", err)
+		}
+	}
+
+	if len(enrollments) != 1 {
+		t.Fatalf("expected 1 enrollment, got %d", len(enrollments))
+	}
+	key, err := keystore.New(cfg.KeyDir).LoadOrCreate(feedID)
+	if err != nil {
+		t.Fatalf("LoadOrCreate: %v", err)
+	}
+	if enrollments[0].PublicKey != key.Public || enrollments[0].DeviceID != st.DeviceID || st.Feeds[feedID].EnrolledPublicKey != key.Public {
+		t.Fatalf("unexpected enrollment %+v (state %+v)", enrollments[0], st.Feeds[feedID])
+	}
+	if len(b.applyCalls) != 2 || !strings.Contains(b.applyCalls[0].Config, "PrivateKey = "+key.Private+"\n") {
+		t.Fatalf("placeholder not filled: %+v", b.applyCalls)
+	}
+}
+
+func TestApplyFeed_ClientKey_EnrollmentFailure(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		_, _ = io.WriteString(w, `{"version": "wg-feed-00", "success": false, "message": "device is already enrolled with a different public key", "retriable": false}`)
+	}))
+	defer srv.Close()
+
+	feedID := "11111111-1111-4111-8111-111111111111"
+	st := &state.State{Feeds: map[string]state.FeedState{}}
+	doc := model.FeedDocument{
+		ID:            feedID,
+		Endpoints:     []string{"https://example.test/feed"},
+		DisplayInfo:   model.DisplayInfo{Title: "Example"},
+		EnrollmentURL: srv.URL,
+		Tunnels: []model.Tunnel{{
+			ID:            "t1",
+			Name:          "home",
+			DisplayInfo:   model.DisplayInfo{Title: "Home"},
+			WGQuickConfig: "[Interface]\nPrivateKey = {{client_private_key}}\n",
+		}},
+	}
+
+	b := &fakeBackend{}
+	err := ApplyFeed(context.Background(), config.Config{KeyDir: t.TempDir()}, b, st, "https://example.test/feed", doc, log.New(io.Discard, "", 0))
+	if wf, ok := feed.AsWGFeedError(err); !ok || wf.Status != http.StatusConflict {
+		t.Fatalf("expected enrollment conflict, got %v", err)
+	}
+	if len(b.applyCalls) != 0 || st.Feeds[feedID].EnrolledPublicKey != "" {
+		t.Fatalf("expected nothing applied, got %+v", b.applyCalls)
 	}
 }
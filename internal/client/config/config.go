@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/exeteres/wg-feed/internal/stringsx"
 )
@@ -23,8 +24,16 @@ type Config struct {
 	Backend   Backend
 	StatePath string
 	SetupURLs []string
+	// KeyDir holds the private keys generated for feeds with client keys
+	// (see package keystore).
+	KeyDir string
+	// StatusReportInterval is how often the daemon re-sends its status report
+	// to feeds with a status_url; 0 disables status reports.
+	StatusReportInterval time.Duration
 }
 
+const defaultStatusReportInterval = 15 * time.Minute
+
 func FromEnv() (Config, error) {
 	backend := Backend(strings.TrimSpace(os.Getenv("BACKEND")))
 	switch backend {
@@ -43,12 +52,28 @@ func FromEnv() (Config, error) {
 		statePath = p
 	}
 
+	keyDir := strings.TrimSpace(os.Getenv("KEY_DIR"))
+	if keyDir == "" {
+		keyDir = filepath.Join(filepath.Dir(statePath), "keys")
+	}
+
 	setupURLs, err := parseSetupURLsFromEnv()
 	if err != nil {
 		return Config{}, err
 	}
 
-	return Config{Backend: backend, StatePath: statePath, SetupURLs: setupURLs}, nil
+	statusReportInterval := defaultStatusReportInterval
+	if raw := strings.TrimSpace(os.Getenv("STATUS_REPORT_INTERVAL")); raw != "" {
+		statusReportInterval, err = time.ParseDuration(raw)
+		if err != nil {
+			return Config{}, fmt.Errorf("STATUS_REPORT_INTERVAL must be a duration: %w", err)
+		}
+		if statusReportInterval < 0 {
+			return Config{}, errors.New("STATUS_REPORT_INTERVAL must be >= 0")
+		}
+	}
+
+	return Config{Backend: backend, StatePath: statePath, SetupURLs: setupURLs, KeyDir: keyDir, StatusReportInterval: statusReportInterval}, nil
 }
 
 func defaultStatePath() (string, error) {
@@ -1,6 +1,9 @@
 package config
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestFromEnv_Valid(t *testing.T) {
 	t.Setenv("BACKEND", string(BackendWGQuick))
@@ -20,6 +23,28 @@ func TestFromEnv_Valid(t *testing.T) {
 	if len(cfg.SetupURLs) != 2 || cfg.SetupURLs[0] != "https://a.example" || cfg.SetupURLs[1] != "https://b.example" {
 		t.Fatalf("unexpected setup urls: %#v", cfg.SetupURLs)
 	}
+	if cfg.KeyDir != "/tmp/keys" {
+		t.Fatalf("unexpected key dir: %q", cfg.KeyDir)
+	}
+	if cfg.StatusReportInterval != 15*time.Minute {
+		t.Fatalf("unexpected status report interval: %v", cfg.StatusReportInterval)
+	}
+}
+
+func TestFromEnv_StatusReportInterval(t *testing.T) {
+	t.Setenv("BACKEND", string(BackendWGQuick))
+	t.Setenv("SETUP_URLS", "https://a.example")
+
+	t.Setenv("STATUS_REPORT_INTERVAL", "0")
+	if cfg, err := FromEnv(); err != nil || cfg.StatusReportInterval != 0 {
+		t.Fatalf("disabled: cfg=%+v err=%v", cfg, err)
+	}
+	for _, v := range []string{"soon", "-1m"} {
+		t.Setenv("STATUS_REPORT_INTERVAL", v)
+		if _, err := FromEnv(); err == nil {
+			t.Fatalf("%q: expected error", v)
+		}
+	}
 }
 
 func TestFromEnv_InvalidBackend(t *testing.T) {
@@ -13,12 +13,33 @@ import (
 	"github.com/exeteres/wg-feed/internal/model"
 )
 
-func ageIdentityFromURL(raw string) (*age.X25519Identity, bool, error) {
+// setupURLFragment splits the fragment of a Setup URL into its age key part
+// and the signer key pinned by its "signer=" parameter. Fragment parts are
+// separated by "&"; the age key is the part that is not a parameter.
+func setupURLFragment(raw string) (ageKey, signer string, err error) {
 	u, err := url.Parse(strings.TrimSpace(raw))
 	if err != nil {
-		return nil, false, fmt.Errorf("parse url: %w", err)
+		return "", "", fmt.Errorf("parse url: %w", err)
+	}
+	for _, part := range strings.Split(u.Fragment, "&") {
+		part = strings.TrimSpace(part)
+		name, value, isParam := strings.Cut(part, "=")
+		switch {
+		case part == "":
+		case !isParam:
+			ageKey = part
+		case name == "signer":
+			signer = value
+		}
+	}
+	return ageKey, signer, nil
+}
+
+func ageIdentityFromURL(raw string) (*age.X25519Identity, bool, error) {
+	frag, _, err := setupURLFragment(raw)
+	if err != nil {
+		return nil, false, err
 	}
-	frag := strings.TrimSpace(u.Fragment)
 	if frag == "" {
 		return nil, false, nil
 	}
@@ -33,30 +54,37 @@ func ageIdentityFromURL(raw string) (*age.X25519Identity, bool, error) {
 }
 
 func DecryptFeedDocumentForSetupURL(setupURL string, armoredCiphertext string) (model.FeedDocument, error) {
+	doc, _, err := decryptFeedDocument(setupURL, armoredCiphertext)
+	return doc, err
+}
+
+// decryptFeedDocument is DecryptFeedDocumentForSetupURL, also returning the
+// decrypted JSON for signature verification.
+func decryptFeedDocument(setupURL string, armoredCiphertext string) (model.FeedDocument, []byte, error) {
 	id, ok, err := ageIdentityFromURL(setupURL)
 	if err != nil {
-		return model.FeedDocument{}, err
+		return model.FeedDocument{}, nil, err
 	}
 	if !ok {
-		return model.FeedDocument{}, &WGFeedError{Status: 200, Message: "encrypted success response but no age key provided in URL fragment", Retriable: false}
+		return model.FeedDocument{}, nil, &WGFeedError{Status: 200, Message: "encrypted success response but no age key provided in URL fragment", Retriable: false}
 	}
 
 	ar := armor.NewReader(strings.NewReader(armoredCiphertext))
 	r, err := age.Decrypt(ar, id)
 	if err != nil {
-		return model.FeedDocument{}, &WGFeedError{Status: 200, Message: "failed to decrypt encrypted_data", Retriable: false}
+		return model.FeedDocument{}, nil, &WGFeedError{Status: 200, Message: "failed to decrypt encrypted_data", Retriable: false}
 	}
 	pt, err := io.ReadAll(r)
 	if err != nil {
-		return model.FeedDocument{}, fmt.Errorf("read decrypted feed document: %w", err)
+		return model.FeedDocument{}, nil, fmt.Errorf("read decrypted feed document: %w", err)
 	}
 
 	var doc model.FeedDocument
 	if err := json.Unmarshal(pt, &doc); err != nil {
-		return model.FeedDocument{}, &WGFeedError{Status: 200, Message: "decrypted feed document is not valid JSON", Retriable: false}
+		return model.FeedDocument{}, nil, &WGFeedError{Status: 200, Message: "decrypted feed document is not valid JSON", Retriable: false}
 	}
 	if err := doc.Validate(); err != nil {
-		return model.FeedDocument{}, &WGFeedError{Status: 200, Message: "decrypted feed document failed validation", Retriable: false}
+		return model.FeedDocument{}, nil, &WGFeedError{Status: 200, Message: "decrypted feed document failed validation", Retriable: false}
 	}
-	return doc, nil
+	return doc, pt, nil
 }
@@ -24,8 +24,9 @@ func normalizeEndpoints(endpoints []string) []string {
 }
 
 // FetchWithDecryptURL fetches requestURL but uses decryptURL (the Setup URL containing the age key
-// fragment) for decrypting encrypted_data when present.
-func FetchWithDecryptURL(ctx context.Context, requestURL, decryptURL string, ifNoneMatchRevision string) (FetchResult, error) {
+// fragment) for decrypting encrypted_data when present. With signer set, the document must carry a
+// valid signature by that key (see PinnedSigner).
+func FetchWithDecryptURL(ctx context.Context, requestURL, decryptURL, signer string, ifNoneMatchRevision string) (FetchResult, error) {
 	sr, body, notModified, err := fetchSuccessResponse(ctx, requestURL, ifNoneMatchRevision)
 	if err != nil {
 		return FetchResult{}, err
@@ -33,35 +34,12 @@ func FetchWithDecryptURL(ctx context.Context, requestURL, decryptURL string, ifN
 	if notModified {
 		return FetchResult{NotModified: true, Revision: strings.TrimSpace(ifNoneMatchRevision)}, nil
 	}
-
-	res := FetchResult{}
-	res.Revision = strings.TrimSpace(sr.Revision)
-	res.TTLSeconds = sr.TTLSeconds
-	res.SupportsSSE = sr.SupportsSSE
-	res.Body = body
-
-	if sr.Encrypted {
-		doc, err := DecryptFeedDocumentForSetupURL(decryptURL, sr.EncryptedData)
-		if err != nil {
-			return FetchResult{}, err
-		}
-		res.Encrypted = true
-		res.EncryptedData = sr.EncryptedData
-		res.Feed = doc
-		return res, nil
-	}
-	if sr.Data == nil {
-		return FetchResult{}, fmt.Errorf("validate response: data is required when encrypted=false")
-	}
-	res.Encrypted = false
-	res.EncryptedData = ""
-	res.Feed = *sr.Data
-	return res, nil
+	return successResult(sr, body, decryptURL, signer)
 }
 
 // FetchAnyEndpoints attempts to fetch a feed from endpoints[] in the given order.
 // It returns the first successful result plus the endpoint URL that succeeded.
-func FetchAnyEndpoints(ctx context.Context, endpoints []string, decryptURL string, ifNoneMatchRevision string) (FetchResult, string, error) {
+func FetchAnyEndpoints(ctx context.Context, endpoints []string, decryptURL, signer string, ifNoneMatchRevision string) (FetchResult, string, error) {
 	order := normalizeEndpoints(endpoints)
 	if len(order) == 0 {
 		return FetchResult{}, "", fmt.Errorf("no endpoints")
@@ -72,7 +50,7 @@ func FetchAnyEndpoints(ctx context.Context, endpoints []string, decryptURL strin
 	var lastNonTerminalEndpoint string
 	terminalCount := 0
 	for _, ep := range order {
-		res, err := FetchWithDecryptURL(ctx, ep, decryptURL, ifNoneMatchRevision)
+		res, err := FetchWithDecryptURL(ctx, ep, decryptURL, signer, ifNoneMatchRevision)
 		if err == nil {
 			return res, ep, nil
 		}
@@ -3,6 +3,7 @@ package feed
 import (
 	"context"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -44,7 +45,7 @@ func TestFetchAnyEndpoints_DoesNotStopOnNonRetriableIfAnotherEndpointSucceeds(t
 	defer successSrv.Close()
 
 	ctx := context.Background()
-	res, used, err := FetchAnyEndpoints(ctx, []string{errSrv.URL, successSrv.URL}, successSrv.URL, "")
+	res, used, err := FetchAnyEndpoints(ctx, []string{errSrv.URL, successSrv.URL}, successSrv.URL, "", "")
 	if err != nil {
 		t.Fatalf("expected success, got err=%v", err)
 	}
@@ -71,7 +72,7 @@ func TestFetchAnyEndpoints_AllNonRetriable_ReturnsNonRetriable(t *testing.T) {
 	}))
 	defer errSrv2.Close()
 
-	_, _, err := FetchAnyEndpoints(context.Background(), []string{errSrv1.URL, errSrv2.URL}, errSrv1.URL, "")
+	_, _, err := FetchAnyEndpoints(context.Background(), []string{errSrv1.URL, errSrv2.URL}, errSrv1.URL, "", "")
 	if err == nil {
 		t.Fatalf("expected error")
 	}
@@ -83,3 +84,29 @@ func TestFetchAnyEndpoints_AllNonRetriable_ReturnsNonRetriable(t *testing.T) {
 		t.Fatalf("expected non-retriable")
 	}
 }
+
+func TestStreamSSEAnyEndpoints_ErrorEventIsTerminal(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, "retry: 5000\n\nevent: feed\ndata: {\"revision\":\"r1\"}\n\n: ping\n\n")
+		_, _ = io.WriteString(w, "event: error\ndata: {\"version\":\"wg-feed-00\",\"success\":false,\"message\":\"revoked\",\"retriable\":false}\n\n")
+	}))
+	defer srv.Close()
+
+	var events []string
+	err := StreamSSEAnyEndpoints(context.Background(), []string{srv.URL}, func(_ string, data []byte) error {
+		events = append(events, string(data))
+		return nil
+	})
+	if len(events) != 1 || events[0] != `{"revision":"r1"}` {
+		t.Fatalf("unexpected events: %q", events)
+	}
+	wf, ok := AsWGFeedError(err)
+	if !ok {
+		t.Fatalf("expected WGFeedError, got %T: %v", err, err)
+	}
+	if wf.Retriable || wf.Message != "revoked" {
+		t.Fatalf("unexpected error: %+v", wf)
+	}
+}
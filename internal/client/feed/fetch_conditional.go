@@ -22,6 +22,10 @@ type FetchResult struct {
 	EncryptedData string
 	Feed          model.FeedDocument
 	Body          []byte
+	// Sequence is the sequence number of the document, or 0 if it has none.
+	Sequence uint64
+	// Signer is the key that signed the document, or "" if it is unsigned.
+	Signer string
 }
 
 func fetchSuccessResponse(ctx context.Context, url string, ifNoneMatchRevision string) (model.SuccessResponse, []byte, bool, error) {
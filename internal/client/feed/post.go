@@ -0,0 +1,58 @@
+package feed
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/exeteres/wg-feed/internal/model"
+)
+
+// PostStatusReport posts report to the status_url of a feed document.
+func PostStatusReport(ctx context.Context, url string, report model.StatusReport) error {
+	return postJSON(ctx, url, report)
+}
+
+// Enroll posts req to the enrollment_url of a feed document.
+func Enroll(ctx context.Context, url string, req model.EnrollmentRequest) error {
+	return postJSON(ctx, url, req)
+}
+
+func postJSON(ctx context.Context, url string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		return nil
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if strings.HasPrefix(strings.ToLower(resp.Header.Get("Content-Type")), "application/json") {
+		if er, ok := tryDecodeErrorResponse(b); ok {
+			return &WGFeedError{Status: resp.StatusCode, Message: er.Message, Retriable: er.Retriable}
+		}
+	}
+	return fmt.Errorf("POST %s: unexpected status %d: %s", RedactURL(url), resp.StatusCode, string(b))
+}
@@ -0,0 +1,111 @@
+package feed
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/exeteres/wg-feed/internal/model"
+)
+
+// ErrBadSignature is returned for a feed document that does not carry a valid
+// signature by the pinned signer key.
+var ErrBadSignature = errors.New("feed signature verification failed")
+
+// SignerFromURL returns the signer key pinned by the "signer=" parameter of
+// the Setup URL fragment, or "" if the URL pins none.
+func SignerFromURL(setupURL string) (string, error) {
+	_, signer, err := setupURLFragment(setupURL)
+	if err != nil || signer == "" {
+		return "", err
+	}
+	if _, err := model.ParseSignerKey(signer); err != nil {
+		return "", fmt.Errorf("signer in url fragment %w", err)
+	}
+	return signer, nil
+}
+
+// PinnedSigner returns the signer key documents of the feed of setupURL must
+// be signed with: the key pinned by the Setup URL, else learned (the key of
+// the first signed document), or "" if neither is set.
+func PinnedSigner(setupURL, learned string) (string, error) {
+	signer, err := SignerFromURL(setupURL)
+	if err != nil || signer != "" {
+		return signer, err
+	}
+	return strings.TrimSpace(learned), nil
+}
+
+// verifySignature checks the signature sig of the feed document JSON doc
+// served with sequence and returns the signer key, or "" for an unsigned
+// document. With signer set, the document must be signed by that key.
+func verifySignature(sig *model.Signature, doc []byte, sequence uint64, signer string) (string, error) {
+	if sig == nil {
+		if signer != "" {
+			return "", fmt.Errorf("%w: document is not signed", ErrBadSignature)
+		}
+		return "", nil
+	}
+	if signer != "" && sig.PublicKey != signer {
+		return "", fmt.Errorf("%w: signed by %s, not by the pinned key", ErrBadSignature, sig.PublicKey)
+	}
+	if err := sig.Verify(doc, sequence); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	return sig.PublicKey, nil
+}
+
+// DecodeSuccessResponse decodes and validates a success response body, as
+// received from a fetch or an SSE event. The document is decrypted with the
+// age key of decryptURL when encrypted, and its signature is verified against
+// signer (see PinnedSigner).
+func DecodeSuccessResponse(body []byte, decryptURL, signer string) (FetchResult, error) {
+	sr, err := decodeSuccessResponse(body)
+	if err != nil {
+		return FetchResult{}, err
+	}
+	return successResult(sr, body, decryptURL, signer)
+}
+
+func successResult(sr model.SuccessResponse, body []byte, decryptURL, signer string) (FetchResult, error) {
+	res := FetchResult{}
+	res.Revision = strings.TrimSpace(sr.Revision)
+	res.TTLSeconds = sr.TTLSeconds
+	res.SupportsSSE = sr.SupportsSSE
+	res.Sequence = sr.Sequence
+	res.Body = body
+
+	var doc []byte
+	if sr.Encrypted {
+		feed, pt, err := decryptFeedDocument(decryptURL, sr.EncryptedData)
+		if err != nil {
+			return FetchResult{}, err
+		}
+		res.Encrypted = true
+		res.EncryptedData = sr.EncryptedData
+		res.Feed = feed
+		doc = pt
+	} else {
+		if sr.Data == nil {
+			return FetchResult{}, fmt.Errorf("validate response: data is required when encrypted=false")
+		}
+		res.Feed = *sr.Data
+		// The signature covers the document as served, including members
+		// this client does not know.
+		var raw struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.NewDecoder(bytes.NewReader(body)).Decode(&raw); err != nil {
+			return FetchResult{}, fmt.Errorf("decode response: %w", err)
+		}
+		doc = raw.Data
+	}
+
+	var err error
+	if res.Signer, err = verifySignature(sr.Signature, doc, sr.Sequence, signer); err != nil {
+		return FetchResult{}, err
+	}
+	return res, nil
+}
@@ -0,0 +1,106 @@
+package feed
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/exeteres/wg-feed/internal/model"
+)
+
+func signedResponse(t *testing.T, priv ed25519.PrivateKey) model.SuccessResponse {
+	t.Helper()
+
+	doc := model.FeedDocument{
+		ID:          "123e4567-e89b-12d3-a456-426614174000",
+		Endpoints:   []string{"https://example.invalid/sub"},
+		DisplayInfo: model.DisplayInfo{Title: "t"},
+		Tunnels:     []model.Tunnel{},
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	sig, err := model.SignFeedDocument(priv, b, 0)
+	if err != nil {
+		t.Fatalf("SignFeedDocument: %v", err)
+	}
+	return model.SuccessResponse{Version: "wg-feed-00", Success: true, Revision: "r1", TTLSeconds: 60, Data: &doc, Signature: &sig}
+}
+
+func TestSignerFromURL(t *testing.T) {
+	t.Parallel()
+
+	pub, _, _ := ed25519.GenerateKey(nil)
+	signer := model.EncodeSignerKey(pub)
+
+	got, err := SignerFromURL("https://example.test/feed#1kyhr0slrn9cdp6q&signer=" + signer)
+	if err != nil || got != signer {
+		t.Fatalf("SignerFromURL = %q, %v; want %q", got, err, signer)
+	}
+	if ageKey, _, _ := setupURLFragment("https://example.test/feed#signer=" + signer + "&1kyhr0slrn9cdp6q"); ageKey != "1kyhr0slrn9cdp6q" {
+		t.Fatalf("age key = %q", ageKey)
+	}
+	if got, err := PinnedSigner("https://example.test/feed#1kyhr0slrn9cdp6q", "learned"); err != nil || got != "learned" {
+		t.Fatalf("PinnedSigner without url pin = %q, %v", got, err)
+	}
+	if got, err := PinnedSigner("https://example.test/feed#signer="+signer, "learned"); err != nil || got != signer {
+		t.Fatalf("PinnedSigner with url pin = %q, %v", got, err)
+	}
+	if _, err := SignerFromURL("https://example.test/feed#signer=short"); err == nil {
+		t.Fatalf("expected error for invalid signer")
+	}
+}
+
+func TestFetchAnyEndpoints_VerifiesSignature(t *testing.T) {
+	t.Parallel()
+
+	_, priv, _ := ed25519.GenerateKey(nil)
+	good := signedResponse(t, priv)
+	signer := good.Signature.PublicKey
+
+	tampered := signedResponse(t, priv)
+	tampered.Data.DisplayInfo.Title = "tampered"
+
+	serve := func(sr model.SuccessResponse) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			_ = json.NewEncoder(w).Encode(sr)
+		}))
+	}
+	tamperedSrv := serve(tampered)
+	defer tamperedSrv.Close()
+	goodSrv := serve(good)
+	defer goodSrv.Close()
+
+	// Learned at bootstrap: without a pin, the signer is reported.
+	res, err := FetchWithDecryptURL(context.Background(), goodSrv.URL, goodSrv.URL, "", "")
+	if err != nil || res.Signer != signer {
+		t.Fatalf("unpinned fetch: signer=%q err=%v", res.Signer, err)
+	}
+
+	res, used, err := FetchAnyEndpoints(context.Background(), []string{tamperedSrv.URL, goodSrv.URL}, goodSrv.URL, signer, "")
+	if err != nil || used != goodSrv.URL || res.Feed.DisplayInfo.Title != "t" {
+		t.Fatalf("unexpected result: used=%q res=%+v err=%v", used, res, err)
+	}
+	if _, err := FetchWithDecryptURL(context.Background(), tamperedSrv.URL, tamperedSrv.URL, signer, ""); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("tampered document: err=%v, want ErrBadSignature", err)
+	}
+
+	// The SSE path decodes events with the same checks.
+	unsigned := good
+	unsigned.Signature = nil
+	body, _ := json.Marshal(unsigned)
+	if _, err := DecodeSuccessResponse(body, goodSrv.URL, signer); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("unsigned document with a pinned signer: err=%v, want ErrBadSignature", err)
+	}
+	_, other, _ := ed25519.GenerateKey(nil)
+	body, _ = json.Marshal(signedResponse(t, other))
+	if _, err := DecodeSuccessResponse(body, goodSrv.URL, signer); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("document signed by another key: err=%v, want ErrBadSignature", err)
+	}
+}
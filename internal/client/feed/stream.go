@@ -3,11 +3,15 @@ package feed
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+
+	"github.com/exeteres/wg-feed/internal/jsonpatch"
+	"github.com/exeteres/wg-feed/internal/model"
 )
 
 var ErrStreamNotSupported = errors.New("stream not supported")
@@ -15,6 +19,11 @@ var ErrStreamNotSupported = errors.New("stream not supported")
 // StreamSSE opens an SSE stream for the given URL.
 // It returns ErrStreamNotSupported if the server responds with a non-SSE content-type.
 // Each event is expected to contain exactly one "data: " line with the full JSON payload.
+// The stream asks for patch events (see model.PatchEvent), which are applied to
+// the last success response so that onEvent always gets a full one; when a
+// patch does not apply to it, the success response is fetched from url instead.
+// An "event: error" carrying a wg-feed JSON error response ends the stream with a
+// *WGFeedError; when it is not retriable, the caller must treat it as a terminal condition.
 func StreamSSE(ctx context.Context, url string, onEvent func(data []byte) error) error {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
@@ -22,6 +31,7 @@ func StreamSSE(ctx context.Context, url string, onEvent func(data []byte) error)
 	}
 	// Draft-00: clients send exactly one Accept media type.
 	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set(model.PatchHeader, model.PatchMediaType)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -45,6 +55,8 @@ func StreamSSE(ctx context.Context, url string, onEvent func(data []byte) error)
 	}
 
 	r := bufio.NewReader(resp.Body)
+	var last []byte
+	var lastRevision string
 	for {
 		select {
 		case <-ctx.Done():
@@ -52,28 +64,73 @@ func StreamSSE(ctx context.Context, url string, onEvent func(data []byte) error)
 		default:
 		}
 
-		data, err := readOneSSEDataEvent(r)
+		eventType, data, err := readOneSSEDataEvent(r)
 		if err != nil {
 			return err
 		}
+		if eventType == "error" {
+			if er, ok := tryDecodeErrorResponse(data); ok {
+				return &WGFeedError{Status: resp.StatusCode, Message: er.Message, Retriable: er.Retriable}
+			}
+			return fmt.Errorf("GET %s: invalid error event: %s", RedactURL(url), string(data))
+		}
+		if eventType == "patch" {
+			var ok bool
+			if data, ok = applyPatchEvent(last, lastRevision, data); !ok {
+				if _, data, _, err = fetchSuccessResponse(ctx, url, ""); err != nil {
+					return err
+				}
+			}
+		}
+		last, lastRevision = data, responseRevision(data)
 		if err := onEvent(data); err != nil {
 			return err
 		}
 	}
 }
 
-func readOneSSEDataEvent(r *bufio.Reader) ([]byte, error) {
+// applyPatchEvent returns the success response of the patch event data,
+// applied to last, the success response of lastRevision. It returns false
+// when the patch is invalid, is not based on lastRevision or does not result
+// in its target revision.
+func applyPatchEvent(last []byte, lastRevision string, data []byte) ([]byte, bool) {
+	var ev model.PatchEvent
+	if err := json.Unmarshal(data, &ev); err != nil || ev.Validate() != nil {
+		return nil, false
+	}
+	if last == nil || ev.BaseRevision != lastRevision {
+		return nil, false
+	}
+	patched, err := jsonpatch.Apply(last, ev.Patch)
+	if err != nil || responseRevision(patched) != ev.Revision {
+		return nil, false
+	}
+	return patched, true
+}
+
+// responseRevision returns the revision of a success response, or "" if it
+// has none.
+func responseRevision(body []byte) string {
+	var sr struct {
+		Revision string `json:"revision"`
+	}
+	_ = json.Unmarshal(body, &sr)
+	return sr.Revision
+}
+
+// readOneSSEDataEvent returns the type and data of the next feed, patch or error event.
+func readOneSSEDataEvent(r *bufio.Reader) (string, []byte, error) {
 	var eventType string
 	var data []byte
 	for {
 		line, err := r.ReadString('\n')
 		if err != nil {
-			return nil, err
+			return "", nil, err
 		}
 		trimmed := strings.TrimRight(line, "\r\n")
 		if trimmed == "" {
-			if eventType == "feed" && len(data) != 0 {
-				return data, nil
+			if (eventType == "feed" || eventType == "patch" || eventType == "error") && len(data) != 0 {
+				return eventType, data, nil
 			}
 			// Reset state for next event.
 			eventType = ""
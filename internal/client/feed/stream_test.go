@@ -0,0 +1,64 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/exeteres/wg-feed/internal/model"
+)
+
+func TestStreamSSE_PatchEvents(t *testing.T) {
+	t.Parallel()
+
+	response := func(rev, title string) string {
+		return `{"version":"wg-feed-00","success":true,"revision":"` + rev + `","ttl_seconds":60,"data":{"id":"123e4567-e89b-12d3-a456-426614174000","endpoints":["https://example.invalid/sub"],"display_info":{"title":"` + title + `"},"tunnels":[]}}`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") == "application/json" {
+			// The full fetch after a patch that does not apply.
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			_, _ = io.WriteString(w, response("r4", "full"))
+			return
+		}
+		if r.Header.Get(model.PatchHeader) != model.PatchMediaType {
+			t.Errorf("patch events not requested")
+		}
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, "event: feed\ndata: "+response("r1", "one")+"\n\n")
+		_, _ = io.WriteString(w, `event: patch`+"\n"+`data: {"version":"wg-feed-00","base_revision":"r1","revision":"r2","patch":[{"op":"replace","path":"/revision","value":"r2"},{"op":"replace","path":"/data/display_info/title","value":"two"}]}`+"\n\n")
+		_, _ = io.WriteString(w, `event: patch`+"\n"+`data: {"version":"wg-feed-00","base_revision":"r1","revision":"r3","patch":[{"op":"replace","path":"/revision","value":"r3"}]}`+"\n\n")
+	}))
+	defer srv.Close()
+
+	var titles []string
+	err := StreamSSE(context.Background(), srv.URL, func(data []byte) error {
+		res, err := DecodeSuccessResponse(data, srv.URL, "")
+		if err != nil {
+			return err
+		}
+		titles = append(titles, res.Revision+":"+res.Feed.DisplayInfo.Title)
+		return nil
+	})
+	if err != io.EOF {
+		t.Fatalf("StreamSSE: %v", err)
+	}
+	// The second patch is based on r1 while the client has r2.
+	if strings.Join(titles, ",") != "r1:one,r2:two,r4:full" {
+		t.Fatalf("unexpected events: %q", titles)
+	}
+
+	if _, ok := applyPatchEvent([]byte(response("r1", "one")), "r1", []byte(`{"version":"wg-feed-00","base_revision":"r1","revision":"r2","patch":[]}`)); ok {
+		t.Fatalf("expected a patch not resulting in its revision to be refused")
+	}
+	var sr model.SuccessResponse
+	patched, ok := applyPatchEvent([]byte(response("r1", "one")), "r1", []byte(`{"version":"wg-feed-00","base_revision":"r1","revision":"r2","patch":[{"op":"replace","path":"/revision","value":"r2"}]}`))
+	if !ok || json.Unmarshal(patched, &sr) != nil || sr.Revision != "r2" {
+		t.Fatalf("unexpected patched response: %s", patched)
+	}
+}
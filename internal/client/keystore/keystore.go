@@ -0,0 +1,88 @@
+// Package keystore keeps the WireGuard private keys the client generates for
+// feeds whose tunnels use model.ClientPrivateKeyPlaceholder, so that the key
+// never leaves the device. Each key is stored as <dir>/<feed id>.key, holding
+// the base64 key and readable only by its owner.
+package keystore
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Store struct {
+	dir string
+}
+
+func New(dir string) Store {
+	return Store{dir: dir}
+}
+
+// Key is a WireGuard keypair in base64 (standard encoding).
+type Key struct {
+	Private string
+	Public  string
+}
+
+// LoadOrCreate returns the key of feedID, generating and storing it on first use.
+func (s Store) LoadOrCreate(feedID string) (Key, error) {
+	if strings.TrimSpace(s.dir) == "" {
+		return Key{}, errors.New("key directory is not configured")
+	}
+	if feedID == "" || filepath.Base(feedID) != feedID || strings.HasPrefix(feedID, ".") {
+		return Key{}, fmt.Errorf("invalid feed id %q", feedID)
+	}
+	path := filepath.Join(s.dir, feedID+".key")
+
+	b, err := os.ReadFile(path)
+	if err == nil {
+		return parse(strings.TrimSpace(string(b)))
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return Key{}, err
+	}
+
+	key, err := generate()
+	if err != nil {
+		return Key{}, err
+	}
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return Key{}, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(key.Private+"\n"), 0o600); err != nil {
+		return Key{}, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return Key{}, err
+	}
+	return key, nil
+}
+
+func generate() (Key, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return Key{}, err
+	}
+	// Clamp as "wg genkey" does.
+	b[0] &= 248
+	b[31] = (b[31] & 127) | 64
+	return parse(base64.StdEncoding.EncodeToString(b))
+}
+
+func parse(private string) (Key, error) {
+	b, err := base64.StdEncoding.DecodeString(private)
+	if err != nil || len(b) != 32 {
+		return Key{}, errors.New("stored key is not a base64-encoded 32-byte key")
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(b)
+	if err != nil {
+		return Key{}, err
+	}
+	return Key{Private: private, Public: base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes())}, nil
+}
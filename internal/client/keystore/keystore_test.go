@@ -0,0 +1,52 @@
+package keystore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreate(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(t.TempDir(), "keys")
+	s := New(dir)
+	feedID := "11111111-1111-4111-8111-111111111111"
+
+	key, err := s.LoadOrCreate(feedID)
+	if err != nil {
+		t.Fatalf("LoadOrCreate: %v", err)
+	}
+	if len(key.Private) != 44 || len(key.Public) != 44 || key.Private == key.Public {
+		t.Fatalf("unexpected key: %+v", key)
+	}
+	fi, err := os.Stat(filepath.Join(dir, feedID+".key"))
+	if err != nil {
+		t.Fatalf("stat key file: %v", err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Fatalf("key file mode = %v", fi.Mode().Perm())
+	}
+
+	again, err := s.LoadOrCreate(feedID)
+	if err != nil || again != key {
+		t.Fatalf("second LoadOrCreate: %+v, %v", again, err)
+	}
+
+	if _, err := s.LoadOrCreate("../escape"); err == nil {
+		t.Fatalf("expected error for path-like feed id")
+	}
+}
+
+func TestParse_RFC7748(t *testing.T) {
+	t.Parallel()
+
+	// Alice's keypair from RFC 7748, section 6.1.
+	key, err := parse("dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCo=")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if want := "hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo="; key.Public != want {
+		t.Fatalf("public key = %q, want %q", key.Public, want)
+	}
+}
@@ -1,10 +1,14 @@
 package state
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 type State struct {
@@ -12,6 +16,8 @@ type State struct {
 	// (without storing them) into stable keys.
 	SubscriptionURLSalt string            `json:"subscription_url_salt,omitempty"`
 	SetupURLMap         map[string]string `json:"setup_url_map,omitempty"` // hashed canonical setup url (no fragment) -> feed id
+	// DeviceID is a per-installation random identifier sent in status reports.
+	DeviceID string `json:"device_id,omitempty"`
 
 	Feeds map[string]FeedState `json:"feeds"`
 }
@@ -23,6 +29,33 @@ type FeedState struct {
 	CachedEncryptedData    string                 `json:"cached_encrypted_data,omitempty"`
 	EndpointOrder          []string               `json:"endpoint_order,omitempty"` // salted hashes; preferred endpoints first
 	Tunnels                map[string]TunnelState `json:"tunnels"`
+
+	// EnrolledPublicKey is the client public key last enrolled at the feed's enrollment_url.
+	EnrolledPublicKey string `json:"enrolled_public_key,omitempty"`
+	// SignerKey is the key documents of the feed must be signed with: the one
+	// pinned by the Setup URL, or learned from the first signed document.
+	SignerKey string `json:"signer_key,omitempty"`
+
+	// Sequence is the highest feed document sequence number accepted so far;
+	// documents with a lower one are replays and are refused (see CheckSequence).
+	Sequence uint64 `json:"sequence,omitempty"`
+	// CachedSequence is the sequence number of CachedEncryptedData.
+	CachedSequence uint64 `json:"cached_sequence,omitempty"`
+}
+
+// ErrStaleSequence is returned by FeedState.CheckSequence for a document older
+// than one already accepted.
+var ErrStaleSequence = errors.New("feed document sequence is lower than the last accepted one")
+
+// CheckSequence returns ErrStaleSequence if a document served with sequence
+// (0 if none) must not be reconciled: its sequence is lower than the highest
+// accepted one. Once a sequence was accepted, documents without one are
+// refused too, so that a feed cannot be downgraded to an unsequenced copy.
+func (fs FeedState) CheckSequence(sequence uint64) error {
+	if sequence < fs.Sequence {
+		return fmt.Errorf("%w (%d < %d)", ErrStaleSequence, sequence, fs.Sequence)
+	}
+	return nil
 }
 
 type TunnelState struct {
@@ -30,6 +63,19 @@ type TunnelState struct {
 	Enabled bool   `json:"enabled"`
 }
 
+// EnsureDeviceID returns the device id, generating it on first use.
+func (st *State) EnsureDeviceID() (string, error) {
+	if id := strings.TrimSpace(st.DeviceID); id != "" {
+		return id, nil
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	st.DeviceID = hex.EncodeToString(b)
+	return st.DeviceID, nil
+}
+
 func Load(path string) (State, error) {
 	b, err := os.ReadFile(path)
 	if err != nil {
@@ -1,6 +1,7 @@
 package state
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
@@ -50,3 +51,22 @@ func TestSaveAtomic_RoundTrip(t *testing.T) {
 		t.Fatalf("expected non-empty file")
 	}
 }
+
+func TestFeedState_CheckSequence(t *testing.T) {
+	t.Parallel()
+
+	if err := (FeedState{}).CheckSequence(0); err != nil {
+		t.Fatalf("unsequenced feed: %v", err)
+	}
+	fs := FeedState{Sequence: 5}
+	for _, seq := range []uint64{5, 6} {
+		if err := fs.CheckSequence(seq); err != nil {
+			t.Fatalf("CheckSequence(%d): %v", seq, err)
+		}
+	}
+	for _, seq := range []uint64{0, 4} {
+		if err := fs.CheckSequence(seq); !errors.Is(err, ErrStaleSequence) {
+			t.Fatalf("CheckSequence(%d): err=%v, want ErrStaleSequence", seq, err)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package wgquick
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseLatestHandshakes parses the output of "wg show <iface> latest-handshakes"
+// (one "<public key>\t<unix seconds>" line per peer, 0 for none) and returns
+// the most recent handshake of any peer, or the zero time if there was none.
+func ParseLatestHandshakes(out string) (time.Time, error) {
+	var latest int64
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return time.Time{}, fmt.Errorf("unexpected latest-handshakes line %q", line)
+		}
+		sec, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unexpected latest-handshakes line %q", line)
+		}
+		latest = max(latest, sec)
+	}
+	if latest == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(latest, 0), nil
+}
@@ -0,0 +1,23 @@
+package wgquick
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLatestHandshakes(t *testing.T) {
+	got, err := ParseLatestHandshakes("pub1=\t1700000000\npub2=\t1700000100\npub3=\t0\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !got.Equal(time.Unix(1700000100, 0)) {
+		t.Fatalf("unexpected latest handshake: %v", got)
+	}
+
+	if got, err := ParseLatestHandshakes("pub1=\t0\n"); err != nil || !got.IsZero() {
+		t.Fatalf("no handshake: got %v, %v", got, err)
+	}
+	if _, err := ParseLatestHandshakes("pub1=\tsoon\n"); err == nil {
+		t.Fatalf("expected error for malformed line")
+	}
+}
@@ -1,9 +1,7 @@
 package daemon
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -16,7 +14,6 @@ import (
 	"github.com/exeteres/wg-feed/internal/client/config"
 	"github.com/exeteres/wg-feed/internal/client/feed"
 	"github.com/exeteres/wg-feed/internal/client/state"
-	"github.com/exeteres/wg-feed/internal/model"
 )
 
 const (
@@ -38,6 +35,10 @@ func Run(ctx context.Context, cfg config.Config, logger *log.Logger) error {
 		logger: logger,
 	}
 
+	if cfg.StatusReportInterval > 0 {
+		go d.statusLoop(ctx)
+	}
+
 	errCh := make(chan error, len(cfg.SetupURLs))
 	for _, url := range cfg.SetupURLs {
 		setupURL := url
@@ -65,6 +66,9 @@ type daemon struct {
 
 	mu sync.Mutex
 
+	reportsMu sync.Mutex
+	reports   map[string]statusReport // feedID -> latest status report
+
 	claimedMu sync.Mutex
 	claimed   map[string]string // feedID -> setupURL
 }
@@ -78,7 +82,11 @@ func (d *daemon) runFeed(ctx context.Context, setupURL string) error {
 	var nextCacheReconcile time.Time
 
 	// Best-effort: resolve feedID + endpoints from cached encrypted_data before any network bootstrap.
-	resolvedID, resolvedEndpoints, err := d.resolveFromStateCache(setupURL)
+	resolvedID, resolvedEndpoints, learnedSigner, err := d.resolveFromStateCache(setupURL)
+	if err != nil {
+		return err
+	}
+	signer, err := feed.PinnedSigner(setupURL, learnedSigner)
 	if err != nil {
 		return err
 	}
@@ -99,7 +107,7 @@ func (d *daemon) runFeed(ctx context.Context, setupURL string) error {
 
 		// If we don't yet know endpoints, bootstrap once using the setup URL.
 		if len(endpoints) == 0 {
-			res, _, err := feed.FetchAnyEndpoints(ctx, []string{setupURL}, setupURL, "")
+			res, _, err := feed.FetchAnyEndpoints(ctx, []string{setupURL}, setupURL, signer, "")
 			if err != nil {
 				if wf, ok := feed.AsWGFeedError(err); ok && !wf.Retriable {
 					return err
@@ -111,6 +119,11 @@ func (d *daemon) runFeed(ctx context.Context, setupURL string) error {
 				sleep(ctx, defaultTickOnFailure)
 				continue
 			}
+			if err := d.checkSequence(res); err != nil {
+				d.logger.Printf("bootstrap document refused feed=%q err=%v", feed.RedactURL(setupURL), err)
+				sleep(ctx, defaultTickOnFailure)
+				continue
+			}
 			if feedID == "" {
 				feedID = strings.TrimSpace(res.Feed.ID)
 				if feedID == "" {
@@ -121,11 +134,10 @@ func (d *daemon) runFeed(ctx context.Context, setupURL string) error {
 				}
 			}
 			endpoints = res.Feed.Endpoints
-			cached := ""
-			if res.Encrypted {
-				cached = res.EncryptedData
+			if res.Signer != "" {
+				signer = res.Signer
 			}
-			if err := d.applyRemoteUpdate(ctx, setupURL, setupURL, res.Feed, res.Revision, res.TTLSeconds, cached); err != nil {
+			if err := d.applyRemoteUpdate(ctx, setupURL, setupURL, res); err != nil {
 				return err
 			}
 			lastRevision = strings.TrimSpace(res.Revision)
@@ -136,7 +148,7 @@ func (d *daemon) runFeed(ctx context.Context, setupURL string) error {
 
 		// Prefer SSE when available.
 		err := feed.StreamSSEAnyEndpoints(ctx, endpoints, func(endpoint string, data []byte) error {
-			doc, rev, ttl, encryptedData, err := decodeAndValidateSuccess(setupURL, data)
+			res, err := feed.DecodeSuccessResponse(data, setupURL, signer)
 			if err != nil {
 				if wf, ok := feed.AsWGFeedError(err); ok && !wf.Retriable {
 					return err
@@ -144,10 +156,15 @@ func (d *daemon) runFeed(ctx context.Context, setupURL string) error {
 				d.logger.Printf("stream event invalid feed=%q err=%v", feed.RedactURL(endpoint), err)
 				return nil
 			}
+			if err := d.checkSequence(res); err != nil {
+				d.logger.Printf("stream event refused feed=%q err=%v", feed.RedactURL(endpoint), err)
+				return nil
+			}
+			ttl := res.TTLSeconds
 			lastTTL = &ttl
-			lastRevision = strings.TrimSpace(rev)
+			lastRevision = res.Revision
 			if feedID == "" {
-				feedID = strings.TrimSpace(doc.ID)
+				feedID = strings.TrimSpace(res.Feed.ID)
 				if feedID == "" {
 					return fmt.Errorf("missing feed id")
 				}
@@ -155,8 +172,11 @@ func (d *daemon) runFeed(ctx context.Context, setupURL string) error {
 					return nil
 				}
 			}
-			endpoints = doc.Endpoints
-			if err := d.applyRemoteUpdate(ctx, endpoint, setupURL, doc, rev, ttl, encryptedData); err != nil {
+			endpoints = res.Feed.Endpoints
+			if res.Signer != "" {
+				signer = res.Signer
+			}
+			if err := d.applyRemoteUpdate(ctx, endpoint, setupURL, res); err != nil {
 				return err
 			}
 			return nil
@@ -166,13 +186,13 @@ func (d *daemon) runFeed(ctx context.Context, setupURL string) error {
 			return ctx.Err()
 		}
 		if errors.Is(err, feed.ErrStreamNotSupported) {
-			res, _, fetchErr := feed.FetchAnyEndpoints(ctx, endpoints, setupURL, "")
+			res, _, fetchErr := feed.FetchAnyEndpoints(ctx, endpoints, setupURL, signer, "")
 			if fetchErr == nil && res.SupportsSSE {
 				d.logger.Printf("stream not supported for %s but supports_sse=true; retrying stream", feed.RedactURL(setupURL))
 				continue
 			}
 			d.logger.Printf("stream not supported for %s; using polling", feed.RedactURL(setupURL))
-			return d.pollLoop(ctx, setupURL, &feedID, &endpoints, &lastRevision, &lastTTL, &nextCacheReconcile)
+			return d.pollLoop(ctx, setupURL, &feedID, &endpoints, &signer, &lastRevision, &lastTTL, &nextCacheReconcile)
 		}
 		if wf, ok := feed.AsWGFeedError(err); ok && !wf.Retriable {
 			d.logger.Printf("wg-feed error (non-retriable) feed=%q message=%q; stopping automatic reconnect", feed.RedactURL(setupURL), wf.Message)
@@ -189,10 +209,13 @@ func (d *daemon) runFeed(ctx context.Context, setupURL string) error {
 	}
 }
 
-func (d *daemon) resolveFromStateCache(setupURL string) (string, []string, error) {
+// resolveFromStateCache returns the feed id, endpoints and learned signer key
+// known for setupURL from the state.
+func (d *daemon) resolveFromStateCache(setupURL string) (string, []string, string, error) {
 	setupURL = strings.TrimSpace(setupURL)
 	var feedID string
 	var endpoints []string
+	var signer string
 	err := d.withStateSave(func(st *state.State) error {
 		key, err := st.SubscriptionURLKey(setupURL)
 		if err != nil {
@@ -206,6 +229,7 @@ func (d *daemon) resolveFromStateCache(setupURL string) (string, []string, error
 		if !ok {
 			return nil
 		}
+		signer = fs.SignerKey
 		if strings.TrimSpace(fs.CachedEncryptedData) == "" {
 			return nil
 		}
@@ -224,9 +248,9 @@ func (d *daemon) resolveFromStateCache(setupURL string) (string, []string, error
 		return nil
 	})
 	if err != nil {
-		return "", nil, err
+		return "", nil, "", err
 	}
-	return feedID, endpoints, nil
+	return feedID, endpoints, signer, nil
 }
 
 func (d *daemon) claimFeedID(feedID, setupURL string) bool {
@@ -272,7 +296,7 @@ func (d *daemon) withStateRead(fn func(st state.State) error) error {
 	return fn(st)
 }
 
-func (d *daemon) pollLoop(ctx context.Context, setupURL string, feedID *string, endpoints *[]string, lastRevision *string, lastTTL **int, nextCacheReconcile *time.Time) error {
+func (d *daemon) pollLoop(ctx context.Context, setupURL string, feedID *string, endpoints *[]string, signer *string, lastRevision *string, lastTTL **int, nextCacheReconcile *time.Time) error {
 	for {
 		if ctx.Err() != nil {
 			return ctx.Err()
@@ -287,7 +311,7 @@ func (d *daemon) pollLoop(ctx context.Context, setupURL string, feedID *string,
 			})
 		}
 
-		res, usedEndpoint, err := feed.FetchAnyEndpoints(ctx, *endpoints, setupURL, strings.TrimSpace(*lastRevision))
+		res, usedEndpoint, err := feed.FetchAnyEndpoints(ctx, *endpoints, setupURL, *signer, strings.TrimSpace(*lastRevision))
 		if err != nil {
 			if wf, ok := feed.AsWGFeedError(err); ok && !wf.Retriable {
 				d.logger.Printf("wg-feed error (non-retriable) feed=%q message=%q; stopping automatic polling", feed.RedactURL(setupURL), wf.Message)
@@ -313,6 +337,11 @@ func (d *daemon) pollLoop(ctx context.Context, setupURL string, feedID *string,
 			sleep(ctx, s)
 			continue
 		}
+		if err := d.checkSequence(res); err != nil {
+			d.logger.Printf("poll document refused feed=%q err=%v", feed.RedactURL(usedEndpoint), err)
+			sleep(ctx, defaultTickOnFailure)
+			continue
+		}
 		*lastRevision = strings.TrimSpace(res.Revision)
 		if *feedID == "" {
 			*feedID = strings.TrimSpace(res.Feed.ID)
@@ -324,14 +353,13 @@ func (d *daemon) pollLoop(ctx context.Context, setupURL string, feedID *string,
 			}
 		}
 		*endpoints = res.Feed.Endpoints
+		if res.Signer != "" {
+			*signer = res.Signer
+		}
 		v := res.TTLSeconds
 		*lastTTL = &v
 
-		cached := ""
-		if res.Encrypted {
-			cached = res.EncryptedData
-		}
-		if err := d.applyRemoteUpdate(ctx, usedEndpoint, setupURL, res.Feed, res.Revision, res.TTLSeconds, cached); err != nil {
+		if err := d.applyRemoteUpdate(ctx, usedEndpoint, setupURL, res); err != nil {
 			if wf, ok := feed.AsWGFeedError(err); ok && !wf.Retriable {
 				d.logger.Printf("wg-feed error (non-retriable) feed=%q message=%q; stopping automatic polling", feed.RedactURL(setupURL), wf.Message)
 				<-ctx.Done()
@@ -360,31 +388,19 @@ func sleep(ctx context.Context, d time.Duration) {
 	}
 }
 
-func decodeAndValidateSuccess(setupURL string, body []byte) (model.FeedDocument, string, int, string, error) {
-	var sr model.SuccessResponse
-	dec := json.NewDecoder(bytes.NewReader(body))
-	if err := dec.Decode(&sr); err != nil {
-		return model.FeedDocument{}, "", 0, "", err
-	}
-	if err := sr.Validate(); err != nil {
-		return model.FeedDocument{}, "", 0, "", err
-	}
-	if sr.Encrypted {
-		doc, err := feed.DecryptFeedDocumentForSetupURL(setupURL, sr.EncryptedData)
-		if err != nil {
-			return model.FeedDocument{}, "", 0, "", err
-		}
-		rev := strings.TrimSpace(sr.Revision)
-		return doc, rev, sr.TTLSeconds, sr.EncryptedData, nil
-	}
-	if sr.Data == nil {
-		return model.FeedDocument{}, "", 0, "", fmt.Errorf("missing data")
-	}
-	rev := strings.TrimSpace(sr.Revision)
-	return *sr.Data, rev, sr.TTLSeconds, "", nil
+// checkSequence returns state.ErrStaleSequence if res is older than the last
+// document accepted for its feed, before anything of it is adopted.
+func (d *daemon) checkSequence(res feed.FetchResult) error {
+	return d.withStateRead(func(st state.State) error {
+		return st.Feeds[strings.TrimSpace(res.Feed.ID)].CheckSequence(res.Sequence)
+	})
 }
 
-func (d *daemon) applyRemoteUpdate(ctx context.Context, requestURL string, setupURL string, doc model.FeedDocument, revision string, ttl int, cachedEncryptedData string) error {
+// applyRemoteUpdate reconciles the fetched document res. Documents with a
+// lower sequence are refused from then on, and its signer key, if any, is
+// pinned.
+func (d *daemon) applyRemoteUpdate(ctx context.Context, requestURL string, setupURL string, res feed.FetchResult) error {
+	doc, revision := res.Feed, res.Revision
 	feedID := strings.TrimSpace(doc.ID)
 	if feedID == "" {
 		return fmt.Errorf("missing feed id")
@@ -392,7 +408,8 @@ func (d *daemon) applyRemoteUpdate(ctx context.Context, requestURL string, setup
 	if msg := strings.TrimSpace(doc.Warning); msg != "" {
 		d.logger.Printf("feed warning: feed=%q message=%q", feed.RedactURL(setupURL), msg)
 	}
-	return d.withStateSave(func(st *state.State) error {
+	report := false
+	err := d.withStateSave(func(st *state.State) error {
 		key, err := st.SubscriptionURLKey(setupURL)
 		if err != nil {
 			return err
@@ -400,6 +417,9 @@ func (d *daemon) applyRemoteUpdate(ctx context.Context, requestURL string, setup
 		st.SetupURLMap[key] = feedID
 
 		fs := st.Feeds[feedID]
+		if err := fs.CheckSequence(res.Sequence); err != nil {
+			return err
+		}
 		if fs.Tunnels == nil {
 			fs.Tunnels = map[string]state.TunnelState{}
 		}
@@ -408,17 +428,25 @@ func (d *daemon) applyRemoteUpdate(ctx context.Context, requestURL string, setup
 		st.ReconcileEndpointOrder(feedID, doc.Endpoints, requestURL)
 		fs = st.Feeds[feedID]
 
-		v := ttl
+		v := res.TTLSeconds
 		fs.TTLSeconds = &v
-		fs.CachedEncryptedData = strings.TrimSpace(cachedEncryptedData)
+		fs.CachedEncryptedData = strings.TrimSpace(res.EncryptedData)
+		fs.CachedSequence = res.Sequence
+		fs.Sequence = res.Sequence
+		if res.Signer != "" {
+			fs.SignerKey = res.Signer
+		}
 		st.Feeds[feedID] = fs
 
 		// Spec: only reconcile when revision changed since last successfully reconciled.
 		if strings.TrimSpace(revision) != "" && strings.TrimSpace(fs.LastReconciledRevision) == strings.TrimSpace(revision) {
+			report = d.recordStatusReport(st, feedID, doc, strings.TrimSpace(revision), nil)
 			return nil
 		}
 
-		if err := client.ApplyFeed(ctx, d.cfg, d.b, st, requestURL, doc, d.logger); err != nil {
+		err = client.ApplyFeed(ctx, d.cfg, d.b, st, requestURL, doc, d.logger)
+		report = d.recordStatusReport(st, feedID, doc, strings.TrimSpace(revision), err)
+		if err != nil {
 			return err
 		}
 		fs = st.Feeds[feedID]
@@ -426,6 +454,10 @@ func (d *daemon) applyRemoteUpdate(ctx context.Context, requestURL string, setup
 		st.Feeds[feedID] = fs
 		return nil
 	})
+	if report {
+		go d.sendStatusReport(ctx, feedID)
+	}
+	return err
 }
 
 func (d *daemon) maybeReconcileFromCache(ctx context.Context, setupURL string, feedID string, notBefore time.Time) error {
@@ -444,6 +476,9 @@ func (d *daemon) maybeReconcileFromCache(ctx context.Context, setupURL string, f
 		if strings.TrimSpace(fs.CachedEncryptedData) == "" {
 			return fmt.Errorf("no cached config")
 		}
+		if err := fs.CheckSequence(fs.CachedSequence); err != nil {
+			return err
+		}
 		doc, err := feed.DecryptFeedDocumentForSetupURL(setupURL, fs.CachedEncryptedData)
 		if err != nil {
 			return err
@@ -7,6 +7,8 @@ import (
 	"errors"
 	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
@@ -17,6 +19,7 @@ import (
 	"filippo.io/age/armor"
 
 	"github.com/exeteres/wg-feed/internal/client/config"
+	"github.com/exeteres/wg-feed/internal/client/feed"
 	"github.com/exeteres/wg-feed/internal/client/state"
 	"github.com/exeteres/wg-feed/internal/model"
 )
@@ -64,7 +67,7 @@ func TestApplyRemoteUpdate_RevisionUnchanged_DoesNotReconcile(t *testing.T) {
 		Tunnels:     []model.Tunnel{},
 	}
 
-	if err := d.applyRemoteUpdate(ctx, setupURL, setupURL, doc, "rev-1", 60, ""); err != nil {
+	if err := d.applyRemoteUpdate(ctx, setupURL, setupURL, feed.FetchResult{Feed: doc, Revision: "rev-1", TTLSeconds: 60}); err != nil {
 		t.Fatalf("applyRemoteUpdate: %v", err)
 	}
 
@@ -105,7 +108,7 @@ func TestApplyRemoteUpdate_ReconcileFailure_DoesNotAdvanceLastReconciledRevision
 		}},
 	}
 
-	if err := d.applyRemoteUpdate(ctx, setupURL, setupURL, doc, "rev-2", 60, ""); err == nil {
+	if err := d.applyRemoteUpdate(ctx, setupURL, setupURL, feed.FetchResult{Feed: doc, Revision: "rev-2", TTLSeconds: 60}); err == nil {
 		t.Fatalf("expected error")
 	}
 
@@ -228,3 +231,172 @@ func TestLoadVersionlessStateJSON_Succeeds(t *testing.T) {
 		t.Fatalf("Load: %v", err)
 	}
 }
+
+func TestApplyRemoteUpdate_SendsStatusReport(t *testing.T) {
+	t.Parallel()
+
+	reports := make(chan model.StatusReport, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report model.StatusReport
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&report) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reports <- report
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	setupURL := "https://example.test/feed"
+	feedID := "11111111-1111-4111-8111-111111111111"
+
+	b := &fakeBackend{applyErr: errors.New("boom")}
+	d := &daemon{cfg: config.Config{StatePath: statePath, StatusReportInterval: time.Hour}, b: b, logger: log.New(io.Discard, "", 0)}
+
+	tunnel := func(id string) model.Tunnel {
+		return model.Tunnel{
+			ID:            id,
+			Name:          id,
+			DisplayInfo:   model.DisplayInfo{Title: id},
+			Enabled:       true,
+			Forced:        true,
+			WGQuickConfig: "[Interface]\nPrivateKey = x\n\n[Peer]\nPublicKey = y\nAllowedIPs = 0.0.0.0/0\n",
+		}
+	}
+	doc := model.FeedDocument{
+		ID:          feedID,
+		Endpoints:   []string{"https://example.test/feed"},
+		DisplayInfo: model.DisplayInfo{Title: "Example"},
+		Tunnels:     []model.Tunnel{tunnel("t1"), tunnel("t2")},
+		StatusURL:   srv.URL,
+	}
+
+	if err := d.applyRemoteUpdate(ctx, setupURL, setupURL, feed.FetchResult{Feed: doc, Revision: "rev-1", TTLSeconds: 60}); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	var report model.StatusReport
+	select {
+	case report = <-reports:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no status report received")
+	}
+	if err := report.Validate(); err != nil {
+		t.Fatalf("invalid report: %v", err)
+	}
+	if report.FeedID != feedID || report.Revision != "rev-1" || len(report.Tunnels) != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if tun := report.Tunnels[0]; tun.Applied || tun.Error != "boom" {
+		t.Fatalf("unexpected failed tunnel status: %+v", tun)
+	}
+	if tun := report.Tunnels[1]; tun.Applied || tun.Error == "" {
+		t.Fatalf("unexpected skipped tunnel status: %+v", tun)
+	}
+
+	st, err := state.Load(statePath)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if st.DeviceID == "" || st.DeviceID != report.DeviceID {
+		t.Fatalf("device id not persisted: state=%q report=%q", st.DeviceID, report.DeviceID)
+	}
+}
+
+func TestApplyRemoteUpdate_PinsSigner(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	setupURL := "https://example.test/feed"
+	feedID := "11111111-1111-4111-8111-111111111111"
+
+	d := &daemon{cfg: config.Config{StatePath: statePath}, b: &fakeBackend{}, logger: log.New(io.Discard, "", 0)}
+	doc := model.FeedDocument{
+		ID:          feedID,
+		Endpoints:   []string{"https://example.test/feed"},
+		DisplayInfo: model.DisplayInfo{Title: "Example"},
+		Tunnels:     []model.Tunnel{},
+	}
+	if err := d.applyRemoteUpdate(ctx, setupURL, setupURL, feed.FetchResult{Feed: doc, Revision: "rev-1", TTLSeconds: 60, Signer: "signer-key"}); err != nil {
+		t.Fatalf("applyRemoteUpdate: %v", err)
+	}
+
+	// A restarted daemon verifies documents against the learned key.
+	resolvedID, _, signer, err := d.resolveFromStateCache(setupURL)
+	if err != nil {
+		t.Fatalf("resolveFromStateCache: %v", err)
+	}
+	if resolvedID != feedID || signer != "signer-key" {
+		t.Fatalf("resolved feed_id=%q signer=%q", resolvedID, signer)
+	}
+
+	// An unsigned update does not drop the pin.
+	if err := d.applyRemoteUpdate(ctx, setupURL, setupURL, feed.FetchResult{Feed: doc, Revision: "rev-2", TTLSeconds: 60}); err != nil {
+		t.Fatalf("applyRemoteUpdate: %v", err)
+	}
+	if _, _, signer, _ := d.resolveFromStateCache(setupURL); signer != "signer-key" {
+		t.Fatalf("signer after unsigned update = %q", signer)
+	}
+}
+
+func TestApplyRemoteUpdate_RefusesStaleSequence(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	setupURL := "https://example.test/feed"
+	feedID := "11111111-1111-4111-8111-111111111111"
+
+	b := &fakeBackend{}
+	d := &daemon{cfg: config.Config{StatePath: statePath}, b: b, logger: log.New(io.Discard, "", 0)}
+	doc := model.FeedDocument{
+		ID:          feedID,
+		Endpoints:   []string{"https://example.test/feed"},
+		DisplayInfo: model.DisplayInfo{Title: "Example"},
+		Tunnels:     []model.Tunnel{},
+	}
+	if err := d.applyRemoteUpdate(ctx, setupURL, setupURL, feed.FetchResult{Feed: doc, Revision: "rev-2", TTLSeconds: 60, Sequence: 2}); err != nil {
+		t.Fatalf("applyRemoteUpdate: %v", err)
+	}
+
+	// A replayed older document and one without a sequence are refused
+	// before anything is applied.
+	for _, seq := range []uint64{1, 0} {
+		old := feed.FetchResult{Feed: doc, Revision: "rev-1", TTLSeconds: 60, Sequence: seq}
+		if err := d.checkSequence(old); !errors.Is(err, state.ErrStaleSequence) {
+			t.Fatalf("checkSequence(%d): err=%v, want ErrStaleSequence", seq, err)
+		}
+		if err := d.applyRemoteUpdate(ctx, setupURL, setupURL, old); !errors.Is(err, state.ErrStaleSequence) {
+			t.Fatalf("applyRemoteUpdate(%d): err=%v, want ErrStaleSequence", seq, err)
+		}
+	}
+	st, err := state.Load(statePath)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if fs := st.Feeds[feedID]; fs.Sequence != 2 || fs.LastReconciledRevision != "rev-2" {
+		t.Fatalf("unexpected feed state: %+v", fs)
+	}
+
+	if err := d.applyRemoteUpdate(ctx, setupURL, setupURL, feed.FetchResult{Feed: doc, Revision: "rev-3", TTLSeconds: 60, Sequence: 3}); err != nil {
+		t.Fatalf("applyRemoteUpdate newer: %v", err)
+	}
+
+	// A cached document older than the accepted one is not reconciled offline.
+	fs := st.Feeds[feedID]
+	fs.Sequence, fs.CachedSequence, fs.CachedEncryptedData = 3, 2, "cached"
+	st.Feeds[feedID] = fs
+	if err := state.SaveAtomic(statePath, st); err != nil {
+		t.Fatalf("SaveAtomic: %v", err)
+	}
+	calls := len(b.applyCalls)
+	if err := d.maybeReconcileFromCache(ctx, setupURL, feedID, time.Time{}); !errors.Is(err, state.ErrStaleSequence) {
+		t.Fatalf("maybeReconcileFromCache: err=%v, want ErrStaleSequence", err)
+	}
+	if len(b.applyCalls) != calls {
+		t.Fatalf("stale cache was applied")
+	}
+}
@@ -0,0 +1,147 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/exeteres/wg-feed/internal/client"
+	"github.com/exeteres/wg-feed/internal/client/backend"
+	"github.com/exeteres/wg-feed/internal/client/feed"
+	"github.com/exeteres/wg-feed/internal/client/state"
+	"github.com/exeteres/wg-feed/internal/model"
+)
+
+// statusReport is the latest status report of a feed, re-sent every
+// StatusReportInterval with fresh handshake ages.
+type statusReport struct {
+	url    string
+	report model.StatusReport
+	names  map[string]string // tunnel id -> backend name
+}
+
+// recordStatusReport stores the outcome of reconciling doc at revision, where
+// applyErr is the ApplyFeed error, if any. It is a no-op unless the feed has a
+// status_url and status reports are enabled.
+func (d *daemon) recordStatusReport(st *state.State, feedID string, doc model.FeedDocument, revision string, applyErr error) bool {
+	url := strings.TrimSpace(doc.StatusURL)
+	if url == "" || d.cfg.StatusReportInterval <= 0 {
+		return false
+	}
+	deviceID, err := st.EnsureDeviceID()
+	if err != nil {
+		d.logger.Printf("status report skipped feed_id=%q err=%v", feedID, err)
+		return false
+	}
+
+	failedAt := len(doc.Tunnels)
+	var te *client.TunnelError
+	if errors.As(applyErr, &te) {
+		failedAt = max(slices.IndexFunc(doc.Tunnels, func(t model.Tunnel) bool { return t.ID == te.TunnelID }), 0)
+	} else if applyErr != nil {
+		failedAt = 0
+	}
+
+	tunnels := st.Feeds[feedID].Tunnels
+	r := statusReport{
+		url: url,
+		report: model.StatusReport{
+			Version:  "wg-feed-00",
+			DeviceID: deviceID,
+			FeedID:   feedID,
+			Revision: revision,
+			Tunnels:  make([]model.TunnelStatus, 0, len(doc.Tunnels)),
+		},
+		names: make(map[string]string, len(doc.Tunnels)),
+	}
+	for i, t := range doc.Tunnels {
+		ts := model.TunnelStatus{ID: t.ID, Applied: i < failedAt, Enabled: t.Enabled}
+		if ts.Applied {
+			if prev, ok := tunnels[t.ID]; ok {
+				ts.Enabled = prev.Enabled
+			}
+		} else if te != nil && t.ID == te.TunnelID {
+			ts.Error = truncateError(te.Err.Error())
+		} else if te != nil {
+			ts.Error = "not applied: tunnel " + te.TunnelID + " failed"
+		} else {
+			ts.Error = truncateError(applyErr.Error())
+		}
+		r.report.Tunnels = append(r.report.Tunnels, ts)
+		r.names[t.ID] = t.Name
+	}
+
+	d.reportsMu.Lock()
+	defer d.reportsMu.Unlock()
+	if d.reports == nil {
+		d.reports = map[string]statusReport{}
+	}
+	d.reports[feedID] = r
+	return true
+}
+
+// sendStatusReport posts the latest status report of feedID. Failures are
+// only logged: the report is re-sent on the next interval.
+func (d *daemon) sendStatusReport(ctx context.Context, feedID string) {
+	d.reportsMu.Lock()
+	r, ok := d.reports[feedID]
+	d.reportsMu.Unlock()
+	if !ok {
+		return
+	}
+
+	report := r.report
+	report.Tunnels = slices.Clone(r.report.Tunnels)
+	if hr, ok := d.b.(backend.HandshakeReader); ok {
+		now := time.Now()
+		for i, t := range report.Tunnels {
+			if !t.Applied || !t.Enabled {
+				continue
+			}
+			latest, err := hr.LatestHandshake(ctx, r.names[t.ID])
+			if err != nil || latest.IsZero() {
+				continue
+			}
+			age := max(int64(now.Sub(latest)/time.Second), 0)
+			report.Tunnels[i].HandshakeAgeSeconds = &age
+		}
+	}
+
+	if err := feed.PostStatusReport(ctx, r.url, report); err != nil && ctx.Err() == nil {
+		d.logger.Printf("status report failed feed_id=%q url=%q err=%v", feedID, feed.RedactURL(r.url), err)
+	}
+}
+
+// statusLoop re-sends the latest status report of every feed periodically.
+func (d *daemon) statusLoop(ctx context.Context) {
+	t := time.NewTicker(d.cfg.StatusReportInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		d.reportsMu.Lock()
+		feedIDs := slices.Collect(maps.Keys(d.reports))
+		d.reportsMu.Unlock()
+		for _, feedID := range feedIDs {
+			d.sendStatusReport(ctx, feedID)
+		}
+	}
+}
+
+func truncateError(s string) string {
+	if len(s) <= model.MaxStatusErrorLength {
+		return s
+	}
+	n := model.MaxStatusErrorLength
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,152 @@
+// Package enrollment stores the public keys clients register at a feed's
+// enrollment_url, for feeds whose tunnels use the client's own private key
+// (see model.ClientPrivateKeyPlaceholder).
+//
+// An enrollment is served at /_enroll/<feed path> and stored under
+// wg-feed/enrollments/<device id>/<feed id>, where feed id is the key
+// component of the feed (its path, or the form derived by feedkey.Deriver.ID).
+// A device keeps the key it enrolled first: enrolling a different key fails
+// with ErrConflict until the enrollment is deleted, so that holders of the
+// feed URL cannot replace the key of another device.
+package enrollment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+
+	"github.com/exeteres/wg-feed/internal/feedkey"
+	"github.com/exeteres/wg-feed/internal/model"
+)
+
+const (
+	Prefix = feedkey.EnrollmentsPrefix
+	// PathPrefix is the request path prefix (without the leading slash) of enrollments.
+	PathPrefix = "_enroll/"
+)
+
+var (
+	ErrConflict = errors.New("device is already enrolled with a different public key")
+	ErrNotFound = errors.New("enrollment not found")
+)
+
+// Store is the subset of feed store operations used to enroll keys.
+type Store interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	CompareAndPut(ctx context.Context, key string, expected, value []byte) (bool, error)
+}
+
+// Lister is the store operation used to list enrollments.
+type Lister interface {
+	List(ctx context.Context, prefix string) ([]*mvccpb.KeyValue, error)
+}
+
+// Deleter is the subset of store operations used to delete an enrollment.
+type Deleter interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	CompareAndDelete(ctx context.Context, key string, expected []byte) (bool, error)
+}
+
+// Record is the stored form of an enrollment.
+type Record struct {
+	PublicKey  string    `json:"public_key"`
+	EnrolledAt time.Time `json:"enrolled_at"`
+}
+
+// Enrollment is a stored enrollment as listed by the admin API.
+type Enrollment struct {
+	// Feed is the key component of the feed the key was enrolled for.
+	Feed       string    `json:"feed"`
+	DeviceID   string    `json:"device_id"`
+	PublicKey  string    `json:"public_key"`
+	EnrolledAt time.Time `json:"enrolled_at"`
+}
+
+func Key(deviceID, feedID string) string {
+	return Prefix + deviceID + "/" + feedID
+}
+
+// Enroll stores the public key of req for feedID. It reports whether the key
+// was newly stored; enrolling the stored key again is a no-op.
+func Enroll(ctx context.Context, st Store, feedID string, req model.EnrollmentRequest, now time.Time) (bool, error) {
+	key := Key(req.DeviceID, feedID)
+	current, found, err := st.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if found {
+		var rec Record
+		if err := json.Unmarshal(current, &rec); err != nil {
+			return false, fmt.Errorf("decode enrollment %s: %w", key, err)
+		}
+		if rec.PublicKey != strings.TrimSpace(req.PublicKey) {
+			return false, ErrConflict
+		}
+		return false, nil
+	}
+
+	value, err := json.Marshal(Record{PublicKey: strings.TrimSpace(req.PublicKey), EnrolledAt: now.UTC().Truncate(time.Second)})
+	if err != nil {
+		return false, err
+	}
+	ok, err := st.CompareAndPut(ctx, key, nil, value)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		// Lost a race with a concurrent enrollment of the same device.
+		return false, ErrConflict
+	}
+	return true, nil
+}
+
+// List returns the stored enrollments, for feedID only unless it is empty,
+// ordered by feed and device.
+func List(ctx context.Context, st Lister, feedID string) ([]Enrollment, error) {
+	kvs, err := st.List(ctx, Prefix)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Enrollment, 0, len(kvs))
+	for _, kv := range kvs {
+		deviceID, feed, ok := strings.Cut(strings.TrimPrefix(string(kv.Key), Prefix), "/")
+		if !ok || (feedID != "" && feed != feedID) {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(kv.Value, &rec); err != nil {
+			return nil, fmt.Errorf("decode enrollment %s: %w", kv.Key, err)
+		}
+		out = append(out, Enrollment{Feed: feed, DeviceID: deviceID, PublicKey: rec.PublicKey, EnrolledAt: rec.EnrolledAt})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Feed != out[j].Feed {
+			return out[i].Feed < out[j].Feed
+		}
+		return out[i].DeviceID < out[j].DeviceID
+	})
+	return out, nil
+}
+
+// Delete removes the enrollment of deviceID for feedID, so that the device
+// can enroll a new key.
+func Delete(ctx context.Context, st Deleter, deviceID, feedID string) error {
+	key := Key(deviceID, feedID)
+	current, found, err := st.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotFound
+	}
+	if _, err := st.CompareAndDelete(ctx, key, current); err != nil {
+		return err
+	}
+	return nil
+}
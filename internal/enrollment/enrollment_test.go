@@ -0,0 +1,132 @@
+package enrollment
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+
+	"github.com/exeteres/wg-feed/internal/feedkey"
+	"github.com/exeteres/wg-feed/internal/model"
+)
+
+type memStore struct {
+	values map[string][]byte
+}
+
+func (s *memStore) Get(_ context.Context, key string) ([]byte, bool, error) {
+	v, ok := s.values[key]
+	return v, ok, nil
+}
+
+func (s *memStore) CompareAndPut(_ context.Context, key string, expected, value []byte) (bool, error) {
+	if v, ok := s.values[key]; ok != (expected != nil) || !bytes.Equal(v, expected) {
+		return false, nil
+	}
+	s.values[key] = value
+	return true, nil
+}
+
+func (s *memStore) CompareAndDelete(_ context.Context, key string, expected []byte) (bool, error) {
+	if v, ok := s.values[key]; !ok || !bytes.Equal(v, expected) {
+		return false, nil
+	}
+	delete(s.values, key)
+	return true, nil
+}
+
+func (s *memStore) List(_ context.Context, prefix string) ([]*mvccpb.KeyValue, error) {
+	var kvs []*mvccpb.KeyValue
+	for k, v := range s.values {
+		if strings.HasPrefix(k, prefix) {
+			kvs = append(kvs, &mvccpb.KeyValue{Key: []byte(k), Value: v})
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return bytes.Compare(kvs[i].Key, kvs[j].Key) < 0 })
+	return kvs, nil
+}
+
+const (
+	keyA = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+	keyB = "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw="
+)
+
+func request(deviceID, publicKey string) model.EnrollmentRequest {
+	return model.EnrollmentRequest{
+		Version:   "wg-feed-00",
+		DeviceID:  deviceID,
+		FeedID:    "11111111-1111-4111-8111-111111111111",
+		PublicKey: publicKey,
+	}
+}
+
+func TestEnroll(t *testing.T) {
+	st := &memStore{values: map[string][]byte{}}
+	ctx := context.Background()
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	if created, err := Enroll(ctx, st, "team/client-a", request("dev-1", keyA), now); err != nil || !created {
+		t.Fatalf("first enrollment: created=%v err=%v", created, err)
+	}
+	if created, err := Enroll(ctx, st, "team/client-a", request("dev-1", keyA), now); err != nil || created {
+		t.Fatalf("repeated enrollment: created=%v err=%v", created, err)
+	}
+	if _, err := Enroll(ctx, st, "team/client-a", request("dev-1", keyB), now); !errors.Is(err, ErrConflict) {
+		t.Fatalf("different key: err=%v", err)
+	}
+	if _, err := Enroll(ctx, st, "client-b", request("dev-1", keyB), now); err != nil {
+		t.Fatalf("other feed: %v", err)
+	}
+
+	got, err := List(ctx, st, "team/client-a")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(got) != 1 || got[0].DeviceID != "dev-1" || got[0].PublicKey != keyA || !got[0].EnrolledAt.Equal(now) {
+		t.Fatalf("unexpected enrollments: %+v", got)
+	}
+
+	if err := Delete(ctx, st, "dev-1", "team/client-a"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := Delete(ctx, st, "dev-1", "team/client-a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("second Delete: err=%v", err)
+	}
+	if created, err := Enroll(ctx, st, "team/client-a", request("dev-1", keyB), now); err != nil || !created {
+		t.Fatalf("re-enrollment after delete: created=%v err=%v", created, err)
+	}
+	if all, err := List(ctx, st, ""); err != nil || len(all) != 2 {
+		t.Fatalf("List all: %+v err=%v", all, err)
+	}
+}
+
+func TestEnroll_MigratedKeys(t *testing.T) {
+	st := &memStore{values: map[string][]byte{}}
+	ctx := context.Background()
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	if _, err := Enroll(ctx, st, "team/client-a", request("dev-1", keyA), now); err != nil {
+		t.Fatalf("Enroll: %v", err)
+	}
+	d := feedkey.New([]byte("0123456789abcdef"))
+	if _, err := feedkey.Migrate(ctx, st, d, false); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+
+	feedID := d.ID("team/client-a")
+	got, err := List(ctx, st, feedID)
+	if err != nil || len(got) != 1 || got[0].DeviceID != "dev-1" || got[0].PublicKey != keyA {
+		t.Fatalf("enrollments after migration: %+v err=%v", got, err)
+	}
+	if _, err := Enroll(ctx, st, feedID, request("dev-1", keyB), now); !errors.Is(err, ErrConflict) {
+		t.Fatalf("different key after migration: err=%v", err)
+	}
+	if all, err := List(ctx, st, ""); err != nil || len(all) != 1 {
+		t.Fatalf("List all: %+v err=%v", all, err)
+	}
+}
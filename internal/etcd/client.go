@@ -1,14 +1,74 @@
 package etcd
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
 	"time"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/namespace"
 )
 
-func NewClient(endpoints []string) (*clientv3.Client, error) {
-	return clientv3.New(clientv3.Config{
-		Endpoints:   endpoints,
+// NewClient connects to the cluster of cfg. With a Prefix, keys read, written
+// and watched through the client are transparently confined to it.
+func NewClient(cfg Config) (*clientv3.Client, error) {
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   cfg.Endpoints,
 		DialTimeout: 5 * time.Second,
+		TLS:         tlsConfig,
+		Username:    cfg.Username,
+		Password:    cfg.Password,
 	})
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Prefix != "" {
+		cli.KV = namespace.NewKV(cli.KV, cfg.Prefix)
+		cli.Watcher = namespace.NewWatcher(cli.Watcher, cfg.Prefix)
+		cli.Lease = namespace.NewLease(cli.Lease, cfg.Prefix)
+	}
+	return cli, nil
+}
+
+// tlsConfig returns the client TLS configuration, or nil when no endpoint uses
+// https and no certificate files are configured.
+func (cfg Config) tlsConfig() (*tls.Config, error) {
+	https := false
+	for _, ep := range cfg.Endpoints {
+		if strings.HasPrefix(strings.ToLower(ep), "https://") {
+			https = true
+		}
+	}
+	if !https && cfg.CAFile == "" && cfg.CertFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("ETCD_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("ETCD_CA_FILE contains no PEM certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("ETCD_CERT_FILE/ETCD_KEY_FILE: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
 }
@@ -8,6 +8,52 @@ import (
 	"github.com/exeteres/wg-feed/internal/stringsx"
 )
 
+// Config is the etcd connection shared by wg-feed-server and wg-feed-upload.
+type Config struct {
+	Endpoints []string
+
+	// CAFile verifies the server certificates instead of the system roots;
+	// CertFile and KeyFile are the client certificate, if the cluster requires one.
+	CAFile   string
+	CertFile string
+	KeyFile  string
+
+	Username string
+	Password string
+
+	// Prefix is prepended to every key, so that several deployments can share
+	// a cluster, e.g. "tenant-a/" stores feeds under tenant-a/wg-feed/feeds/.
+	Prefix string
+}
+
+// ConfigFromEnv reads ETCD_ENDPOINTS, ETCD_CA_FILE, ETCD_CERT_FILE,
+// ETCD_KEY_FILE, ETCD_USERNAME, ETCD_PASSWORD and ETCD_PREFIX.
+func ConfigFromEnv() (Config, error) {
+	endpoints, err := EndpointsFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+	cfg := Config{
+		Endpoints: endpoints,
+		CAFile:    strings.TrimSpace(os.Getenv("ETCD_CA_FILE")),
+		CertFile:  strings.TrimSpace(os.Getenv("ETCD_CERT_FILE")),
+		KeyFile:   strings.TrimSpace(os.Getenv("ETCD_KEY_FILE")),
+		Username:  strings.TrimSpace(os.Getenv("ETCD_USERNAME")),
+		Password:  os.Getenv("ETCD_PASSWORD"),
+		Prefix:    strings.TrimSpace(os.Getenv("ETCD_PREFIX")),
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return Config{}, errors.New("ETCD_CERT_FILE and ETCD_KEY_FILE must be set together")
+	}
+	if (cfg.Username == "") != (cfg.Password == "") {
+		return Config{}, errors.New("ETCD_USERNAME and ETCD_PASSWORD must be set together")
+	}
+	if cfg.Prefix != "" && (!strings.HasSuffix(cfg.Prefix, "/") || strings.HasPrefix(cfg.Prefix, "/")) {
+		return Config{}, errors.New("ETCD_PREFIX must end with / and must not start with /")
+	}
+	return cfg, nil
+}
+
 func EndpointsFromEnv() ([]string, error) {
 	rawEndpoints := strings.TrimSpace(os.Getenv("ETCD_ENDPOINTS"))
 	if rawEndpoints == "" {
@@ -33,3 +33,49 @@ func TestEndpointsFromEnv(t *testing.T) {
 		}
 	})
 }
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("ETCD_ENDPOINTS", "https://a:2379")
+	for _, k := range []string{"ETCD_CA_FILE", "ETCD_CERT_FILE", "ETCD_KEY_FILE", "ETCD_USERNAME", "ETCD_PASSWORD", "ETCD_PREFIX"} {
+		t.Setenv(k, "")
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		t.Setenv("ETCD_USERNAME", "wg-feed")
+		t.Setenv("ETCD_PASSWORD", "secret")
+		t.Setenv("ETCD_PREFIX", "tenant-a/")
+		cfg, err := ConfigFromEnv()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cfg.Username != "wg-feed" || cfg.Password != "secret" || cfg.Prefix != "tenant-a/" {
+			t.Fatalf("unexpected config: %#v", cfg)
+		}
+		if tlsConfig, err := cfg.tlsConfig(); err != nil || tlsConfig == nil {
+			t.Fatalf("https endpoints must use TLS: %v", err)
+		}
+	})
+
+	for name, env := range map[string]map[string]string{
+		"cert without key":      {"ETCD_CERT_FILE": "client.pem"},
+		"username without pass": {"ETCD_USERNAME": "wg-feed"},
+		"prefix without slash":  {"ETCD_PREFIX": "tenant-a"},
+		"absolute prefix":       {"ETCD_PREFIX": "/tenant-a/"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for k, v := range env {
+				t.Setenv(k, v)
+			}
+			if _, err := ConfigFromEnv(); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+
+	t.Run("missing CA file", func(t *testing.T) {
+		cfg := Config{Endpoints: []string{"http://a:2379"}, CAFile: t.TempDir() + "/missing.pem"}
+		if _, err := cfg.tlsConfig(); err == nil {
+			t.Fatalf("expected error")
+		}
+	})
+}
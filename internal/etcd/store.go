@@ -2,8 +2,10 @@ package etcd
 
 import (
 	"context"
+	"fmt"
 	"time"
 
+	"go.etcd.io/etcd/api/v3/mvccpb"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
@@ -29,6 +31,29 @@ func (s *Store) Get(ctx context.Context, key string) ([]byte, bool, error) {
 	return resp.Kvs[0].Value, true, nil
 }
 
+// GetWithRevision is like Get but also returns the store revision the read was
+// served at. Watching from that revision + 1 observes every later change.
+func (s *Store) GetWithRevision(ctx context.Context, key string) ([]byte, int64, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	resp, err := s.client.Get(ctx, key)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, resp.Header.Revision, false, nil
+	}
+	return resp.Kvs[0].Value, resp.Header.Revision, true, nil
+}
+
+// Ready performs a linearizable read, which only succeeds when the cluster has
+// a leader and a quorum. The caller's ctx bounds how long to wait.
+func (s *Store) Ready(ctx context.Context) error {
+	_, err := s.client.Get(ctx, "wg-feed/health", clientv3.WithCountOnly())
+	return err
+}
+
 func (s *Store) Put(ctx context.Context, key string, value []byte) error {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
@@ -37,6 +62,79 @@ func (s *Store) Put(ctx context.Context, key string, value []byte) error {
 	return err
 }
 
+// List returns all keys under prefix, sorted by key.
+func (s *Store) List(ctx context.Context, prefix string) ([]*mvccpb.KeyValue, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	resp, err := s.client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Kvs, nil
+}
+
+// CompareAndPut sets key to value if its current value equals expected; a nil
+// expected requires the key to be absent. It reports whether the write happened.
+func (s *Store) CompareAndPut(ctx context.Context, key string, expected, value []byte) (bool, error) {
+	return s.compareAnd(ctx, key, expected, clientv3.OpPut(key, string(value)))
+}
+
+// CompareAndDelete deletes key if its current value equals expected.
+func (s *Store) CompareAndDelete(ctx context.Context, key string, expected []byte) (bool, error) {
+	return s.compareAnd(ctx, key, expected, clientv3.OpDelete(key))
+}
+
+// CompareAndPutAll sets keys[i] to values[i] for every i in a single
+// transaction, if each key's current value equals expected[i] (nil requires
+// the key to be absent). It reports whether the writes happened.
+func (s *Store) CompareAndPutAll(ctx context.Context, keys []string, expected, values [][]byte) (bool, error) {
+	if len(expected) != len(keys) || len(values) != len(keys) {
+		return false, fmt.Errorf("keys, expected and values must have the same length")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	cmps := make([]clientv3.Cmp, 0, len(keys))
+	ops := make([]clientv3.Op, 0, len(keys))
+	for i, key := range keys {
+		cmps = append(cmps, valueEquals(key, expected[i]))
+		ops = append(ops, clientv3.OpPut(key, string(values[i])))
+	}
+	resp, err := s.client.Txn(ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+func (s *Store) compareAnd(ctx context.Context, key string, expected []byte, op clientv3.Op) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	resp, err := s.client.Txn(ctx).If(valueEquals(key, expected)).Then(op).Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+// valueEquals compares the value of key with expected; nil expected compares for absence.
+func valueEquals(key string, expected []byte) clientv3.Cmp {
+	if expected == nil {
+		return clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+	}
+	return clientv3.Compare(clientv3.Value(key), "=", string(expected))
+}
+
 func (s *Store) Watch(ctx context.Context, key string) clientv3.WatchChan {
 	return s.client.Watch(ctx, key)
 }
+
+// WatchFromRevision watches key starting at rev (inclusive), replaying changes
+// made while the caller was not watching. The watch fails with a compaction
+// error if rev is no longer available. Extra options (e.g. clientv3.WithPrefix)
+// are passed through to the watch.
+func (s *Store) WatchFromRevision(ctx context.Context, key string, rev int64, opts ...clientv3.OpOption) clientv3.WatchChan {
+	return s.client.Watch(clientv3.WithRequireLeader(ctx), key, append([]clientv3.OpOption{clientv3.WithRev(rev)}, opts...)...)
+}
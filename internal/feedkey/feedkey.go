@@ -0,0 +1,108 @@
+// Package feedkey maps feed paths to store keys.
+//
+// Without a secret the store key of a feed is wg-feed/feeds/<feedPath>, so
+// anyone who can list the store (or read a backup) learns every subscription
+// path. With a secret the path component becomes "hmac-" followed by the hex
+// HMAC-SHA256 of the feed path, and the policy and history keys use the same
+// derived component. The store contents then no longer grant feed access on
+// their own.
+package feedkey
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	FeedsPrefix    = "wg-feed/feeds/"
+	PoliciesPrefix = "wg-feed/policies/"
+	HistoryPrefix  = "wg-feed/history/"
+	// Status and enrollment keys are "<prefix><device ID>/<feed key component>".
+	StatusPrefix      = "wg-feed/status/"
+	EnrollmentsPrefix = "wg-feed/enrollments/"
+
+	derivedPrefix = "hmac-"
+	// domain separates derived keys from access policy HMAC tokens, which are
+	// computed over the bare feed path, in case the same secret is used for both.
+	domain = "wg-feed/key\x00"
+
+	minSecretBytes = 16
+)
+
+// Deriver derives the store key component of feed paths.
+// A nil *Deriver keeps feed paths as they are.
+type Deriver struct {
+	secret []byte
+}
+
+// New returns a Deriver for secret, or nil when secret is empty.
+func New(secret []byte) *Deriver {
+	if len(secret) == 0 {
+		return nil
+	}
+	return &Deriver{secret: append([]byte(nil), secret...)}
+}
+
+// ParseSecret decodes a base64 (standard encoding) secret of at least 16 bytes.
+func ParseSecret(raw string) ([]byte, error) {
+	secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, errors.New("must be base64")
+	}
+	if len(secret) < minSecretBytes {
+		return nil, fmt.Errorf("must be at least %d bytes", minSecretBytes)
+	}
+	return secret, nil
+}
+
+// FromEnv returns the Deriver configured by FEED_KEY_SECRET, or nil when it is unset.
+func FromEnv() (*Deriver, error) {
+	raw := strings.TrimSpace(os.Getenv("FEED_KEY_SECRET"))
+	if raw == "" {
+		return nil, nil
+	}
+	secret, err := ParseSecret(raw)
+	if err != nil {
+		return nil, fmt.Errorf("FEED_KEY_SECRET %w", err)
+	}
+	return New(secret), nil
+}
+
+// Enabled reports whether feed paths are derived rather than stored as they are.
+func (d *Deriver) Enabled() bool {
+	return d != nil
+}
+
+// ID returns the store key component for feedPath.
+func (d *Deriver) ID(feedPath string) string {
+	if d == nil {
+		return feedPath
+	}
+	mac := hmac.New(sha256.New, d.secret)
+	_, _ = mac.Write([]byte(domain + feedPath))
+	return derivedPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *Deriver) FeedKey(feedPath string) string {
+	return FeedsPrefix + d.ID(feedPath)
+}
+
+func (d *Deriver) PolicyKey(feedPath string) string {
+	return PoliciesPrefix + d.ID(feedPath)
+}
+
+// IsDerived reports whether id has the form returned by ID with a secret.
+func IsDerived(id string) bool {
+	rest, ok := strings.CutPrefix(id, derivedPrefix)
+	if !ok || len(rest) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(rest)
+	return err == nil && strings.ToLower(rest) == rest
+}
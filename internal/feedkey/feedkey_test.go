@@ -0,0 +1,180 @@
+package feedkey
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+func TestDeriver(t *testing.T) {
+	var plain *Deriver
+	if plain.Enabled() || plain.FeedKey("team/a") != "wg-feed/feeds/team/a" || plain.PolicyKey("team/a") != "wg-feed/policies/team/a" {
+		t.Fatalf("nil Deriver must keep feed paths")
+	}
+
+	d := New([]byte("0123456789abcdef"))
+	id := d.ID("team/a")
+	if !IsDerived(id) || id == d.ID("team/b") || id != New([]byte("0123456789abcdef")).ID("team/a") {
+		t.Fatalf("unexpected id %q", id)
+	}
+	if d.FeedKey("team/a") != "wg-feed/feeds/"+id || d.PolicyKey("team/a") != "wg-feed/policies/"+id {
+		t.Fatalf("unexpected keys for %q", id)
+	}
+
+	// Access policy HMAC tokens for the same secret must not be usable as keys, or the reverse.
+	mac := hmac.New(sha256.New, []byte("0123456789abcdef"))
+	_, _ = mac.Write([]byte("team/a"))
+	if strings.HasSuffix(id, hex.EncodeToString(mac.Sum(nil))) {
+		t.Fatalf("derived key equals the access token")
+	}
+
+	for _, s := range []string{"team/a", "hmac-xyz", "hmac-" + strings.Repeat("A", 64)} {
+		if IsDerived(s) {
+			t.Fatalf("IsDerived(%q) = true", s)
+		}
+	}
+}
+
+func TestParseSecret(t *testing.T) {
+	if _, err := ParseSecret("c2hvcnQ="); err == nil {
+		t.Fatalf("expected error for short secret")
+	}
+	if _, err := ParseSecret("not base64!"); err == nil {
+		t.Fatalf("expected error for invalid base64")
+	}
+	if s, err := ParseSecret(" MDEyMzQ1Njc4OWFiY2RlZg== "); err != nil || string(s) != "0123456789abcdef" {
+		t.Fatalf("unexpected secret %q err=%v", s, err)
+	}
+}
+
+type memStore struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func (s *memStore) Get(_ context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	return v, ok, nil
+}
+
+func (s *memStore) List(_ context.Context, prefix string) ([]*mvccpb.KeyValue, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kvs []*mvccpb.KeyValue
+	for k, v := range s.values {
+		if strings.HasPrefix(k, prefix) {
+			kvs = append(kvs, &mvccpb.KeyValue{Key: []byte(k), Value: v})
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return bytes.Compare(kvs[i].Key, kvs[j].Key) < 0 })
+	return kvs, nil
+}
+
+func (s *memStore) CompareAndPut(_ context.Context, key string, expected, value []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, ok := s.values[key]
+	if (expected == nil && ok) || (expected != nil && (!ok || !bytes.Equal(cur, expected))) {
+		return false, nil
+	}
+	s.values[key] = value
+	return true, nil
+}
+
+func (s *memStore) CompareAndDelete(_ context.Context, key string, expected []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, ok := s.values[key]
+	if !ok || !bytes.Equal(cur, expected) {
+		return false, nil
+	}
+	delete(s.values, key)
+	return true, nil
+}
+
+func TestMigrate(t *testing.T) {
+	d := New([]byte("0123456789abcdef"))
+	st := &memStore{values: map[string][]byte{
+		"wg-feed/feeds/team/a":          []byte("feed-a"),
+		"wg-feed/policies/team/a":       []byte("policy-a"),
+		"wg-feed/history/team/a":        []byte("history-a"),
+		"wg-feed/status/d1/team/a":      []byte("status-a"),
+		"wg-feed/enrollments/d1/team/a": []byte("enrollment-a"),
+		"wg-feed/feeds/b":               []byte("feed-b-old"),
+		d.FeedKey("b"):                  []byte("feed-b-new"),
+	}}
+	ctx := context.Background()
+
+	stats, err := Migrate(ctx, st, d, true)
+	if err != nil || stats.Copied != 5 || stats.Removed != 0 {
+		t.Fatalf("copy: stats=%+v err=%v", stats, err)
+	}
+	if len(st.values) != 12 {
+		t.Fatalf("unexpected keys after copy: %v", st.values)
+	}
+
+	stats, err = Migrate(ctx, st, d, false)
+	if err != nil || stats.Copied != 0 || stats.Removed != 6 {
+		t.Fatalf("remove: stats=%+v err=%v", stats, err)
+	}
+	want := map[string]string{
+		d.FeedKey("team/a"):                        "feed-a",
+		d.PolicyKey("team/a"):                      "policy-a",
+		HistoryPrefix + d.ID("team/a"):             "history-a",
+		StatusPrefix + "d1/" + d.ID("team/a"):      "status-a",
+		EnrollmentsPrefix + "d1/" + d.ID("team/a"): "enrollment-a",
+		d.FeedKey("b"):                             "feed-b-new",
+	}
+	if len(st.values) != len(want) {
+		t.Fatalf("unexpected keys after migration: %v", st.values)
+	}
+	for k, v := range want {
+		if string(st.values[k]) != v {
+			t.Fatalf("%s = %q, want %q", k, st.values[k], v)
+		}
+	}
+
+	if _, err := Migrate(ctx, st, nil, false); err == nil {
+		t.Fatalf("expected error without a secret")
+	}
+}
+
+func TestMigrate_Alias(t *testing.T) {
+	d := New([]byte("0123456789abcdef"))
+	st := &memStore{values: map[string][]byte{
+		"wg-feed/feeds/new":   []byte(`{"revision":"r1","ttl_seconds":60,"data":{"id":"x"}}`),
+		"wg-feed/feeds/old":   []byte(`{"revision":"r1","ttl_seconds":60,"alias_of":"new"}`),
+		d.FeedKey("migrated"): []byte(`{"revision":"r1","ttl_seconds":60,"alias_of":"new"}`),
+	}}
+
+	stats, err := Migrate(context.Background(), st, d, false)
+	if err != nil || stats.Copied != 2 || stats.Removed != 2 || stats.Aliases != 2 {
+		t.Fatalf("stats=%+v err=%v", stats, err)
+	}
+	if string(st.values[d.FeedKey("new")]) != `{"revision":"r1","ttl_seconds":60,"data":{"id":"x"}}` {
+		t.Fatalf("target rewritten: %s", st.values[d.FeedKey("new")])
+	}
+	for _, key := range []string{d.FeedKey("old"), d.FeedKey("migrated")} {
+		var entry struct {
+			Revision string `json:"revision"`
+			AliasOf  string `json:"alias_of"`
+		}
+		if err := json.Unmarshal(st.values[key], &entry); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if entry.AliasOf != d.ID("new") || entry.Revision != "r1" {
+			t.Fatalf("%s = %s, want alias of %s", key, st.values[key], d.ID("new"))
+		}
+	}
+}
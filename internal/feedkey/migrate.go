@@ -0,0 +1,137 @@
+package feedkey
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+// MigrateStore is the subset of store operations used by Migrate.
+type MigrateStore interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	List(ctx context.Context, prefix string) ([]*mvccpb.KeyValue, error)
+	CompareAndPut(ctx context.Context, key string, expected, value []byte) (bool, error)
+	CompareAndDelete(ctx context.Context, key string, expected []byte) (bool, error)
+}
+
+// MigrateStats counts the keys handled by Migrate.
+type MigrateStats struct {
+	// Copied keys were written under their derived name.
+	Copied int
+	// Removed legacy keys were deleted after their derived copy existed.
+	Removed int
+	// Changed legacy keys were modified while being migrated and were left in place.
+	Changed int
+	// Aliases are alias entries whose alias_of was rewritten to the derived
+	// key component of their target.
+	Aliases int
+}
+
+// Migrate rewrites feed, policy, history, device status and enrollment keys
+// stored under plain feed paths to their derived names, and the alias_of of alias entries to the derived
+// key component of their target. A derived key that already exists wins over
+// the legacy one, which makes Migrate safe to run repeatedly.
+//
+// With keepLegacy the legacy keys are only copied, so servers without the
+// secret keep working until they are restarted with it; a second run without
+// keepLegacy then removes the legacy keys.
+func Migrate(ctx context.Context, st MigrateStore, d *Deriver, keepLegacy bool) (MigrateStats, error) {
+	var stats MigrateStats
+	if d == nil {
+		return stats, errors.New("a secret is required to migrate keys")
+	}
+	for _, prefix := range []string{FeedsPrefix, PoliciesPrefix, HistoryPrefix, StatusPrefix, EnrollmentsPrefix} {
+		kvs, err := st.List(ctx, prefix)
+		if err != nil {
+			return stats, err
+		}
+		for _, kv := range kvs {
+			head, feedPath, ok := splitKey(prefix, string(kv.Key))
+			if !ok {
+				continue
+			}
+			value, isAlias := kv.Value, false
+			if prefix == FeedsPrefix {
+				value, isAlias = d.deriveAlias(kv.Value)
+			}
+			if IsDerived(feedPath) {
+				// Copied by an earlier run that left alias_of as it was.
+				if isAlias {
+					rewritten, err := st.CompareAndPut(ctx, string(kv.Key), kv.Value, value)
+					if err != nil {
+						return stats, err
+					}
+					if rewritten {
+						stats.Aliases++
+					}
+				}
+				continue
+			}
+			legacyKey, derivedKey := string(kv.Key), head+d.ID(feedPath)
+
+			_, exists, err := st.Get(ctx, derivedKey)
+			if err != nil {
+				return stats, err
+			}
+			if !exists {
+				copied, err := st.CompareAndPut(ctx, derivedKey, nil, value)
+				if err != nil {
+					return stats, err
+				}
+				if copied {
+					stats.Copied++
+					if isAlias {
+						stats.Aliases++
+					}
+				}
+			}
+			if keepLegacy {
+				continue
+			}
+			removed, err := st.CompareAndDelete(ctx, legacyKey, kv.Value)
+			if err != nil {
+				return stats, err
+			}
+			if removed {
+				stats.Removed++
+			} else {
+				stats.Changed++
+			}
+		}
+	}
+	return stats, nil
+}
+
+// splitKey splits key into the part before its feed path and the feed path.
+// Device records carry the device ID in between.
+func splitKey(prefix, key string) (string, string, bool) {
+	rest := strings.TrimPrefix(key, prefix)
+	if prefix != StatusPrefix && prefix != EnrollmentsPrefix {
+		return prefix, rest, true
+	}
+	deviceID, feedPath, ok := strings.Cut(rest, "/")
+	return prefix + deviceID + "/", feedPath, ok
+}
+
+// deriveAlias returns the feed entry value with its alias_of rewritten to the
+// derived key component of the target, and whether value is an alias entry
+// that needed it. Other values are returned unchanged.
+func (d *Deriver) deriveAlias(value []byte) ([]byte, bool) {
+	var entry map[string]json.RawMessage
+	if err := json.Unmarshal(value, &entry); err != nil {
+		return value, false
+	}
+	var target string
+	if err := json.Unmarshal(entry["alias_of"], &target); err != nil || target == "" || IsDerived(target) {
+		return value, false
+	}
+	entry["alias_of"], _ = json.Marshal(d.ID(target))
+	next, err := json.Marshal(entry)
+	if err != nil {
+		return value, false
+	}
+	return next, true
+}
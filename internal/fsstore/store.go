@@ -0,0 +1,288 @@
+package fsstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Store serves feed entries from a directory tree.
+// The key wg-feed/feeds/<feedPath> maps to <root>/wg-feed/feeds/<feedPath>.json.
+//
+// Change notification is implemented by polling, which keeps working for
+// bind mounts, network filesystems and symlink swaps (e.g. git checkouts or
+// Kubernetes ConfigMaps) where inotify-style events are unreliable.
+type Store struct {
+	root         string
+	pollInterval time.Duration
+
+	// casMu serializes conditional writes made through this Store.
+	casMu sync.Mutex
+}
+
+func NewStore(root string, pollInterval time.Duration) *Store {
+	if pollInterval <= 0 {
+		pollInterval = 2 * time.Second
+	}
+	return &Store{root: root, pollInterval: pollInterval}
+}
+
+func (s *Store) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	p, ok := s.pathForKey(key)
+	if !ok {
+		// Keys that cannot be mapped to a file inside root never exist.
+		return nil, false, nil
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+// Ready reports whether the store root is an accessible directory.
+func (s *Store) Ready(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fi, err := os.Stat(s.root)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", s.root)
+	}
+	return nil
+}
+
+// Put atomically replaces the file for key.
+func (s *Store) Put(ctx context.Context, key string, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p, ok := s.pathForKey(key)
+	if !ok {
+		return fmt.Errorf("invalid key %q", key)
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	// A unique temp file per write, so that concurrent writes to the same key
+	// do not clobber each other before the rename. It is created with mode 0600.
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// CompareAndPut sets key to value if its current value equals expected; a nil
+// expected requires the key to be absent. It reports whether the write happened.
+//
+// The comparison is only atomic with respect to other conditional writes made
+// through this Store, not to edits of the files by other processes.
+func (s *Store) CompareAndPut(ctx context.Context, key string, expected, value []byte) (bool, error) {
+	s.casMu.Lock()
+	defer s.casMu.Unlock()
+
+	if ok, err := s.currentEquals(ctx, key, expected); err != nil || !ok {
+		return false, err
+	}
+	return true, s.Put(ctx, key, value)
+}
+
+// CompareAndPutAll sets keys[i] to values[i] for every i if each key's current
+// value equals expected[i] (nil requires the key to be absent). It reports
+// whether the writes happened.
+//
+// Besides the caveat of CompareAndPut, the files are replaced one after the
+// other, so a crash in between can leave only some of them written.
+func (s *Store) CompareAndPutAll(ctx context.Context, keys []string, expected, values [][]byte) (bool, error) {
+	if len(expected) != len(keys) || len(values) != len(keys) {
+		return false, fmt.Errorf("keys, expected and values must have the same length")
+	}
+	s.casMu.Lock()
+	defer s.casMu.Unlock()
+
+	for i, key := range keys {
+		if ok, err := s.currentEquals(ctx, key, expected[i]); err != nil || !ok {
+			return false, err
+		}
+	}
+	for i, key := range keys {
+		if err := s.Put(ctx, key, values[i]); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// CompareAndDelete removes the file for key if its content equals expected.
+// It has the same atomicity caveat as CompareAndPut.
+func (s *Store) CompareAndDelete(ctx context.Context, key string, expected []byte) (bool, error) {
+	s.casMu.Lock()
+	defer s.casMu.Unlock()
+
+	if expected == nil {
+		return false, nil
+	}
+	if ok, err := s.currentEquals(ctx, key, expected); err != nil || !ok {
+		return false, err
+	}
+	p, _ := s.pathForKey(key)
+	if err := os.Remove(p); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Store) currentEquals(ctx context.Context, key string, expected []byte) (bool, error) {
+	if _, ok := s.pathForKey(key); !ok {
+		return false, fmt.Errorf("invalid key %q", key)
+	}
+	cur, ok, err := s.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if expected == nil {
+		return !ok, nil
+	}
+	return ok && bytes.Equal(cur, expected), nil
+}
+
+// List returns all keys under prefix (which must end at a directory boundary,
+// e.g. "wg-feed/feeds/"), sorted by key.
+func (s *Store) List(ctx context.Context, prefix string) ([]*mvccpb.KeyValue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(s.root, filepath.FromSlash(strings.TrimSuffix(prefix, "/")))
+	var kvs []*mvccpb.KeyValue
+	err := filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) && p == dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(p, ".json") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(strings.TrimSuffix(rel, ".json"))
+		if _, ok := s.pathForKey(key); !ok || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		kvs = append(kvs, &mvccpb.KeyValue{Key: []byte(key), Value: b})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(kvs, func(a, b *mvccpb.KeyValue) int { return bytes.Compare(a.Key, b.Key) })
+	return kvs, nil
+}
+
+// Watch reports changes to the file for key as etcd-style PUT/DELETE events.
+// Like an etcd watch, only changes made after the call are reported.
+func (s *Store) Watch(ctx context.Context, key string) clientv3.WatchChan {
+	ch := make(chan clientv3.WatchResponse)
+	// Snapshot synchronously so that writes racing with the caller after Watch returns are reported.
+	last, exists, _ := s.Get(ctx, key)
+	go s.poll(ctx, key, last, exists, ch)
+	return ch
+}
+
+func (s *Store) poll(ctx context.Context, key string, last []byte, exists bool, ch chan<- clientv3.WatchResponse) {
+	defer close(ch)
+
+	t := time.NewTicker(s.pollInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		cur, ok, err := s.Get(ctx, key)
+		if err != nil {
+			// Transient read errors (e.g. a file being replaced) are retried on the next tick.
+			continue
+		}
+
+		var ev *clientv3.Event
+		switch {
+		case ok && (!exists || !bytes.Equal(cur, last)):
+			ev = &clientv3.Event{
+				Type: mvccpb.PUT,
+				Kv:   &mvccpb.KeyValue{Key: []byte(key), Value: cur},
+			}
+		case !ok && exists:
+			ev = &clientv3.Event{
+				Type: mvccpb.DELETE,
+				Kv:   &mvccpb.KeyValue{Key: []byte(key)},
+			}
+		}
+		last, exists = cur, ok
+		if ev == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case ch <- clientv3.WatchResponse{Events: []*clientv3.Event{ev}}:
+		}
+	}
+}
+
+func (s *Store) pathForKey(key string) (string, bool) {
+	if key == "" || strings.ContainsAny(key, "\\\x00") {
+		return "", false
+	}
+	for _, seg := range strings.Split(key, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return "", false
+		}
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)) + ".json", true
+}
@@ -0,0 +1,170 @@
+package fsstore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+func TestStore_GetMapsKeyToJSONFile(t *testing.T) {
+	root := t.TempDir()
+	p := filepath.Join(root, "wg-feed", "feeds", "a", "b.json")
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(p, []byte(`{"x":1}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	st := NewStore(root, time.Second)
+	got, ok, err := st.Get(context.Background(), "wg-feed/feeds/a/b")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ok || string(got) != `{"x":1}` {
+		t.Fatalf("unexpected value: ok=%v value=%q", ok, got)
+	}
+
+	_, ok, err = st.Get(context.Background(), "wg-feed/feeds/missing")
+	if err != nil || ok {
+		t.Fatalf("expected not found, got ok=%v err=%v", ok, err)
+	}
+}
+
+func TestStore_GetRejectsTraversal(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "secret.json"), []byte(`{}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	st := NewStore(filepath.Join(root, "store"), time.Second)
+	for _, key := range []string{"../secret", "wg-feed/feeds/../../../secret", "wg-feed//feeds", ""} {
+		_, ok, err := st.Get(context.Background(), key)
+		if err != nil || ok {
+			t.Fatalf("key %q: expected not found, got ok=%v err=%v", key, ok, err)
+		}
+	}
+}
+
+func TestStore_WatchReportsReplaceAndDelete(t *testing.T) {
+	st := NewStore(t.TempDir(), 10*time.Millisecond)
+	key := "wg-feed/feeds/client-a"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	watchCh := st.Watch(ctx, key)
+
+	if err := st.Put(ctx, key, []byte(`{"v":1}`)); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	wr := <-watchCh
+	if len(wr.Events) != 1 || wr.Events[0].Type != mvccpb.PUT || string(wr.Events[0].Kv.Value) != `{"v":1}` {
+		t.Fatalf("unexpected watch response: %#v", wr.Events)
+	}
+
+	p, _ := st.pathForKey(key)
+	if err := os.Remove(p); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	wr = <-watchCh
+	if len(wr.Events) != 1 || wr.Events[0].Type != mvccpb.DELETE {
+		t.Fatalf("unexpected watch response: %#v", wr.Events)
+	}
+
+	cancel()
+	for range watchCh {
+	}
+}
+
+func TestStore_CompareAndSwapAndList(t *testing.T) {
+	st := NewStore(t.TempDir(), time.Second)
+	ctx := context.Background()
+
+	if ok, err := st.CompareAndPut(ctx, "wg-feed/feeds/a/b", nil, []byte(`{"v":1}`)); err != nil || !ok {
+		t.Fatalf("create: ok=%v err=%v", ok, err)
+	}
+	if ok, err := st.CompareAndPut(ctx, "wg-feed/feeds/a/b", []byte(`{"v":0}`), []byte(`{"v":2}`)); err != nil || ok {
+		t.Fatalf("stale swap: ok=%v err=%v", ok, err)
+	}
+	if err := st.Put(ctx, "wg-feed/feeds/c", []byte(`{}`)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	kvs, err := st.List(ctx, "wg-feed/feeds/")
+	if err != nil || len(kvs) != 2 || string(kvs[0].Key) != "wg-feed/feeds/a/b" || string(kvs[0].Value) != `{"v":1}` {
+		t.Fatalf("unexpected list: %v err=%v", kvs, err)
+	}
+
+	if ok, err := st.CompareAndDelete(ctx, "wg-feed/feeds/a/b", []byte(`{"v":1}`)); err != nil || !ok {
+		t.Fatalf("delete: ok=%v err=%v", ok, err)
+	}
+	if kvs, err := st.List(ctx, "wg-feed/feeds/"); err != nil || len(kvs) != 1 {
+		t.Fatalf("unexpected list after delete: %v err=%v", kvs, err)
+	}
+	if kvs, err := st.List(ctx, "wg-feed/missing/"); err != nil || len(kvs) != 0 {
+		t.Fatalf("unexpected list of missing dir: %v err=%v", kvs, err)
+	}
+}
+
+func TestStore_CompareAndPutAll(t *testing.T) {
+	st := NewStore(t.TempDir(), time.Second)
+	ctx := context.Background()
+
+	keys := []string{"wg-feed/feeds/a", "wg-feed/history/a"}
+	if ok, err := st.CompareAndPutAll(ctx, keys, [][]byte{nil, nil}, [][]byte{[]byte("f1"), []byte("h1")}); err != nil || !ok {
+		t.Fatalf("create: ok=%v err=%v", ok, err)
+	}
+	if ok, err := st.CompareAndPutAll(ctx, keys, [][]byte{[]byte("f1"), nil}, [][]byte{[]byte("f2"), []byte("h2")}); err != nil || ok {
+		t.Fatalf("partially stale swap: ok=%v err=%v", ok, err)
+	}
+	if v, _, _ := st.Get(ctx, "wg-feed/feeds/a"); string(v) != "f1" {
+		t.Fatalf("failed swap wrote %q", v)
+	}
+	if ok, err := st.CompareAndPutAll(ctx, keys, [][]byte{[]byte("f1"), []byte("h1")}, [][]byte{[]byte("f2"), []byte("h2")}); err != nil || !ok {
+		t.Fatalf("swap: ok=%v err=%v", ok, err)
+	}
+	if v, _, _ := st.Get(ctx, "wg-feed/history/a"); string(v) != "h2" {
+		t.Fatalf("unexpected value %q", v)
+	}
+}
+
+func TestStore_ConcurrentPutsToSameKey(t *testing.T) {
+	root := t.TempDir()
+	st := NewStore(root, time.Second)
+	ctx := context.Background()
+
+	values := make([]string, 16)
+	var wg sync.WaitGroup
+	for i := range values {
+		values[i] = strings.Repeat(strconv.Itoa(i%10), 1000+i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := st.Put(ctx, "wg-feed/feeds/a", []byte(values[i])); err != nil {
+				t.Errorf("Put: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, ok, err := st.Get(ctx, "wg-feed/feeds/a")
+	if err != nil || !ok || !slices.Contains(values, string(got)) {
+		t.Fatalf("value is not one of the written ones: ok=%v err=%v len=%d", ok, err, len(got))
+	}
+	entries, err := os.ReadDir(filepath.Join(root, "wg-feed", "feeds"))
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("temp files left behind: %v", entries)
+	}
+}
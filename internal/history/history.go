@@ -0,0 +1,246 @@
+// Package history keeps the last revisions of every feed entry, so that a bad
+// upload can be rolled back without the original input.
+//
+// The history of wg-feed/feeds/<id> is a single JSON value under
+// wg-feed/history/<id>, holding the most recent records first. It is written
+// in the same store transaction as the feed entry itself. id is the key
+// component of the feed: its path, or the form derived by feedkey.Deriver.ID.
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/exeteres/wg-feed/internal/feedkey"
+)
+
+const (
+	// DefaultKeep is the number of records kept per feed unless configured otherwise.
+	DefaultKeep = 10
+
+	// putAttempts bounds retries of Put when it loses a race with a concurrent writer.
+	putAttempts = 5
+)
+
+var (
+	ErrConflict         = errors.New("feed was modified concurrently")
+	ErrRevisionNotFound = errors.New("revision not found in history")
+)
+
+// Store is the subset of feed store operations used to maintain history.
+type Store interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	CompareAndPutAll(ctx context.Context, keys []string, expected, values [][]byte) (bool, error)
+}
+
+// Meta describes who published a revision and why.
+type Meta struct {
+	Uploader string
+	Comment  string
+}
+
+// Record is one published revision of a feed.
+type Record struct {
+	Revision   string    `json:"revision"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	Uploader   string    `json:"uploader,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+	// Entry is the stored feed entry as published.
+	Entry json.RawMessage `json:"entry"`
+}
+
+type document struct {
+	Records []Record `json:"records"`
+}
+
+func FeedKey(id string) string {
+	return feedkey.FeedsPrefix + id
+}
+
+func Key(id string) string {
+	return feedkey.HistoryPrefix + id
+}
+
+// Publish replaces the feed entry of id with entry and records it in the
+// history, keeping at most keep records, if the current entry still equals
+// expected (nil requires the feed to be absent). It reports whether the write
+// happened; false means the feed or its history changed concurrently.
+func Publish(ctx context.Context, st Store, id string, expected, entry []byte, meta Meta, keep int) (bool, error) {
+	if keep <= 0 {
+		keep = DefaultKeep
+	}
+	var e struct {
+		Revision string `json:"revision"`
+	}
+	if err := json.Unmarshal(entry, &e); err != nil {
+		return false, fmt.Errorf("decode feed entry: %w", err)
+	}
+
+	current, found, err := st.Get(ctx, Key(id))
+	if err != nil {
+		return false, err
+	}
+	var doc document
+	if found {
+		if err := json.Unmarshal(current, &doc); err != nil {
+			return false, fmt.Errorf("decode history of %q: %w", id, err)
+		}
+	} else {
+		current = nil
+	}
+
+	rec := Record{
+		Revision:   e.Revision,
+		UploadedAt: time.Now().UTC().Truncate(time.Second),
+		Uploader:   strings.TrimSpace(meta.Uploader),
+		Comment:    strings.TrimSpace(meta.Comment),
+		Entry:      json.RawMessage(entry),
+	}
+	doc.Records = append([]Record{rec}, doc.Records...)
+	if len(doc.Records) > keep {
+		doc.Records = doc.Records[:keep]
+	}
+	next, err := json.Marshal(doc)
+	if err != nil {
+		return false, fmt.Errorf("encode history: %w", err)
+	}
+
+	return st.CompareAndPutAll(ctx,
+		[]string{FeedKey(id), Key(id)},
+		[][]byte{expected, current},
+		[][]byte{entry, next},
+	)
+}
+
+// Put publishes entry regardless of the current feed entry, retrying when it
+// races with another writer.
+func Put(ctx context.Context, st Store, id string, entry []byte, meta Meta, keep int) error {
+	for attempt := 0; attempt < putAttempts; attempt++ {
+		current, found, err := st.Get(ctx, FeedKey(id))
+		if err != nil {
+			return err
+		}
+		if !found {
+			current = nil
+		}
+		ok, err := Publish(ctx, st, id, current, entry, meta, keep)
+		if err != nil || ok {
+			return err
+		}
+	}
+	return ErrConflict
+}
+
+// List returns the recorded revisions of id, most recent first.
+func List(ctx context.Context, st Store, id string) ([]Record, error) {
+	body, found, err := st.Get(ctx, Key(id))
+	if err != nil || !found {
+		return nil, err
+	}
+	var doc document
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("decode history of %q: %w", id, err)
+	}
+	return doc.Records, nil
+}
+
+// Rewrite applies fn to the entry of every record of an encoded history and
+// reports whether any entry changed. It is used to rewrite stored entries in
+// place, e.g. when they are re-encrypted.
+func Rewrite(body []byte, fn func(entry []byte) ([]byte, bool, error)) ([]byte, bool, error) {
+	var doc document
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, false, fmt.Errorf("decode history: %w", err)
+	}
+	changed := false
+	for i, rec := range doc.Records {
+		entry, ok, err := fn(rec.Entry)
+		if err != nil {
+			return nil, false, fmt.Errorf("record %s: %w", rec.Revision, err)
+		}
+		if ok {
+			doc.Records[i].Entry = json.RawMessage(entry)
+			changed = true
+		}
+	}
+	if !changed {
+		return body, false, nil
+	}
+	next, err := json.Marshal(doc)
+	if err != nil {
+		return nil, false, fmt.Errorf("encode history: %w", err)
+	}
+	return next, true, nil
+}
+
+// NextSequence returns the sequence number of the next entry published for
+// id: one more than the highest sequence of its current and recorded entries,
+// so that sequences keep increasing across rollbacks and a re-created feed.
+// open opens sealed entries (see atrest.Keyring.Open).
+func NextSequence(ctx context.Context, st Store, id string, open func([]byte) ([]byte, error)) (uint64, error) {
+	entries := [][]byte{}
+	current, found, err := st.Get(ctx, FeedKey(id))
+	if err != nil {
+		return 0, err
+	}
+	if found {
+		entries = append(entries, current)
+	}
+	records, err := List(ctx, st, id)
+	if err != nil {
+		return 0, err
+	}
+	for _, rec := range records {
+		entries = append(entries, rec.Entry)
+	}
+
+	var highest uint64
+	for _, entry := range entries {
+		body, err := open(entry)
+		if err != nil {
+			return 0, err
+		}
+		var e struct {
+			Sequence uint64 `json:"sequence"`
+		}
+		if err := json.Unmarshal(body, &e); err != nil {
+			return 0, fmt.Errorf("decode feed entry of %q: %w", id, err)
+		}
+		highest = max(highest, e.Sequence)
+	}
+	return highest + 1, nil
+}
+
+// Rollback republishes the most recent recorded entry with the given revision.
+// The rollback itself is recorded as a new history record. prepare, if not
+// nil, returns the entry to publish from the recorded one, e.g. with a new
+// sequence number.
+func Rollback(ctx context.Context, st Store, id, revision string, meta Meta, keep int, prepare func(entry []byte) ([]byte, error)) (Record, error) {
+	records, err := List(ctx, st, id)
+	if err != nil {
+		return Record{}, err
+	}
+	for _, rec := range records {
+		if rec.Revision != revision {
+			continue
+		}
+		if strings.TrimSpace(meta.Comment) == "" {
+			meta.Comment = "rollback to " + revision
+		}
+		entry := []byte(rec.Entry)
+		if prepare != nil {
+			if entry, err = prepare(entry); err != nil {
+				return Record{}, err
+			}
+		}
+		if err := Put(ctx, st, id, entry, meta, keep); err != nil {
+			return Record{}, err
+		}
+		return rec, nil
+	}
+	return Record{}, fmt.Errorf("%w: %s", ErrRevisionNotFound, revision)
+}
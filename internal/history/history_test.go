@@ -0,0 +1,139 @@
+package history
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+type memStore struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func (s *memStore) Get(_ context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	return v, ok, nil
+}
+
+func (s *memStore) CompareAndPutAll(_ context.Context, keys []string, expected, values [][]byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, key := range keys {
+		cur, ok := s.values[key]
+		if (expected[i] == nil && ok) || (expected[i] != nil && (!ok || !bytes.Equal(cur, expected[i]))) {
+			return false, nil
+		}
+	}
+	for i, key := range keys {
+		s.values[key] = values[i]
+	}
+	return true, nil
+}
+
+func entry(rev string) []byte {
+	return []byte(fmt.Sprintf(`{"revision":%q,"ttl_seconds":60}`, rev))
+}
+
+func TestPutKeepsLastRevisions(t *testing.T) {
+	st := &memStore{values: map[string][]byte{}}
+	ctx := context.Background()
+
+	for i := 1; i <= 4; i++ {
+		if err := Put(ctx, st, "team/a", entry(fmt.Sprintf("r%d", i)), Meta{Uploader: "alice", Comment: fmt.Sprintf("push %d", i)}, 3); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	if got := st.values["wg-feed/feeds/team/a"]; !bytes.Equal(got, entry("r4")) {
+		t.Fatalf("unexpected feed entry: %s", got)
+	}
+	records, err := List(ctx, st, "team/a")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(records) != 3 || records[0].Revision != "r4" || records[2].Revision != "r2" {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+	if records[0].Uploader != "alice" || records[0].Comment != "push 4" || records[0].UploadedAt.IsZero() {
+		t.Fatalf("unexpected metadata: %+v", records[0])
+	}
+	if records, _ := List(ctx, st, "team"); len(records) != 0 {
+		t.Fatalf("unexpected records of another feed: %+v", records)
+	}
+}
+
+func TestPublishDetectsConcurrentChange(t *testing.T) {
+	st := &memStore{values: map[string][]byte{}}
+	ctx := context.Background()
+
+	if ok, err := Publish(ctx, st, "a", nil, entry("r1"), Meta{}, 0); err != nil || !ok {
+		t.Fatalf("create: ok=%v err=%v", ok, err)
+	}
+	if ok, err := Publish(ctx, st, "a", nil, entry("r2"), Meta{}, 0); err != nil || ok {
+		t.Fatalf("stale create: ok=%v err=%v", ok, err)
+	}
+	if records, _ := List(ctx, st, "a"); len(records) != 1 {
+		t.Fatalf("failed publish was recorded: %+v", records)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	st := &memStore{values: map[string][]byte{}}
+	ctx := context.Background()
+
+	for _, rev := range []string{"r1", "r2"} {
+		if err := Put(ctx, st, "a", entry(rev), Meta{}, 0); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	if _, err := Rollback(ctx, st, "a", "nope", Meta{}, 0, nil); !errors.Is(err, ErrRevisionNotFound) {
+		t.Fatalf("expected ErrRevisionNotFound, got %v", err)
+	}
+	if _, err := Rollback(ctx, st, "a", "r1", Meta{Uploader: "bob"}, 0, nil); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	if got := st.values["wg-feed/feeds/a"]; !bytes.Equal(got, entry("r1")) {
+		t.Fatalf("unexpected feed entry after rollback: %s", got)
+	}
+	records, _ := List(ctx, st, "a")
+	if len(records) != 3 || records[0].Revision != "r1" || records[0].Comment != "rollback to r1" || records[0].Uploader != "bob" {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+}
+
+func TestNextSequence(t *testing.T) {
+	st := &memStore{values: map[string][]byte{}}
+	ctx := context.Background()
+	open := func(b []byte) ([]byte, error) { return b, nil }
+
+	if seq, err := NextSequence(ctx, st, "a", open); err != nil || seq != 1 {
+		t.Fatalf("NextSequence of a new feed = %d, %v", seq, err)
+	}
+	for _, body := range []string{`{"revision":"r1","sequence":7}`, `{"revision":"r2","sequence":3}`} {
+		if err := Put(ctx, st, "a", []byte(body), Meta{}, 0); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	// The highest recorded sequence counts, not only the current one.
+	if seq, err := NextSequence(ctx, st, "a", open); err != nil || seq != 8 {
+		t.Fatalf("NextSequence = %d, %v; want 8", seq, err)
+	}
+
+	// A deleted feed keeps counting from its history.
+	delete(st.values, FeedKey("a"))
+	if seq, err := NextSequence(ctx, st, "a", open); err != nil || seq != 8 {
+		t.Fatalf("NextSequence after delete = %d, %v; want 8", seq, err)
+	}
+
+	sealed := func(b []byte) ([]byte, error) { return nil, errors.New("sealed") }
+	if _, err := NextSequence(ctx, st, "a", sealed); err == nil {
+		t.Fatalf("expected error when entries cannot be opened")
+	}
+}
@@ -0,0 +1,446 @@
+// Package jsonpatch implements JSON Patch (RFC 6902): applying a patch to a
+// JSON document, and computing a patch from one document to another.
+package jsonpatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// operation is a patch operation as emitted by Diff.
+type operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Apply applies the JSON Patch patch to the JSON document doc and returns the
+// resulting document. Numbers are kept as written.
+func Apply(doc, patch []byte) ([]byte, error) {
+	root, err := decode(doc)
+	if err != nil {
+		return nil, fmt.Errorf("decode document: %w", err)
+	}
+	raw, err := decode(patch)
+	if err != nil {
+		return nil, fmt.Errorf("decode patch: %w", err)
+	}
+	ops, ok := raw.([]any)
+	if !ok {
+		return nil, errors.New("patch must be an array of operations")
+	}
+	for i, op := range ops {
+		obj, ok := op.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("operation %d: must be an object", i)
+		}
+		if root, err = applyOp(root, obj); err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	return json.Marshal(root)
+}
+
+func applyOp(root any, op map[string]any) (any, error) {
+	name, _ := op["op"].(string)
+	path, err := member(op, "path")
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "add", "replace", "test":
+		value, ok := op["value"]
+		if !ok {
+			return nil, fmt.Errorf("%s: value is required", name)
+		}
+		switch name {
+		case "add":
+			return add(root, path, value)
+		case "replace":
+			if path == "" {
+				return value, nil
+			}
+			if root, _, err = remove(root, path); err != nil {
+				return nil, err
+			}
+			return add(root, path, value)
+		default:
+			cur, err := get(root, path)
+			if err != nil {
+				return nil, err
+			}
+			if !equal(cur, value) {
+				return nil, fmt.Errorf("test: value at %q differs", path)
+			}
+			return root, nil
+		}
+	case "remove":
+		root, _, err = remove(root, path)
+		return root, err
+	case "move", "copy":
+		from, err := member(op, "from")
+		if err != nil {
+			return nil, err
+		}
+		if name == "copy" {
+			value, err := get(root, from)
+			if err != nil {
+				return nil, err
+			}
+			return add(root, path, deepCopy(value))
+		}
+		if strings.HasPrefix(path, from+"/") {
+			return nil, fmt.Errorf("move: %q is a child of %q", path, from)
+		}
+		root, value, err := remove(root, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(root, path, value)
+	default:
+		return nil, fmt.Errorf("unknown op %q", name)
+	}
+}
+
+func member(op map[string]any, name string) (string, error) {
+	s, ok := op[name].(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string", name)
+	}
+	return s, nil
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its reference tokens.
+func parsePointer(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("invalid pointer %q", path)
+	}
+	tokens := strings.Split(path[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func escapeToken(t string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(t, "~", "~0"), "/", "~1")
+}
+
+// arrayIndex parses the array index token t for an array of length n. With
+// end set, t may be "-" or n, the position after the last element.
+func arrayIndex(t string, n int, end bool) (int, error) {
+	if end && t == "-" {
+		return n, nil
+	}
+	i, err := strconv.Atoi(t)
+	if err != nil || strings.Trim(t, "0123456789") != "" || (t != "0" && t[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", t)
+	}
+	if i > n || (i == n && !end) {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+func get(root any, path string) (any, error) {
+	tokens, err := parsePointer(path)
+	if err != nil {
+		return nil, err
+	}
+	node := root
+	for _, t := range tokens {
+		if node, err = child(node, t); err != nil {
+			return nil, fmt.Errorf("%q: %w", path, err)
+		}
+	}
+	return node, nil
+}
+
+func child(node any, t string) (any, error) {
+	switch n := node.(type) {
+	case map[string]any:
+		v, ok := n[t]
+		if !ok {
+			return nil, fmt.Errorf("member %q not found", t)
+		}
+		return v, nil
+	case []any:
+		i, err := arrayIndex(t, len(n), false)
+		if err != nil {
+			return nil, err
+		}
+		return n[i], nil
+	default:
+		return nil, fmt.Errorf("cannot index a scalar with %q", t)
+	}
+}
+
+// update calls leaf with the container the last token of path refers into and
+// stores the container it returns in place of the old one.
+func update(root any, path string, leaf func(container any, token string) (any, error)) (any, error) {
+	tokens, err := parsePointer(path)
+	if err != nil {
+		return nil, err
+	}
+	var walk func(node any, tokens []string) (any, error)
+	walk = func(node any, tokens []string) (any, error) {
+		if len(tokens) == 1 {
+			return leaf(node, tokens[0])
+		}
+		c, err := child(node, tokens[0])
+		if err != nil {
+			return nil, err
+		}
+		if c, err = walk(c, tokens[1:]); err != nil {
+			return nil, err
+		}
+		switch n := node.(type) {
+		case map[string]any:
+			n[tokens[0]] = c
+		case []any:
+			i, _ := arrayIndex(tokens[0], len(n), false)
+			n[i] = c
+		}
+		return node, nil
+	}
+	if root, err = walk(root, tokens); err != nil {
+		return nil, fmt.Errorf("%q: %w", path, err)
+	}
+	return root, nil
+}
+
+func add(root any, path string, value any) (any, error) {
+	if path == "" {
+		return value, nil
+	}
+	return update(root, path, func(container any, t string) (any, error) {
+		switch n := container.(type) {
+		case map[string]any:
+			n[t] = value
+			return n, nil
+		case []any:
+			i, err := arrayIndex(t, len(n), true)
+			if err != nil {
+				return nil, err
+			}
+			return slices.Insert(n, i, value), nil
+		default:
+			return nil, fmt.Errorf("cannot add %q to a scalar", t)
+		}
+	})
+}
+
+func remove(root any, path string) (any, any, error) {
+	if path == "" {
+		return nil, nil, errors.New("cannot remove the whole document")
+	}
+	var removed any
+	root, err := update(root, path, func(container any, t string) (any, error) {
+		switch n := container.(type) {
+		case map[string]any:
+			v, ok := n[t]
+			if !ok {
+				return nil, fmt.Errorf("member %q not found", t)
+			}
+			removed = v
+			delete(n, t)
+			return n, nil
+		case []any:
+			i, err := arrayIndex(t, len(n), false)
+			if err != nil {
+				return nil, err
+			}
+			removed = n[i]
+			return slices.Delete(n, i, i+1), nil
+		default:
+			return nil, fmt.Errorf("cannot remove %q from a scalar", t)
+		}
+	})
+	return root, removed, err
+}
+
+// equal compares JSON values as the test operation does: numbers by value.
+func equal(a, b any) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		fa, errA := a.Float64()
+		fb, errB := b.Float64()
+		return errA == nil && errB == nil && fa == fb
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			if w, ok := b[k]; !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		return ok && slices.EqualFunc(a, b, equal)
+	default:
+		return a == b
+	}
+}
+
+func deepCopy(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			out[k] = deepCopy(e)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = deepCopy(e)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// Diff returns a JSON Patch that turns the JSON document from into to. It
+// only uses add, remove and replace. Arrays are diffed element by element
+// between their common prefix and suffix, so that inserting or removing one
+// element of a long array yields one operation.
+func Diff(from, to []byte) ([]byte, error) {
+	a, err := decode(from)
+	if err != nil {
+		return nil, fmt.Errorf("decode source document: %w", err)
+	}
+	b, err := decode(to)
+	if err != nil {
+		return nil, fmt.Errorf("decode target document: %w", err)
+	}
+	ops := []operation{}
+	if err := diff(&ops, "", a, b); err != nil {
+		return nil, err
+	}
+	return json.Marshal(ops)
+}
+
+func diff(ops *[]operation, path string, a, b any) error {
+	if reflect.DeepEqual(a, b) {
+		return nil
+	}
+	switch a := a.(type) {
+	case map[string]any:
+		if b, ok := b.(map[string]any); ok {
+			return diffObjects(ops, path, a, b)
+		}
+	case []any:
+		if b, ok := b.([]any); ok {
+			return diffArrays(ops, path, a, b)
+		}
+	}
+	return emit(ops, "replace", path, b)
+}
+
+func diffObjects(ops *[]operation, path string, a, b map[string]any) error {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		p := path + "/" + escapeToken(k)
+		va, inA := a[k]
+		vb, inB := b[k]
+		var err error
+		switch {
+		case !inB:
+			err = emit(ops, "remove", p, nil)
+		case !inA:
+			err = emit(ops, "add", p, vb)
+		default:
+			err = diff(ops, p, va, vb)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func diffArrays(ops *[]operation, path string, a, b []any) error {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && reflect.DeepEqual(a[prefix], b[prefix]) {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && reflect.DeepEqual(a[len(a)-1-suffix], b[len(b)-1-suffix]) {
+		suffix++
+	}
+	am, bm := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	index := func(i int) string { return path + "/" + strconv.Itoa(prefix+i) }
+
+	common := min(len(am), len(bm))
+	for i := range common {
+		if err := diff(ops, index(i), am[i], bm[i]); err != nil {
+			return err
+		}
+	}
+	// Remove from the back, so that the indices of the elements still to
+	// remove do not shift.
+	for i := len(am) - 1; i >= common; i-- {
+		if err := emit(ops, "remove", index(i), nil); err != nil {
+			return err
+		}
+	}
+	for i := common; i < len(bm); i++ {
+		if err := emit(ops, "add", index(i), bm[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func emit(ops *[]operation, op, path string, value any) error {
+	o := operation{Op: op, Path: path}
+	if op != "remove" {
+		b, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		o.Value = b
+	}
+	*ops = append(*ops, o)
+	return nil
+}
+
+func decode(raw []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("trailing data after JSON value")
+	}
+	return v, nil
+}
@@ -0,0 +1,104 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	// RFC 6902, appendix A.
+	cases := []struct {
+		doc, patch, want string
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2.0}]`, `{"baz":"qux","foo":["a",2,"c"]}`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"child":{"grandchild":{}},"foo":"bar"}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+		{`{"foo":null}`, `[{"op":"test","path":"/foo","value":null}]`, `{"foo":null}`},
+		{`{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10}]`, `{"/":9,"~1":10}`},
+		{`{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"replace","path":"/c/b","value":2}]`, `{"a":{"b":1},"c":{"b":2}}`},
+		{`{"a":1}`, `[{"op":"replace","path":"","value":[1e400]}]`, `[1e400]`},
+	}
+	for _, tc := range cases {
+		got, err := Apply([]byte(tc.doc), []byte(tc.patch))
+		if err != nil {
+			t.Fatalf("Apply(%s, %s): %v", tc.doc, tc.patch, err)
+		}
+		if string(got) != tc.want {
+			t.Fatalf("Apply(%s, %s)\n got %s\nwant %s", tc.doc, tc.patch, got, tc.want)
+		}
+	}
+
+	errCases := []struct {
+		doc, patch string
+	}{
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/2","value":"qux"}]`},
+		{`{"foo":["bar"]}`, `[{"op":"remove","path":"/foo/01"}]`},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz"}]`},
+		{`{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar/x"}]`},
+		{`{"foo":"bar"}`, `[{"op":"frobnicate","path":"/foo"}]`},
+		{`{"foo":"bar"}`, `{"op":"remove","path":"/foo"}`},
+	}
+	for _, tc := range errCases {
+		if got, err := Apply([]byte(tc.doc), []byte(tc.patch)); err == nil {
+			t.Fatalf("Apply(%s, %s) = %s, want error", tc.doc, tc.patch, got)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tunnels := func(ids ...string) string {
+		parts := make([]string, len(ids))
+		for i, id := range ids {
+			parts[i] = `{"id":"` + id + `","enabled":true}`
+		}
+		return `[` + strings.Join(parts, ",") + `]`
+	}
+	cases := []struct {
+		from, to string
+		ops      int
+	}{
+		{`{"a":1}`, `{"a":1}`, 0},
+		{`{"a":1,"b":2}`, `{"a":1,"c":2}`, 2},
+		{`{"revision":"r1","data":{"tunnels":` + tunnels("a", "b", "c", "d") + `}}`, `{"revision":"r2","data":{"tunnels":` + tunnels("a", "b", "x", "c", "d") + `}}`, 2},
+		{`{"t":` + tunnels("a", "b", "c", "d") + `}`, `{"t":` + tunnels("a", "d") + `}`, 2},
+		{`{"t":` + tunnels("a", "b", "c") + `}`, `{"t":[{"id":"a","enabled":true},{"id":"b","enabled":false},{"id":"c","enabled":true}]}`, 1},
+		{`{"t":[1,2]}`, `{"t":[3,4,5]}`, 3},
+		{`{"a":{"b":1}}`, `{"a":[1]}`, 1},
+		{`{"a":1}`, `[1]`, 1},
+		{`{"a/b":1,"c~d":1}`, `{"a/b":2,"c~d":null}`, 2},
+	}
+	for _, tc := range cases {
+		patch, err := Diff([]byte(tc.from), []byte(tc.to))
+		if err != nil {
+			t.Fatalf("Diff(%s, %s): %v", tc.from, tc.to, err)
+		}
+		var ops []map[string]any
+		if err := json.Unmarshal(patch, &ops); err != nil {
+			t.Fatalf("decode patch %s: %v", patch, err)
+		}
+		if len(ops) != tc.ops {
+			t.Fatalf("Diff(%s, %s) = %s, want %d operations", tc.from, tc.to, patch, tc.ops)
+		}
+		got, err := Apply([]byte(tc.from), patch)
+		if err != nil {
+			t.Fatalf("Apply(%s, %s): %v", tc.from, patch, err)
+		}
+		var want any
+		_ = json.Unmarshal([]byte(tc.to), &want)
+		wantJSON, _ := json.Marshal(want)
+		if string(got) != string(wantJSON) {
+			t.Fatalf("Apply(Diff(%s, %s))\n got %s\nwant %s", tc.from, tc.to, got, wantJSON)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package model
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ClientPrivateKeyPlaceholder stands for the client's own private key in the
+// [Interface] PrivateKey of a wg_quick_config (optional extension). Clients
+// generate that key locally and register its public key at the feed's
+// enrollment_url, so the server never holds it.
+const ClientPrivateKeyPlaceholder = "{{client_private_key}}"
+
+var clientKeyLineRe = regexp.MustCompile(`(?m)^([ \t]*PrivateKey[ \t]*=[ \t]*)` + regexp.QuoteMeta(ClientPrivateKeyPlaceholder) + `[ \t]*$`)
+
+// UsesClientKey reports whether the tunnel config uses ClientPrivateKeyPlaceholder.
+func (t Tunnel) UsesClientKey() bool {
+	return clientKeyLineRe.MatchString(t.WGQuickConfig)
+}
+
+// WithClientKey returns the tunnel config with ClientPrivateKeyPlaceholder
+// replaced by privateKey.
+func (t Tunnel) WithClientKey(privateKey string) string {
+	return clientKeyLineRe.ReplaceAllLiteralString(t.WGQuickConfig, "PrivateKey = "+privateKey)
+}
+
+// EnrollmentRequest is posted by a client to the feed's enrollment_url to
+// register the public key of the keypair it generated for the feed.
+type EnrollmentRequest struct {
+	Version   string `json:"version"`
+	DeviceID  string `json:"device_id"`
+	FeedID    string `json:"feed_id"`
+	PublicKey string `json:"public_key"`
+}
+
+func (r EnrollmentRequest) Validate() error {
+	if r.Version != "wg-feed-00" {
+		return fmt.Errorf("version must be wg-feed-00")
+	}
+	if !deviceIDRe.MatchString(r.DeviceID) {
+		return fmt.Errorf("device_id must match %s", deviceIDRe.String())
+	}
+	if !uuidRe.MatchString(r.FeedID) {
+		return fmt.Errorf("feed_id must be a UUID")
+	}
+	if err := ValidateWireGuardKey(r.PublicKey); err != nil {
+		return fmt.Errorf("public_key %w", err)
+	}
+	return nil
+}
+
+// ValidateWireGuardKey checks the base64 (standard encoding) form of a 32-byte key.
+func ValidateWireGuardKey(key string) error {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil || len(b) != 32 {
+		return fmt.Errorf("must be a base64-encoded 32-byte key")
+	}
+	return nil
+}
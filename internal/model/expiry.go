@@ -0,0 +1,60 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// Expired reports whether the entry is past its not_after at now.
+func (e FeedEntry) Expired(now time.Time) bool {
+	return e.NotAfter != nil && !now.Before(*e.NotAfter)
+}
+
+// Warned reports whether the entry is past its warn_after at now.
+func (e FeedEntry) Warned(now time.Time) bool {
+	return e.WarnAfter != nil && !now.Before(*e.WarnAfter)
+}
+
+// AtTime returns the entry as it is served at now. Past warn_after, the
+// document carries the expiry warning (appended to its own warning_message)
+// and the revision is replaced by one derived from the stored revision and
+// the warning, so that clients pick up the change without a new upload, and
+// again when a re-upload changes only the expiry.
+func (e FeedEntry) AtTime(now time.Time) FeedEntry {
+	if !e.Warned(now) || e.Data == nil {
+		return e
+	}
+	doc := *e.Data
+	warning := e.expiryWarning()
+	if doc.Warning != "" {
+		warning = doc.Warning + "\n" + warning
+	}
+	doc.Warning = warning
+	e.Data = &doc
+
+	sum := sha256.Sum256([]byte("warn_after\x00" + e.Revision + "\x00" + warning))
+	e.Revision = hex.EncodeToString(sum[:])
+	return e
+}
+
+// NextChange returns the first warn_after or not_after deadline after now,
+// i.e. when the entry as served changes next.
+func (e FeedEntry) NextChange(now time.Time) (time.Time, bool) {
+	for _, t := range []*time.Time{e.WarnAfter, e.NotAfter} {
+		if t != nil && now.Before(*t) {
+			return *t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (e FeedEntry) expiryWarning() string {
+	if e.ExpiryWarning != "" {
+		return e.ExpiryWarning
+	}
+	if e.NotAfter != nil {
+		return "This subscription expires on " + e.NotAfter.UTC().Format("2006-01-02 15:04 MST") + "."
+	}
+	return "This subscription is about to expire."
+}
@@ -0,0 +1,51 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFeedEntryAtTime(t *testing.T) {
+	warn := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := warn.Add(24 * time.Hour)
+	doc := &FeedDocument{ID: "123e4567-e89b-12d3-a456-426614174000", Warning: "Maintenance on Friday."}
+	e := FeedEntry{Revision: "r1", Data: doc, WarnAfter: &warn, NotAfter: &notAfter}
+
+	before := e.AtTime(warn.Add(-time.Second))
+	if before.Revision != "r1" || before.Data.Warning != doc.Warning {
+		t.Fatalf("changed before warn_after: %+v", before)
+	}
+	if next, ok := e.NextChange(warn.Add(-time.Second)); !ok || !next.Equal(warn) {
+		t.Fatalf("NextChange before warn_after = %v, %v", next, ok)
+	}
+
+	after := e.AtTime(warn)
+	if after.Revision == "r1" || after.Revision != e.AtTime(warn.Add(time.Hour)).Revision {
+		t.Fatalf("unexpected revision after warn_after: %q", after.Revision)
+	}
+	if want := "Maintenance on Friday.\nThis subscription expires on 2026-01-02 00:00 UTC."; after.Data.Warning != want {
+		t.Fatalf("warning = %q, want %q", after.Data.Warning, want)
+	}
+	if doc.Warning != "Maintenance on Friday." {
+		t.Fatalf("AtTime modified the stored document")
+	}
+	later := notAfter.Add(24 * time.Hour)
+	extended := FeedEntry{Revision: "r1", Data: doc, WarnAfter: &warn, NotAfter: &later}
+	if extended.AtTime(warn).Revision == after.Revision {
+		t.Fatalf("a later not_after kept the warned revision")
+	}
+	reworded := FeedEntry{Revision: "r1", Data: doc, WarnAfter: &warn, NotAfter: &notAfter, ExpiryWarning: "Renew now."}
+	if reworded.AtTime(warn).Revision == after.Revision {
+		t.Fatalf("a new expiry_warning kept the warned revision")
+	}
+	if next, ok := e.NextChange(warn); !ok || !next.Equal(notAfter) {
+		t.Fatalf("NextChange after warn_after = %v, %v", next, ok)
+	}
+
+	if e.Expired(notAfter.Add(-time.Second)) || !e.Expired(notAfter) {
+		t.Fatalf("unexpected Expired around not_after")
+	}
+	if _, ok := e.NextChange(notAfter); ok {
+		t.Fatalf("NextChange after not_after")
+	}
+}
@@ -1,5 +1,7 @@
 package model
 
+import "time"
+
 type SuccessResponse struct {
 	Version     string `json:"version"`
 	Success     bool   `json:"success"`
@@ -10,6 +12,12 @@ type SuccessResponse struct {
 	Encrypted     bool          `json:"encrypted,omitempty"`
 	EncryptedData string        `json:"encrypted_data,omitempty"`
 	Data          *FeedDocument `json:"data,omitempty"`
+
+	// Sequence increases with every publication of the feed, so that clients
+	// can refuse older documents (optional extension); 0 if absent.
+	Sequence uint64 `json:"sequence,omitempty"`
+	// Signature is the detached signature of the feed document, if the feed is signed.
+	Signature *Signature `json:"signature,omitempty"`
 }
 
 // FeedEntry is the etcd-stored value for a feed under wg-feed/feeds/<feedPath>.
@@ -17,7 +25,26 @@ type SuccessResponse struct {
 //
 // Exactly one of the following shapes is allowed:
 // - {"encrypted": true,  "encrypted_data": <string>}
+// - {"encrypted": true,  "data": <FeedDocument>, "recipients": [<age recipient>, ...]}
 // - {"encrypted": false, "data": <FeedDocument>}
+// - {"revoked": true, "message": <string>}
+// - {"alias_of": <feed id>}
+//
+// With recipients, the server encrypts data to the recipients when serving it.
+// A revoked entry is a tombstone: the feed was withdrawn, and requests for it
+// receive a non-retriable error carrying the operator message. An alias serves
+// the feed stored under another key: alias_of is the key component of the
+// target (its feed path, or the derived form, see package feedkey), which must
+// not be an alias itself.
+//
+// Entries other than tombstones may expire: from warn_after on, the served
+// document carries an expiry warning (see AtTime), and from not_after on,
+// requests receive a non-retriable error as for a tombstone.
+//
+// A signed entry carries the signature of its document, which the server
+// serves unchanged; it cannot have warn_after, since the expiry warning would
+// change the signed document. Entries serving a document may carry the
+// sequence number of their publication, served as is.
 type FeedEntry struct {
 	Revision   string `json:"revision"`
 	TTLSeconds int    `json:"ttl_seconds"`
@@ -25,6 +52,41 @@ type FeedEntry struct {
 	Encrypted     bool          `json:"encrypted"`
 	EncryptedData string        `json:"encrypted_data,omitempty"`
 	Data          *FeedDocument `json:"data,omitempty"`
+	Recipients    []string      `json:"recipients,omitempty"`
+	Sequence      uint64        `json:"sequence,omitempty"`
+	Signature     *Signature    `json:"signature,omitempty"`
+
+	Revoked bool   `json:"revoked,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	AliasOf string `json:"alias_of,omitempty"`
+
+	WarnAfter *time.Time `json:"warn_after,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+	// ExpiryWarning replaces the default warning_message served after warn_after.
+	ExpiryWarning string `json:"expiry_warning,omitempty"`
+}
+
+// AccessPolicy is the etcd-stored value under wg-feed/policies/<feedPath>.
+// When present, requests for the feed must carry a token accepted by the policy,
+// either as "Authorization: Bearer <token>" or as the "token" query parameter.
+// A policy without tokens and keys denies every request.
+type AccessPolicy struct {
+	// Tokens lists accepted static tokens by their SHA-256 hash, so the store never holds them in clear.
+	Tokens []AccessToken `json:"tokens,omitempty"`
+	// HMACKeys accepts tokens of the form hex(HMAC-SHA256(secret, feedPath)).
+	HMACKeys []HMACKey `json:"hmac_keys,omitempty"`
+}
+
+type AccessToken struct {
+	ID     string `json:"id"`
+	SHA256 string `json:"sha256"`
+}
+
+type HMACKey struct {
+	ID string `json:"id"`
+	// Secret is the base64-encoded (standard encoding) HMAC key.
+	Secret string `json:"secret"`
 }
 
 type ErrorResponse struct {
@@ -40,6 +102,11 @@ type FeedDocument struct {
 	Warning     string      `json:"warning_message,omitempty"`
 	DisplayInfo DisplayInfo `json:"display_info"`
 	Tunnels     []Tunnel    `json:"tunnels"`
+	// StatusURL is where clients post a StatusReport after applying the feed (optional extension).
+	StatusURL string `json:"status_url,omitempty"`
+	// EnrollmentURL is where clients register the public key of their locally
+	// generated keypair (optional extension, see ClientPrivateKeyPlaceholder).
+	EnrollmentURL string `json:"enrollment_url,omitempty"`
 }
 
 type DisplayInfo struct {
@@ -0,0 +1,41 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// PatchHeader is the SSE request header by which a client asks for patch
+// events (optional extension); its value is PatchMediaType.
+const PatchHeader = "Wg-Feed-Accept-Patch"
+
+// PatchMediaType is the media type of JSON Patch (RFC 6902).
+const PatchMediaType = "application/json-patch+json"
+
+// PatchEvent is the data of an SSE "event: patch": a JSON Patch that turns
+// the success response of BaseRevision, the last one sent on the stream, into
+// the success response of Revision.
+type PatchEvent struct {
+	Version      string          `json:"version"`
+	BaseRevision string          `json:"base_revision"`
+	Revision     string          `json:"revision"`
+	Patch        json.RawMessage `json:"patch"`
+}
+
+func (e PatchEvent) Validate() error {
+	if e.Version != "wg-feed-00" {
+		return fmt.Errorf("version must be wg-feed-00")
+	}
+	if strings.TrimSpace(e.BaseRevision) == "" {
+		return fmt.Errorf("base_revision is required")
+	}
+	if strings.TrimSpace(e.Revision) == "" {
+		return fmt.Errorf("revision is required")
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(e.Patch), []byte("[")) {
+		return fmt.Errorf("patch must be an array of operations")
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package model
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		// RFC 8785, section 3.2.2 and 3.2.3.
+		{
+			in:   `{"numbers": [333333333.33333329, 1E30, 4.50, 2e-3, 0.000000000000000000000000001], "string": "\u20ac$\u000F\u000aA'\u0042\u0022\u005c\\\"\/", "literals": [null, true, false]}`,
+			want: `{"literals":[null,true,false],"numbers":[333333333.3333333,1e+30,4.5,0.002,1e-27],"string":"€$\u000f\nA'B\"\\\\\"/"}`,
+		},
+		{
+			in:   `{"\u20ac": "Euro Sign", "\r": "Carriage Return", "\ufb33": "Hebrew Letter Dalet With Dagesh", "1": "One", "\ud83d\ude00": "Emoji: Grinning Face", "\u0080": "Control", "\u00f6": "Latin Small Letter O With Diaeresis"}`,
+			want: "{\"\\r\":\"Carriage Return\",\"1\":\"One\",\"\u0080\":\"Control\",\"\u00f6\":\"Latin Small Letter O With Diaeresis\",\"\u20ac\":\"Euro Sign\",\"\U0001f600\":\"Emoji: Grinning Face\",\"\ufb33\":\"Hebrew Letter Dalet With Dagesh\"}",
+		},
+		{in: ` [ -0, "<&>" ] `, want: `[0,"<&>"]`},
+	}
+	for _, tc := range cases {
+		got, err := CanonicalJSON([]byte(tc.in))
+		if err != nil {
+			t.Fatalf("CanonicalJSON(%s): %v", tc.in, err)
+		}
+		if string(got) != tc.want {
+			t.Fatalf("CanonicalJSON(%s)\n got %s\nwant %s", tc.in, got, tc.want)
+		}
+	}
+
+	if _, err := CanonicalJSON([]byte(`{} {}`)); err == nil {
+		t.Fatalf("expected error for trailing data")
+	}
+}
+
+func TestSignFeedDocument(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	doc := []byte(`{"id":"123e4567-e89b-12d3-a456-426614174000","tunnels":[]}`)
+
+	sig, err := SignFeedDocument(priv, doc, 0)
+	if err != nil {
+		t.Fatalf("SignFeedDocument: %v", err)
+	}
+	if sig.PublicKey != EncodeSignerKey(pub) {
+		t.Fatalf("public_key = %q, want %q", sig.PublicKey, EncodeSignerKey(pub))
+	}
+	if err := sig.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	// The signature covers the canonical form, not the serialization.
+	if err := sig.Verify([]byte("{\n  \"tunnels\": [],\n  \"id\": \"123e4567-e89b-12d3-a456-426614174000\"\n}"), 0); err != nil {
+		t.Fatalf("Verify reformatted document: %v", err)
+	}
+	if err := sig.Verify([]byte(`{"id":"123e4567-e89b-12d3-a456-426614174001","tunnels":[]}`), 0); !errors.Is(err, ErrSignatureMismatch) {
+		t.Fatalf("Verify modified document: err=%v, want ErrSignatureMismatch", err)
+	}
+
+	_, other, _ := ed25519.GenerateKey(nil)
+	forged := sig
+	forged.PublicKey = EncodeSignerKey(other.Public().(ed25519.PublicKey))
+	if err := forged.Verify(doc, 0); !errors.Is(err, ErrSignatureMismatch) {
+		t.Fatalf("Verify with another key: err=%v, want ErrSignatureMismatch", err)
+	}
+
+	// The sequence the document is served with is covered too.
+	seqSig, err := SignFeedDocument(priv, doc, 7)
+	if err != nil {
+		t.Fatalf("SignFeedDocument with sequence: %v", err)
+	}
+	if err := seqSig.Verify(doc, 7); err != nil {
+		t.Fatalf("Verify with sequence: %v", err)
+	}
+	if err := seqSig.Verify(doc, 6); !errors.Is(err, ErrSignatureMismatch) {
+		t.Fatalf("Verify with another sequence: err=%v, want ErrSignatureMismatch", err)
+	}
+	if err := seqSig.Verify(doc, 0); !errors.Is(err, ErrSignatureMismatch) {
+		t.Fatalf("Verify without sequence: err=%v, want ErrSignatureMismatch", err)
+	}
+
+	if _, err := ParseSignerKey("not a key"); err == nil {
+		t.Fatalf("expected ParseSignerKey error")
+	}
+}
+
+func TestFeedEntryValidate_Signature(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	sig, err := SignFeedDocument(priv, []byte(`{}`), 0)
+	if err != nil {
+		t.Fatalf("SignFeedDocument: %v", err)
+	}
+	doc := &FeedDocument{
+		ID:          "123e4567-e89b-12d3-a456-426614174000",
+		Endpoints:   []string{"https://example.com/feed"},
+		DisplayInfo: DisplayInfo{Title: "Example"},
+		Tunnels:     []Tunnel{},
+	}
+
+	e := FeedEntry{Revision: "r1", Data: doc, Signature: &sig}
+	if err := e.Validate(); err != nil {
+		t.Fatalf("Validate signed entry: %v", err)
+	}
+
+	warn := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	e.WarnAfter = &warn
+	if err := e.Validate(); err == nil {
+		t.Fatalf("expected error for signature with warn_after")
+	}
+
+	revoked := FeedEntry{Revision: "r1", Revoked: true, Message: "gone", Signature: &sig}
+	if err := revoked.Validate(); err == nil {
+		t.Fatalf("expected error for signed tombstone")
+	}
+}
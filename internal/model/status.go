@@ -0,0 +1,82 @@
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var deviceIDRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+const (
+	// MaxStatusTunnels bounds the number of tunnels in a StatusReport.
+	MaxStatusTunnels = 256
+	// MaxStatusErrorLength bounds TunnelStatus.Error.
+	MaxStatusErrorLength = 1024
+)
+
+// StatusReport is posted by a client to the feed's status_url after it has
+// applied the feed (optional extension). It describes one device: the revision
+// it applied and the state of each tunnel of the feed.
+type StatusReport struct {
+	Version string `json:"version"`
+	// DeviceID is a random identifier the client keeps for its installation.
+	DeviceID string `json:"device_id"`
+	FeedID   string `json:"feed_id"`
+	// Revision is the feed revision the client last reconciled, or attempted
+	// to; the tunnels tell whether it was applied.
+	Revision string         `json:"revision"`
+	Tunnels  []TunnelStatus `json:"tunnels"`
+}
+
+type TunnelStatus struct {
+	ID      string `json:"id"`
+	Applied bool   `json:"applied"`
+	// Enabled is whether the tunnel is meant to be up on the device.
+	Enabled bool `json:"enabled"`
+	// Error is the apply failure when Applied is false.
+	Error string `json:"error,omitempty"`
+	// HandshakeAgeSeconds is the age of the latest WireGuard handshake of any
+	// peer of the tunnel, when the client could read it; nil if unknown or
+	// there was none.
+	HandshakeAgeSeconds *int64 `json:"handshake_age_seconds,omitempty"`
+}
+
+func (r StatusReport) Validate() error {
+	if r.Version != "wg-feed-00" {
+		return fmt.Errorf("version must be wg-feed-00")
+	}
+	if !deviceIDRe.MatchString(r.DeviceID) {
+		return fmt.Errorf("device_id must match %s", deviceIDRe.String())
+	}
+	if !uuidRe.MatchString(r.FeedID) {
+		return fmt.Errorf("feed_id must be a UUID")
+	}
+	if strings.TrimSpace(r.Revision) == "" {
+		return fmt.Errorf("revision is required")
+	}
+	if len(r.Tunnels) > MaxStatusTunnels {
+		return fmt.Errorf("tunnels must have at most %d items", MaxStatusTunnels)
+	}
+	for i, t := range r.Tunnels {
+		if strings.TrimSpace(t.ID) == "" {
+			return fmt.Errorf("tunnels[%d].id is required", i)
+		}
+		if len(t.Error) > MaxStatusErrorLength {
+			return fmt.Errorf("tunnels[%d].error must be at most %d bytes", i, MaxStatusErrorLength)
+		}
+		if t.HandshakeAgeSeconds != nil && *t.HandshakeAgeSeconds < 0 {
+			return fmt.Errorf("tunnels[%d].handshake_age_seconds must be >= 0", i)
+		}
+	}
+	return nil
+}
+
+// HandshakeAge returns the handshake age of t as a duration.
+func (t TunnelStatus) HandshakeAge() (time.Duration, bool) {
+	if t.HandshakeAgeSeconds == nil {
+		return 0, false
+	}
+	return time.Duration(*t.HandshakeAgeSeconds) * time.Second, true
+}
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net/url"
 	"regexp"
@@ -10,6 +11,7 @@ import (
 var (
 	uuidRe       = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[89abAB][0-9a-fA-F]{3}-[0-9a-fA-F]{12}$`)
 	tunnelNameRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]*$`)
+	sha256HexRe  = regexp.MustCompile(`^[0-9a-f]{64}$`)
 )
 
 func (r SuccessResponse) Validate() error {
@@ -25,6 +27,11 @@ func (r SuccessResponse) Validate() error {
 	if r.TTLSeconds < 0 {
 		return fmt.Errorf("ttl_seconds must be >= 0")
 	}
+	if r.Signature != nil {
+		if err := r.Signature.Validate(); err != nil {
+			return fmt.Errorf("signature: %w", err)
+		}
+	}
 	if r.Encrypted {
 		if strings.TrimSpace(r.EncryptedData) == "" {
 			return fmt.Errorf("encrypted_data is required when encrypted=true")
@@ -53,6 +60,67 @@ func (e FeedEntry) Validate() error {
 	if e.TTLSeconds < 0 {
 		return fmt.Errorf("ttl_seconds must be >= 0")
 	}
+	if e.AliasOf != "" {
+		if strings.TrimSpace(e.AliasOf) != e.AliasOf || strings.Trim(e.AliasOf, "/") != e.AliasOf {
+			return fmt.Errorf("alias_of must be a feed path without surrounding slashes or spaces")
+		}
+		if e.Encrypted || strings.TrimSpace(e.EncryptedData) != "" || e.Data != nil || len(e.Recipients) > 0 || e.Sequence != 0 || e.Signature != nil ||
+			e.Revoked || e.Message != "" || e.WarnAfter != nil || e.NotAfter != nil || e.ExpiryWarning != "" {
+			return fmt.Errorf("an alias must only have revision, ttl_seconds and alias_of")
+		}
+		return nil
+	}
+	if e.Revoked {
+		if strings.TrimSpace(e.Message) == "" {
+			return fmt.Errorf("message is required when revoked=true")
+		}
+		if e.Encrypted || strings.TrimSpace(e.EncryptedData) != "" || e.Data != nil || len(e.Recipients) > 0 || e.Sequence != 0 || e.Signature != nil {
+			return fmt.Errorf("encrypted, encrypted_data, data, recipients, sequence and signature must be omitted when revoked=true")
+		}
+		if e.WarnAfter != nil || e.NotAfter != nil || e.ExpiryWarning != "" {
+			return fmt.Errorf("warn_after, not_after and expiry_warning must be omitted when revoked=true")
+		}
+		return nil
+	}
+	if e.Message != "" {
+		return fmt.Errorf("message must be omitted unless revoked=true")
+	}
+	if e.Signature != nil {
+		if err := e.Signature.Validate(); err != nil {
+			return fmt.Errorf("signature: %w", err)
+		}
+		if e.WarnAfter != nil {
+			return fmt.Errorf("warn_after cannot be combined with signature: the expiry warning changes the signed document")
+		}
+	}
+	if e.WarnAfter != nil {
+		// The warning is added to the document, which the server cannot do for encrypted_data.
+		if e.Data == nil {
+			return fmt.Errorf("warn_after requires data")
+		}
+		if e.NotAfter != nil && !e.WarnAfter.Before(*e.NotAfter) {
+			return fmt.Errorf("warn_after must be before not_after")
+		}
+	} else if e.ExpiryWarning != "" {
+		return fmt.Errorf("expiry_warning requires warn_after")
+	}
+	if e.Encrypted && len(e.Recipients) > 0 {
+		if strings.TrimSpace(e.EncryptedData) != "" {
+			return fmt.Errorf("encrypted_data must be omitted when recipients are present")
+		}
+		if e.Data == nil {
+			return fmt.Errorf("data is required when recipients are present")
+		}
+		for i, r := range e.Recipients {
+			if !strings.HasPrefix(r, "age1") {
+				return fmt.Errorf("recipients[%d]: must be an age X25519 recipient", i)
+			}
+		}
+		if err := e.Data.Validate(); err != nil {
+			return fmt.Errorf("data: %w", err)
+		}
+		return nil
+	}
 	if e.Encrypted {
 		if strings.TrimSpace(e.EncryptedData) == "" {
 			return fmt.Errorf("encrypted_data is required when encrypted=true")
@@ -62,6 +130,9 @@ func (e FeedEntry) Validate() error {
 		}
 		return nil
 	}
+	if len(e.Recipients) > 0 {
+		return fmt.Errorf("recipients must be omitted when encrypted=false")
+	}
 	if strings.TrimSpace(e.EncryptedData) != "" {
 		return fmt.Errorf("encrypted_data must be omitted when encrypted=false")
 	}
@@ -74,6 +145,30 @@ func (e FeedEntry) Validate() error {
 	return nil
 }
 
+func (p AccessPolicy) Validate() error {
+	for i, t := range p.Tokens {
+		if strings.TrimSpace(t.ID) == "" {
+			return fmt.Errorf("tokens[%d].id is required", i)
+		}
+		if !sha256HexRe.MatchString(t.SHA256) {
+			return fmt.Errorf("tokens[%d].sha256 must be 64 lowercase hex characters", i)
+		}
+	}
+	for i, k := range p.HMACKeys {
+		if strings.TrimSpace(k.ID) == "" {
+			return fmt.Errorf("hmac_keys[%d].id is required", i)
+		}
+		secret, err := base64.StdEncoding.DecodeString(k.Secret)
+		if err != nil {
+			return fmt.Errorf("hmac_keys[%d].secret must be base64", i)
+		}
+		if len(secret) < 16 {
+			return fmt.Errorf("hmac_keys[%d].secret must be at least 16 bytes", i)
+		}
+	}
+	return nil
+}
+
 func (r ErrorResponse) Validate() error {
 	if r.Version != "wg-feed-00" {
 		return fmt.Errorf("version must be wg-feed-00")
@@ -98,18 +193,18 @@ func (f FeedDocument) Validate() error {
 		return fmt.Errorf("warning_message must be non-empty when present")
 	}
 	for i, raw := range f.Endpoints {
-		u, err := url.Parse(strings.TrimSpace(raw))
-		if err != nil {
-			return fmt.Errorf("endpoints[%d]: invalid url", i)
-		}
-		if u.Scheme != "https" {
-			return fmt.Errorf("endpoints[%d]: scheme must be https", i)
+		if err := validateSubscriptionURL(raw); err != nil {
+			return fmt.Errorf("endpoints[%d]: %w", i, err)
 		}
-		if strings.TrimSpace(u.Host) == "" {
-			return fmt.Errorf("endpoints[%d]: host is required", i)
+	}
+	if f.StatusURL != "" {
+		if err := validateSubscriptionURL(f.StatusURL); err != nil {
+			return fmt.Errorf("status_url: %w", err)
 		}
-		if strings.TrimSpace(u.Fragment) != "" {
-			return fmt.Errorf("endpoints[%d]: fragment must be omitted", i)
+	}
+	if f.EnrollmentURL != "" {
+		if err := validateSubscriptionURL(f.EnrollmentURL); err != nil {
+			return fmt.Errorf("enrollment_url: %w", err)
 		}
 	}
 	if strings.TrimSpace(f.DisplayInfo.Title) == "" {
@@ -132,6 +227,9 @@ func (f FeedDocument) Validate() error {
 		if _, ok := seenTunnelIDs[t.ID]; ok {
 			return fmt.Errorf("tunnels[%d].id duplicates another tunnel id", i)
 		}
+		if f.EnrollmentURL == "" && t.UsesClientKey() {
+			return fmt.Errorf("tunnels[%d].wg_quick_config uses %s, which requires enrollment_url", i, ClientPrivateKeyPlaceholder)
+		}
 		seenTunnelIDs[t.ID] = struct{}{}
 	}
 	return nil
@@ -161,6 +259,25 @@ func (t Tunnel) Validate() error {
 	return nil
 }
 
+// validateSubscriptionURL checks an HTTPS URL without a fragment, as used for
+// endpoints, the status URL and the enrollment URL.
+func validateSubscriptionURL(raw string) error {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return fmt.Errorf("invalid url")
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("scheme must be https")
+	}
+	if strings.TrimSpace(u.Host) == "" {
+		return fmt.Errorf("host is required")
+	}
+	if strings.TrimSpace(u.Fragment) != "" {
+		return fmt.Errorf("fragment must be omitted")
+	}
+	return nil
+}
+
 func validateIconURL(raw string) error {
 	// Schema and draft require an SVG data: URL (image/svg+xml).
 	s := strings.ToLower(strings.TrimSpace(raw))
@@ -1,6 +1,9 @@
 package model
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestFeedDocumentValidate(t *testing.T) {
 	valid := FeedDocument{
@@ -42,3 +45,207 @@ func TestFeedDocumentValidate(t *testing.T) {
 		t.Fatalf("expected error")
 	}
 }
+
+func TestAccessPolicyValidate(t *testing.T) {
+	valid := AccessPolicy{
+		Tokens:   []AccessToken{{ID: "ops", SHA256: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"}},
+		HMACKeys: []HMACKey{{ID: "k1", Secret: "MDEyMzQ1Njc4OWFiY2RlZg=="}},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := (AccessPolicy{}).Validate(); err != nil {
+		t.Fatalf("unexpected error for deny-all policy: %v", err)
+	}
+
+	invalid := valid
+	invalid.Tokens = []AccessToken{{ID: "ops", SHA256: "plaintext-token"}}
+	if err := invalid.Validate(); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	invalid = valid
+	invalid.HMACKeys = []HMACKey{{ID: "k1", Secret: "c2hvcnQ="}}
+	if err := invalid.Validate(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestFeedEntryValidate_Recipients(t *testing.T) {
+	doc := &FeedDocument{
+		ID:          "123e4567-e89b-12d3-a456-426614174000",
+		Endpoints:   []string{"https://example.com/feed"},
+		DisplayInfo: DisplayInfo{Title: "Example"},
+		Tunnels:     []Tunnel{},
+	}
+	recipient := "age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"
+
+	valid := FeedEntry{Revision: "r1", Encrypted: true, Data: doc, Recipients: []string{recipient}}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	invalid := valid
+	invalid.EncryptedData = "-----BEGIN AGE ENCRYPTED FILE-----"
+	if err := invalid.Validate(); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	invalid = valid
+	invalid.Encrypted = false
+	if err := invalid.Validate(); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	invalid = valid
+	invalid.Recipients = []string{"ssh-ed25519 AAAA"}
+	if err := invalid.Validate(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestFeedEntryValidate_Revoked(t *testing.T) {
+	valid := FeedEntry{Revision: "r2", Revoked: true, Message: "This subscription was cancelled."}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	invalid := valid
+	invalid.Message = " "
+	if err := invalid.Validate(); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	invalid = valid
+	invalid.Data = &FeedDocument{}
+	if err := invalid.Validate(); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	invalid = valid
+	invalid.Revoked = false
+	if err := invalid.Validate(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestFeedEntryValidate_Expiry(t *testing.T) {
+	doc := FeedDocument{
+		ID:          "123e4567-e89b-12d3-a456-426614174000",
+		Endpoints:   []string{"https://example.com/feed"},
+		DisplayInfo: DisplayInfo{Title: "Example"},
+		Tunnels:     []Tunnel{},
+	}
+	warn := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := warn.Add(24 * time.Hour)
+
+	ok := FeedEntry{Revision: "r", Data: &doc, WarnAfter: &warn, NotAfter: &notAfter, ExpiryWarning: "renew"}
+	if err := ok.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	encrypted := FeedEntry{Revision: "r", Encrypted: true, EncryptedData: "age", NotAfter: &notAfter}
+	if err := encrypted.Validate(); err != nil {
+		t.Fatalf("not_after on encrypted_data: unexpected error: %v", err)
+	}
+
+	for name, e := range map[string]FeedEntry{
+		"warn_after on encrypted_data": {Revision: "r", Encrypted: true, EncryptedData: "age", WarnAfter: &warn},
+		"warn_after after not_after":   {Revision: "r", Data: &doc, WarnAfter: &notAfter, NotAfter: &warn},
+		"expiry_warning alone":         {Revision: "r", Data: &doc, ExpiryWarning: "renew"},
+		"revoked with not_after":       {Revision: "r", Revoked: true, Message: "gone", NotAfter: &notAfter},
+	} {
+		if err := e.Validate(); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
+
+func TestFeedEntryValidate_Alias(t *testing.T) {
+	valid := FeedEntry{Revision: "r", TTLSeconds: 60, AliasOf: "team/client-a"}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for name, e := range map[string]FeedEntry{
+		"leading slash": {Revision: "r", AliasOf: "/team/client-a"},
+		"with data":     {Revision: "r", AliasOf: "team/client-a", Data: &FeedDocument{}},
+		"revoked":       {Revision: "r", AliasOf: "team/client-a", Revoked: true, Message: "gone"},
+		"encrypted":     {Revision: "r", AliasOf: "team/client-a", Encrypted: true, EncryptedData: "age"},
+	} {
+		if err := e.Validate(); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
+
+func TestStatusReportValidate(t *testing.T) {
+	age := int64(5)
+	valid := StatusReport{
+		Version:  "wg-feed-00",
+		DeviceID: "device-1",
+		FeedID:   "123e4567-e89b-12d3-a456-426614174000",
+		Revision: "r",
+		Tunnels:  []TunnelStatus{{ID: "t1", Applied: true, Enabled: true, HandshakeAgeSeconds: &age}},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	invalid := valid
+	invalid.DeviceID = "a/b"
+	if err := invalid.Validate(); err == nil {
+		t.Fatalf("expected error for device_id")
+	}
+	invalid = valid
+	invalid.Tunnels = []TunnelStatus{{ID: " "}}
+	if err := invalid.Validate(); err == nil {
+		t.Fatalf("expected error for tunnel id")
+	}
+}
+
+func TestFeedDocumentValidate_ClientKey(t *testing.T) {
+	doc := FeedDocument{
+		ID:          "123e4567-e89b-12d3-a456-426614174000",
+		Endpoints:   []string{"https://example.com/feed"},
+		DisplayInfo: DisplayInfo{Title: "Example"},
+		Tunnels: []Tunnel{{
+			ID:            "t1",
+			Name:          "work",
+			DisplayInfo:   DisplayInfo{Title: "Work"},
+			WGQuickConfig: "[Interface]\nPrivateKey = {{client_private_key}}\nAddress = 10.0.0.2/32\n",
+		}},
+	}
+	if !doc.Tunnels[0].UsesClientKey() {
+		t.Fatalf("expected placeholder to be detected")
+	}
+	if err := doc.Validate(); err == nil {
+		t.Fatalf("expected error without enrollment_url")
+	}
+	doc.EnrollmentURL = "https://example.com/_enroll/feed"
+	if err := doc.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := doc.Tunnels[0].WithClientKey("KEY")
+	if want := "[Interface]\nPrivateKey = KEY\nAddress = 10.0.0.2/32\n"; got != want {
+		t.Fatalf("WithClientKey = %q, want %q", got, want)
+	}
+}
+
+func TestEnrollmentRequestValidate(t *testing.T) {
+	valid := EnrollmentRequest{
+		Version:   "wg-feed-00",
+		DeviceID:  "device-1",
+		FeedID:    "123e4567-e89b-12d3-a456-426614174000",
+		PublicKey: "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	invalid := valid
+	invalid.PublicKey = "c2hvcnQ="
+	if err := invalid.Validate(); err == nil {
+		t.Fatalf("expected error for public_key")
+	}
+}
@@ -0,0 +1,453 @@
+// Package admin implements the authenticated feed management API of wg-feed-server.
+//
+// Routes (all require "Authorization: Bearer <ADMIN_TOKEN>"):
+//
+//	GET    /v1/feeds                      list feed paths and revisions
+//	GET    /v1/feeds/{feedPath...}        stored feed entry, ETag = revision
+//	PUT    /v1/feeds/{feedPath...}        publish a feed (same input as wg-feed-upload)
+//	DELETE /v1/feeds/{feedPath...}        delete a feed
+//	PUT    /v1/revocations/{feedPath...}  replace a feed with a tombstone, body {"message": ...}
+//	PUT    /v1/aliases/{feedPath...}      make a feed an alias of another, body {"target": ...}
+//	GET    /v1/status                     status reports of all devices (see package status)
+//	GET    /v1/status/{feedPath...}       status reports for one feed
+//	GET    /v1/enrollments                enrolled client public keys (see package enrollment)
+//	GET    /v1/enrollments/{feedPath...}  enrolled client public keys of one feed
+//	DELETE /v1/enrollments/{feedPath...}  delete the enrollment of ?device_id=, so it can enroll again
+//
+// PUT and DELETE honor If-Match (current revision or *) and PUT honors
+// If-None-Match: * for optimistic concurrency. PUTs are recorded in the feed
+// history (see package history), with the optional ?comment= query parameter.
+//
+// With derived feed keys (see package feedkey) the store no longer knows feed
+// paths, so GET /v1/feeds lists key ids instead. With at-rest keys (see
+// package atrest) published entries are sealed and GET returns them opened.
+package admin
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+
+	"github.com/exeteres/wg-feed/internal/atrest"
+	"github.com/exeteres/wg-feed/internal/feedkey"
+	"github.com/exeteres/wg-feed/internal/history"
+	"github.com/exeteres/wg-feed/internal/upload"
+)
+
+const (
+	feedsPrefix = feedkey.FeedsPrefix
+
+	maxBodyBytes = 1 << 20
+	// unconditionalAttempts bounds retries of writes without preconditions
+	// that lose a race with a concurrent writer.
+	unconditionalAttempts = 3
+)
+
+// Store is the subset of feed store operations used by the admin API.
+type Store interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	List(ctx context.Context, prefix string) ([]*mvccpb.KeyValue, error)
+	CompareAndPutAll(ctx context.Context, keys []string, expected, values [][]byte) (bool, error)
+	CompareAndDelete(ctx context.Context, key string, expected []byte) (bool, error)
+}
+
+// historyUploader is recorded as the uploader of revisions published through the admin API.
+const historyUploader = "admin-api"
+
+type Handler struct {
+	store    Store
+	tokenSum [sha256.Size]byte
+	keys     *feedkey.Deriver
+	atRest   *atrest.Keyring
+	logger   *log.Logger
+	mux      *http.ServeMux
+}
+
+// NewHandler returns the admin API handler. token must be non-empty; keys and atRest may be nil.
+func NewHandler(store Store, token string, keys *feedkey.Deriver, atRest *atrest.Keyring, logger *log.Logger) *Handler {
+	h := &Handler{
+		store:    store,
+		tokenSum: sha256.Sum256([]byte(token)),
+		keys:     keys,
+		atRest:   atRest,
+		logger:   logger,
+		mux:      http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /v1/feeds", h.listFeeds)
+	h.mux.HandleFunc("GET /v1/feeds/{feedPath...}", h.getFeed)
+	h.mux.HandleFunc("PUT /v1/feeds/{feedPath...}", h.putFeed)
+	h.mux.HandleFunc("DELETE /v1/feeds/{feedPath...}", h.deleteFeed)
+	h.mux.HandleFunc("PUT /v1/revocations/{feedPath...}", h.revokeFeed)
+	h.mux.HandleFunc("PUT /v1/aliases/{feedPath...}", h.aliasFeed)
+	h.mux.HandleFunc("GET /v1/status", h.listStatus)
+	h.mux.HandleFunc("GET /v1/status/{feedPath...}", h.getFeedStatus)
+	h.mux.HandleFunc("GET /v1/enrollments", h.listEnrollments)
+	h.mux.HandleFunc("GET /v1/enrollments/{feedPath...}", h.getFeedEnrollments)
+	h.mux.HandleFunc("DELETE /v1/enrollments/{feedPath...}", h.deleteEnrollment)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "invalid or missing admin token")
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) authorized(r *http.Request) bool {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(r.Header.Get("Authorization")), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+	sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	return subtle.ConstantTimeCompare(sum[:], h.tokenSum[:]) == 1
+}
+
+type feedInfo struct {
+	FeedPath string `json:"feed_path,omitempty"`
+	// KeyID is set instead of FeedPath in listings of derived feed keys.
+	KeyID    string `json:"key_id,omitempty"`
+	Revision string `json:"revision"`
+}
+
+func (h *Handler) listFeeds(w http.ResponseWriter, r *http.Request) {
+	kvs, err := h.store.List(r.Context(), feedsPrefix)
+	if err != nil {
+		h.logger.Printf("admin list failed prefix=%q err=%v", feedsPrefix, err)
+		writeError(w, http.StatusInternalServerError, "store error")
+		return
+	}
+	feeds := make([]feedInfo, 0, len(kvs))
+	for _, kv := range kvs {
+		info := feedInfo{Revision: entryRevision(kv.Value)}
+		if id := strings.TrimPrefix(string(kv.Key), feedsPrefix); h.keys.Enabled() {
+			info.KeyID = id
+		} else {
+			info.FeedPath = id
+		}
+		feeds = append(feeds, info)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"feeds": feeds})
+}
+
+func (h *Handler) getFeed(w http.ResponseWriter, r *http.Request) {
+	feedPath, key, ok := h.feedKey(w, r)
+	if !ok {
+		return
+	}
+	body, found, err := h.store.Get(r.Context(), key)
+	if err != nil {
+		h.logger.Printf("admin get failed feedPath=%q key=%q err=%v", feedPath, key, err)
+		writeError(w, http.StatusInternalServerError, "store error")
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, "feed not found")
+		return
+	}
+	if rev := entryRevision(body); rev != "" {
+		w.Header().Set("ETag", strconv.Quote(rev))
+	}
+	if body, err = h.atRest.Open(body); err != nil {
+		h.logger.Printf("admin open failed feedPath=%q key=%q err=%v", feedPath, key, err)
+		writeError(w, http.StatusInternalServerError, "cannot open sealed entry")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(body)
+}
+
+func (h *Handler) putFeed(w http.ResponseWriter, r *http.Request) {
+	feedPath, key, ok := h.feedKey(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	ttlSeconds := 15 * 60
+	if raw := q.Get("ttl"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "ttl must be an integer")
+			return
+		}
+		ttlSeconds = n
+	}
+
+	input, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		writeError(w, http.StatusBadRequest, "read body: "+err.Error())
+		return
+	}
+	parsed, err := upload.ParseInput(string(input))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "input error: "+err.Error())
+		return
+	}
+	parsed.Recipients = q["recipient"]
+	if parsed.WarnAfter, err = upload.ParseTimestamp(q.Get("warn_after")); err != nil {
+		writeError(w, http.StatusBadRequest, "warn_after "+err.Error())
+		return
+	}
+	if parsed.NotAfter, err = upload.ParseTimestamp(q.Get("not_after")); err != nil {
+		writeError(w, http.StatusBadRequest, "not_after "+err.Error())
+		return
+	}
+	parsed.ExpiryWarning = strings.TrimSpace(q.Get("expiry_warning"))
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	parsed.Sequence, err = history.NextSequence(ctx, h.store, h.keys.ID(feedPath), h.atRest.Open)
+	cancel()
+	if err != nil {
+		h.logger.Printf("admin sequence read failed feedPath=%q err=%v", feedPath, err)
+		writeError(w, http.StatusInternalServerError, "cannot read feed sequence")
+		return
+	}
+	storeBody, revision, err := upload.BuildStoreBodyJSON(ttlSeconds, parsed)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "input error: "+err.Error())
+		return
+	}
+	if storeBody, err = h.atRest.Seal(storeBody); err != nil {
+		h.logger.Printf("admin seal failed feedPath=%q err=%v", feedPath, err)
+		writeError(w, http.StatusInternalServerError, "cannot seal entry")
+		return
+	}
+
+	meta := history.Meta{Uploader: historyUploader, Comment: q.Get("comment")}
+	created, status, msg := h.conditionalWrite(r, feedPath, key, func(ctx context.Context, current []byte) (bool, error) {
+		return history.Publish(ctx, h.store, h.keys.ID(feedPath), current, storeBody, meta, history.DefaultKeep)
+	}, false)
+	if status != 0 {
+		writeError(w, status, msg)
+		return
+	}
+
+	h.logger.Printf("admin put feedPath=%q revision=%q", feedPath, revision)
+	w.Header().Set("ETag", strconv.Quote(revision))
+	status = http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, feedInfo{FeedPath: feedPath, Revision: revision})
+}
+
+func (h *Handler) revokeFeed(w http.ResponseWriter, r *http.Request) {
+	feedPath, key, ok := h.feedKey(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Message string `json:"message"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "decode body: "+err.Error())
+		return
+	}
+	storeBody, revision, err := upload.BuildTombstoneBodyJSON(req.Message)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "input error: "+err.Error())
+		return
+	}
+
+	meta := history.Meta{Uploader: historyUploader, Comment: r.URL.Query().Get("comment")}
+	_, status, msg := h.conditionalWrite(r, feedPath, key, func(ctx context.Context, current []byte) (bool, error) {
+		return history.Publish(ctx, h.store, h.keys.ID(feedPath), current, storeBody, meta, history.DefaultKeep)
+	}, false)
+	if status != 0 {
+		writeError(w, status, msg)
+		return
+	}
+
+	h.logger.Printf("admin revoke feedPath=%q revision=%q", feedPath, revision)
+	w.Header().Set("ETag", strconv.Quote(revision))
+	writeJSON(w, http.StatusOK, feedInfo{FeedPath: feedPath, Revision: revision})
+}
+
+func (h *Handler) aliasFeed(w http.ResponseWriter, r *http.Request) {
+	feedPath, key, ok := h.feedKey(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Target string `json:"target"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "decode body: "+err.Error())
+		return
+	}
+	targetPath, err := upload.ParseFeedPath(req.Target)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "target error: "+err.Error())
+		return
+	}
+	if targetPath == feedPath {
+		writeError(w, http.StatusBadRequest, "input error: a feed cannot be an alias of itself")
+		return
+	}
+	storeBody, revision, err := upload.BuildAliasBodyJSON(h.keys.ID(targetPath))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "input error: "+err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	targetKey := h.keys.FeedKey(targetPath)
+	target, found, err := h.store.Get(ctx, targetKey)
+	if err != nil {
+		h.logger.Printf("admin get failed feedPath=%q key=%q err=%v", targetPath, targetKey, err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if err := upload.ValidateAliasTarget(target, found); err != nil {
+		writeError(w, http.StatusBadRequest, "input error: "+err.Error())
+		return
+	}
+
+	meta := history.Meta{Uploader: historyUploader, Comment: r.URL.Query().Get("comment")}
+	_, status, msg := h.conditionalWrite(r, feedPath, key, func(ctx context.Context, current []byte) (bool, error) {
+		return history.Publish(ctx, h.store, h.keys.ID(feedPath), current, storeBody, meta, history.DefaultKeep)
+	}, false)
+	if status != 0 {
+		writeError(w, status, msg)
+		return
+	}
+
+	h.logger.Printf("admin alias feedPath=%q target=%q revision=%q", feedPath, targetPath, revision)
+	w.Header().Set("ETag", strconv.Quote(revision))
+	writeJSON(w, http.StatusOK, feedInfo{FeedPath: feedPath, Revision: revision})
+}
+
+func (h *Handler) deleteFeed(w http.ResponseWriter, r *http.Request) {
+	feedPath, key, ok := h.feedKey(w, r)
+	if !ok {
+		return
+	}
+	_, status, msg := h.conditionalWrite(r, feedPath, key, func(ctx context.Context, current []byte) (bool, error) {
+		return h.store.CompareAndDelete(ctx, key, current)
+	}, true)
+	if status != 0 {
+		writeError(w, status, msg)
+		return
+	}
+	h.logger.Printf("admin delete feedPath=%q", feedPath)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// conditionalWrite reads the current value of key, checks the request
+// preconditions against it and applies write, which must only succeed if the
+// value is still current. Without preconditions a lost race is retried.
+// It returns whether the key did not exist before, or an error status and message.
+func (h *Handler) conditionalWrite(r *http.Request, feedPath, key string, write func(ctx context.Context, current []byte) (bool, error), mustExist bool) (bool, int, string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	ifNoneMatch := strings.TrimSpace(r.Header.Get("If-None-Match"))
+	conditional := ifMatch != "" || ifNoneMatch != ""
+
+	for attempt := 0; ; attempt++ {
+		current, found, err := h.store.Get(ctx, key)
+		if err != nil {
+			h.logger.Printf("admin get failed feedPath=%q key=%q err=%v", feedPath, key, err)
+			return false, http.StatusInternalServerError, "store error"
+		}
+		if !found {
+			current = nil
+			if mustExist {
+				return false, http.StatusNotFound, "feed not found"
+			}
+		}
+		if ifMatch != "" && (!found || !etagListMatches(ifMatch, entryRevision(current))) {
+			return false, http.StatusPreconditionFailed, "If-Match does not match the current revision"
+		}
+		if ifNoneMatch == "*" && found {
+			return false, http.StatusPreconditionFailed, "feed already exists"
+		}
+
+		ok, err := write(ctx, current)
+		if err != nil {
+			h.logger.Printf("admin write failed feedPath=%q key=%q err=%v", feedPath, key, err)
+			return false, http.StatusInternalServerError, "store error"
+		}
+		if ok {
+			return !found, 0, ""
+		}
+		if conditional {
+			return false, http.StatusPreconditionFailed, "feed was modified concurrently"
+		}
+		if attempt+1 == unconditionalAttempts {
+			return false, http.StatusConflict, "feed was modified concurrently; retry"
+		}
+	}
+}
+
+func (h *Handler) feedKey(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	feedPath, err := upload.ParseFeedPath(r.PathValue("feedPath"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return "", "", false
+	}
+	return feedPath, h.keys.FeedKey(feedPath), true
+}
+
+// entryRevision returns the revision of a stored feed entry, or "" if it cannot be decoded.
+func entryRevision(body []byte) string {
+	var entry struct {
+		Revision string `json:"revision"`
+	}
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return ""
+	}
+	return entry.Revision
+}
+
+func etagListMatches(header, revision string) bool {
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "*" {
+			return true
+		}
+		if unq, err := strconv.Unquote(part); err == nil {
+			part = unq
+		}
+		if revision != "" && part == revision {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,420 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+
+	"github.com/exeteres/wg-feed/internal/atrest"
+	"github.com/exeteres/wg-feed/internal/enrollment"
+	"github.com/exeteres/wg-feed/internal/feedkey"
+	"github.com/exeteres/wg-feed/internal/history"
+	"github.com/exeteres/wg-feed/internal/model"
+	"github.com/exeteres/wg-feed/internal/status"
+)
+
+type memStore struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func (s *memStore) Get(_ context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	return v, ok, nil
+}
+
+func (s *memStore) List(_ context.Context, prefix string) ([]*mvccpb.KeyValue, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kvs []*mvccpb.KeyValue
+	for k, v := range s.values {
+		if strings.HasPrefix(k, prefix) {
+			kvs = append(kvs, &mvccpb.KeyValue{Key: []byte(k), Value: v})
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return bytes.Compare(kvs[i].Key, kvs[j].Key) < 0 })
+	return kvs, nil
+}
+
+func (s *memStore) CompareAndPutAll(_ context.Context, keys []string, expected, values [][]byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, key := range keys {
+		cur, ok := s.values[key]
+		if (expected[i] == nil && ok) || (expected[i] != nil && (!ok || !bytes.Equal(cur, expected[i]))) {
+			return false, nil
+		}
+	}
+	for i, key := range keys {
+		s.values[key] = values[i]
+	}
+	return true, nil
+}
+
+func (s *memStore) CompareAndDelete(_ context.Context, key string, expected []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, ok := s.values[key]
+	if !ok || !bytes.Equal(cur, expected) {
+		return false, nil
+	}
+	delete(s.values, key)
+	return true, nil
+}
+
+const feedDoc = `{
+	"id": "11111111-1111-4111-8111-111111111111",
+	"endpoints": ["https://example.invalid/client-a"],
+	"display_info": {"title": "Example"},
+	"tunnels": []
+}`
+
+func do(t *testing.T, h http.Handler, method, target, body string, header http.Header) *http.Response {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	for k, vs := range header {
+		r.Header[k] = vs
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Result()
+}
+
+func TestHandler_RequiresToken(t *testing.T) {
+	t.Parallel()
+
+	h := NewHandler(&memStore{values: map[string][]byte{}}, "admin-secret", nil, nil, log.New(io.Discard, "", 0))
+	for _, auth := range []string{"", "Bearer nope", "Basic admin-secret"} {
+		resp := do(t, h, http.MethodGet, "/v1/feeds", "", http.Header{"Authorization": {auth}})
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("auth %q: status = %d", auth, resp.StatusCode)
+		}
+	}
+}
+
+func TestHandler_FeedLifecycle(t *testing.T) {
+	t.Parallel()
+
+	st := &memStore{values: map[string][]byte{}}
+	h := NewHandler(st, "admin-secret", nil, nil, log.New(io.Discard, "", 0))
+
+	resp := do(t, h, http.MethodPut, "/v1/feeds/team/client-a?ttl=60&comment=initial", feedDoc, http.Header{"If-None-Match": {"*"}})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: status = %d", resp.StatusCode)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatalf("create: missing ETag")
+	}
+	if resp := do(t, h, http.MethodPut, "/v1/feeds/team/client-a", feedDoc, http.Header{"If-None-Match": {"*"}}); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("create existing: status = %d", resp.StatusCode)
+	}
+
+	resp = do(t, h, http.MethodGet, "/v1/feeds/team/client-a", "", nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != etag {
+		t.Fatalf("get: status = %d etag = %q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	var entry map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil || entry["ttl_seconds"] != float64(60) || entry["sequence"] != float64(1) {
+		t.Fatalf("get: unexpected entry %v (%v)", entry, err)
+	}
+
+	changed := strings.Replace(feedDoc, `"Example"`, `"Changed"`, 1)
+	if resp := do(t, h, http.MethodPut, "/v1/feeds/team/client-a", changed, http.Header{"If-Match": {`"stale"`}}); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("stale If-Match: status = %d", resp.StatusCode)
+	}
+	resp = do(t, h, http.MethodPut, "/v1/feeds/team/client-a", changed, http.Header{"If-Match": {etag}})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag {
+		t.Fatalf("update: status = %d etag = %q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	etag = resp.Header.Get("ETag")
+	resp = do(t, h, http.MethodGet, "/v1/feeds/team/client-a", "", nil)
+	if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil || entry["sequence"] != float64(2) {
+		t.Fatalf("get updated: unexpected entry %v (%v)", entry, err)
+	}
+
+	resp = do(t, h, http.MethodGet, "/v1/feeds", "", nil)
+	var list struct {
+		Feeds []feedInfo `json:"feeds"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(list.Feeds) != 1 || list.Feeds[0].FeedPath != "team/client-a" || `"`+list.Feeds[0].Revision+`"` != etag {
+		t.Fatalf("list: unexpected feeds %+v", list.Feeds)
+	}
+
+	records, err := history.List(context.Background(), st, "team/client-a")
+	if err != nil || len(records) != 2 || `"`+records[0].Revision+`"` != etag || records[1].Comment != "initial" || records[1].Uploader != historyUploader {
+		t.Fatalf("unexpected history: %+v (%v)", records, err)
+	}
+
+	if resp := do(t, h, http.MethodPut, "/v1/feeds/team/client-b", "not json", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid input: status = %d", resp.StatusCode)
+	}
+
+	if resp := do(t, h, http.MethodDelete, "/v1/feeds/team/client-a", "", http.Header{"If-Match": {`"stale"`}}); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("stale delete: status = %d", resp.StatusCode)
+	}
+	if resp := do(t, h, http.MethodDelete, "/v1/feeds/team/client-a", "", http.Header{"If-Match": {etag}}); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: status = %d", resp.StatusCode)
+	}
+	if resp := do(t, h, http.MethodGet, "/v1/feeds/team/client-a", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("get deleted: status = %d", resp.StatusCode)
+	}
+	if resp := do(t, h, http.MethodDelete, "/v1/feeds/team/client-a", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("delete missing: status = %d", resp.StatusCode)
+	}
+}
+
+func TestHandler_RevokeFeed(t *testing.T) {
+	t.Parallel()
+
+	st := &memStore{values: map[string][]byte{}}
+	h := NewHandler(st, "admin-secret", nil, nil, log.New(io.Discard, "", 0))
+
+	if resp := do(t, h, http.MethodPut, "/v1/feeds/client-a", feedDoc, nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: status = %d", resp.StatusCode)
+	}
+	if resp := do(t, h, http.MethodPut, "/v1/revocations/client-a", `{"message": " "}`, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("empty message: status = %d", resp.StatusCode)
+	}
+	resp := do(t, h, http.MethodPut, "/v1/revocations/client-a", `{"message": "subscription cancelled"}`, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("revoke: status = %d", resp.StatusCode)
+	}
+
+	var entry map[string]any
+	if err := json.Unmarshal(st.values["wg-feed/feeds/client-a"], &entry); err != nil {
+		t.Fatalf("decode stored entry: %v", err)
+	}
+	if entry["revoked"] != true || entry["message"] != "subscription cancelled" || `"`+entry["revision"].(string)+`"` != resp.Header.Get("ETag") {
+		t.Fatalf("unexpected stored entry: %v", entry)
+	}
+}
+
+func TestHandler_AliasFeed(t *testing.T) {
+	t.Parallel()
+
+	st := &memStore{values: map[string][]byte{}}
+	h := NewHandler(st, "admin-secret", nil, nil, log.New(io.Discard, "", 0))
+
+	if resp := do(t, h, http.MethodPut, "/v1/aliases/old/client-a", `{"target": "new/client-a"}`, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("missing target: status = %d", resp.StatusCode)
+	}
+	if resp := do(t, h, http.MethodPut, "/v1/feeds/new/client-a", feedDoc, nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: status = %d", resp.StatusCode)
+	}
+	if resp := do(t, h, http.MethodPut, "/v1/aliases/old/client-a", `{"target": "new/client-a"}`, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("alias: status = %d", resp.StatusCode)
+	}
+	if resp := do(t, h, http.MethodPut, "/v1/aliases/older/client-a", `{"target": "old/client-a"}`, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("alias of alias: status = %d", resp.StatusCode)
+	}
+
+	var entry map[string]any
+	if err := json.Unmarshal(st.values["wg-feed/feeds/old/client-a"], &entry); err != nil {
+		t.Fatalf("decode stored entry: %v", err)
+	}
+	if entry["alias_of"] != "new/client-a" || entry["data"] != nil {
+		t.Fatalf("unexpected stored entry: %v", entry)
+	}
+}
+
+func TestHandler_DerivedFeedKeys(t *testing.T) {
+	t.Parallel()
+
+	keys := feedkey.New([]byte("0123456789abcdef"))
+	st := &memStore{values: map[string][]byte{}}
+	h := NewHandler(st, "admin-secret", keys, nil, log.New(io.Discard, "", 0))
+
+	if resp := do(t, h, http.MethodPut, "/v1/feeds/team/client-a", feedDoc, nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: status = %d", resp.StatusCode)
+	}
+	for k := range st.values {
+		if strings.Contains(k, "client-a") {
+			t.Fatalf("feed path leaked into store key %q", k)
+		}
+	}
+	if _, ok := st.values[keys.FeedKey("team/client-a")]; !ok {
+		t.Fatalf("missing derived key, have %v", st.values)
+	}
+	if resp := do(t, h, http.MethodGet, "/v1/feeds/team/client-a", "", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("get: status = %d", resp.StatusCode)
+	}
+
+	resp := do(t, h, http.MethodGet, "/v1/feeds", "", nil)
+	var list struct {
+		Feeds []feedInfo `json:"feeds"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(list.Feeds) != 1 || list.Feeds[0].FeedPath != "" || list.Feeds[0].KeyID != keys.ID("team/client-a") {
+		t.Fatalf("list: unexpected feeds %+v", list.Feeds)
+	}
+}
+
+func TestHandler_SealsEntries(t *testing.T) {
+	t.Parallel()
+
+	keys, err := atrest.ParseKeyring("k1:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	if err != nil {
+		t.Fatalf("ParseKeyring: %v", err)
+	}
+	st := &memStore{values: map[string][]byte{}}
+	h := NewHandler(st, "admin-secret", nil, keys, log.New(io.Discard, "", 0))
+
+	resp := do(t, h, http.MethodPut, "/v1/feeds/team/client-a", feedDoc, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: status = %d", resp.StatusCode)
+	}
+	stored := st.values["wg-feed/feeds/team/client-a"]
+	if id, ok := atrest.SealedWith(stored); !ok || id != "k1" || bytes.Contains(stored, []byte("client-a")) {
+		t.Fatalf("entry not sealed: %s", stored)
+	}
+
+	get := do(t, h, http.MethodGet, "/v1/feeds/team/client-a", "", nil)
+	if get.StatusCode != http.StatusOK || get.Header.Get("ETag") != resp.Header.Get("ETag") {
+		t.Fatalf("get: status = %d etag = %q", get.StatusCode, get.Header.Get("ETag"))
+	}
+	body, _ := io.ReadAll(get.Body)
+	if !bytes.Contains(body, []byte("https://example.invalid/client-a")) {
+		t.Fatalf("get: entry not opened: %s", body)
+	}
+}
+
+func TestHandler_Status(t *testing.T) {
+	t.Parallel()
+
+	st := &memStore{values: map[string][]byte{}}
+	h := NewHandler(st, "admin-secret", nil, nil, log.New(io.Discard, "", 0))
+	resp := do(t, h, http.MethodPut, "/v1/feeds/client-a", feedDoc, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: status = %d", resp.StatusCode)
+	}
+	current := strings.Trim(resp.Header.Get("ETag"), `"`)
+
+	now := time.Now()
+	report := func(device, feed, revision string, age time.Duration) {
+		value, err := json.Marshal(status.Record{
+			ReceivedAt: now.Add(-age),
+			Report: model.StatusReport{
+				DeviceID: device,
+				Revision: revision,
+				Tunnels:  []model.TunnelStatus{{ID: "t1", Applied: true, Enabled: true}},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.values[status.Key(device, feed)] = value
+	}
+	report("dev-a", "client-a", current, time.Minute)
+	report("dev-b", "client-a", "old", time.Minute)
+	report("dev-c", "client-a", current, 48*time.Hour)
+	report("dev-d", "client-b", "whatever", time.Minute)
+
+	list := func(target string) map[string][]string {
+		t.Helper()
+		resp := do(t, h, http.MethodGet, target, "", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d", target, resp.StatusCode)
+		}
+		var out struct {
+			Devices []status.Device `json:"devices"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			t.Fatalf("%s: decode: %v", target, err)
+		}
+		problems := make(map[string][]string)
+		for _, d := range out.Devices {
+			problems[d.Feed+"/"+d.DeviceID] = d.Problems
+		}
+		return problems
+	}
+
+	got := list("/v1/status")
+	want := map[string][]string{
+		"client-a/dev-a": nil,
+		"client-a/dev-b": {status.ProblemOutdated},
+		"client-a/dev-c": {status.ProblemStale},
+		// client-b is not published, so its revision is not checked.
+		"client-b/dev-d": nil,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("all: got %v, want %v", got, want)
+	}
+
+	got = list("/v1/status/client-a?problems=true&stale_after=0")
+	want = map[string][]string{"client-a/dev-b": {status.ProblemOutdated}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("client-a problems: got %v, want %v", got, want)
+	}
+
+	got = list("/v1/status/client-a?handshake_after=5m&stale_after=0")
+	if len(got["client-a/dev-a"]) != 1 || got["client-a/dev-a"][0] != status.ProblemNoHandshake {
+		t.Fatalf("handshake: got %v", got)
+	}
+
+	if resp := do(t, h, http.MethodGet, "/v1/status?stale_after=soon", "", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad threshold: status = %d", resp.StatusCode)
+	}
+}
+
+func TestHandler_Enrollments(t *testing.T) {
+	t.Parallel()
+
+	st := &memStore{values: map[string][]byte{
+		enrollment.Key("dev-1", "team/client-a"): []byte(`{"public_key": "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=", "enrolled_at": "2026-10-01T12:00:00Z"}`),
+		enrollment.Key("dev-2", "client-b"):      []byte(`{"public_key": "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=", "enrolled_at": "2026-10-01T12:00:00Z"}`),
+	}}
+	h := NewHandler(st, "admin-secret", nil, nil, log.New(io.Discard, "", 0))
+
+	list := func(target string) []enrollment.Enrollment {
+		t.Helper()
+		resp := do(t, h, http.MethodGet, target, "", nil)
+		var out struct {
+			Enrollments []enrollment.Enrollment `json:"enrollments"`
+		}
+		if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&out) != nil {
+			t.Fatalf("%s: status = %d", target, resp.StatusCode)
+		}
+		return out.Enrollments
+	}
+
+	if got := list("/v1/enrollments"); len(got) != 2 {
+		t.Fatalf("all: %+v", got)
+	}
+	if got := list("/v1/enrollments/team/client-a"); len(got) != 1 || got[0].DeviceID != "dev-1" {
+		t.Fatalf("team/client-a: %+v", got)
+	}
+
+	if resp := do(t, h, http.MethodDelete, "/v1/enrollments/team/client-a", "", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("delete without device: status = %d", resp.StatusCode)
+	}
+	if resp := do(t, h, http.MethodDelete, "/v1/enrollments/team/client-a?device_id=dev-1", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: status = %d", resp.StatusCode)
+	}
+	if resp := do(t, h, http.MethodDelete, "/v1/enrollments/team/client-a?device_id=dev-1", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("delete again: status = %d", resp.StatusCode)
+	}
+	if got := list("/v1/enrollments/team/client-a"); len(got) != 0 {
+		t.Fatalf("after delete: %+v", got)
+	}
+}
@@ -0,0 +1,55 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/exeteres/wg-feed/internal/enrollment"
+)
+
+func (h *Handler) listEnrollments(w http.ResponseWriter, r *http.Request) {
+	h.serveEnrollments(w, r, "")
+}
+
+func (h *Handler) getFeedEnrollments(w http.ResponseWriter, r *http.Request) {
+	feedPath, _, ok := h.feedKey(w, r)
+	if !ok {
+		return
+	}
+	h.serveEnrollments(w, r, h.keys.ID(feedPath))
+}
+
+func (h *Handler) serveEnrollments(w http.ResponseWriter, r *http.Request, feedID string) {
+	enrollments, err := enrollment.List(r.Context(), h.store, feedID)
+	if err != nil {
+		h.logger.Printf("admin enrollment list failed feed=%q err=%v", feedID, err)
+		writeError(w, http.StatusInternalServerError, "store error")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"enrollments": enrollments})
+}
+
+func (h *Handler) deleteEnrollment(w http.ResponseWriter, r *http.Request) {
+	feedPath, _, ok := h.feedKey(w, r)
+	if !ok {
+		return
+	}
+	deviceID := strings.TrimSpace(r.URL.Query().Get("device_id"))
+	if deviceID == "" || strings.Contains(deviceID, "/") {
+		writeError(w, http.StatusBadRequest, "device_id query parameter is required")
+		return
+	}
+	err := enrollment.Delete(r.Context(), h.store, deviceID, h.keys.ID(feedPath))
+	if errors.Is(err, enrollment.ErrNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		h.logger.Printf("admin enrollment delete failed feedPath=%q device=%q err=%v", feedPath, deviceID, err)
+		writeError(w, http.StatusInternalServerError, "store error")
+		return
+	}
+	h.logger.Printf("admin enrollment deleted feedPath=%q device=%q", feedPath, deviceID)
+	w.WriteHeader(http.StatusNoContent)
+}
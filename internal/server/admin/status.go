@@ -0,0 +1,128 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/exeteres/wg-feed/internal/model"
+	"github.com/exeteres/wg-feed/internal/status"
+)
+
+// defaultStaleAfter is the stale threshold when the query does not set stale_after.
+const defaultStaleAfter = 24 * time.Hour
+
+func (h *Handler) listStatus(w http.ResponseWriter, r *http.Request) {
+	h.serveStatus(w, r, "")
+}
+
+func (h *Handler) getFeedStatus(w http.ResponseWriter, r *http.Request) {
+	feedPath, _, ok := h.feedKey(w, r)
+	if !ok {
+		return
+	}
+	h.serveStatus(w, r, h.keys.ID(feedPath))
+}
+
+// serveStatus lists the status reports for feedID (all feeds if empty) with
+// their problems. Query parameters: stale_after and handshake_after are Go
+// durations (0 disables the check), problems=true keeps only devices with
+// problems.
+func (h *Handler) serveStatus(w http.ResponseWriter, r *http.Request, feedID string) {
+	q := r.URL.Query()
+	criteria := status.Criteria{StaleAfter: defaultStaleAfter}
+	var err error
+	if v := q.Get("stale_after"); v != "" {
+		if criteria.StaleAfter, err = parseThreshold(v); err != nil {
+			writeError(w, http.StatusBadRequest, "stale_after "+err.Error())
+			return
+		}
+	}
+	if v := q.Get("handshake_after"); v != "" {
+		if criteria.HandshakeAfter, err = parseThreshold(v); err != nil {
+			writeError(w, http.StatusBadRequest, "handshake_after "+err.Error())
+			return
+		}
+	}
+	onlyProblems := false
+	if v := q.Get("problems"); v != "" {
+		if onlyProblems, err = strconv.ParseBool(v); err != nil {
+			writeError(w, http.StatusBadRequest, "problems must be a boolean")
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	devices, err := status.List(ctx, h.store, feedID)
+	if err != nil {
+		h.logger.Printf("admin status list failed feed=%q err=%v", feedID, err)
+		writeError(w, http.StatusInternalServerError, "store error")
+		return
+	}
+
+	now := time.Now()
+	revisions := make(map[string]string)
+	out := make([]status.Device, 0, len(devices))
+	for _, d := range devices {
+		rev, ok := revisions[d.Feed]
+		if !ok {
+			if rev, err = h.servedRevision(ctx, d.Feed, now); err != nil {
+				h.logger.Printf("admin status revision failed feed=%q err=%v", d.Feed, err)
+				writeError(w, http.StatusInternalServerError, "store error")
+				return
+			}
+			revisions[d.Feed] = rev
+		}
+		d.Problems = d.Evaluate(now, criteria, rev)
+		if onlyProblems && len(d.Problems) == 0 {
+			continue
+		}
+		out = append(out, d)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"devices": out})
+}
+
+// servedRevision returns the revision clients currently receive for feedID,
+// following an alias, or "" when the feed is missing, revoked or expired.
+func (h *Handler) servedRevision(ctx context.Context, feedID string, now time.Time) (string, error) {
+	entry, found, err := h.loadEntry(ctx, feedsPrefix+feedID)
+	if err != nil || !found {
+		return "", err
+	}
+	if entry.AliasOf != "" {
+		if entry, found, err = h.loadEntry(ctx, feedsPrefix+entry.AliasOf); err != nil || !found {
+			return "", err
+		}
+	}
+	if entry.Revoked || entry.AliasOf != "" || entry.Expired(now) {
+		return "", nil
+	}
+	return entry.AtTime(now).Revision, nil
+}
+
+func (h *Handler) loadEntry(ctx context.Context, key string) (model.FeedEntry, bool, error) {
+	body, found, err := h.store.Get(ctx, key)
+	if err != nil || !found {
+		return model.FeedEntry{}, false, err
+	}
+	if body, err = h.atRest.Open(body); err != nil {
+		return model.FeedEntry{}, false, fmt.Errorf("open %s: %w", key, err)
+	}
+	var entry model.FeedEntry
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return model.FeedEntry{}, false, fmt.Errorf("decode %s: %w", key, err)
+	}
+	return entry, true, nil
+}
+
+func parseThreshold(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("must be a non-negative duration")
+	}
+	return d, nil
+}
@@ -2,51 +2,153 @@ package app
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"time"
 
+	"github.com/exeteres/wg-feed/internal/boltstore"
 	"github.com/exeteres/wg-feed/internal/etcd"
+	"github.com/exeteres/wg-feed/internal/feedkey"
+	"github.com/exeteres/wg-feed/internal/fsstore"
+	"github.com/exeteres/wg-feed/internal/server/admin"
+	"github.com/exeteres/wg-feed/internal/server/certs"
 	"github.com/exeteres/wg-feed/internal/server/config"
 	"github.com/exeteres/wg-feed/internal/server/httpapi"
+	"github.com/exeteres/wg-feed/internal/server/metrics"
 )
 
 func Run(ctx context.Context, cfg config.Config, logger *log.Logger) error {
-	etcdClient, err := etcd.NewClient(cfg.EtcdEndpoints)
+	st, closeStore, err := openStore(cfg)
 	if err != nil {
-		return fmt.Errorf("create etcd client: %w", err)
+		return err
+	}
+	defer closeStore()
+
+	var m *metrics.Metrics
+	if cfg.MetricsPort != "" {
+		m = metrics.New()
 	}
-	defer etcdClient.Close()
 
-	st := etcd.NewStore(etcdClient)
-	h := httpapi.NewHandler(st, logger)
+	keys := feedkey.New(cfg.FeedKeySecret)
 
-	addr := ":" + cfg.ServerPort
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		return fmt.Errorf("listen %s: %w", addr, err)
+	cacheSize := cfg.ResponseCacheSize
+	if cacheSize == 0 {
+		cacheSize = -1
+	}
+	reportLimit := cfg.StatusReportLimit
+	if reportLimit == 0 {
+		reportLimit = -1
+	}
+	h := httpapi.NewHandler(st, logger, httpapi.Options{
+		SSEHeartbeatInterval: cfg.SSEHeartbeatInterval,
+		SSERetry:             cfg.SSERetry,
+		SSERewatchDelay:      cfg.SSERewatchDelay,
+		SSERewatchMaxDelay:   cfg.SSERewatchMaxDelay,
+		ResponseCacheSize:    cacheSize,
+		DisableStaleIfError:  !cfg.StaleIfError,
+		SnapshotDir:          cfg.SnapshotDir,
+		Metrics:              m,
+		ReadyTimeout:         cfg.ReadyTimeout,
+		FeedKeys:             keys,
+		AtRest:               cfg.AtRestKeys,
+		StatusReports:        cfg.StatusReports,
+		StatusReportLimit:    reportLimit,
+		Enrollment:           cfg.Enrollment,
+	})
+	defer func() {
+		h.Close()
+		if stats := h.ResponseCacheStats(); stats.Hits+stats.Misses > 0 {
+			logger.Printf("response cache hits=%d misses=%d hit_ratio=%.3f", stats.Hits, stats.Misses, stats.HitRatio())
+		}
+	}()
+
+	var tlsConfig *tls.Config
+	if cfg.TLSCertFile != "" {
+		reloader, err := certs.NewReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return err
+		}
+		go reloader.Run(ctx, cfg.TLSReloadInterval, logger)
+		tlsConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		}
 	}
-	defer ln.Close()
 
-	srv := &http.Server{
-		Handler:           h,
-		ReadHeaderTimeout: 5 * time.Second,
+	var adminHandler http.Handler
+	if cfg.AdminPort != "" {
+		as, ok := st.(admin.Store)
+		if !ok {
+			return fmt.Errorf("store %q does not support the admin API", cfg.Store)
+		}
+		adminHandler = admin.NewHandler(as, cfg.AdminToken, keys, cfg.AtRestKeys, logger)
 	}
 
-	errCh := make(chan error, 1)
-	go func() {
-		errCh <- srv.Serve(ln)
+	errCh := make(chan error, 3)
+	var servers []*http.Server
+	defer func() {
+		for _, srv := range servers {
+			_ = srv.Close()
+		}
 	}()
+	serve := func(port string, handler http.Handler, tlsConfig *tls.Config) (net.Addr, error) {
+		addr := ":" + port
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("listen %s: %w", addr, err)
+		}
+		srv := &http.Server{
+			Handler:           handler,
+			ReadHeaderTimeout: 5 * time.Second,
+			TLSConfig:         tlsConfig,
+		}
+		servers = append(servers, srv)
+		go func() {
+			if tlsConfig != nil {
+				// Certificates come from TLSConfig.GetCertificate.
+				errCh <- srv.ServeTLS(ln, "", "")
+				return
+			}
+			errCh <- srv.Serve(ln)
+		}()
+		return ln.Addr(), nil
+	}
 
-	logger.Printf("listening on %s", ln.Addr().String())
+	if cfg.MetricsPort != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", m.Handler())
+		// Probes live here rather than on the feed listener, where every path is a feed path.
+		mux.HandleFunc("GET /healthz", h.ServeHealthz)
+		mux.HandleFunc("GET /readyz", h.ServeReadyz)
+		addr, err := serve(cfg.MetricsPort, mux, nil)
+		if err != nil {
+			return err
+		}
+		logger.Printf("serving metrics and health checks on %s", addr)
+	}
+	if adminHandler != nil {
+		addr, err := serve(cfg.AdminPort, adminHandler, tlsConfig)
+		if err != nil {
+			return err
+		}
+		logger.Printf("admin API listening on %s (tls=%v)", addr, tlsConfig != nil)
+	}
+	addr, err := serve(cfg.ServerPort, h, tlsConfig)
+	if err != nil {
+		return err
+	}
+	logger.Printf("listening on %s (tls=%v)", addr, tlsConfig != nil)
 
 	select {
 	case <-ctx.Done():
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		_ = srv.Shutdown(shutdownCtx)
+		for _, srv := range servers {
+			_ = srv.Shutdown(shutdownCtx)
+		}
 		return nil
 	case err := <-errCh:
 		if err == nil || err == http.ErrServerClosed {
@@ -55,3 +157,26 @@ func Run(ctx context.Context, cfg config.Config, logger *log.Logger) error {
 		return err
 	}
 }
+
+type feedStore interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+}
+
+func openStore(cfg config.Config) (feedStore, func(), error) {
+	switch cfg.Store {
+	case config.StoreFS:
+		return fsstore.NewStore(cfg.FSStoreDir, cfg.FSPollInterval), func() {}, nil
+	case config.StoreBolt:
+		st, err := boltstore.NewStore(cfg.BoltPath, cfg.BoltPollInterval)
+		if err != nil {
+			return nil, nil, err
+		}
+		return st, func() {}, nil
+	default:
+		etcdClient, err := etcd.NewClient(cfg.Etcd)
+		if err != nil {
+			return nil, nil, fmt.Errorf("create etcd client: %w", err)
+		}
+		return etcd.NewStore(etcdClient), func() { _ = etcdClient.Close() }, nil
+	}
+}
@@ -0,0 +1,109 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader serves a TLS certificate loaded from disk and reloads it when the
+// certificate or key file changes (e.g. after a cert-manager rotation).
+//
+// The certificate is looked up per handshake, so established connections
+// (including long-lived SSE streams) are not affected by a reload.
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certVer fileVersion
+	keyVer  fileVersion
+}
+
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Reload reloads the key pair if either file changed since the last successful load.
+// It reports whether a new certificate was installed. On error the previous certificate is kept.
+func (r *Reloader) Reload() (bool, error) {
+	certVer, err := statVersion(r.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyVer, err := statVersion(r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	unchanged := r.cert != nil && certVer == r.certVer && keyVer == r.keyVer
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("load TLS key pair: %w", err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.certVer = certVer
+	r.keyVer = keyVer
+	r.mu.Unlock()
+	return true, nil
+}
+
+// Run checks the files every interval until ctx is done.
+func (r *Reloader) Run(ctx context.Context, interval time.Duration, logger *log.Logger) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		reloaded, err := r.Reload()
+		if err != nil {
+			// Files are often replaced non-atomically (cert first, key second); keep serving the old pair.
+			logger.Printf("tls certificate reload failed err=%v", err)
+			continue
+		}
+		if reloaded {
+			logger.Printf("tls certificate reloaded")
+		}
+	}
+}
+
+func statVersion(path string) (fileVersion, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	return fileVersion{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
@@ -1,17 +1,77 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/exeteres/wg-feed/internal/atrest"
 	"github.com/exeteres/wg-feed/internal/etcd"
+	"github.com/exeteres/wg-feed/internal/feedkey"
+)
+
+type StoreKind string
+
+const (
+	StoreEtcd StoreKind = "etcd"
+	StoreFS   StoreKind = "fs"
+	StoreBolt StoreKind = "bolt"
 )
 
 type Config struct {
-	ServerPort    string
-	EtcdEndpoints []string
+	ServerPort string
+	// MetricsPort serves /metrics, /healthz and /readyz on a separate listener when set.
+	MetricsPort string
+	// ReadyTimeout bounds the store check behind /readyz.
+	ReadyTimeout time.Duration
+
+	// AdminPort serves the admin API (authenticated with AdminToken) when set.
+	AdminPort  string
+	AdminToken string
+
+	// TLSCertFile and TLSKeyFile enable native TLS termination when both are set.
+	TLSCertFile       string
+	TLSKeyFile        string
+	TLSReloadInterval time.Duration
+
+	// SSE timings; see httpapi.Options.
+	SSEHeartbeatInterval time.Duration
+	SSERetry             time.Duration
+	SSERewatchDelay      time.Duration
+	SSERewatchMaxDelay   time.Duration
+
+	// ResponseCacheSize bounds the JSON response cache; 0 disables it.
+	ResponseCacheSize int
+
+	// StaleIfError serves last-known-good snapshots while the store is
+	// unavailable; SnapshotDir optionally persists them.
+	StaleIfError bool
+	SnapshotDir  string
+
+	// StatusReports accepts client status reports (see package status), from
+	// up to StatusReportLimit devices per feed; 0 keeps all.
+	StatusReports     bool
+	StatusReportLimit int
+	// Enrollment accepts client public keys (see package enrollment).
+	Enrollment bool
+
+	// FeedKeySecret, when set, stores feeds under HMAC-derived keys (see package feedkey).
+	FeedKeySecret []byte
+
+	// AtRestKeys, when set, seals plaintext feed entries in the store (see package atrest).
+	AtRestKeys *atrest.Keyring
+
+	Store StoreKind
+	Etcd  etcd.Config
+
+	FSStoreDir     string
+	FSPollInterval time.Duration
+
+	BoltPath         string
+	BoltPollInterval time.Duration
 }
 
 func FromEnv() (Config, error) {
@@ -23,13 +83,170 @@ func FromEnv() (Config, error) {
 		return Config{}, fmt.Errorf("SERVER_PORT must be an integer: %w", err)
 	}
 
-	endpoints, err := etcd.EndpointsFromEnv()
+	metricsPort := strings.TrimSpace(os.Getenv("METRICS_PORT"))
+	if metricsPort != "" {
+		if _, err := strconv.Atoi(metricsPort); err != nil {
+			return Config{}, fmt.Errorf("METRICS_PORT must be an integer: %w", err)
+		}
+		if metricsPort == port {
+			return Config{}, errors.New("METRICS_PORT must differ from SERVER_PORT")
+		}
+	}
+
+	adminPort := strings.TrimSpace(os.Getenv("ADMIN_PORT"))
+	adminToken := strings.TrimSpace(os.Getenv("ADMIN_TOKEN"))
+	if adminPort != "" {
+		if _, err := strconv.Atoi(adminPort); err != nil {
+			return Config{}, fmt.Errorf("ADMIN_PORT must be an integer: %w", err)
+		}
+		if adminPort == port || adminPort == metricsPort {
+			return Config{}, errors.New("ADMIN_PORT must differ from SERVER_PORT and METRICS_PORT")
+		}
+		if len(adminToken) < 16 {
+			return Config{}, errors.New("ADMIN_TOKEN of at least 16 characters is required when ADMIN_PORT is set")
+		}
+	}
+
+	cfg := Config{
+		ServerPort:  port,
+		MetricsPort: metricsPort,
+		AdminPort:   adminPort,
+		AdminToken:  adminToken,
+		TLSCertFile: strings.TrimSpace(os.Getenv("TLS_CERT_FILE")),
+		TLSKeyFile:  strings.TrimSpace(os.Getenv("TLS_KEY_FILE")),
+		Store:       StoreKind(strings.TrimSpace(os.Getenv("STORE"))),
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return Config{}, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	reloadInterval, err := durationFromEnv("TLS_RELOAD_INTERVAL", 30*time.Second)
 	if err != nil {
 		return Config{}, err
 	}
+	cfg.TLSReloadInterval = reloadInterval
+
+	if cfg.ReadyTimeout, err = durationFromEnv("READY_TIMEOUT", 2*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.SSEHeartbeatInterval, err = durationFromEnv("SSE_HEARTBEAT_INTERVAL", 15*time.Second); err != nil {
+		return Config{}, err
+	}
+	if cfg.SSERetry, err = durationFromEnv("SSE_RETRY", 5*time.Second); err != nil {
+		return Config{}, err
+	}
+	if cfg.SSERewatchDelay, err = durationFromEnv("SSE_REWATCH_DELAY", time.Second); err != nil {
+		return Config{}, err
+	}
+	if cfg.SSERewatchMaxDelay, err = durationFromEnv("SSE_REWATCH_MAX_DELAY", 30*time.Second); err != nil {
+		return Config{}, err
+	}
+	if cfg.SSERewatchMaxDelay < cfg.SSERewatchDelay {
+		return Config{}, errors.New("SSE_REWATCH_MAX_DELAY must be >= SSE_REWATCH_DELAY")
+	}
+
+	if cfg.ResponseCacheSize, err = nonNegativeIntFromEnv("RESPONSE_CACHE_SIZE", 10000); err != nil {
+		return Config{}, err
+	}
 
-	return Config{
-		ServerPort:    port,
-		EtcdEndpoints: endpoints,
-	}, nil
+	if cfg.StaleIfError, err = boolFromEnv("STALE_IF_ERROR", true); err != nil {
+		return Config{}, err
+	}
+	cfg.SnapshotDir = strings.TrimSpace(os.Getenv("SNAPSHOT_DIR"))
+
+	if cfg.StatusReports, err = boolFromEnv("STATUS_REPORTS", false); err != nil {
+		return Config{}, err
+	}
+	if cfg.StatusReportLimit, err = nonNegativeIntFromEnv("STATUS_REPORT_LIMIT", 1000); err != nil {
+		return Config{}, err
+	}
+	if cfg.Enrollment, err = boolFromEnv("ENROLLMENT", false); err != nil {
+		return Config{}, err
+	}
+
+	if raw := strings.TrimSpace(os.Getenv("FEED_KEY_SECRET")); raw != "" {
+		if cfg.FeedKeySecret, err = feedkey.ParseSecret(raw); err != nil {
+			return Config{}, fmt.Errorf("FEED_KEY_SECRET %w", err)
+		}
+	}
+	if cfg.AtRestKeys, err = atrest.FromEnv(); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.Store == "" {
+		cfg.Store = StoreEtcd
+	}
+
+	switch cfg.Store {
+	case StoreEtcd:
+		if cfg.Etcd, err = etcd.ConfigFromEnv(); err != nil {
+			return Config{}, err
+		}
+	case StoreFS:
+		cfg.FSStoreDir = strings.TrimSpace(os.Getenv("FS_STORE_DIR"))
+		if cfg.FSStoreDir == "" {
+			return Config{}, errors.New("FS_STORE_DIR is required when STORE=fs")
+		}
+		interval, err := durationFromEnv("FS_POLL_INTERVAL", 2*time.Second)
+		if err != nil {
+			return Config{}, err
+		}
+		cfg.FSPollInterval = interval
+	case StoreBolt:
+		cfg.BoltPath = strings.TrimSpace(os.Getenv("BOLT_PATH"))
+		if cfg.BoltPath == "" {
+			return Config{}, errors.New("BOLT_PATH is required when STORE=bolt")
+		}
+		interval, err := durationFromEnv("BOLT_POLL_INTERVAL", time.Second)
+		if err != nil {
+			return Config{}, err
+		}
+		cfg.BoltPollInterval = interval
+	default:
+		return Config{}, fmt.Errorf("STORE must be one of %q, %q, %q", StoreEtcd, StoreFS, StoreBolt)
+	}
+
+	return cfg, nil
+}
+
+func durationFromEnv(name string, def time.Duration) (time.Duration, error) {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a duration: %w", name, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s must be positive", name)
+	}
+	return d, nil
+}
+
+func nonNegativeIntFromEnv(name string, def int) (int, error) {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer: %w", name, err)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%s must not be negative", name)
+	}
+	return n, nil
+}
+
+func boolFromEnv(name string, def bool) (bool, error) {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("%s must be a boolean: %w", name, err)
+	}
+	return b, nil
 }
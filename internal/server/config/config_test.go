@@ -1,6 +1,9 @@
 package config
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestFromEnv_DefaultPort(t *testing.T) {
 	t.Setenv("SERVER_PORT", "")
@@ -13,8 +16,8 @@ func TestFromEnv_DefaultPort(t *testing.T) {
 	if cfg.ServerPort != "8080" {
 		t.Fatalf("unexpected port: %q", cfg.ServerPort)
 	}
-	if len(cfg.EtcdEndpoints) != 1 || cfg.EtcdEndpoints[0] != "http://127.0.0.1:2379" {
-		t.Fatalf("unexpected endpoints: %#v", cfg.EtcdEndpoints)
+	if len(cfg.Etcd.Endpoints) != 1 || cfg.Etcd.Endpoints[0] != "http://127.0.0.1:2379" {
+		t.Fatalf("unexpected endpoints: %#v", cfg.Etcd.Endpoints)
 	}
 }
 
@@ -26,3 +29,220 @@ func TestFromEnv_InvalidPort(t *testing.T) {
 		t.Fatalf("expected error")
 	}
 }
+
+func TestFromEnv_FSStore(t *testing.T) {
+	t.Setenv("STORE", "fs")
+	t.Setenv("ETCD_ENDPOINTS", "")
+	t.Setenv("FS_STORE_DIR", "/srv/wg-feed")
+	t.Setenv("FS_POLL_INTERVAL", "500ms")
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Store != StoreFS || cfg.FSStoreDir != "/srv/wg-feed" {
+		t.Fatalf("unexpected config: %#v", cfg)
+	}
+	if cfg.FSPollInterval != 500*time.Millisecond {
+		t.Fatalf("unexpected poll interval: %v", cfg.FSPollInterval)
+	}
+}
+
+func TestFromEnv_FSStoreRequiresDir(t *testing.T) {
+	t.Setenv("STORE", "fs")
+	t.Setenv("FS_STORE_DIR", "")
+	_, err := FromEnv()
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestFromEnv_BoltStore(t *testing.T) {
+	t.Setenv("STORE", "bolt")
+	t.Setenv("ETCD_ENDPOINTS", "")
+	t.Setenv("BOLT_PATH", "/var/lib/wg-feed/feeds.db")
+	t.Setenv("BOLT_POLL_INTERVAL", "")
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Store != StoreBolt || cfg.BoltPath != "/var/lib/wg-feed/feeds.db" {
+		t.Fatalf("unexpected config: %#v", cfg)
+	}
+	if cfg.BoltPollInterval != time.Second {
+		t.Fatalf("unexpected poll interval: %v", cfg.BoltPollInterval)
+	}
+}
+
+func TestFromEnv_UnknownStore(t *testing.T) {
+	t.Setenv("STORE", "redis")
+	t.Setenv("ETCD_ENDPOINTS", "http://127.0.0.1:2379")
+	_, err := FromEnv()
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestFromEnv_TLS(t *testing.T) {
+	t.Setenv("ETCD_ENDPOINTS", "http://127.0.0.1:2379")
+	t.Setenv("TLS_CERT_FILE", "/etc/tls/tls.crt")
+	t.Setenv("TLS_KEY_FILE", "/etc/tls/tls.key")
+	t.Setenv("TLS_RELOAD_INTERVAL", "")
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.TLSCertFile != "/etc/tls/tls.crt" || cfg.TLSKeyFile != "/etc/tls/tls.key" {
+		t.Fatalf("unexpected tls files: %#v", cfg)
+	}
+	if cfg.TLSReloadInterval != 30*time.Second {
+		t.Fatalf("unexpected reload interval: %v", cfg.TLSReloadInterval)
+	}
+}
+
+func TestFromEnv_TLSRequiresBothFiles(t *testing.T) {
+	t.Setenv("ETCD_ENDPOINTS", "http://127.0.0.1:2379")
+	t.Setenv("TLS_CERT_FILE", "/etc/tls/tls.crt")
+	t.Setenv("TLS_KEY_FILE", "")
+	_, err := FromEnv()
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestFromEnv_SSETimings(t *testing.T) {
+	t.Setenv("ETCD_ENDPOINTS", "http://127.0.0.1:2379")
+	t.Setenv("SSE_HEARTBEAT_INTERVAL", "20s")
+	t.Setenv("SSE_RETRY", "")
+	t.Setenv("SSE_REWATCH_DELAY", "2s")
+	t.Setenv("SSE_REWATCH_MAX_DELAY", "1m")
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.SSEHeartbeatInterval != 20*time.Second || cfg.SSERetry != 5*time.Second {
+		t.Fatalf("unexpected sse timings: %#v", cfg)
+	}
+	if cfg.SSERewatchDelay != 2*time.Second || cfg.SSERewatchMaxDelay != time.Minute {
+		t.Fatalf("unexpected rewatch timings: %#v", cfg)
+	}
+
+	t.Setenv("SSE_REWATCH_MAX_DELAY", "1s")
+	if _, err := FromEnv(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestFromEnv_ResponseCacheSize(t *testing.T) {
+	t.Setenv("ETCD_ENDPOINTS", "http://127.0.0.1:2379")
+	t.Setenv("RESPONSE_CACHE_SIZE", "")
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.ResponseCacheSize != 10000 {
+		t.Fatalf("unexpected default: %d", cfg.ResponseCacheSize)
+	}
+
+	t.Setenv("RESPONSE_CACHE_SIZE", "0")
+	if cfg, err = FromEnv(); err != nil || cfg.ResponseCacheSize != 0 {
+		t.Fatalf("unexpected result: %d, %v", cfg.ResponseCacheSize, err)
+	}
+
+	t.Setenv("RESPONSE_CACHE_SIZE", "-1")
+	if _, err := FromEnv(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestFromEnv_StaleIfError(t *testing.T) {
+	t.Setenv("ETCD_ENDPOINTS", "http://127.0.0.1:2379")
+	t.Setenv("STALE_IF_ERROR", "")
+	t.Setenv("SNAPSHOT_DIR", "/var/lib/wg-feed/snapshots")
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.StaleIfError || cfg.SnapshotDir != "/var/lib/wg-feed/snapshots" {
+		t.Fatalf("unexpected config: %#v", cfg)
+	}
+
+	t.Setenv("STALE_IF_ERROR", "false")
+	if cfg, err = FromEnv(); err != nil || cfg.StaleIfError {
+		t.Fatalf("unexpected result: %v, %v", cfg.StaleIfError, err)
+	}
+
+	t.Setenv("STALE_IF_ERROR", "maybe")
+	if _, err := FromEnv(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestFromEnv_MetricsPort(t *testing.T) {
+	t.Setenv("ETCD_ENDPOINTS", "http://127.0.0.1:2379")
+	t.Setenv("SERVER_PORT", "")
+	t.Setenv("METRICS_PORT", "9090")
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.MetricsPort != "9090" || cfg.ReadyTimeout != 2*time.Second {
+		t.Fatalf("unexpected config: %#v", cfg)
+	}
+
+	t.Setenv("METRICS_PORT", "8080")
+	if _, err := FromEnv(); err == nil {
+		t.Fatalf("expected error for port clash")
+	}
+}
+
+func TestFromEnv_Admin(t *testing.T) {
+	t.Setenv("ETCD_ENDPOINTS", "http://127.0.0.1:2379")
+	t.Setenv("SERVER_PORT", "")
+	t.Setenv("METRICS_PORT", "")
+	t.Setenv("ADMIN_PORT", "8443")
+	t.Setenv("ADMIN_TOKEN", "short")
+	if _, err := FromEnv(); err == nil {
+		t.Fatalf("expected error for short token")
+	}
+
+	t.Setenv("ADMIN_TOKEN", "0123456789abcdef")
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.AdminPort != "8443" || cfg.AdminToken != "0123456789abcdef" {
+		t.Fatalf("unexpected admin config: %#v", cfg)
+	}
+
+	t.Setenv("ADMIN_PORT", "8080")
+	if _, err := FromEnv(); err == nil {
+		t.Fatalf("expected error for port clash")
+	}
+}
+
+func TestFromEnv_FeedKeySecret(t *testing.T) {
+	t.Setenv("ETCD_ENDPOINTS", "http://127.0.0.1:2379")
+	t.Setenv("FEED_KEY_SECRET", "")
+
+	cfg, err := FromEnv()
+	if err != nil || cfg.FeedKeySecret != nil {
+		t.Fatalf("unexpected result: %q, %v", cfg.FeedKeySecret, err)
+	}
+
+	t.Setenv("FEED_KEY_SECRET", "MDEyMzQ1Njc4OWFiY2RlZg==")
+	if cfg, err = FromEnv(); err != nil || string(cfg.FeedKeySecret) != "0123456789abcdef" {
+		t.Fatalf("unexpected result: %q, %v", cfg.FeedKeySecret, err)
+	}
+
+	t.Setenv("FEED_KEY_SECRET", "c2hvcnQ=")
+	if _, err := FromEnv(); err == nil {
+		t.Fatalf("expected error for short secret")
+	}
+}
@@ -0,0 +1,186 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/exeteres/wg-feed/internal/model"
+)
+
+// accessError describes why a request was denied, using wg-feed error semantics.
+type accessError struct {
+	status    int
+	message   string
+	retriable bool
+}
+
+// authorize enforces the optional access policy stored under wg-feed/policies/<feedPath>
+// (or its derived key, see Options.FeedKeys) on a request. SSE streams re-check
+// it whenever the policy changes and on every heartbeat. Feeds without a policy are protected only by their path.
+func (h *Handler) authorize(ctx context.Context, r *http.Request, feedPath string) *accessError {
+	p, aerr := h.loadPolicy(ctx, feedPath)
+	if aerr != nil || !p.found {
+		return aerr
+	}
+	policy := p.policy
+
+	token := requestToken(r)
+	if token == "" {
+		return &accessError{status: http.StatusUnauthorized, message: "access token required", retriable: false}
+	}
+	if !policyAcceptsToken(policy, feedPath, token) {
+		// Revoked and unknown tokens are indistinguishable by design; neither will start working on retry.
+		return &accessError{status: http.StatusForbidden, message: "access token rejected", retriable: false}
+	}
+	return nil
+}
+
+// loadPolicy returns the access policy of feedPath, from the policy cache when possible.
+func (h *Handler) loadPolicy(ctx context.Context, feedPath string) (cachedPolicy, *accessError) {
+	key := h.opts.FeedKeys.PolicyKey(feedPath)
+	if h.policies != nil {
+		if p, ok := h.policies.get(key); ok {
+			return p, nil
+		}
+	}
+
+	body, rev, ok, err := h.readWithRevision(ctx, "policy", key)
+	if err != nil {
+		snap, found := h.snapshots.lookup(key)
+		if !found {
+			h.logger.Printf("etcd get failed feedPath=%q key=%q err=%v", feedPath, key, err)
+			return cachedPolicy{}, &accessError{status: http.StatusInternalServerError, message: "internal error", retriable: true}
+		}
+		h.logger.Printf("etcd get failed feedPath=%q key=%q err=%v; using last known policy", feedPath, key, err)
+		body, ok = snap.Body, snap.Found
+		rev = 0
+	} else if ok {
+		h.snapshots.record(snapshot{Key: key, Found: true, Body: body})
+	} else if _, served := h.snapshots.lookup(h.opts.FeedKeys.FeedKey(feedPath)); served {
+		// The absence of a policy is only recorded for feeds that have been
+		// served, so that requests for random paths leave nothing behind.
+		h.snapshots.record(snapshot{Key: key})
+	} else {
+		h.snapshots.remove(key)
+	}
+
+	p := cachedPolicy{found: ok}
+	if ok {
+		if p.policy, err = decodeAndValidatePolicy(body); err != nil {
+			h.logger.Printf("access policy invalid feedPath=%q key=%q err=%v", feedPath, key, err)
+			return cachedPolicy{}, &accessError{status: http.StatusInternalServerError, message: "invalid access policy", retriable: true}
+		}
+	}
+	if h.policies != nil && rev > 0 {
+		h.hub.cachePolicy(key, rev, p)
+	}
+	return p, nil
+}
+
+func decodeAndValidatePolicy(body []byte) (model.AccessPolicy, error) {
+	var policy model.AccessPolicy
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if err := dec.Decode(&policy); err != nil {
+		return model.AccessPolicy{}, fmt.Errorf("decode policy: %w", err)
+	}
+	if err := policy.Validate(); err != nil {
+		return model.AccessPolicy{}, fmt.Errorf("validate policy: %w", err)
+	}
+	return policy, nil
+}
+
+// requestToken returns the bearer token, falling back to the "token" query parameter.
+func requestToken(r *http.Request) string {
+	if auth := strings.TrimSpace(r.Header.Get("Authorization")); auth != "" {
+		scheme, token, ok := strings.Cut(auth, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return strings.TrimSpace(r.URL.Query().Get("token"))
+}
+
+// policyAcceptsToken compares token against every policy entry in constant time.
+func policyAcceptsToken(policy model.AccessPolicy, feedPath, token string) bool {
+	accepted := 0
+
+	sum := sha256.Sum256([]byte(token))
+	for _, t := range policy.Tokens {
+		want, err := hex.DecodeString(t.SHA256)
+		if err != nil {
+			continue
+		}
+		accepted |= subtle.ConstantTimeCompare(sum[:], want)
+	}
+
+	presented, err := hex.DecodeString(token)
+	if err != nil {
+		presented = nil
+	}
+	for _, k := range policy.HMACKeys {
+		secret, err := base64.StdEncoding.DecodeString(k.Secret)
+		if err != nil {
+			continue
+		}
+		mac := hmac.New(sha256.New, secret)
+		_, _ = mac.Write([]byte(feedPath))
+		if hmac.Equal(mac.Sum(nil), presented) {
+			accepted = 1
+		}
+	}
+
+	return accepted == 1
+}
+
+// cachedPolicy is the access policy of a feed as last read from the store;
+// found is false for a feed without one.
+type cachedPolicy struct {
+	policy model.AccessPolicy
+	found  bool
+}
+
+// policyCache is an LRU of access policies keyed by store key, feeds without
+// a policy included. Like responseCache, entries are only admitted and
+// invalidated through the hub.
+type policyCache struct {
+	mu      sync.Mutex
+	entries *lru[cachedPolicy]
+}
+
+func newPolicyCache(max int) *policyCache {
+	return &policyCache{entries: newLRU[cachedPolicy](max)}
+}
+
+func (c *policyCache) get(key string) (cachedPolicy, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries.get(key)
+}
+
+func (c *policyCache) put(key string, p cachedPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.put(key, p)
+}
+
+func (c *policyCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.remove(key)
+}
+
+func (c *policyCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.clear()
+}
@@ -0,0 +1,199 @@
+package httpapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/exeteres/wg-feed/internal/model"
+)
+
+type memStore struct {
+	values map[string][]byte
+	errs   map[string]error
+}
+
+func (s *memStore) Get(_ context.Context, key string) ([]byte, bool, error) {
+	if err := s.errs[key]; err != nil {
+		return nil, false, err
+	}
+	v, ok := s.values[key]
+	return v, ok, nil
+}
+
+const testEntryJSON = `{
+	"revision": "rev-1",
+	"ttl_seconds": 60,
+	"encrypted": false,
+	"data": {
+		"id": "11111111-1111-4111-8111-111111111111",
+		"endpoints": ["https://example.invalid/client-a"],
+		"display_info": {"title": "Example"},
+		"tunnels": []
+	}
+}`
+
+func newTestHandler(st getter) *Handler {
+	return NewHandler(st, log.New(io.Discard, "", 0), Options{})
+}
+
+func serveTestRequest(t *testing.T, h *Handler, target string, header http.Header) (*http.Response, model.ErrorResponse) {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Set("Accept", "application/json")
+	for k, vs := range header {
+		for _, v := range vs {
+			r.Header.Add(k, v)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	resp := w.Result()
+	var er model.ErrorResponse
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotModified {
+		if err := json.NewDecoder(resp.Body).Decode(&er); err != nil {
+			t.Fatalf("decode error response: %v", err)
+		}
+	}
+	return resp, er
+}
+
+func TestHandler_AccessPolicy(t *testing.T) {
+	t.Parallel()
+
+	tokenSum := sha256.Sum256([]byte("s3cret"))
+	hmacSecret := []byte("0123456789abcdef")
+	mac := hmac.New(sha256.New, hmacSecret)
+	_, _ = mac.Write([]byte("client-a"))
+	hmacToken := hex.EncodeToString(mac.Sum(nil))
+
+	policy := `{
+		"tokens": [{"id": "ops", "sha256": "` + hex.EncodeToString(tokenSum[:]) + `"}],
+		"hmac_keys": [{"id": "k1", "secret": "MDEyMzQ1Njc4OWFiY2RlZg=="}]
+	}`
+	st := &memStore{values: map[string][]byte{
+		"wg-feed/feeds/client-a":    []byte(testEntryJSON),
+		"wg-feed/policies/client-a": []byte(policy),
+		"wg-feed/feeds/open":        []byte(testEntryJSON),
+	}}
+
+	h := newTestHandler(st)
+
+	cases := []struct {
+		name          string
+		target        string
+		authorization string
+		wantStatus    int
+		wantRetriable bool
+	}{
+		{name: "no policy", target: "/open", wantStatus: http.StatusOK},
+		{name: "missing token", target: "/client-a", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", target: "/client-a?token=nope", wantStatus: http.StatusForbidden},
+		{name: "bearer token", target: "/client-a", authorization: "Bearer s3cret", wantStatus: http.StatusOK},
+		{name: "query token", target: "/client-a?token=s3cret", wantStatus: http.StatusOK},
+		{name: "hmac token", target: "/client-a?token=" + hmacToken, wantStatus: http.StatusOK},
+		{name: "hmac token for other path", target: "/client-a?token=" + strings.Repeat("0", 64), wantStatus: http.StatusForbidden},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			header := http.Header{}
+			if tc.authorization != "" {
+				header.Set("Authorization", tc.authorization)
+			}
+			resp, er := serveTestRequest(t, h, tc.target, header)
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("status = %d, want %d (message=%q)", resp.StatusCode, tc.wantStatus, er.Message)
+			}
+			if tc.wantStatus != http.StatusOK && er.Retriable != tc.wantRetriable {
+				t.Fatalf("retriable = %v, want %v", er.Retriable, tc.wantRetriable)
+			}
+		})
+	}
+}
+
+func TestHandler_AccessPolicyStoreOutageIsRetriable(t *testing.T) {
+	t.Parallel()
+
+	st := &memStore{
+		values: map[string][]byte{"wg-feed/feeds/client-a": []byte(testEntryJSON)},
+		errs:   map[string]error{"wg-feed/policies/client-a": errors.New("etcd unavailable")},
+	}
+	resp, er := serveTestRequest(t, newTestHandler(st), "/client-a?token=s3cret", nil)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+	if !er.Retriable {
+		t.Fatalf("expected retriable error")
+	}
+}
+
+func TestHandler_PolicyCacheInvalidatedByWatch(t *testing.T) {
+	t.Parallel()
+
+	const policyKey = "wg-feed/policies/client-a"
+	st := &revStore{
+		values:        map[string][]byte{"wg-feed/feeds/client-a": []byte(testEntryJSON)},
+		rev:           1,
+		policyWatches: make(chan revWatch, 1),
+		gets:          map[string]int{},
+	}
+	h := newTestHandler(st)
+	defer h.Close()
+
+	status := func(target string) int {
+		t.Helper()
+		resp, _ := serveTestRequest(t, h, target, nil)
+		return resp.StatusCode
+	}
+	policyGets := func() int {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		return st.gets[policyKey]
+	}
+
+	// The absence of a policy is cached too.
+	for range 3 {
+		if got := status("/client-a"); got != http.StatusOK {
+			t.Fatalf("unexpected status: %d", got)
+		}
+	}
+	if got := policyGets(); got != 1 {
+		t.Fatalf("policy read %d times, want 1", got)
+	}
+
+	w := <-st.policyWatches
+	tokenSum := sha256.Sum256([]byte("s3cret"))
+	w.ch <- st.put(policyKey, []byte(`{"tokens": [{"id": "ops", "sha256": "`+hex.EncodeToString(tokenSum[:])+`"}]}`))
+	deadline := time.Now().Add(5 * time.Second)
+	for status("/client-a") != http.StatusUnauthorized {
+		if time.Now().After(deadline) {
+			t.Fatalf("policy cache was not invalidated by the watch")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	reads := policyGets()
+	for range 3 {
+		if got := status("/client-a?token=s3cret"); got != http.StatusOK {
+			t.Fatalf("unexpected status with token: %d", got)
+		}
+	}
+	if got := policyGets(); got != reads {
+		t.Fatalf("policy read %d more times, want cached", got-reads)
+	}
+}
@@ -0,0 +1,90 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/exeteres/wg-feed/internal/model"
+)
+
+func aliasEntry(target string) []byte {
+	return []byte(`{"revision": "alias-1", "alias_of": "` + target + `"}`)
+}
+
+func TestHandler_Alias(t *testing.T) {
+	t.Parallel()
+
+	st := &revStore{values: map[string][]byte{
+		"wg-feed/feeds/new/client-a": []byte(testEntryJSON),
+		"wg-feed/feeds/old/client-a": aliasEntry("new/client-a"),
+		"wg-feed/feeds/old/chained":  aliasEntry("old/client-a"),
+		"wg-feed/feeds/old/dangling": aliasEntry("new/missing"),
+		"wg-feed/feeds/old/retired":  []byte(`{"revision": "alias-2", "revoked": true, "message": "moved to https://feeds.example.com"}`),
+	}}
+	h := newTestHandler(st)
+
+	resp, _ := serveTestRequest(t, h, "/old/client-a", nil)
+	var sr model.SuccessResponse
+	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"rev-1"` || sr.Revision != "rev-1" || sr.Data == nil {
+		t.Fatalf("alias: status=%d etag=%q response=%+v", resp.StatusCode, resp.Header.Get("ETag"), sr)
+	}
+
+	if resp, er := serveTestRequest(t, h, "/old/chained", nil); resp.StatusCode != http.StatusInternalServerError || !er.Retriable {
+		t.Fatalf("alias of alias: status=%d error=%+v", resp.StatusCode, er)
+	}
+	if resp, er := serveTestRequest(t, h, "/old/dangling", nil); resp.StatusCode != http.StatusNotFound || er.Retriable {
+		t.Fatalf("dangling alias: status=%d error=%+v", resp.StatusCode, er)
+	}
+	if resp, er := serveTestRequest(t, h, "/old/retired", nil); resp.StatusCode != http.StatusGone || er.Retriable || !strings.Contains(er.Message, "moved to") {
+		t.Fatalf("retired alias: status=%d error=%+v", resp.StatusCode, er)
+	}
+}
+
+func TestServeSSE_Alias(t *testing.T) {
+	t.Parallel()
+
+	st := &revStore{
+		values: map[string][]byte{
+			"wg-feed/feeds/new/client-a": entryWithRevision("a-1"),
+			"wg-feed/feeds/old/client-a": aliasEntry("new/client-a"),
+		},
+		rev:     1,
+		watches: make(chan revWatch, 4),
+	}
+	srv := httptest.NewServer(newTestHandler(st))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r := openSSE(t, ctx, srv.URL+"/old/client-a")
+	if rev := readFeedRevision(t, r); rev != "a-1" {
+		t.Fatalf("unexpected initial revision %q", rev)
+	}
+	w := <-st.watches
+
+	// Updates of the target are streamed through the alias.
+	w.ch <- st.put("wg-feed/feeds/new/client-a", entryWithRevision("a-2"))
+	if rev := readFeedRevision(t, r); rev != "a-2" {
+		t.Fatalf("unexpected revision %q", rev)
+	}
+
+	// Retiring the alias ends the stream with its message.
+	w.ch <- st.put("wg-feed/feeds/old/client-a", []byte(`{"revision": "alias-2", "revoked": true, "message": "feed has moved"}`))
+	frame := readSSEFrame(t, r)
+	if len(frame) != 2 || frame[0] != "event: error" || !strings.Contains(frame[1], "feed has moved") {
+		t.Fatalf("unexpected frame: %q", frame)
+	}
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Fatalf("expected retired alias stream to end, got %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package httpapi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+
+	"github.com/exeteres/wg-feed/internal/model"
+)
+
+// ciphertextCache memoizes server-side age encryption of entries that carry
+// plaintext data plus recipients.
+//
+// age encryption is randomized, so caching per revision also keeps
+// encrypted_data stable across requests: clients that cache ciphertext
+// verbatim see the same payload until the revision changes.
+type ciphertextCache struct {
+	max int
+
+	mu    sync.Mutex
+	order []string
+	items map[string]*cachedCiphertext
+}
+
+type cachedCiphertext struct {
+	once sync.Once
+	data string
+	err  error
+}
+
+func newCiphertextCache(max int) *ciphertextCache {
+	return &ciphertextCache{max: max, items: map[string]*cachedCiphertext{}}
+}
+
+func (c *ciphertextCache) encrypt(entry model.FeedEntry) (string, error) {
+	key := ciphertextCacheKey(entry)
+
+	c.mu.Lock()
+	item, ok := c.items[key]
+	if !ok {
+		item = &cachedCiphertext{}
+		c.items[key] = item
+		c.order = append(c.order, key)
+		for len(c.order) > c.max {
+			delete(c.items, c.order[0])
+			c.order = c.order[1:]
+		}
+	}
+	c.mu.Unlock()
+
+	// Failures (e.g. a malformed recipient) are deterministic, so they are cached too.
+	item.once.Do(func() {
+		item.data, item.err = encryptFeedDocument(entry.Data, entry.Recipients)
+	})
+	return item.data, item.err
+}
+
+// ciphertextCacheKey identifies the ciphertext by revision and recipient set,
+// so changing recipients without changing the document yields a fresh payload.
+func ciphertextCacheKey(entry model.FeedEntry) string {
+	h := sha256.New()
+	_, _ = h.Write([]byte(entry.Revision))
+	for _, r := range entry.Recipients {
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(strings.TrimSpace(r)))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func encryptFeedDocument(doc *model.FeedDocument, rawRecipients []string) (string, error) {
+	recipients := make([]age.Recipient, 0, len(rawRecipients))
+	for i, raw := range rawRecipients {
+		r, err := age.ParseX25519Recipient(strings.TrimSpace(raw))
+		if err != nil {
+			return "", fmt.Errorf("recipients[%d]: %w", i, err)
+		}
+		recipients = append(recipients, r)
+	}
+
+	pt, err := json.Marshal(doc)
+	if err != nil {
+		return "", fmt.Errorf("encode feed document: %w", err)
+	}
+
+	var buf bytes.Buffer
+	aw := armor.NewWriter(&buf)
+	w, err := age.Encrypt(aw, recipients...)
+	if err != nil {
+		return "", fmt.Errorf("encrypt feed document: %w", err)
+	}
+	if _, err := w.Write(pt); err != nil {
+		return "", fmt.Errorf("encrypt feed document: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("encrypt feed document: %w", err)
+	}
+	if err := aw.Close(); err != nil {
+		return "", fmt.Errorf("encrypt feed document: %w", err)
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,75 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+
+	"github.com/exeteres/wg-feed/internal/model"
+)
+
+func TestHandler_EncryptsPlaintextEntryForRecipients(t *testing.T) {
+	t.Parallel()
+
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("GenerateX25519Identity: %v", err)
+	}
+	entry := `{
+		"revision": "plain-rev",
+		"ttl_seconds": 60,
+		"encrypted": true,
+		"recipients": ["` + id.Recipient().String() + `"],
+		"data": {
+			"id": "11111111-1111-4111-8111-111111111111",
+			"endpoints": ["https://example.invalid/client-a"],
+			"display_info": {"title": "Example"},
+			"tunnels": []
+		}
+	}`
+	h := newTestHandler(&memStore{values: map[string][]byte{"wg-feed/feeds/client-a": []byte(entry)}})
+
+	fetch := func() model.SuccessResponse {
+		resp, er := serveTestRequest(t, h, "/client-a", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status %d: %q", resp.StatusCode, er.Message)
+		}
+		if got := resp.Header.Get("ETag"); got != `"plain-rev"` {
+			t.Fatalf("unexpected ETag: %q", got)
+		}
+		var sr model.SuccessResponse
+		if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return sr
+	}
+
+	first := fetch()
+	if !first.Encrypted || first.Data != nil || first.Revision != "plain-rev" {
+		t.Fatalf("unexpected response: %#v", first)
+	}
+	if second := fetch(); second.EncryptedData != first.EncryptedData {
+		t.Fatalf("expected ciphertext to be cached per revision")
+	}
+
+	r, err := age.Decrypt(armor.NewReader(strings.NewReader(first.EncryptedData)), id)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	pt, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	var doc model.FeedDocument
+	if err := json.Unmarshal(pt, &doc); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if doc.ID != "11111111-1111-4111-8111-111111111111" {
+		t.Fatalf("unexpected document: %#v", doc)
+	}
+}
@@ -0,0 +1,40 @@
+package httpapi
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/exeteres/wg-feed/internal/enrollment"
+	"github.com/exeteres/wg-feed/internal/model"
+)
+
+// serveEnrollment registers the public key of a client posted to
+// /_enroll/<feed path> (see package enrollment). The request is authorized
+// like a request for the feed path.
+func (h *Handler) serveEnrollment(w http.ResponseWriter, r *http.Request, feedPath, key string) {
+	st, ok := h.store.(enrollment.Store)
+	if !ok || !h.opts.Enrollment {
+		h.writeError(w, http.StatusNotFound, "enrollment is not enabled", false)
+		return
+	}
+	var req model.EnrollmentRequest
+	if _, ok := h.readFeedPost(w, r, feedPath, key, &req); !ok {
+		return
+	}
+
+	created, err := enrollment.Enroll(r.Context(), st, h.opts.FeedKeys.ID(feedPath), req, time.Now())
+	if errors.Is(err, enrollment.ErrConflict) {
+		h.writeError(w, http.StatusConflict, err.Error(), false)
+		return
+	}
+	if err != nil {
+		h.logger.Printf("enrollment failed feedPath=%q device=%q err=%v", feedPath, req.DeviceID, err)
+		h.writeError(w, http.StatusInternalServerError, "internal error", true)
+		return
+	}
+	if created {
+		h.logger.Printf("enrolled device=%q public_key=%q", req.DeviceID, req.PublicKey)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
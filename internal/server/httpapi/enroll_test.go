@@ -0,0 +1,65 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"testing"
+
+	"github.com/exeteres/wg-feed/internal/enrollment"
+)
+
+func enrollmentBody(publicKey string) string {
+	return `{
+	"version": "wg-feed-00",
+	"device_id": "device-1",
+	"feed_id": "11111111-1111-4111-8111-111111111111",
+	"public_key": "` + publicKey + `"
+}`
+}
+
+func TestHandler_Enrollment(t *testing.T) {
+	t.Parallel()
+
+	const (
+		keyA = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+		keyB = "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw="
+	)
+	st := &casStore{memStore{values: map[string][]byte{
+		"wg-feed/feeds/team/client-a": []byte(testEntryJSON),
+	}}}
+
+	if code := postStatusReport(newTestHandler(st), "/_enroll/team/client-a", enrollmentBody(keyA)); code != http.StatusNotFound {
+		t.Fatalf("enrollment disabled: status = %d", code)
+	}
+
+	h := NewHandler(st, log.New(io.Discard, "", 0), Options{Enrollment: true})
+	for _, step := range []struct {
+		target, key string
+		want        int
+	}{
+		{"/_enroll/team/client-a", keyA, http.StatusNoContent},
+		{"/_enroll/team/client-a", keyA, http.StatusNoContent},
+		{"/_enroll/team/client-a", keyB, http.StatusConflict},
+		{"/_enroll/team/missing", keyA, http.StatusNotFound},
+		{"/_enroll/team/client-a", "short", http.StatusBadRequest},
+	} {
+		if code := postStatusReport(h, step.target, enrollmentBody(step.key)); code != step.want {
+			t.Fatalf("%s with %s: status = %d, want %d", step.target, step.key, code, step.want)
+		}
+	}
+
+	var rec enrollment.Record
+	if err := json.Unmarshal(st.values[enrollment.Key("device-1", "team/client-a")], &rec); err != nil {
+		t.Fatalf("decode stored enrollment: %v", err)
+	}
+	if rec.PublicKey != keyA {
+		t.Fatalf("unexpected stored enrollment: %+v", rec)
+	}
+
+	resp, _ := serveTestRequest(t, h, "/_enroll/team/client-a", nil)
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("GET: status = %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,119 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/exeteres/wg-feed/internal/model"
+)
+
+// expiringEntry returns testEntryJSON with the given warn_after and not_after (zero times are omitted).
+func expiringEntry(warnAfter, notAfter time.Time) []byte {
+	fields := `"ttl_seconds": 60,`
+	if !warnAfter.IsZero() {
+		fields += ` "warn_after": "` + warnAfter.Format(time.RFC3339Nano) + `",`
+	}
+	if !notAfter.IsZero() {
+		fields += ` "not_after": "` + notAfter.Format(time.RFC3339Nano) + `",`
+	}
+	return []byte(strings.Replace(testEntryJSON, `"ttl_seconds": 60,`, fields, 1))
+}
+
+func TestHandler_Expiry(t *testing.T) {
+	t.Parallel()
+
+	warnAt := time.Now().Add(200 * time.Millisecond)
+	st := &revStore{values: map[string][]byte{
+		"wg-feed/feeds/client-a": expiringEntry(warnAt, time.Time{}),
+		"wg-feed/feeds/client-b": expiringEntry(time.Time{}, time.Now().Add(-time.Second)),
+	}}
+	h := newTestHandler(st)
+
+	if resp, _ := serveTestRequest(t, h, "/client-a", nil); resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"rev-1"` {
+		t.Fatalf("before warn_after: status=%d etag=%q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	time.Sleep(time.Until(warnAt))
+
+	// The cached response goes stale at warn_after.
+	resp, _ := serveTestRequest(t, h, "/client-a", nil)
+	var sr model.SuccessResponse
+	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.Header.Get("ETag") == `"rev-1"` || sr.Revision == "rev-1" || sr.Data == nil || sr.Data.Warning != "This subscription is about to expire." {
+		t.Fatalf("after warn_after: etag=%q response=%+v", resp.Header.Get("ETag"), sr)
+	}
+
+	resp, er := serveTestRequest(t, h, "/client-b", nil)
+	if resp.StatusCode != http.StatusGone || er.Retriable || er.Message != expiredMessage {
+		t.Fatalf("after not_after: status=%d error=%+v", resp.StatusCode, er)
+	}
+}
+
+func TestServeSSE_Expiry(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	st := &revStore{values: map[string][]byte{
+		"wg-feed/feeds/client-a": expiringEntry(now.Add(200*time.Millisecond), now.Add(400*time.Millisecond)),
+	}}
+	srv := httptest.NewServer(newTestHandler(st))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r := openSSE(t, ctx, srv.URL+"/client-a")
+	if rev := readFeedRevision(t, r); rev != "rev-1" {
+		t.Fatalf("unexpected initial revision %q", rev)
+	}
+	if rev := readFeedRevision(t, r); rev == "rev-1" {
+		t.Fatalf("no new revision at warn_after")
+	}
+	frame := readSSEFrame(t, r)
+	if len(frame) != 2 || frame[0] != "event: error" || !strings.Contains(frame[1], expiredMessage) {
+		t.Fatalf("unexpected frame at not_after: %q", frame)
+	}
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Fatalf("expected expired stream to end, got %v", err)
+	}
+}
+
+func TestHandler_StaleSnapshotHonorsWarnAfter(t *testing.T) {
+	t.Parallel()
+
+	warnAt := time.Now().Add(200 * time.Millisecond)
+	st := &memStore{values: map[string][]byte{
+		"wg-feed/feeds/client-a": expiringEntry(warnAt, time.Time{}),
+	}}
+	h := newTestHandler(st)
+
+	if resp, _ := serveTestRequest(t, h, "/client-a", nil); resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"rev-1"` {
+		t.Fatalf("before warn_after: status=%d etag=%q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	time.Sleep(time.Until(warnAt))
+
+	// The snapshot lacks the warning, so it is not served past warn_after.
+	st.errs = map[string]error{"wg-feed/feeds/client-a": errors.New("etcd unavailable")}
+	if resp, er := serveTestRequest(t, h, "/client-a", nil); resp.StatusCode != http.StatusInternalServerError || !er.Retriable {
+		t.Fatalf("outdated snapshot: status=%d error=%+v", resp.StatusCode, er)
+	}
+
+	st.errs = nil
+	resp, _ := serveTestRequest(t, h, "/client-a", nil)
+	warned := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || warned == `"rev-1"` {
+		t.Fatalf("after warn_after: status=%d etag=%q", resp.StatusCode, warned)
+	}
+	st.errs = map[string]error{"wg-feed/feeds/client-a": errors.New("etcd unavailable")}
+	if resp, _ := serveTestRequest(t, h, "/client-a", nil); resp.StatusCode != http.StatusOK || resp.Header.Get(staleHeader) != "true" || resp.Header.Get("ETag") != warned {
+		t.Fatalf("warned snapshot: status=%d etag=%q stale=%q", resp.StatusCode, resp.Header.Get("ETag"), resp.Header.Get(staleHeader))
+	}
+}
@@ -4,15 +4,20 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/exeteres/wg-feed/internal/atrest"
+	"github.com/exeteres/wg-feed/internal/enrollment"
+	"github.com/exeteres/wg-feed/internal/feedkey"
 	"github.com/exeteres/wg-feed/internal/model"
-	"go.etcd.io/etcd/api/v3/mvccpb"
+	"github.com/exeteres/wg-feed/internal/server/metrics"
+	"github.com/exeteres/wg-feed/internal/setuplink"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
@@ -24,31 +29,188 @@ type watcher interface {
 	Watch(ctx context.Context, key string) clientv3.WatchChan
 }
 
+// revisionWatcher is implemented by stores that can resume a watch at a given
+// store revision (etcd), so that no update is missed between reconnects.
+// SSE streams on such stores share prefix watches (see hub).
+type revisionWatcher interface {
+	GetWithRevision(ctx context.Context, key string) ([]byte, int64, bool, error)
+	WatchFromRevision(ctx context.Context, key string, rev int64, opts ...clientv3.OpOption) clientv3.WatchChan
+}
+
+// Options tunes Handler behavior. Zero values select the defaults.
+type Options struct {
+	// SSEHeartbeatInterval is how often an SSE comment is sent on idle streams
+	// so that proxies and load balancers do not cut them.
+	SSEHeartbeatInterval time.Duration
+	// SSERetry is sent as the SSE retry: field (client reconnection delay).
+	SSERetry time.Duration
+	// SSERewatchDelay is the initial delay before re-establishing a failed
+	// store watch; it doubles on consecutive failures up to SSERewatchMaxDelay.
+	SSERewatchDelay    time.Duration
+	SSERewatchMaxDelay time.Duration
+	// ResponseCacheSize bounds the number of feeds whose rendered JSON response,
+	// and separately whose access policy, is cached (stores with revisions
+	// only). Negative disables both caches.
+	ResponseCacheSize int
+	// DisableStaleIfError turns off serving last-known-good snapshots while the store is unavailable.
+	DisableStaleIfError bool
+	// SnapshotDir, when set, persists last-known-good snapshots so they survive
+	// restarts. With AtRest set, their bodies are sealed.
+	SnapshotDir string
+	// SnapshotLimit bounds the number of last-known-good snapshots (feeds and
+	// policies); the least recently used are dropped.
+	SnapshotLimit int
+	// Metrics receives request, store and SSE metrics; nil records nothing.
+	Metrics *metrics.Metrics
+	// ReadyTimeout bounds the store check of ServeReadyz.
+	ReadyTimeout time.Duration
+	// FeedKeys maps feed paths to store keys; nil stores them under the plain path.
+	FeedKeys *feedkey.Deriver
+	// AtRest opens sealed feed entries; nil only reads entries that are not sealed.
+	AtRest *atrest.Keyring
+	// StatusReports accepts client status reports POSTed to feed paths (see package status).
+	StatusReports bool
+	// StatusReportLimit bounds the number of devices whose report is kept per
+	// feed (see status.Put); 0 defaults to 1000, negative keeps all.
+	StatusReportLimit int
+	// Enrollment accepts client public keys POSTed to /_enroll/<feed path> (see package enrollment).
+	Enrollment bool
+}
+
+func (o Options) withDefaults() Options {
+	if o.SSEHeartbeatInterval <= 0 {
+		o.SSEHeartbeatInterval = 15 * time.Second
+	}
+	if o.SSERetry <= 0 {
+		o.SSERetry = 5 * time.Second
+	}
+	if o.SSERewatchDelay <= 0 {
+		o.SSERewatchDelay = time.Second
+	}
+	if o.SSERewatchMaxDelay < o.SSERewatchDelay {
+		o.SSERewatchMaxDelay = max(30*time.Second, o.SSERewatchDelay)
+	}
+	if o.ReadyTimeout <= 0 {
+		o.ReadyTimeout = 2 * time.Second
+	}
+	if o.ResponseCacheSize == 0 {
+		o.ResponseCacheSize = 10000
+	}
+	if o.SnapshotLimit <= 0 {
+		o.SnapshotLimit = 20000
+	}
+	if o.StatusReportLimit == 0 {
+		o.StatusReportLimit = 1000
+	}
+	return o
+}
+
 type Handler struct {
-	store  getter
-	logger *log.Logger
+	store       getter
+	logger      *log.Logger
+	opts        Options
+	ciphertexts *ciphertextCache
+	hub         *hub
+	cache       *responseCache
+	policies    *policyCache
+	snapshots   *lastKnownGood
 }
 
-func NewHandler(store getter, logger *log.Logger) *Handler {
-	return &Handler{store: store, logger: logger}
+func NewHandler(store getter, logger *log.Logger, opts Options) *Handler {
+	h := &Handler{
+		store:       store,
+		logger:      logger,
+		opts:        opts.withDefaults(),
+		ciphertexts: newCiphertextCache(1024),
+	}
+	if !h.opts.DisableStaleIfError {
+		h.snapshots = newLastKnownGood(h.opts.SnapshotDir, h.opts.SnapshotLimit, h.opts.AtRest, logger)
+	}
+	if rw, ok := store.(revisionWatcher); ok {
+		if h.opts.ResponseCacheSize > 0 {
+			h.cache = newResponseCache(h.opts.ResponseCacheSize)
+			h.policies = newPolicyCache(h.opts.ResponseCacheSize)
+		}
+		h.hub = newHub(rw, h.renderFeedEvent, h.cache, h.policies, logger, h.opts)
+	}
+	if h.cache != nil {
+		h.opts.Metrics.RegisterResponseCache(func() (uint64, uint64, int) {
+			stats := h.cache.stats()
+			return stats.Hits, stats.Misses, stats.Entries
+		})
+	}
+	return h
+}
+
+// Close stops the shared store watch. Open SSE streams keep running until their requests end.
+func (h *Handler) Close() {
+	if h.hub != nil {
+		h.hub.close()
+	}
+}
+
+// ResponseCacheStats reports JSON response cache usage; all zero when the cache is disabled.
+func (h *Handler) ResponseCacheStats() ResponseCacheStats {
+	if h.cache == nil {
+		return ResponseCacheStats{}
+	}
+	return h.cache.stats()
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+	mode := negotiateResponseMode(r)
+
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	defer func() { h.opts.Metrics.ObserveRequest(mode.String(), rec.status) }()
+	w = rec
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodPost {
 		h.writeError(w, http.StatusMethodNotAllowed, "method not allowed", false)
 		return
 	}
 
-	mode := negotiateResponseMode(r)
-
 	feedPath := strings.TrimPrefix(r.URL.Path, "/")
 	feedPath = strings.Trim(feedPath, "/")
 	if feedPath == "" {
 		h.writeError(w, http.StatusNotFound, "feed not found", false)
 		return
 	}
+	if token, ok := strings.CutPrefix(feedPath, setuplink.PathPrefix); ok {
+		if r.Method == http.MethodPost {
+			h.writeError(w, http.StatusMethodNotAllowed, "method not allowed", false)
+			return
+		}
+		h.serveSetupLink(w, r, mode, token)
+		return
+	}
+	enroll := false
+	if p, ok := strings.CutPrefix(feedPath, enrollment.PathPrefix); ok {
+		if r.Method != http.MethodPost {
+			h.writeError(w, http.StatusMethodNotAllowed, "method not allowed", false)
+			return
+		}
+		if feedPath = strings.Trim(p, "/"); feedPath == "" {
+			h.writeError(w, http.StatusNotFound, "feed not found", false)
+			return
+		}
+		enroll = true
+	}
 
-	key := "wg-feed/feeds/" + feedPath
+	key := h.opts.FeedKeys.FeedKey(feedPath)
+
+	if aerr := h.authorize(r.Context(), r, feedPath); aerr != nil {
+		h.writeError(w, aerr.status, aerr.message, aerr.retriable)
+		return
+	}
+
+	if enroll {
+		h.serveEnrollment(w, r, feedPath, key)
+		return
+	}
+	if r.Method == http.MethodPost {
+		h.serveStatusReport(w, r, feedPath, key)
+		return
+	}
 
 	if mode == responseModeSSE {
 		if r.Method != http.MethodGet {
@@ -63,12 +225,21 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-	defer cancel()
-
-	body, ok, err := h.store.Get(ctx, key)
+	resp, ok, err := h.loadResponse(r.Context(), key)
+	if errors.Is(err, errInvalidEntry) {
+		h.logger.Printf("feed entry invalid feedPath=%q key=%q err=%v", feedPath, key, err)
+		h.opts.Metrics.InvalidEntry(invalidEntryID(err))
+		h.writeError(w, http.StatusInternalServerError, "invalid feed entry", true)
+		return
+	}
 	if err != nil {
 		h.logger.Printf("etcd get failed feedPath=%q key=%q err=%v", feedPath, key, err)
+		if snap, ok := h.snapshots.lookup(key); ok && snap.Found {
+			h.opts.Metrics.StaleResponse()
+			setStaleHeaders(w, snap)
+			h.writeSuccess(w, r, cachedResponse{body: snap.Body, etag: snap.ETag})
+			return
+		}
 		h.writeError(w, http.StatusInternalServerError, "internal error", true)
 		return
 	}
@@ -76,24 +247,18 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.writeError(w, http.StatusNotFound, "feed not found", false)
 		return
 	}
-
-	entry, err := decodeAndValidateEntry(body)
-	if err != nil {
-		h.logger.Printf("feed entry invalid feedPath=%q key=%q err=%v", feedPath, key, err)
-		h.writeError(w, http.StatusInternalServerError, "invalid feed entry", true)
+	if resp.gone != "" {
+		h.writeError(w, http.StatusGone, resp.gone, false)
 		return
 	}
 
-	respBody, etag, err := entryToSuccessResponseJSON(entry)
-	if err != nil {
-		h.logger.Printf("feed entry invalid feedPath=%q key=%q err=%v", feedPath, key, err)
-		h.writeError(w, http.StatusInternalServerError, "invalid feed entry", true)
-		return
-	}
+	h.writeSuccess(w, r, resp)
+}
 
-	if strings.TrimSpace(etag) != "" {
-		w.Header().Set("ETag", etag)
-		if ifNoneMatchMatches(r.Header.Get("If-None-Match"), etag) {
+func (h *Handler) writeSuccess(w http.ResponseWriter, r *http.Request, resp cachedResponse) {
+	if strings.TrimSpace(resp.etag) != "" {
+		w.Header().Set("ETag", resp.etag)
+		if ifNoneMatchMatches(r.Header.Get("If-None-Match"), resp.etag) {
 			w.WriteHeader(http.StatusNotModified)
 			return
 		}
@@ -104,7 +269,122 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodHead {
 		return
 	}
-	_, _ = w.Write(respBody)
+	_, _ = w.Write(resp.body)
+}
+
+// staleHeader marks responses served from a last-known-good snapshot while the store is unavailable.
+const staleHeader = "Wg-Feed-Stale"
+
+func setStaleHeaders(w http.ResponseWriter, snap snapshot) {
+	w.Header().Set(staleHeader, "true")
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(snap.At).Seconds())))
+}
+
+var errInvalidEntry = errors.New("invalid feed entry")
+
+// invalidEntryError reports the feed entry stored at key as invalid; it matches errInvalidEntry.
+type invalidEntryError struct {
+	key string
+	err error
+}
+
+func (e *invalidEntryError) Error() string {
+	return fmt.Sprintf("%v: %v", errInvalidEntry, e.err)
+}
+
+func (e *invalidEntryError) Unwrap() error {
+	return errInvalidEntry
+}
+
+// entryID returns the key component of the feed entry stored at key: its feed
+// path, or its derived key with Options.FeedKeys. Invalid entries are counted
+// under it, so that JSON and SSE requests agree whichever path they came in on.
+func entryID(key string) string {
+	return strings.TrimPrefix(key, feedsPrefix)
+}
+
+// invalidEntryID returns the entryID of the entry err reports as invalid.
+func invalidEntryID(err error) string {
+	var ie *invalidEntryError
+	if errors.As(err, &ie) {
+		return entryID(ie.key)
+	}
+	return ""
+}
+
+// loadResponse returns the rendered JSON response for key, following an alias
+// to its target. Entry decoding and validation failures, and aliases of
+// aliases, wrap errInvalidEntry.
+func (h *Handler) loadResponse(ctx context.Context, key string) (cachedResponse, bool, error) {
+	resp, ok, err := h.loadEntryResponse(ctx, key)
+	if err != nil || !ok || resp.aliasOf == "" {
+		return resp, ok, err
+	}
+	target := resp.aliasOf
+	resp, ok, err = h.loadEntryResponse(ctx, target)
+	if err != nil {
+		return cachedResponse{}, false, err
+	}
+	if !ok {
+		h.snapshots.remove(key)
+		return cachedResponse{}, false, nil
+	}
+	if resp.aliasOf != "" {
+		return cachedResponse{}, false, &invalidEntryError{key: target, err: fmt.Errorf("alias target %q is an alias", target)}
+	}
+	if resp.gone != "" {
+		h.snapshots.remove(key)
+	} else {
+		h.snapshots.record(snapshot{Key: key, Found: true, Body: resp.body, ETag: resp.etag, NotAfter: resp.notAfter, WarnAfter: resp.warnAfter})
+	}
+	return resp, true, nil
+}
+
+// loadEntryResponse returns the response for the entry stored at key, from the
+// response cache when possible, without following aliases.
+func (h *Handler) loadEntryResponse(ctx context.Context, key string) (cachedResponse, bool, error) {
+	if h.cache != nil {
+		if resp, ok := h.cache.get(key); ok {
+			return resp, true, nil
+		}
+	}
+
+	body, rev, ok, err := h.getWithRevision(ctx, key)
+	if err != nil {
+		return cachedResponse{}, false, err
+	}
+	if !ok {
+		h.snapshots.remove(key)
+		return cachedResponse{}, false, nil
+	}
+	entry, err := h.decodeAndValidateEntry(body)
+	if err != nil {
+		return cachedResponse{}, false, &invalidEntryError{key: key, err: err}
+	}
+
+	now := time.Now()
+	entry, gone := servedEntry(entry, now)
+	var resp cachedResponse
+	if entry.AliasOf != "" {
+		// The alias itself has no snapshot; loadResponse records the target's response under key.
+		resp = cachedResponse{aliasOf: feedsPrefix + entry.AliasOf}
+	} else if gone != "" {
+		// A revoked or expired feed must not come back from a snapshot during an outage.
+		resp = cachedResponse{gone: gone}
+		h.snapshots.remove(key)
+	} else {
+		respBody, etag, err := h.entryToSuccessResponseJSON(entry)
+		if err != nil {
+			return cachedResponse{}, false, &invalidEntryError{key: key, err: err}
+		}
+		resp = cachedResponse{body: respBody, etag: etag, notAfter: entry.NotAfter, warnAfter: pendingWarning(entry, now)}
+		resp.until, _ = entry.NextChange(now)
+		h.snapshots.record(snapshot{Key: key, Found: true, Body: respBody, ETag: etag, NotAfter: resp.notAfter, WarnAfter: resp.warnAfter})
+	}
+	if h.cache != nil {
+		h.hub.cacheResponse(key, rev, resp)
+	}
+	return resp, true, nil
 }
 
 const (
@@ -120,6 +400,42 @@ const (
 	responseModeOther
 )
 
+func (m responseMode) String() string {
+	switch m {
+	case responseModeJSON:
+		return "json"
+	case responseModeSSE:
+		return "sse"
+	default:
+		return "other"
+	}
+}
+
+// statusRecorder captures the response status for metrics.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 func negotiateResponseMode(r *http.Request) responseMode {
 	vals := r.Header.Values("Accept")
 	// Missing/empty Accept is not treated as JSON.
@@ -168,7 +484,11 @@ func negotiateResponseMode(r *http.Request) responseMode {
 	return responseModeOther
 }
 
-func decodeAndValidateEntry(body []byte) (model.FeedEntry, error) {
+func (h *Handler) decodeAndValidateEntry(body []byte) (model.FeedEntry, error) {
+	body, err := h.opts.AtRest.Open(body)
+	if err != nil {
+		return model.FeedEntry{}, fmt.Errorf("open entry: %w", err)
+	}
 	var entry model.FeedEntry
 	dec := json.NewDecoder(bytes.NewReader(body))
 	if err := dec.Decode(&entry); err != nil {
@@ -180,8 +500,41 @@ func decodeAndValidateEntry(body []byte) (model.FeedEntry, error) {
 	return entry, nil
 }
 
-func entryToSuccessResponseJSON(entry model.FeedEntry) ([]byte, string, error) {
+// expiredMessage is the error message for feeds past their not_after.
+const expiredMessage = "subscription has expired"
+
+// servedEntry returns entry as it is served at now (see model.FeedEntry.AtTime),
+// or the message of the non-retriable error answered instead for a revoked or
+// expired feed.
+func servedEntry(entry model.FeedEntry, now time.Time) (model.FeedEntry, string) {
+	if entry.Revoked {
+		return entry, entry.Message
+	}
+	if entry.Expired(now) {
+		return entry, expiredMessage
+	}
+	return entry.AtTime(now), ""
+}
+
+// pendingWarning returns the warn_after of entry if the document served at now
+// does not carry the expiry warning yet.
+func pendingWarning(entry model.FeedEntry, now time.Time) *time.Time {
+	if entry.WarnAfter == nil || entry.Warned(now) {
+		return nil
+	}
+	return entry.WarnAfter
+}
+
+func (h *Handler) entryToSuccessResponseJSON(entry model.FeedEntry) ([]byte, string, error) {
 	if entry.Encrypted {
+		encryptedData := entry.EncryptedData
+		if len(entry.Recipients) > 0 {
+			var err error
+			encryptedData, err = h.ciphertexts.encrypt(entry)
+			if err != nil {
+				return nil, "", err
+			}
+		}
 		sr := model.SuccessResponse{
 			Version:       "wg-feed-00",
 			Success:       true,
@@ -189,7 +542,9 @@ func entryToSuccessResponseJSON(entry model.FeedEntry) ([]byte, string, error) {
 			TTLSeconds:    entry.TTLSeconds,
 			SupportsSSE:   true,
 			Encrypted:     true,
-			EncryptedData: entry.EncryptedData,
+			EncryptedData: encryptedData,
+			Sequence:      entry.Sequence,
+			Signature:     entry.Signature,
 		}
 		if err := sr.Validate(); err != nil {
 			return nil, "", err
@@ -204,6 +559,8 @@ func entryToSuccessResponseJSON(entry model.FeedEntry) ([]byte, string, error) {
 		TTLSeconds:  entry.TTLSeconds,
 		SupportsSSE: true,
 		Data:        entry.Data,
+		Sequence:    entry.Sequence,
+		Signature:   entry.Signature,
 	}
 	if err := sr.Validate(); err != nil {
 		return nil, "", err
@@ -248,107 +605,6 @@ func ifNoneMatchMatches(headerValue string, revision string) bool {
 	return false
 }
 
-func (h *Handler) serveSSE(w http.ResponseWriter, r *http.Request, feedPath, key string) {
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		h.writeError(w, http.StatusNotImplemented, "streaming not supported", true)
-		return
-	}
-
-	getCtx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-	defer cancel()
-	body, ok2, err := h.store.Get(getCtx, key)
-	if err != nil {
-		h.logger.Printf("etcd get failed feedPath=%q key=%q err=%v", feedPath, key, err)
-		h.writeError(w, http.StatusInternalServerError, "internal error", true)
-		return
-	}
-	if !ok2 {
-		h.writeError(w, http.StatusNotFound, "feed not found", false)
-		return
-	}
-	entry, err := decodeAndValidateEntry(body)
-	if err != nil {
-		h.logger.Printf("feed entry invalid feedPath=%q key=%q err=%v", feedPath, key, err)
-		h.writeError(w, http.StatusInternalServerError, "invalid feed entry", true)
-		return
-	}
-
-	respBody, _, err := entryToSuccessResponseJSON(entry)
-	if err != nil {
-		h.logger.Printf("feed entry invalid feedPath=%q key=%q err=%v", feedPath, key, err)
-		h.writeError(w, http.StatusInternalServerError, "invalid feed entry", true)
-		return
-	}
-
-	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.WriteHeader(http.StatusOK)
-
-	writeEvent := func(b []byte) error {
-		if _, err := io.WriteString(w, "event: feed\n"); err != nil {
-			return err
-		}
-		// Single data: line containing full JSON success response.
-		if _, err := io.WriteString(w, "data: "); err != nil {
-			return err
-		}
-		if _, err := w.Write(b); err != nil {
-			return err
-		}
-		if _, err := io.WriteString(w, "\n\n"); err != nil {
-			return err
-		}
-		flusher.Flush()
-		return nil
-	}
-
-	if err := writeEvent(respBody); err != nil {
-		return
-	}
-
-	ws, ok := h.store.(watcher)
-	if !ok {
-		// Store doesn't support watch; just serve the initial event.
-		return
-	}
-
-	watchCh := ws.Watch(r.Context(), key)
-	for {
-		select {
-		case <-r.Context().Done():
-			return
-		case wr, ok := <-watchCh:
-			if !ok {
-				return
-			}
-			if wr.Err() != nil {
-				h.logger.Printf("etcd watch failed feedPath=%q key=%q err=%v", feedPath, key, wr.Err())
-				return
-			}
-			for _, ev := range wr.Events {
-				if ev.Type != mvccpb.PUT || ev.Kv == nil {
-					continue
-				}
-				b := ev.Kv.Value
-				entry, err := decodeAndValidateEntry(b)
-				if err != nil {
-					h.logger.Printf("feed entry invalid feedPath=%q key=%q err=%v", feedPath, key, err)
-					continue
-				}
-				respBody, _, err := entryToSuccessResponseJSON(entry)
-				if err != nil {
-					h.logger.Printf("feed entry invalid feedPath=%q key=%q err=%v", feedPath, key, err)
-					continue
-				}
-				if err := writeEvent(respBody); err != nil {
-					return
-				}
-			}
-		}
-	}
-}
-
 func (h *Handler) writeError(w http.ResponseWriter, status int, message string, retriable bool) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(status)
@@ -1,9 +1,19 @@
 package httpapi
 
 import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/exeteres/wg-feed/internal/atrest"
+	"github.com/exeteres/wg-feed/internal/feedkey"
+	"github.com/exeteres/wg-feed/internal/model"
 )
 
 func TestNegotiateResponseMode(t *testing.T) {
@@ -43,3 +53,118 @@ func TestNegotiateResponseMode(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler_RevokedFeedIsGone(t *testing.T) {
+	t.Parallel()
+
+	st := &revStore{values: map[string][]byte{
+		"wg-feed/feeds/client-a": []byte(`{"revision": "rev-2", "revoked": true, "message": "subscription cancelled"}`),
+	}}
+	h := newTestHandler(st)
+	defer h.Close()
+
+	// The second request is answered from the response cache.
+	for i := 0; i < 2; i++ {
+		resp, er := serveTestRequest(t, h, "/client-a", nil)
+		if resp.StatusCode != http.StatusGone || er.Message != "subscription cancelled" || er.Retriable {
+			t.Fatalf("request %d: unexpected response %d %+v", i, resp.StatusCode, er)
+		}
+	}
+	if stats := h.ResponseCacheStats(); stats.Hits != 1 {
+		t.Fatalf("unexpected cache stats: %+v", stats)
+	}
+}
+
+func TestHandler_DerivedFeedKeys(t *testing.T) {
+	t.Parallel()
+
+	keys := feedkey.New([]byte("0123456789abcdef"))
+	tokenSum := sha256.Sum256([]byte("s3cret"))
+	st := &memStore{values: map[string][]byte{
+		keys.FeedKey("client-a"):   []byte(testEntryJSON),
+		keys.PolicyKey("client-a"): []byte(`{"tokens": [{"id": "ops", "sha256": "` + hex.EncodeToString(tokenSum[:]) + `"}]}`),
+		"wg-feed/feeds/client-b":   []byte(testEntryJSON),
+	}}
+	h := NewHandler(st, log.New(io.Discard, "", 0), Options{FeedKeys: keys})
+
+	if resp, _ := serveTestRequest(t, h, "/client-a?token=s3cret", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+	if resp, _ := serveTestRequest(t, h, "/client-a", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("policy under the derived key was not enforced: %d", resp.StatusCode)
+	}
+	// Plain keys are not served once keys are derived.
+	if resp, _ := serveTestRequest(t, h, "/client-b", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status for plain key: %d", resp.StatusCode)
+	}
+}
+
+func TestHandler_SealedEntries(t *testing.T) {
+	t.Parallel()
+
+	keys, err := atrest.ParseKeyring("k1:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	if err != nil {
+		t.Fatalf("ParseKeyring: %v", err)
+	}
+	sealed, err := keys.Seal([]byte(testEntryJSON))
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	st := &memStore{values: map[string][]byte{"wg-feed/feeds/client-a": sealed}}
+
+	h := NewHandler(st, log.New(io.Discard, "", 0), Options{AtRest: keys})
+	if resp, _ := serveTestRequest(t, h, "/client-a", nil); resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"rev-1"` {
+		t.Fatalf("unexpected response: %d etag=%q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+
+	// Without the keys the sealed entry cannot be served.
+	h = NewHandler(st, log.New(io.Discard, "", 0), Options{})
+	if resp, _ := serveTestRequest(t, h, "/client-a", nil); resp.StatusCode == http.StatusOK {
+		t.Fatalf("sealed entry served without keys")
+	}
+}
+
+func TestHandler_SignedEntry(t *testing.T) {
+	t.Parallel()
+
+	var entry model.FeedEntry
+	if err := json.Unmarshal([]byte(testEntryJSON), &entry); err != nil {
+		t.Fatalf("decode entry: %v", err)
+	}
+	doc, err := json.Marshal(entry.Data)
+	if err != nil {
+		t.Fatalf("encode document: %v", err)
+	}
+	_, priv, _ := ed25519.GenerateKey(nil)
+	sig, err := model.SignFeedDocument(priv, doc, 3)
+	if err != nil {
+		t.Fatalf("SignFeedDocument: %v", err)
+	}
+	entry.Sequence = 3
+	entry.Signature = &sig
+	body, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatalf("encode entry: %v", err)
+	}
+	h := newTestHandler(&memStore{values: map[string][]byte{"wg-feed/feeds/client-a": body}})
+
+	resp, _ := serveTestRequest(t, h, "/client-a", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+	var sr struct {
+		Data      json.RawMessage  `json:"data"`
+		Sequence  uint64           `json:"sequence"`
+		Signature *model.Signature `json:"signature"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if sr.Signature == nil || *sr.Signature != sig {
+		t.Fatalf("signature = %+v, want %+v", sr.Signature, sig)
+	}
+	// The served document is the one that was signed.
+	if err := sr.Signature.Verify(sr.Data, sr.Sequence); err != nil {
+		t.Fatalf("Verify served document: %v", err)
+	}
+}
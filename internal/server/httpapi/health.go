@@ -0,0 +1,38 @@
+package httpapi
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+// readinessChecker is implemented by stores that can tell whether they are able to serve reads.
+type readinessChecker interface {
+	Ready(ctx context.Context) error
+}
+
+// ServeHealthz reports that the process is alive. It never touches the store.
+func (h *Handler) ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = io.WriteString(w, "ok\n")
+}
+
+// ServeReadyz reports whether the store can be read within Options.ReadyTimeout.
+// Stores without a readiness check are always ready.
+func (h *Handler) ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if rc, ok := h.store.(readinessChecker); ok {
+		ctx, cancel := context.WithTimeout(r.Context(), h.opts.ReadyTimeout)
+		defer cancel()
+		if err := rc.Ready(ctx); err != nil {
+			h.logger.Printf("readiness check failed err=%v", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = io.WriteString(w, "store not ready\n")
+			return
+		}
+	}
+	_, _ = io.WriteString(w, "ok\n")
+}
@@ -0,0 +1,58 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type readyStore struct {
+	memStore
+	err error
+}
+
+func (s *readyStore) Ready(ctx context.Context) error {
+	if s.err != nil {
+		return s.err
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestHandler_Readyz(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name  string
+		store getter
+		want  int
+	}{
+		{name: "no readiness check", store: &memStore{}, want: http.StatusOK},
+		{name: "store error", store: &readyStore{err: errors.New("no leader")}, want: http.StatusServiceUnavailable},
+		{name: "deadline exceeded", store: &readyStore{}, want: http.StatusServiceUnavailable},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			h := NewHandler(tc.store, log.New(io.Discard, "", 0), Options{ReadyTimeout: 10 * time.Millisecond})
+			w := httptest.NewRecorder()
+			h.ServeReadyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if w.Code != tc.want {
+				t.Fatalf("status = %d, want %d", w.Code, tc.want)
+			}
+
+			w = httptest.NewRecorder()
+			h.ServeHealthz(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("healthz status = %d", w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/exeteres/wg-feed/internal/feedkey"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	feedsPrefix    = feedkey.FeedsPrefix
+	policiesPrefix = feedkey.PoliciesPrefix
+
+	// hubSubscriberBuffer is how many pending events a subscriber may lag behind
+	// before it is disconnected as a slow consumer.
+	hubSubscriberBuffer = 16
+)
+
+// hubMessage is delivered to subscribers of a feed key.
+type hubMessage struct {
+	// modRev is the store revision of the change.
+	modRev int64
+	// event is the pre-rendered SSE event.
+	event sseEvent
+	// resync asks the subscriber to re-read the key because changes may have been missed.
+	resync bool
+}
+
+type hubSub struct {
+	key string
+	ch  chan hubMessage
+}
+
+// hub holds prefix watches on wg-feed/feeds/ and wg-feed/policies/ shared by
+// all SSE streams. Each feed change is decoded, validated and rendered once,
+// then fanned out to the subscribers of its key. Subscribers that fall behind
+// are disconnected instead of blocking the others; their clients reconnect per
+// the SSE retry hint.
+//
+// The watches run while there are subscribers, and for good once the response
+// and policy caches are in use, since they are what keeps cached entries current.
+type hub struct {
+	store    revisionWatcher
+	render   func(key string, value []byte) (sseEvent, bool)
+	cache    *responseCache
+	policies *policyCache
+	logger   *log.Logger
+	opts     Options
+
+	mu   sync.Mutex
+	subs map[string]map[*hubSub]struct{}
+	// lastMod is the revision of the latest change per key seen by the running watch.
+	lastMod  map[string]int64
+	startRev int64
+	cancel   context.CancelFunc
+	retained bool
+	closed   bool
+}
+
+// newHub creates a hub; cache and policies may be nil.
+func newHub(store revisionWatcher, render func(key string, value []byte) (sseEvent, bool), cache *responseCache, policies *policyCache, logger *log.Logger, opts Options) *hub {
+	return &hub{
+		store:    store,
+		render:   render,
+		cache:    cache,
+		policies: policies,
+		logger:   logger,
+		opts:     opts,
+		subs:     map[string]map[*hubSub]struct{}{},
+	}
+}
+
+// subscribe registers interest in key for changes after sinceRev, the store
+// revision the caller last read key at.
+func (h *hub) subscribe(key string, sinceRev int64) *hubSub {
+	sub := &hubSub{key: key, ch: make(chan hubMessage, hubSubscriberBuffer)}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.ensureRunningLocked(key, sinceRev) {
+		// Changes between the caller's read and now were dispatched before it subscribed.
+		sub.ch <- hubMessage{resync: true}
+	}
+
+	if h.subs[key] == nil {
+		h.subs[key] = map[*hubSub]struct{}{}
+	}
+	h.subs[key][sub] = struct{}{}
+	return sub
+}
+
+func (h *hub) unsubscribe(sub *hubSub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.removeLocked(sub)
+	if len(h.subs) == 0 && !h.retained && h.cancel != nil {
+		h.cancel()
+		h.cancel = nil
+	}
+}
+
+// cacheResponse admits resp, rendered from key as read at store revision rev,
+// into the response cache unless the watch has already seen a newer change.
+func (h *hub) cacheResponse(key string, rev int64, resp cachedResponse) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return
+	}
+	h.retained = true
+	if h.ensureRunningLocked(key, rev) {
+		h.cache.put(key, resp)
+	}
+}
+
+// cachePolicy admits p, read from key at store revision rev, into the policy
+// cache unless the watch has already seen a newer change.
+func (h *hub) cachePolicy(key string, rev int64, p cachedPolicy) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return
+	}
+	h.retained = true
+	if h.ensureRunningLocked(key, rev) {
+		h.policies.put(key, p)
+	}
+}
+
+// ensureRunningLocked starts the watches right after sinceRev if they are not
+// running. It reports whether they cover every change to key after sinceRev.
+func (h *hub) ensureRunningLocked(key string, sinceRev int64) bool {
+	if h.cancel == nil && !h.closed {
+		ctx, cancel := context.WithCancel(context.Background())
+		h.cancel = cancel
+		h.lastMod = map[string]int64{}
+		h.startRev = sinceRev + 1
+		go h.run(ctx, feedsPrefix, h.startRev)
+		go h.run(ctx, policiesPrefix, h.startRev)
+		return true
+	}
+	return sinceRev+1 >= h.startRev && h.lastMod[key] <= sinceRev
+}
+
+// close stops the watch for good.
+func (h *hub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	if h.cancel != nil {
+		h.cancel()
+		h.cancel = nil
+	}
+}
+
+func (h *hub) removeLocked(sub *hubSub) bool {
+	set, ok := h.subs[sub.key]
+	if !ok {
+		return false
+	}
+	if _, ok := set[sub]; !ok {
+		return false
+	}
+	delete(set, sub)
+	if len(set) == 0 {
+		delete(h.subs, sub.key)
+	}
+	return true
+}
+
+func (h *hub) run(ctx context.Context, prefix string, rev int64) {
+	delay := h.opts.SSERewatchDelay
+	for {
+		watchErr := h.watch(ctx, prefix, &rev, &delay)
+		if ctx.Err() != nil {
+			return
+		}
+		h.logger.Printf("etcd watch failed prefix=%q err=%v; rewatching in %s", prefix, watchErr, delay)
+		h.opts.Metrics.WatchFailed()
+		if !sleepCtx(ctx, delay) {
+			return
+		}
+		delay = min(delay*2, h.opts.SSERewatchMaxDelay)
+
+		if errors.Is(watchErr, errWatchCompacted) {
+			// History after rev is gone: restart from the current revision and
+			// let every subscriber catch up with a fresh read.
+			_, cur, _, err := h.store.GetWithRevision(ctx, prefix)
+			if err != nil {
+				h.logger.Printf("etcd get failed key=%q err=%v", prefix, err)
+				continue
+			}
+			rev = cur + 1
+			h.resyncAll(rev)
+		}
+	}
+}
+
+// watch consumes one prefix watch starting at *rev until it fails, advancing *rev past every seen event.
+func (h *hub) watch(ctx context.Context, prefix string, rev *int64, delay *time.Duration) error {
+	watchCh := h.store.WatchFromRevision(ctx, prefix, *rev, clientv3.WithPrefix())
+	for wr := range watchCh {
+		if wr.CompactRevision != 0 {
+			return fmt.Errorf("%w at %d", errWatchCompacted, wr.CompactRevision)
+		}
+		if err := wr.Err(); err != nil {
+			return err
+		}
+		for _, ev := range wr.Events {
+			if ev.Kv == nil {
+				continue
+			}
+			start := time.Now()
+			h.dispatch(ev)
+			h.opts.Metrics.ObserveWatchDispatch(time.Since(start))
+			*rev = ev.Kv.ModRevision + 1
+		}
+		*delay = h.opts.SSERewatchDelay
+	}
+	return errWatchClosed
+}
+
+func (h *hub) dispatch(ev *clientv3.Event) {
+	key := string(ev.Kv.Key)
+	modRev := ev.Kv.ModRevision
+
+	h.mu.Lock()
+	h.lastMod[key] = modRev
+	if h.cache != nil {
+		h.cache.remove(key)
+	}
+	if h.policies != nil {
+		h.policies.remove(key)
+	}
+	n := len(h.subs[key])
+	h.mu.Unlock()
+	if n == 0 {
+		return
+	}
+
+	msg := hubMessage{modRev: modRev, event: sseEvent{final: true}}
+	if ev.Type == mvccpb.PUT && strings.HasPrefix(key, feedsPrefix) {
+		var ok bool
+		if msg.event, ok = h.render(key, ev.Kv.Value); !ok {
+			return
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs[key] {
+		h.deliverLocked(sub, msg)
+	}
+}
+
+func (h *hub) resyncAll(startRev int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.startRev = startRev
+	h.lastMod = map[string]int64{}
+	if h.cache != nil {
+		h.cache.clear()
+	}
+	if h.policies != nil {
+		h.policies.clear()
+	}
+	for _, set := range h.subs {
+		for sub := range set {
+			h.deliverLocked(sub, hubMessage{resync: true})
+		}
+	}
+}
+
+// deliverLocked never blocks: a subscriber with a full buffer is dropped and its channel closed.
+func (h *hub) deliverLocked(sub *hubSub, msg hubMessage) {
+	select {
+	case sub.ch <- msg:
+	default:
+		if h.removeLocked(sub) {
+			close(sub.ch)
+		}
+	}
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
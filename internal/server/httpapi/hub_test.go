@@ -0,0 +1,359 @@
+package httpapi
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/exeteres/wg-feed/internal/model"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+type revWatch struct {
+	key string
+	rev int64
+	ch  chan clientv3.WatchResponse
+}
+
+// revStore is an in-memory revisionWatcher. Watches are handed to the test
+// through watches, or policyWatches for the policy prefix (if set).
+type revStore struct {
+	mu            sync.Mutex
+	values        map[string][]byte
+	rev           int64
+	watches       chan revWatch
+	policyWatches chan revWatch
+	gets          map[string]int
+}
+
+func (s *revStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	v, _, ok, err := s.GetWithRevision(ctx, key)
+	return v, ok, err
+}
+
+func (s *revStore) GetWithRevision(_ context.Context, key string) ([]byte, int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gets != nil {
+		s.gets[key]++
+	}
+	v, ok := s.values[key]
+	return v, s.rev, ok, nil
+}
+
+func (s *revStore) WatchFromRevision(ctx context.Context, key string, rev int64, _ ...clientv3.OpOption) clientv3.WatchChan {
+	ch := make(chan clientv3.WatchResponse)
+	watches := s.watches
+	if key == policiesPrefix {
+		watches = s.policyWatches
+	}
+	if watches != nil {
+		watches <- revWatch{key: key, rev: rev, ch: ch}
+	}
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch
+}
+
+// put stores value and returns the watch event for it.
+func (s *revStore) put(key string, value []byte) clientv3.WatchResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rev++
+	s.values[key] = value
+	return clientv3.WatchResponse{Events: []*clientv3.Event{{
+		Type: mvccpb.PUT,
+		Kv:   &mvccpb.KeyValue{Key: []byte(key), Value: value, ModRevision: s.rev},
+	}}}
+}
+
+// delete removes key and returns the watch event for it.
+func (s *revStore) delete(key string) clientv3.WatchResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rev++
+	delete(s.values, key)
+	return clientv3.WatchResponse{Events: []*clientv3.Event{{
+		Type: mvccpb.DELETE,
+		Kv:   &mvccpb.KeyValue{Key: []byte(key), ModRevision: s.rev},
+	}}}
+}
+
+func openSSE(t *testing.T, ctx context.Context, url string) *bufio.Reader {
+	t.Helper()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	r := bufio.NewReader(resp.Body)
+	readSSEFrame(t, r) // retry:
+	return r
+}
+
+func TestServeSSE_SharedWatch(t *testing.T) {
+	t.Parallel()
+
+	st := &revStore{
+		values: map[string][]byte{
+			"wg-feed/feeds/client-a": entryWithRevision("a-1"),
+			"wg-feed/feeds/client-b": entryWithRevision("b-1"),
+		},
+		rev:     1,
+		watches: make(chan revWatch, 4),
+	}
+	srv := httptest.NewServer(newTestHandler(st))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	a1 := openSSE(t, ctx, srv.URL+"/client-a")
+	a2 := openSSE(t, ctx, srv.URL+"/client-a")
+	b := openSSE(t, ctx, srv.URL+"/client-b")
+	for _, r := range []*bufio.Reader{a1, a2} {
+		if rev := readFeedRevision(t, r); rev != "a-1" {
+			t.Fatalf("unexpected initial revision: %q", rev)
+		}
+	}
+	if rev := readFeedRevision(t, b); rev != "b-1" {
+		t.Fatalf("unexpected initial revision: %q", rev)
+	}
+
+	w := <-st.watches
+	if w.key != feedsPrefix || w.rev != 2 {
+		t.Fatalf("unexpected watch: key=%q rev=%d", w.key, w.rev)
+	}
+
+	w.ch <- st.put("wg-feed/feeds/client-b", entryWithRevision("b-2"))
+	w.ch <- st.put("wg-feed/feeds/client-a", entryWithRevision("a-2"))
+	for _, r := range []*bufio.Reader{a1, a2} {
+		if rev := readFeedRevision(t, r); rev != "a-2" {
+			t.Fatalf("unexpected revision: %q", rev)
+		}
+	}
+	if rev := readFeedRevision(t, b); rev != "b-2" {
+		t.Fatalf("unexpected revision: %q", rev)
+	}
+
+	select {
+	case extra := <-st.watches:
+		t.Fatalf("expected a single shared watch, got another on %q", extra.key)
+	default:
+	}
+}
+
+func TestServeSSE_FanOutDoesNotReadPolicy(t *testing.T) {
+	t.Parallel()
+
+	const policyKey = "wg-feed/policies/client-a"
+	st := &revStore{
+		values: map[string][]byte{
+			"wg-feed/feeds/client-a": entryWithRevision("a-1"),
+			policyKey:                []byte(`{"hmac_keys": [{"id": "k1", "secret": "MDEyMzQ1Njc4OWFiY2RlZg=="}]}`),
+		},
+		rev:           1,
+		watches:       make(chan revWatch, 1),
+		policyWatches: make(chan revWatch, 1),
+		gets:          map[string]int{},
+	}
+	// Without the policy cache, every policy check is a store read.
+	srv := httptest.NewServer(NewHandler(st, log.New(io.Discard, "", 0), Options{SSEHeartbeatInterval: time.Hour, ResponseCacheSize: -1}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mac := hmac.New(sha256.New, []byte("0123456789abcdef"))
+	_, _ = mac.Write([]byte("client-a"))
+	var streams []*bufio.Reader
+	for range 3 {
+		r := openSSE(t, ctx, srv.URL+"/client-a?token="+hex.EncodeToString(mac.Sum(nil)))
+		if rev := readFeedRevision(t, r); rev != "a-1" {
+			t.Fatalf("unexpected initial revision: %q", rev)
+		}
+		streams = append(streams, r)
+	}
+	w := <-st.watches
+	pw := <-st.policyWatches
+
+	st.mu.Lock()
+	reads := st.gets[policyKey]
+	st.mu.Unlock()
+	w.ch <- st.put("wg-feed/feeds/client-a", entryWithRevision("a-2"))
+	for _, r := range streams {
+		if rev := readFeedRevision(t, r); rev != "a-2" {
+			t.Fatalf("unexpected revision: %q", rev)
+		}
+	}
+	st.mu.Lock()
+	got := st.gets[policyKey]
+	st.mu.Unlock()
+	if got != reads {
+		t.Fatalf("policy read %d times for one update", got-reads)
+	}
+
+	// Revoking the key ends the streams without waiting for a heartbeat.
+	pw.ch <- st.put(policyKey, []byte(`{}`))
+	for _, r := range streams {
+		if _, err := io.ReadAll(r); err != nil {
+			t.Fatalf("read stream: %v", err)
+		}
+	}
+}
+
+func TestServeSSE_EndsOnRevocationAndDeletion(t *testing.T) {
+	t.Parallel()
+
+	st := &revStore{
+		values: map[string][]byte{
+			"wg-feed/feeds/client-a": entryWithRevision("a-1"),
+			"wg-feed/feeds/client-b": entryWithRevision("b-1"),
+		},
+		rev:     1,
+		watches: make(chan revWatch, 4),
+	}
+	srv := httptest.NewServer(newTestHandler(st))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	a := openSSE(t, ctx, srv.URL+"/client-a")
+	b := openSSE(t, ctx, srv.URL+"/client-b")
+	readFeedRevision(t, a)
+	readFeedRevision(t, b)
+	w := <-st.watches
+
+	w.ch <- st.put("wg-feed/feeds/client-a", []byte(`{"revision": "a-2", "revoked": true, "message": "subscription cancelled"}`))
+	frame := readSSEFrame(t, a)
+	if len(frame) != 2 || frame[0] != "event: error" {
+		t.Fatalf("unexpected frame: %q", frame)
+	}
+	var er model.ErrorResponse
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(frame[1], "data: ")), &er); err != nil || er.Message != "subscription cancelled" || er.Retriable {
+		t.Fatalf("unexpected error event %q (%v)", frame[1], err)
+	}
+	if _, err := a.ReadString('\n'); err != io.EOF {
+		t.Fatalf("expected revoked stream to end, got %v", err)
+	}
+
+	w.ch <- st.delete("wg-feed/feeds/client-b")
+	if line, err := b.ReadString('\n'); err != io.EOF {
+		t.Fatalf("expected deleted stream to end, got %q %v", line, err)
+	}
+}
+
+func TestHub_DropsSlowSubscriber(t *testing.T) {
+	t.Parallel()
+
+	st := &revStore{values: map[string][]byte{}}
+	h := newTestHandler(st)
+	slow := h.hub.subscribe("wg-feed/feeds/client-a", 0)
+	fast := h.hub.subscribe("wg-feed/feeds/client-a", 0)
+	defer h.hub.unsubscribe(fast)
+
+	for i := 0; i < hubSubscriberBuffer+1; i++ {
+		wr := st.put("wg-feed/feeds/client-a", entryWithRevision(fmt.Sprintf("rev-%d", i)))
+		h.hub.dispatch(wr.Events[0])
+		if msg := <-fast.ch; msg.event.revision != fmt.Sprintf("rev-%d", i) {
+			t.Fatalf("unexpected message: %#v", msg)
+		}
+	}
+
+	n := 0
+	for range slow.ch {
+		n++
+	}
+	if n != hubSubscriberBuffer {
+		t.Fatalf("slow subscriber received %d buffered events, want %d", n, hubSubscriberBuffer)
+	}
+}
+
+func TestHub_ResyncsLateSubscriber(t *testing.T) {
+	t.Parallel()
+
+	st := &revStore{values: map[string][]byte{}}
+	h := newTestHandler(st)
+	first := h.hub.subscribe("wg-feed/feeds/client-b", 0)
+	defer h.hub.unsubscribe(first)
+
+	wr := st.put("wg-feed/feeds/client-a", entryWithRevision("rev-1"))
+	h.hub.dispatch(wr.Events[0])
+
+	// Read at revision 0, subscribed after the change was dispatched.
+	late := h.hub.subscribe("wg-feed/feeds/client-a", 0)
+	defer h.hub.unsubscribe(late)
+	if msg := <-late.ch; !msg.resync {
+		t.Fatalf("expected resync, got %#v", msg)
+	}
+}
+
+// BenchmarkSSEFanout compares delivering one update to n streams of the same
+// feed through the hub against the former per-connection watches, where each
+// stream decoded, validated and rendered the entry itself (on top of holding
+// its own etcd watcher, reported as the watchers metric).
+func BenchmarkSSEFanout(b *testing.B) {
+	const key = "wg-feed/feeds/client-a"
+	value := []byte(testEntryJSON)
+	logger := log.New(io.Discard, "", 0)
+
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("hub/subscribers=%d", n), func(b *testing.B) {
+			h := NewHandler(&revStore{values: map[string][]byte{}}, logger, Options{})
+			subs := make([]*hubSub, n)
+			for i := range subs {
+				subs[i] = h.hub.subscribe(key, 0)
+			}
+			defer func() {
+				for _, s := range subs {
+					h.hub.unsubscribe(s)
+				}
+			}()
+			ev := &clientv3.Event{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte(key), Value: value}}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ev.Kv.ModRevision = int64(i + 1)
+				h.hub.dispatch(ev)
+				for _, s := range subs {
+					if msg := <-s.ch; !strings.HasPrefix(string(msg.event.frame), "event: feed") {
+						b.Fatalf("unexpected frame: %q", msg.event.frame)
+					}
+				}
+			}
+			b.ReportMetric(1, "watchers")
+		})
+
+		b.Run(fmt.Sprintf("per-connection/subscribers=%d", n), func(b *testing.B) {
+			h := NewHandler(&memStore{}, logger, Options{})
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < n; j++ {
+					if _, ok := h.renderFeedEvent(key, value); !ok {
+						b.Fatal("render failed")
+					}
+				}
+			}
+			b.ReportMetric(float64(n), "watchers")
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package httpapi
+
+import "container/list"
+
+// lru is a map bounded to max entries that evicts the least recently used
+// key. It is not safe for concurrent use.
+type lru[V any] struct {
+	max   int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type lruItem[V any] struct {
+	key   string
+	value V
+}
+
+func newLRU[V any](max int) *lru[V] {
+	return &lru[V]{max: max, ll: list.New(), items: map[string]*list.Element{}}
+}
+
+// get returns the value of key and marks it as most recently used.
+func (c *lru[V]) get(key string) (V, bool) {
+	el, ok := c.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*lruItem[V]).value, true
+}
+
+// put sets the value of key and evicts the least recently used keys beyond
+// max. It returns the evicted keys.
+func (c *lru[V]) put(key string, value V) []string {
+	if el, ok := c.items[key]; ok {
+		el.Value.(*lruItem[V]).value = value
+		c.ll.MoveToFront(el)
+		return nil
+	}
+	c.items[key] = c.ll.PushFront(&lruItem[V]{key: key, value: value})
+	var evicted []string
+	for c.ll.Len() > c.max {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		k := oldest.Value.(*lruItem[V]).key
+		delete(c.items, k)
+		evicted = append(evicted, k)
+	}
+	return evicted
+}
+
+func (c *lru[V]) remove(key string) {
+	if el, ok := c.items[key]; ok {
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+func (c *lru[V]) clear() {
+	c.ll.Init()
+	c.items = map[string]*list.Element{}
+}
+
+func (c *lru[V]) len() int {
+	return c.ll.Len()
+}
@@ -0,0 +1,97 @@
+package httpapi
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/exeteres/wg-feed/internal/feedkey"
+	"github.com/exeteres/wg-feed/internal/server/metrics"
+)
+
+func TestHandler_RecordsMetrics(t *testing.T) {
+	t.Parallel()
+
+	st := &reportStore{memStore{values: map[string][]byte{
+		"wg-feed/feeds/client-a": []byte(testEntryJSON),
+		"wg-feed/feeds/broken":   []byte(`{"revision": ""}`),
+	}}}
+	m := metrics.New()
+	h := NewHandler(st, log.New(io.Discard, "", 0), Options{Metrics: m, StatusReports: true})
+
+	serveTestRequest(t, h, "/client-a", nil)
+	serveTestRequest(t, h, "/client-a", http.Header{"If-None-Match": {`"rev-1"`}})
+	serveTestRequest(t, h, "/broken", nil)
+	if code := postStatusReport(h, "/broken", testStatusReport); code != http.StatusInternalServerError {
+		t.Fatalf("report for a broken entry: status = %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	out := w.Body.String()
+
+	for _, want := range []string{
+		`wg_feed_requests_total{mode="json",status="200"} 1`,
+		`wg_feed_requests_total{mode="json",status="304"} 1`,
+		`wg_feed_requests_total{mode="json",status="500"} 1`,
+		`wg_feed_invalid_entries_total{feed="` + metrics.FeedID("broken") + `"} 2`,
+		`wg_feed_store_get_duration_seconds_count{kind="policy"} 4`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "client-a") {
+		t.Fatalf("metrics leak a feed path")
+	}
+}
+
+func TestHandler_InvalidEntryLabelWithDerivedKeys(t *testing.T) {
+	t.Parallel()
+
+	keys := feedkey.New([]byte("0123456789abcdef"))
+	key := keys.FeedKey("client-a")
+	st := &revStore{
+		values:  map[string][]byte{key: entryWithRevision("rev-1")},
+		rev:     1,
+		watches: make(chan revWatch, 1),
+	}
+	m := metrics.New()
+	h := NewHandler(st, log.New(io.Discard, "", 0), Options{Metrics: m, FeedKeys: keys, ResponseCacheSize: -1})
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r := openSSE(t, ctx, srv.URL+"/client-a")
+	readFeedRevision(t, r)
+
+	// The entry breaks: the shared watch and a JSON request both reject it.
+	w := <-st.watches
+	w.ch <- st.put(key, []byte(`{"revision": ""}`))
+	want := `wg_feed_invalid_entries_total{feed="` + metrics.FeedID(keys.ID("client-a")) + `"} `
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return rec.Body.String()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(scrape(), want+"1") {
+		if time.Now().After(deadline) {
+			t.Fatalf("missing %q in:\n%s", want+"1", scrape())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if resp, _ := serveTestRequest(t, h, "/client-a", nil); resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+	if out := scrape(); !strings.Contains(out, want+"2") {
+		t.Fatalf("missing %q in:\n%s", want+"2", out)
+	}
+}
@@ -0,0 +1,65 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+)
+
+// maxPostBytes bounds the body of status reports and enrollments.
+const maxPostBytes = 64 << 10
+
+// readFeedPost decodes and validates the JSON body of a POST for a feed, and
+// checks that the feed exists and is not revoked or expired. It returns the
+// feed's response, or writes the error response and returns false on failure.
+func (h *Handler) readFeedPost(w http.ResponseWriter, r *http.Request, feedPath, key string, v interface{ Validate() error }) (cachedResponse, bool) {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != acceptJSON {
+		h.writeError(w, http.StatusUnsupportedMediaType, "request body must be application/json", false)
+		return cachedResponse{}, false
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPostBytes)).Decode(v); err != nil {
+		h.writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error(), false)
+		return cachedResponse{}, false
+	}
+	if err := v.Validate(); err != nil {
+		h.writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error(), false)
+		return cachedResponse{}, false
+	}
+
+	resp, ok, err := h.loadResponse(r.Context(), key)
+	if errors.Is(err, errInvalidEntry) {
+		h.logger.Printf("feed entry invalid feedPath=%q key=%q err=%v", feedPath, key, err)
+		h.opts.Metrics.InvalidEntry(invalidEntryID(err))
+		h.writeError(w, http.StatusInternalServerError, "invalid feed entry", true)
+		return cachedResponse{}, false
+	}
+	if err != nil {
+		h.logger.Printf("etcd get failed feedPath=%q key=%q err=%v", feedPath, key, err)
+		h.writeError(w, http.StatusInternalServerError, "internal error", true)
+		return cachedResponse{}, false
+	}
+	if !ok {
+		h.writeError(w, http.StatusNotFound, "feed not found", false)
+		return cachedResponse{}, false
+	}
+	if resp.gone != "" {
+		h.writeError(w, http.StatusGone, resp.gone, false)
+		return cachedResponse{}, false
+	}
+	return resp, true
+}
+
+// servedFeedID returns the id of the feed document in the rendered response
+// body, or "" when the document is encrypted.
+func servedFeedID(body []byte) string {
+	var sr struct {
+		Data *struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &sr); err != nil || sr.Data == nil {
+		return ""
+	}
+	return sr.Data.ID
+}
@@ -0,0 +1,95 @@
+package httpapi
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cachedResponse is a rendered JSON success response, the error message of a
+// revoked or expired feed, or the target key of an alias (see model.FeedEntry).
+type cachedResponse struct {
+	body []byte
+	etag string
+	gone string
+	// until is when the response goes stale because the entry reaches its
+	// warn_after or not_after; zero if it does not.
+	until time.Time
+	// notAfter and warnAfter are the snapshot deadlines of the rendered feed
+	// (see snapshot), kept for snapshots of aliases.
+	notAfter  *time.Time
+	warnAfter *time.Time
+	aliasOf   string
+}
+
+// ResponseCacheStats reports JSON response cache usage.
+type ResponseCacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+// HitRatio returns Hits / (Hits + Misses), or 0 before the first lookup.
+func (s ResponseCacheStats) HitRatio() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+// responseCache is an LRU of rendered JSON responses keyed by store key.
+// Entries are only admitted and invalidated through the hub, whose watch keeps them current.
+type responseCache struct {
+	mu      sync.Mutex
+	entries *lru[cachedResponse]
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func newResponseCache(max int) *responseCache {
+	return &responseCache{entries: newLRU[cachedResponse](max)}
+}
+
+func (c *responseCache) get(key string) (cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	resp, ok := c.entries.get(key)
+	if ok && !resp.until.IsZero() && !time.Now().Before(resp.until) {
+		c.entries.remove(key)
+		ok = false
+	}
+	if !ok {
+		c.misses.Add(1)
+		return cachedResponse{}, false
+	}
+	c.hits.Add(1)
+	return resp, true
+}
+
+func (c *responseCache) put(key string, resp cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.put(key, resp)
+}
+
+func (c *responseCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.remove(key)
+}
+
+func (c *responseCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.clear()
+}
+
+func (c *responseCache) stats() ResponseCacheStats {
+	c.mu.Lock()
+	entries := c.entries.len()
+	c.mu.Unlock()
+	return ResponseCacheStats{Hits: c.hits.Load(), Misses: c.misses.Load(), Entries: entries}
+}
@@ -0,0 +1,96 @@
+package httpapi
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHandler_ResponseCacheInvalidatedByWatch(t *testing.T) {
+	t.Parallel()
+
+	const key = "wg-feed/feeds/client-a"
+	st := &revStore{
+		values:  map[string][]byte{key: entryWithRevision("rev-1")},
+		rev:     1,
+		watches: make(chan revWatch, 1),
+	}
+	h := newTestHandler(st)
+	defer h.Close()
+
+	etag := func() string {
+		t.Helper()
+		resp, er := serveTestRequest(t, h, "/client-a", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status %d: %q", resp.StatusCode, er.Message)
+		}
+		return resp.Header.Get("ETag")
+	}
+
+	if got := etag(); got != `"rev-1"` {
+		t.Fatalf("unexpected ETag: %q", got)
+	}
+	w := <-st.watches
+
+	// Changed behind the watch's back: the cached response is still served.
+	st.mu.Lock()
+	st.values[key] = entryWithRevision("rev-x")
+	st.mu.Unlock()
+	if got := etag(); got != `"rev-1"` {
+		t.Fatalf("expected cached ETag, got %q", got)
+	}
+	if stats := h.ResponseCacheStats(); stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	w.ch <- st.put(key, entryWithRevision("rev-2"))
+	deadline := time.Now().Add(5 * time.Second)
+	for etag() != `"rev-2"` {
+		if time.Now().After(deadline) {
+			t.Fatalf("cache was not invalidated by the watch")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHandler_ResponseCacheRejectsReadsOlderThanWatch(t *testing.T) {
+	t.Parallel()
+
+	st := &revStore{values: map[string][]byte{}, watches: make(chan revWatch, 1)}
+	h := newTestHandler(st)
+	defer h.Close()
+
+	h.hub.cacheResponse("wg-feed/feeds/a", 10, cachedResponse{etag: `"a"`})
+	<-st.watches
+	// The watch started after revision 10; a read at revision 5 may have missed changes.
+	h.hub.cacheResponse("wg-feed/feeds/b", 5, cachedResponse{etag: `"b"`})
+
+	if _, ok := h.cache.get("wg-feed/feeds/a"); !ok {
+		t.Fatalf("expected a to be cached")
+	}
+	if _, ok := h.cache.get("wg-feed/feeds/b"); ok {
+		t.Fatalf("expected b not to be cached")
+	}
+}
+
+func TestResponseCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	t.Parallel()
+
+	c := newResponseCache(2)
+	c.put("a", cachedResponse{etag: "a"})
+	c.put("b", cachedResponse{etag: "b"})
+	c.get("a")
+	c.put("c", cachedResponse{etag: "c"})
+
+	if _, ok := c.get("b"); ok {
+		t.Fatalf("expected b to be evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := c.get(k); !ok {
+			t.Fatalf("expected %s to be cached", k)
+		}
+	}
+	if got := c.stats().HitRatio(); got != 0.75 {
+		t.Fatalf("unexpected hit ratio: %v", got)
+	}
+}
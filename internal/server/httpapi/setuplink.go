@@ -0,0 +1,74 @@
+package httpapi
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/exeteres/wg-feed/internal/setuplink"
+)
+
+// serveSetupLink answers /_setup/<token> with the document of the link's
+// target feed. Only successful GETs count as a use; HEAD requests and
+// requests for other media types (e.g. link previews of chat clients) do not.
+func (h *Handler) serveSetupLink(w http.ResponseWriter, r *http.Request, mode responseMode, token string) {
+	st, ok := h.store.(setuplink.Store)
+	if !ok || token == "" || strings.Contains(token, "/") {
+		h.writeError(w, http.StatusNotFound, "feed not found", false)
+		return
+	}
+	if mode != responseModeJSON {
+		h.writeError(w, http.StatusNotAcceptable, "setup links are only served as application/json", false)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	ctx := r.Context()
+	rec, err := setuplink.Lookup(ctx, st, token, time.Now())
+	if err != nil {
+		h.writeSetupLinkError(w, err)
+		return
+	}
+
+	key := feedsPrefix + rec.FeedID
+	resp, ok, err := h.loadResponse(ctx, key)
+	if errors.Is(err, errInvalidEntry) {
+		h.logger.Printf("feed entry invalid key=%q err=%v", key, err)
+		h.writeError(w, http.StatusInternalServerError, "invalid feed entry", true)
+		return
+	}
+	if err != nil {
+		h.logger.Printf("etcd get failed key=%q err=%v", key, err)
+		h.writeError(w, http.StatusInternalServerError, "internal error", true)
+		return
+	}
+	if !ok {
+		h.writeError(w, http.StatusNotFound, "feed not found", false)
+		return
+	}
+	if resp.gone != "" {
+		h.writeError(w, http.StatusGone, resp.gone, false)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		if _, err := setuplink.Redeem(ctx, st, token, time.Now()); err != nil {
+			h.writeSetupLinkError(w, err)
+			return
+		}
+	}
+	h.writeSuccess(w, r, resp)
+}
+
+func (h *Handler) writeSetupLinkError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, setuplink.ErrNotFound):
+		h.writeError(w, http.StatusNotFound, "feed not found", false)
+	case errors.Is(err, setuplink.ErrExpired), errors.Is(err, setuplink.ErrUsedUp):
+		h.writeError(w, http.StatusGone, err.Error(), false)
+	default:
+		h.logger.Printf("setup link failed err=%v", err)
+		h.writeError(w, http.StatusInternalServerError, "internal error", true)
+	}
+}
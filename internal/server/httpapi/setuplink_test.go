@@ -0,0 +1,68 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/exeteres/wg-feed/internal/setuplink"
+)
+
+// casStore adds CompareAndPut to memStore, as needed by setup links.
+type casStore struct {
+	memStore
+}
+
+func (s *casStore) CompareAndPut(_ context.Context, key string, expected, value []byte) (bool, error) {
+	cur, ok := s.values[key]
+	if (expected == nil && ok) || (expected != nil && (!ok || !bytes.Equal(cur, expected))) {
+		return false, nil
+	}
+	s.values[key] = value
+	return true, nil
+}
+
+func TestHandler_SetupLink(t *testing.T) {
+	t.Parallel()
+
+	st := &casStore{memStore{values: map[string][]byte{"wg-feed/feeds/client-a": []byte(testEntryJSON)}}}
+	token, _, err := setuplink.Create(context.Background(), st, "client-a", 0, 1)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	h := NewHandler(st, log.New(io.Discard, "", 0), Options{})
+	target := "/" + setuplink.PathPrefix + token
+
+	// Link previews (other media types) and HEAD requests do not use the link up.
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNotAcceptable {
+		t.Fatalf("preview: status = %d", w.Code)
+	}
+	r = httptest.NewRequest(http.MethodHead, target, nil)
+	r.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("head: status = %d", w.Code)
+	}
+
+	resp, _ := serveTestRequest(t, h, target, nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"rev-1"` || resp.Header.Get("Cache-Control") != "no-store" {
+		t.Fatalf("first fetch: status = %d headers = %v", resp.StatusCode, resp.Header)
+	}
+	resp, er := serveTestRequest(t, h, target, nil)
+	if resp.StatusCode != http.StatusGone || er.Retriable {
+		t.Fatalf("second fetch: status = %d error = %+v", resp.StatusCode, er)
+	}
+
+	if resp, _ := serveTestRequest(t, h, "/"+setuplink.PathPrefix+"unknown", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown link: status = %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,298 @@
+package httpapi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/exeteres/wg-feed/internal/atrest"
+)
+
+// snapshot is the last successful store read of a key, as used by the handler:
+// the rendered JSON response for feeds and the raw policy for access policies.
+type snapshot struct {
+	Key   string `json:"key"`
+	Found bool   `json:"found"`
+	Body  []byte `json:"body,omitempty"`
+	// Sealed replaces Body in snapshot files when at-rest keys are configured
+	// (see atrest.Keyring.SealValue).
+	Sealed json.RawMessage `json:"sealed,omitempty"`
+	ETag   string          `json:"etag,omitempty"`
+	// At is when the store last confirmed this content.
+	At time.Time `json:"at"`
+	// NotAfter is the expiry of the feed; the snapshot is not served after it.
+	NotAfter *time.Time `json:"not_after,omitempty"`
+	// WarnAfter is the warn_after of a feed rendered before it, without the
+	// expiry warning; the snapshot is not served after it either.
+	WarnAfter *time.Time `json:"warn_after,omitempty"`
+}
+
+func (s snapshot) sameContent(o snapshot) bool {
+	return s.Found == o.Found && s.ETag == o.ETag && bytes.Equal(s.Body, o.Body) &&
+		sameTime(s.NotAfter, o.NotAfter) && sameTime(s.WarnAfter, o.WarnAfter)
+}
+
+// outdated reports whether the snapshot is past a deadline it was rendered before.
+func (s snapshot) outdated(now time.Time) bool {
+	for _, t := range []*time.Time{s.NotAfter, s.WarnAfter} {
+		if t != nil && !now.Before(*t) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameTime(a, b *time.Time) bool {
+	return (a == nil) == (b == nil) && (a == nil || a.Equal(*b))
+}
+
+// lastKnownGood keeps a snapshot of the keys the handler has read successfully,
+// to be served while the store is unavailable, up to a limit beyond which the
+// least recently used are dropped. With a directory set, snapshots are also
+// written to disk (one file per key, with bodies sealed when keys are set)
+// and loaded back on startup.
+//
+// A nil *lastKnownGood is valid and keeps nothing.
+type lastKnownGood struct {
+	dir    string
+	keys   *atrest.Keyring
+	logger *log.Logger
+
+	mu    sync.Mutex
+	items *lru[snapshot]
+
+	// diskMu orders file writes so that the newest content wins.
+	diskMu sync.Mutex
+}
+
+func newLastKnownGood(dir string, limit int, keys *atrest.Keyring, logger *log.Logger) *lastKnownGood {
+	l := &lastKnownGood{dir: dir, keys: keys, logger: logger, items: newLRU[snapshot](limit)}
+	if dir != "" {
+		if err := l.load(); err != nil {
+			logger.Printf("snapshot load failed dir=%q err=%v", dir, err)
+		}
+	}
+	return l
+}
+
+func (l *lastKnownGood) load() error {
+	entries, err := os.ReadDir(l.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(l.dir, e.Name())
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var s snapshot
+		if err := json.Unmarshal(b, &s); err != nil || l.fileFor(s.Key) != path {
+			l.logger.Printf("snapshot file invalid path=%q err=%v", path, err)
+			continue
+		}
+		if s.Sealed != nil {
+			if s.Body, err = l.keys.OpenValue(s.Sealed, snapshotAAD(s.Key)); err != nil {
+				l.logger.Printf("snapshot file invalid path=%q err=%v", path, err)
+				continue
+			}
+			s.Sealed = nil
+		}
+		for _, k := range l.items.put(s.Key, s) {
+			l.removeFile(k)
+		}
+	}
+	return nil
+}
+
+func (l *lastKnownGood) fileFor(key string) string {
+	return snapshotFile(l.dir, key)
+}
+
+func snapshotFile(dir, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// snapshotAAD binds a sealed snapshot body to its key.
+func snapshotAAD(key string) []byte {
+	return []byte("wg-feed/snapshot\x00" + key)
+}
+
+func (l *lastKnownGood) lookup(key string) (snapshot, bool) {
+	if l == nil {
+		return snapshot{}, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.items.get(key)
+	if ok && s.outdated(time.Now()) {
+		return snapshot{}, false
+	}
+	return s, ok
+}
+
+// record stores s as the latest content of s.Key. Disk is only written when the content changed.
+func (l *lastKnownGood) record(s snapshot) {
+	if l == nil {
+		return
+	}
+	s.At = time.Now()
+
+	l.mu.Lock()
+	prev, ok := l.items.get(s.Key)
+	if ok && prev.sameContent(s) {
+		l.items.put(s.Key, s)
+		l.mu.Unlock()
+		return
+	}
+	l.mu.Unlock()
+
+	l.diskMu.Lock()
+	defer l.diskMu.Unlock()
+
+	l.mu.Lock()
+	evicted := l.items.put(s.Key, s)
+	l.mu.Unlock()
+
+	if l.dir == "" {
+		return
+	}
+	for _, k := range evicted {
+		l.removeFile(k)
+	}
+	if err := l.persist(s); err != nil {
+		l.logger.Printf("snapshot write failed key=%q err=%v", s.Key, err)
+	}
+}
+
+func (l *lastKnownGood) remove(key string) {
+	if l == nil {
+		return
+	}
+	l.diskMu.Lock()
+	defer l.diskMu.Unlock()
+
+	l.mu.Lock()
+	_, ok := l.items.get(key)
+	l.items.remove(key)
+	l.mu.Unlock()
+
+	if l.dir == "" || !ok {
+		return
+	}
+	l.removeFile(key)
+}
+
+func (l *lastKnownGood) removeFile(key string) {
+	if err := os.Remove(l.fileFor(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		l.logger.Printf("snapshot remove failed key=%q err=%v", key, err)
+	}
+}
+
+func (l *lastKnownGood) persist(s snapshot) error {
+	if l.keys.Enabled() && s.Body != nil {
+		sealed, err := l.keys.SealValue(s.Body, snapshotAAD(s.Key))
+		if err != nil {
+			return err
+		}
+		s.Body, s.Sealed = nil, sealed
+	}
+	return writeSnapshot(l.dir, s)
+}
+
+func writeSnapshot(dir string, s snapshot) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	// Policies contain secrets; keep snapshot files private.
+	tmp, err := os.CreateTemp(dir, ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), snapshotFile(dir, s.Key)); err != nil {
+		return fmt.Errorf("rename snapshot: %w", err)
+	}
+	return nil
+}
+
+// ReencryptSnapshots seals the bodies of the last-known-good snapshots persisted
+// in dir (see Options.SnapshotDir) with the active key of keys: plaintext ones,
+// and those sealed with another key. It returns the number of files rewritten.
+func ReencryptSnapshots(dir string, keys *atrest.Keyring) (int, error) {
+	if !keys.Enabled() {
+		return 0, errors.New("at-rest keys are required to re-encrypt snapshots")
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return n, err
+		}
+		var s snapshot
+		if err := json.Unmarshal(b, &s); err != nil || snapshotFile(dir, s.Key) != path {
+			return n, fmt.Errorf("%s: invalid snapshot file", path)
+		}
+		switch {
+		case s.Sealed != nil:
+			next, changed, err := keys.ResealValue(s.Sealed, snapshotAAD(s.Key))
+			if err != nil {
+				return n, fmt.Errorf("%s: %w", path, err)
+			}
+			if !changed {
+				continue
+			}
+			s.Sealed = next
+		case s.Body != nil:
+			if s.Sealed, err = keys.SealValue(s.Body, snapshotAAD(s.Key)); err != nil {
+				return n, err
+			}
+			s.Body = nil
+		default:
+			continue
+		}
+		if err := writeSnapshot(dir, s); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,175 @@
+package httpapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/exeteres/wg-feed/internal/atrest"
+)
+
+func TestHandler_ServesLastKnownGoodWhenStoreFails(t *testing.T) {
+	t.Parallel()
+
+	tokenSum := sha256.Sum256([]byte("s3cret"))
+	st := &memStore{values: map[string][]byte{
+		"wg-feed/feeds/client-a":    []byte(testEntryJSON),
+		"wg-feed/policies/client-a": []byte(`{"tokens": [{"id": "ops", "sha256": "` + hex.EncodeToString(tokenSum[:]) + `"}]}`),
+		"wg-feed/feeds/never-read":  []byte(testEntryJSON),
+	}}
+	h := newTestHandler(st)
+
+	resp, _ := serveTestRequest(t, h, "/client-a?token=s3cret", nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(staleHeader) != "" {
+		t.Fatalf("unexpected response: %d stale=%q", resp.StatusCode, resp.Header.Get(staleHeader))
+	}
+
+	outage := errors.New("etcd unavailable")
+	st.errs = map[string]error{
+		"wg-feed/feeds/client-a":      outage,
+		"wg-feed/policies/client-a":   outage,
+		"wg-feed/feeds/never-read":    outage,
+		"wg-feed/policies/never-read": outage,
+	}
+
+	resp, er := serveTestRequest(t, h, "/client-a?token=s3cret", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d: %q", resp.StatusCode, er.Message)
+	}
+	if resp.Header.Get(staleHeader) != "true" || resp.Header.Get("ETag") != `"rev-1"` {
+		t.Fatalf("unexpected headers: %v", resp.Header)
+	}
+
+	// The last known policy is still enforced.
+	if resp, _ := serveTestRequest(t, h, "/client-a?token=nope", nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected status for wrong token: %d", resp.StatusCode)
+	}
+
+	resp, er = serveTestRequest(t, h, "/never-read", nil)
+	if resp.StatusCode != http.StatusInternalServerError || !er.Retriable {
+		t.Fatalf("unexpected response without snapshot: %d retriable=%v", resp.StatusCode, er.Retriable)
+	}
+}
+
+func TestLastKnownGood_PersistsToDisk(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	logger := log.New(io.Discard, "", 0)
+
+	l := newLastKnownGood(dir, 10, nil, logger)
+	l.record(snapshot{Key: "wg-feed/feeds/a", Found: true, Body: []byte(`{"a":1}`), ETag: `"a"`})
+	l.record(snapshot{Key: "wg-feed/policies/a", Found: false})
+	l.record(snapshot{Key: "wg-feed/feeds/b", Found: true, Body: []byte(`{"b":1}`)})
+	l.remove("wg-feed/feeds/b")
+
+	reloaded := newLastKnownGood(dir, 10, nil, logger)
+	if s, ok := reloaded.lookup("wg-feed/feeds/a"); !ok || !s.Found || string(s.Body) != `{"a":1}` || s.ETag != `"a"` {
+		t.Fatalf("unexpected snapshot: %#v ok=%v", s, ok)
+	}
+	if s, ok := reloaded.lookup("wg-feed/policies/a"); !ok || s.Found {
+		t.Fatalf("expected recorded absence, got %#v ok=%v", s, ok)
+	}
+	if _, ok := reloaded.lookup("wg-feed/feeds/b"); ok {
+		t.Fatalf("expected removed snapshot to stay removed")
+	}
+}
+
+func TestLastKnownGood_SealsPersistedBodies(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	logger := log.New(io.Discard, "", 0)
+	oldKeys, _ := atrest.ParseKeyring("k1:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	newKeys, _ := atrest.ParseKeyring("k2:ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=,k1:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+
+	l := newLastKnownGood(dir, 10, oldKeys, logger)
+	l.record(snapshot{Key: "wg-feed/policies/a", Found: true, Body: []byte(`{"hmac_keys":[{"id":"k","secret":"c2VjcmV0"}]}`)})
+	// Written before at-rest keys were configured.
+	plain := newLastKnownGood(dir, 10, nil, logger)
+	plain.record(snapshot{Key: "wg-feed/feeds/a", Found: true, Body: []byte(`{"data":"PrivateKey = secret"}`)})
+
+	if n, err := ReencryptSnapshots(dir, newKeys); err != nil || n != 2 {
+		t.Fatalf("ReencryptSnapshots = %d, %v", n, err)
+	}
+	if n, err := ReencryptSnapshots(dir, newKeys); err != nil || n != 0 {
+		t.Fatalf("second ReencryptSnapshots = %d, %v", n, err)
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		b, _ := os.ReadFile(filepath.Join(dir, e.Name()))
+		if strings.Contains(string(b), "secret") || strings.Contains(string(b), "c2VjcmV0") || !strings.Contains(string(b), `"key_id":"k2"`) {
+			t.Fatalf("snapshot file not sealed with the active key: %s", b)
+		}
+	}
+
+	// The old key is retired; the snapshots still open.
+	retired, _ := atrest.ParseKeyring("k2:ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=")
+	reloaded := newLastKnownGood(dir, 10, retired, logger)
+	if s, ok := reloaded.lookup("wg-feed/feeds/a"); !ok || string(s.Body) != `{"data":"PrivateKey = secret"}` {
+		t.Fatalf("unexpected snapshot: %#v ok=%v", s, ok)
+	}
+	if s, ok := reloaded.lookup("wg-feed/policies/a"); !ok || !s.Found || s.Sealed != nil {
+		t.Fatalf("unexpected snapshot: %#v ok=%v", s, ok)
+	}
+}
+
+func TestHandler_MissingPathsLeaveNoSnapshots(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	st := &memStore{values: map[string][]byte{"wg-feed/feeds/open": []byte(testEntryJSON)}}
+	h := NewHandler(st, log.New(io.Discard, "", 0), Options{SnapshotDir: dir})
+
+	for i := range 100 {
+		if resp, _ := serveTestRequest(t, h, "/missing-"+strconv.Itoa(i), nil); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("unexpected status: %d", resp.StatusCode)
+		}
+	}
+	h.snapshots.mu.Lock()
+	n := h.snapshots.items.len()
+	h.snapshots.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d snapshots retained for missing paths", n)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("%d snapshot files written for missing paths", len(entries))
+	}
+
+	// Once the feed has been served, the absence of its policy is recorded too.
+	for range 2 {
+		if resp, _ := serveTestRequest(t, h, "/open", nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status: %d", resp.StatusCode)
+		}
+	}
+	outage := errors.New("etcd unavailable")
+	st.errs = map[string]error{"wg-feed/feeds/open": outage, "wg-feed/policies/open": outage}
+	if resp, er := serveTestRequest(t, h, "/open", nil); resp.StatusCode != http.StatusOK || resp.Header.Get(staleHeader) != "true" {
+		t.Fatalf("unexpected response during outage: %d %q", resp.StatusCode, er.Message)
+	}
+}
+
+func TestLastKnownGood_EvictsBeyondLimit(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	l := newLastKnownGood(dir, 2, nil, log.New(io.Discard, "", 0))
+	for _, k := range []string{"wg-feed/feeds/a", "wg-feed/feeds/b", "wg-feed/feeds/c"} {
+		l.record(snapshot{Key: k, Found: true, Body: []byte(`{}`)})
+	}
+
+	if _, ok := l.lookup("wg-feed/feeds/a"); ok {
+		t.Fatalf("expected the least recently used snapshot to be evicted")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Fatalf("expected 2 snapshot files, got %d", len(entries))
+	}
+}
@@ -0,0 +1,632 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/exeteres/wg-feed/internal/jsonpatch"
+	"github.com/exeteres/wg-feed/internal/model"
+	"github.com/exeteres/wg-feed/internal/stringsx"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	errWatchClosed    = errors.New("watch channel closed")
+	errWatchCompacted = errors.New("watch revision compacted")
+)
+
+// sseStream writes SSE frames and flushes after each one.
+type sseStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (s sseStream) writeFeed(b []byte) error {
+	return s.writeFrame(feedEventFrame(b))
+}
+
+// writeFrame writes a pre-rendered frame.
+func (s sseStream) writeFrame(frame []byte) error {
+	if _, err := s.w.Write(frame); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// writeHeartbeat writes an SSE comment line, which clients ignore.
+func (s sseStream) writeHeartbeat() error {
+	if _, err := io.WriteString(s.w, ": ping\n\n"); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s sseStream) writeRetry(d time.Duration) error {
+	if _, err := fmt.Fprintf(s.w, "retry: %d\n\n", d.Milliseconds()); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// feedEventFrame renders an event: feed frame with a single data: line containing the full JSON success response.
+func feedEventFrame(b []byte) []byte {
+	frame := make([]byte, 0, len(b)+len("event: feed\ndata: \n\n"))
+	frame = append(frame, "event: feed\ndata: "...)
+	frame = append(frame, b...)
+	return append(frame, "\n\n"...)
+}
+
+// patchEventFrame renders an event: patch frame whose data: line is a model.PatchEvent.
+func patchEventFrame(b []byte) []byte {
+	frame := make([]byte, 0, len(b)+len("event: patch\ndata: \n\n"))
+	frame = append(frame, "event: patch\ndata: "...)
+	frame = append(frame, b...)
+	return append(frame, "\n\n"...)
+}
+
+// errorEventFrame renders an event: error frame whose data: line is a wg-feed JSON error response.
+func errorEventFrame(message string, retriable bool) []byte {
+	b, _ := json.Marshal(model.ErrorResponse{
+		Version:   "wg-feed-00",
+		Success:   false,
+		Message:   message,
+		Retriable: retriable,
+	})
+	frame := make([]byte, 0, len(b)+len("event: error\ndata: \n\n"))
+	frame = append(frame, "event: error\ndata: "...)
+	frame = append(frame, b...)
+	return append(frame, "\n\n"...)
+}
+
+// sseEvent is a rendered SSE frame and the feed revision it carries.
+// The stream ends after a final event; a final event without a frame ends it
+// without sending anything (the feed was deleted and the client learns why
+// when it reconnects).
+type sseEvent struct {
+	frame    []byte
+	revision string
+	final    bool
+	// body is the success response of a feed event, which patch events
+	// (see sseSubscriber.frameFor) are computed from.
+	body []byte
+	// until is when the rendered feed reaches its next warn_after or not_after; zero if never.
+	until time.Time
+}
+
+// renderFeedEvent decodes and validates a stored entry and renders it as an SSE
+// event: a feed event, or a final error event for a revoked or expired feed.
+// An alias ends the stream without an event; the client reconnects and follows it.
+func (h *Handler) renderFeedEvent(key string, value []byte) (sseEvent, bool) {
+	entry, err := h.decodeAndValidateEntry(value)
+	if err != nil {
+		h.logger.Printf("feed entry invalid key=%q err=%v", key, err)
+		h.opts.Metrics.InvalidEntry(entryID(key))
+		return sseEvent{}, false
+	}
+	if entry.AliasOf != "" {
+		return sseEvent{revision: entry.Revision, final: true}, true
+	}
+	now := time.Now()
+	entry, gone := servedEntry(entry, now)
+	if gone != "" {
+		return sseEvent{frame: errorEventFrame(gone, false), revision: entry.Revision, final: true}, true
+	}
+	respBody, _, err := h.entryToSuccessResponseJSON(entry)
+	if err != nil {
+		h.logger.Printf("feed entry invalid key=%q err=%v", key, err)
+		h.opts.Metrics.InvalidEntry(entryID(key))
+		return sseEvent{}, false
+	}
+	until, _ := entry.NextChange(now)
+	return sseEvent{frame: feedEventFrame(respBody), revision: entry.Revision, body: respBody, until: until}, true
+}
+
+// sseSubscriber is the per-connection state of an SSE stream.
+type sseSubscriber struct {
+	h        *Handler
+	r        *http.Request
+	stream   sseStream
+	feedPath string
+	// key is the store key the feed is streamed from: the alias target when
+	// the request path is an alias.
+	key string
+	// policyKey is the store key of the access policy of feedPath; the stream
+	// is re-authorized whenever it changes.
+	policyKey    string
+	alias        *streamAlias
+	lastRevision string
+	// patches is set when the client accepts patch events; lastBody is then
+	// the success response it was last sent.
+	patches  bool
+	lastBody []byte
+	// deadline fires when the last sent feed reaches its next warn_after or not_after.
+	deadline *time.Timer
+}
+
+func newSSESubscriber(h *Handler, r *http.Request, stream sseStream, feedPath, key string) *sseSubscriber {
+	deadline := time.NewTimer(time.Hour)
+	deadline.Stop()
+	patches := slices.ContainsFunc(stringsx.SplitCommaSeparated(r.Header.Get(model.PatchHeader)), func(t string) bool {
+		return strings.EqualFold(t, model.PatchMediaType)
+	})
+	return &sseSubscriber{h: h, r: r, stream: stream, feedPath: feedPath, key: key, policyKey: h.opts.FeedKeys.PolicyKey(feedPath), deadline: deadline, patches: patches}
+}
+
+// streamAlias is the alias entry an SSE stream was resolved through. The stream
+// ends when the alias changes, so that the client reconnects and follows it.
+type streamAlias struct {
+	key  string
+	body []byte
+	rev  int64
+}
+
+// streamRead is the entry an SSE stream starts from.
+type streamRead struct {
+	key   string
+	entry model.FeedEntry
+	rev   int64
+	alias *streamAlias
+}
+
+// readStreamEntry reads and validates the entry at key, following an alias to
+// its target. Invalid entries and aliases of aliases wrap errInvalidEntry.
+func (h *Handler) readStreamEntry(ctx context.Context, key string) (streamRead, bool, error) {
+	body, rev, found, err := h.getWithRevision(ctx, key)
+	if err != nil || !found {
+		return streamRead{}, found, err
+	}
+	entry, err := h.decodeAndValidateEntry(body)
+	if err != nil {
+		return streamRead{}, false, &invalidEntryError{key: key, err: err}
+	}
+	if entry.AliasOf == "" {
+		return streamRead{key: key, entry: entry, rev: rev}, true, nil
+	}
+
+	alias := &streamAlias{key: key, body: body, rev: rev}
+	target := feedsPrefix + entry.AliasOf
+	body, rev, found, err = h.getWithRevision(ctx, target)
+	if err != nil || !found {
+		return streamRead{}, found, err
+	}
+	if entry, err = h.decodeAndValidateEntry(body); err != nil {
+		return streamRead{}, false, &invalidEntryError{key: target, err: err}
+	}
+	if entry.AliasOf != "" {
+		return streamRead{}, false, &invalidEntryError{key: target, err: fmt.Errorf("alias target %q is an alias", target)}
+	}
+	return streamRead{key: target, entry: entry, rev: rev, alias: alias}, true, nil
+}
+
+// aliasUnchanged re-reads the alias of the stream after a resync and reports
+// whether it is still the entry the stream was resolved through.
+func (s *sseSubscriber) aliasUnchanged(ctx context.Context) bool {
+	body, _, found, err := s.h.getWithRevision(ctx, s.alias.key)
+	if err != nil {
+		s.h.logger.Printf("etcd get failed feedPath=%q key=%q err=%v", s.feedPath, s.alias.key, err)
+		return false
+	}
+	return found && bytes.Equal(body, s.alias.body)
+}
+
+// sent records the revision the client has and arms the deadline timer for until.
+func (s *sseSubscriber) sent(revision string, until time.Time) {
+	s.lastRevision = revision
+	s.deadline.Stop()
+	if !until.IsZero() {
+		s.deadline.Reset(time.Until(until))
+	}
+}
+
+// sendEvent sends a rendered event. It returns false when the stream must end.
+func (s *sseSubscriber) sendEvent(ev sseEvent) bool {
+	if ev.frame == nil {
+		return !ev.final
+	}
+	if err := s.stream.writeFrame(s.frameFor(ev)); err != nil {
+		return false
+	}
+	s.sent(ev.revision, ev.until)
+	s.lastBody = ev.body
+	return !ev.final
+}
+
+// revoked re-checks the request against the access policy of the feed, so
+// that streams end once their token is revoked; the client reconnects and
+// receives the corresponding error response. Store failures do not end the stream.
+func (s *sseSubscriber) revoked() bool {
+	aerr := s.h.authorize(s.r.Context(), s.r, s.feedPath)
+	return aerr != nil && !aerr.retriable
+}
+
+// frameFor returns the frame to send for ev: a patch event against the last
+// sent success response when the client accepts them and the patch is
+// smaller than the full feed event.
+func (s *sseSubscriber) frameFor(ev sseEvent) []byte {
+	if !s.patches || ev.body == nil || s.lastBody == nil {
+		return ev.frame
+	}
+	patch, err := jsonpatch.Diff(s.lastBody, ev.body)
+	if err != nil {
+		s.h.logger.Printf("sse patch failed feedPath=%q err=%v", s.feedPath, err)
+		return ev.frame
+	}
+	b, err := json.Marshal(model.PatchEvent{Version: "wg-feed-00", BaseRevision: s.lastRevision, Revision: ev.revision, Patch: patch})
+	if err != nil {
+		return ev.frame
+	}
+	if frame := patchEventFrame(b); len(frame) < len(ev.frame) {
+		return frame
+	}
+	return ev.frame
+}
+
+// sendEntry renders and sends a stored entry. Invalid entries are logged and skipped.
+func (s *sseSubscriber) sendEntry(body []byte) bool {
+	ev, ok := s.h.renderFeedEvent(s.key, body)
+	if !ok {
+		return true
+	}
+	return s.sendEvent(ev)
+}
+
+// catchUp sends the re-read entry unless the client already has its revision
+// as served now. The stream ends when the feed no longer exists.
+func (s *sseSubscriber) catchUp(body []byte, found bool) bool {
+	if !found {
+		return false
+	}
+	if entry, err := s.h.decodeAndValidateEntry(body); err == nil {
+		if served, gone := servedEntry(entry, time.Now()); gone == "" && served.Revision == s.lastRevision {
+			return true
+		}
+	}
+	return s.sendEntry(body)
+}
+
+// refresh re-reads the feed and catches up with it. It returns the store
+// revision of the read, and false when the stream must end.
+func (s *sseSubscriber) refresh(ctx context.Context) (int64, bool) {
+	body, rev, found, err := s.h.getWithRevision(ctx, s.key)
+	if err != nil {
+		s.h.logger.Printf("etcd get failed feedPath=%q key=%q err=%v", s.feedPath, s.key, err)
+		return 0, false
+	}
+	return rev, s.catchUp(body, found)
+}
+
+func (h *Handler) serveSSE(w http.ResponseWriter, r *http.Request, feedPath, key string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.writeError(w, http.StatusNotImplemented, "streaming not supported", true)
+		return
+	}
+	ctx := r.Context()
+
+	read, ok2, err := h.readStreamEntry(ctx, key)
+	if errors.Is(err, errInvalidEntry) {
+		h.logger.Printf("feed entry invalid feedPath=%q key=%q err=%v", feedPath, key, err)
+		h.opts.Metrics.InvalidEntry(invalidEntryID(err))
+		h.writeError(w, http.StatusInternalServerError, "invalid feed entry", true)
+		return
+	}
+	if err != nil {
+		h.logger.Printf("etcd get failed feedPath=%q key=%q err=%v", feedPath, key, err)
+		if snap, ok := h.snapshots.lookup(key); ok && snap.Found {
+			h.opts.Metrics.StaleResponse()
+			h.serveStaleSSE(w, flusher, snap)
+			return
+		}
+		h.writeError(w, http.StatusInternalServerError, "internal error", true)
+		return
+	}
+	if !ok2 {
+		h.snapshots.remove(key)
+		h.writeError(w, http.StatusNotFound, "feed not found", false)
+		return
+	}
+	now := time.Now()
+	entry, gone := servedEntry(read.entry, now)
+	if gone != "" {
+		h.snapshots.remove(key)
+		h.writeError(w, http.StatusGone, gone, false)
+		return
+	}
+
+	respBody, _, err := h.entryToSuccessResponseJSON(entry)
+	if err != nil {
+		h.logger.Printf("feed entry invalid feedPath=%q key=%q err=%v", feedPath, key, err)
+		h.opts.Metrics.InvalidEntry(entryID(read.key))
+		h.writeError(w, http.StatusInternalServerError, "invalid feed entry", true)
+		return
+	}
+
+	h.snapshots.record(snapshot{Key: key, Found: true, Body: respBody, ETag: formatETagHeaderValue(entry.Revision), NotAfter: entry.NotAfter, WarnAfter: pendingWarning(entry, now)})
+
+	stream := startSSE(w, flusher)
+	defer h.opts.Metrics.SSEOpened()()
+	if err := stream.writeRetry(h.opts.SSERetry); err != nil {
+		return
+	}
+	if err := stream.writeFeed(respBody); err != nil {
+		return
+	}
+
+	sub := newSSESubscriber(h, r, stream, feedPath, read.key)
+	sub.alias = read.alias
+	sub.lastBody = respBody
+	defer sub.deadline.Stop()
+	until, _ := entry.NextChange(now)
+	sub.sent(entry.Revision, until)
+	heartbeat := time.NewTicker(h.opts.SSEHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	if h.hub != nil {
+		h.streamFromHub(ctx, sub, read.rev, heartbeat.C)
+		return
+	}
+	ws, ok := h.store.(watcher)
+	if !ok {
+		// Store doesn't support watch; just serve the initial event.
+		return
+	}
+	h.streamFromWatch(ctx, sub, ws, heartbeat.C)
+}
+
+func startSSE(w http.ResponseWriter, flusher http.Flusher) sseStream {
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	return sseStream{w: w, flusher: flusher}
+}
+
+// serveStaleSSE sends the last-known-good feed as the only event and ends the
+// stream; the client reconnects after the retry delay and gets live updates once the store is back.
+func (h *Handler) serveStaleSSE(w http.ResponseWriter, flusher http.Flusher, snap snapshot) {
+	setStaleHeaders(w, snap)
+	stream := startSSE(w, flusher)
+	if err := stream.writeRetry(h.opts.SSERetry); err != nil {
+		return
+	}
+	_ = stream.writeFeed(snap.Body)
+}
+
+// streamFromHub forwards updates from the shared watch. rev is the store revision the initial event was read at.
+func (h *Handler) streamFromHub(ctx context.Context, sub *sseSubscriber, rev int64, heartbeat <-chan time.Time) {
+	hs := h.hub.subscribe(sub.key, rev)
+	defer h.hub.unsubscribe(hs)
+	ps := h.hub.subscribe(sub.policyKey, rev)
+	defer h.hub.unsubscribe(ps)
+	// The policy may have changed between the request's authorization and rev.
+	if sub.revoked() {
+		return
+	}
+	var aliasCh <-chan hubMessage
+	if sub.alias != nil {
+		as := h.hub.subscribe(sub.alias.key, sub.alias.rev)
+		defer h.hub.unsubscribe(as)
+		aliasCh = as.ch
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-aliasCh:
+			switch {
+			case !ok:
+				return
+			case msg.resync:
+				if !sub.aliasUnchanged(ctx) {
+					return
+				}
+			case msg.modRev > sub.alias.rev:
+				// The alias was retired or repointed. A final error event
+				// (retirement) is sent before the stream ends.
+				if msg.event.final {
+					sub.sendEvent(msg.event)
+				}
+				return
+			}
+		case _, ok := <-ps.ch:
+			if !ok || sub.revoked() {
+				return
+			}
+		case <-heartbeat:
+			if sub.revoked() {
+				return
+			}
+			if err := sub.stream.writeHeartbeat(); err != nil {
+				return
+			}
+		case <-sub.deadline.C:
+			getRev, ok := sub.refresh(ctx)
+			if !ok {
+				return
+			}
+			rev = getRev
+		case msg, ok := <-hs.ch:
+			if !ok {
+				// Dropped as a slow consumer; the client reconnects and catches up.
+				h.logger.Printf("sse subscriber too slow feedPath=%q key=%q; closing stream", sub.feedPath, sub.key)
+				return
+			}
+			if msg.resync {
+				getRev, ok := sub.refresh(ctx)
+				if !ok {
+					return
+				}
+				rev = getRev
+				continue
+			}
+			if msg.modRev <= rev {
+				// Already covered by the initial read.
+				continue
+			}
+			rev = msg.modRev
+			if !sub.sendEvent(msg.event) {
+				return
+			}
+		}
+	}
+}
+
+// streamFromWatch forwards updates from a per-connection store watch, re-watching with backoff when it fails.
+func (h *Handler) streamFromWatch(ctx context.Context, sub *sseSubscriber, ws watcher, heartbeat <-chan time.Time) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// A policy change that revokes the token ends the stream. If the policy
+	// watch fails, heartbeats still re-check it.
+	policyCh := ws.Watch(ctx, sub.policyKey)
+	if sub.revoked() {
+		return
+	}
+	go func() {
+		for wr := range policyCh {
+			if len(wr.Events) > 0 && sub.revoked() {
+				cancel()
+				return
+			}
+		}
+	}()
+	if sub.alias != nil {
+		// Any change to the alias, or a failure to watch it, ends the stream;
+		// the client reconnects and follows the alias as it is then.
+		go func() {
+			defer cancel()
+			for wr := range ws.Watch(ctx, sub.alias.key) {
+				if len(wr.Events) > 0 || wr.Err() != nil || wr.CompactRevision != 0 {
+					return
+				}
+			}
+		}()
+	}
+	delay := h.opts.SSERewatchDelay
+	for {
+		watchCtx, cancelWatch := context.WithCancel(ctx)
+		cont, watchErr := pumpWatch(ctx, ws.Watch(watchCtx, sub.key), heartbeat, sub, func(ev *clientv3.Event) bool {
+			delay = h.opts.SSERewatchDelay
+			if ev.Kv == nil {
+				return true
+			}
+			if ev.Type == mvccpb.DELETE {
+				return false
+			}
+			return sub.sendEntry(ev.Kv.Value)
+		})
+		cancelWatch()
+		if !cont {
+			return
+		}
+
+		h.logger.Printf("etcd watch failed feedPath=%q key=%q err=%v; rewatching in %s", sub.feedPath, sub.key, watchErr, delay)
+		h.opts.Metrics.WatchFailed()
+		if !waitWithHeartbeats(ctx, delay, heartbeat, sub.stream) {
+			return
+		}
+		delay = min(delay*2, h.opts.SSERewatchMaxDelay)
+
+		// Catch up with a fresh read before watching again.
+		body, _, found, err := h.getWithRevision(ctx, sub.key)
+		if err != nil {
+			h.logger.Printf("etcd get failed feedPath=%q key=%q err=%v", sub.feedPath, sub.key, err)
+			continue
+		}
+		if !sub.catchUp(body, found) {
+			return
+		}
+	}
+}
+
+// pumpWatch forwards watch events to onEvent, writes heartbeats (ending the
+// stream if its token was revoked) and refreshes the feed at its deadlines
+// while the watch is healthy. It returns cont=false when the
+// stream must end (request done, client gone, or onEvent returned false), and
+// otherwise the reason the watch ended.
+func pumpWatch(ctx context.Context, watchCh clientv3.WatchChan, heartbeat <-chan time.Time, sub *sseSubscriber, onEvent func(*clientv3.Event) bool) (bool, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-heartbeat:
+			if sub.revoked() {
+				return false, nil
+			}
+			if err := sub.stream.writeHeartbeat(); err != nil {
+				return false, err
+			}
+		case <-sub.deadline.C:
+			if _, ok := sub.refresh(ctx); !ok {
+				return false, nil
+			}
+		case wr, ok := <-watchCh:
+			if !ok {
+				return ctx.Err() == nil, errWatchClosed
+			}
+			if wr.CompactRevision != 0 {
+				return true, fmt.Errorf("%w at %d", errWatchCompacted, wr.CompactRevision)
+			}
+			if err := wr.Err(); err != nil {
+				return true, err
+			}
+			for _, ev := range wr.Events {
+				if !onEvent(ev) {
+					return false, nil
+				}
+			}
+		}
+	}
+}
+
+// waitWithHeartbeats sleeps for d while keeping the stream alive. It reports false when the stream must end.
+func waitWithHeartbeats(ctx context.Context, d time.Duration, heartbeat <-chan time.Time, stream sseStream) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-heartbeat:
+			if err := stream.writeHeartbeat(); err != nil {
+				return false
+			}
+		case <-t.C:
+			return true
+		}
+	}
+}
+
+// getWithRevision reads key together with the store revision the read was served at
+// (0 when the store does not expose revisions), so that a watch can start right after it.
+func (h *Handler) getWithRevision(ctx context.Context, key string) ([]byte, int64, bool, error) {
+	return h.readWithRevision(ctx, "feed", key)
+}
+
+// readWithRevision is getWithRevision for any key; kind labels the store metrics.
+func (h *Handler) readWithRevision(ctx context.Context, kind, key string) ([]byte, int64, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if rw, ok := h.store.(revisionWatcher); ok {
+		body, rev, ok, err := rw.GetWithRevision(ctx, key)
+		h.opts.Metrics.ObserveStoreGet(kind, time.Since(start), err)
+		return body, rev, ok, err
+	}
+	body, ok, err := h.store.Get(ctx, key)
+	h.opts.Metrics.ObserveStoreGet(kind, time.Since(start), err)
+	return body, 0, ok, err
+}
@@ -0,0 +1,233 @@
+package httpapi
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/exeteres/wg-feed/internal/jsonpatch"
+	"github.com/exeteres/wg-feed/internal/model"
+)
+
+type flakyWatchStore struct {
+	mu      sync.Mutex
+	value   []byte
+	watches chan chan clientv3.WatchResponse
+}
+
+func (s *flakyWatchStore) Get(_ context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !strings.HasPrefix(key, "wg-feed/feeds/") {
+		return nil, false, nil
+	}
+	return s.value, true, nil
+}
+
+func (s *flakyWatchStore) set(value []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.value = value
+}
+
+// Watch hands watches on feeds to the test; other watches never fire.
+func (s *flakyWatchStore) Watch(ctx context.Context, key string) clientv3.WatchChan {
+	ch := make(chan clientv3.WatchResponse)
+	if strings.HasPrefix(key, "wg-feed/feeds/") {
+		s.watches <- ch
+	}
+	return ch
+}
+
+func entryWithRevision(rev string) []byte {
+	return []byte(strings.Replace(testEntryJSON, `"rev-1"`, `"`+rev+`"`, 1))
+}
+
+// readSSEFrame returns the lines of the next SSE frame (up to a blank line).
+func readSSEFrame(t *testing.T, r *bufio.Reader) []string {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read stream: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+// readFeedRevision skips heartbeats and returns the revision of the next feed event.
+func readFeedRevision(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	for {
+		frame := readSSEFrame(t, r)
+		if len(frame) == 2 && frame[0] == "event: feed" {
+			_, rest, _ := strings.Cut(frame[1], `"revision":"`)
+			rev, _, _ := strings.Cut(rest, `"`)
+			return rev
+		}
+	}
+}
+
+func TestServeSSE_RetryHeartbeatAndRewatch(t *testing.T) {
+	t.Parallel()
+
+	st := &flakyWatchStore{value: entryWithRevision("rev-1"), watches: make(chan chan clientv3.WatchResponse, 4)}
+	h := NewHandler(st, log.New(io.Discard, "", 0), Options{
+		SSEHeartbeatInterval: 10 * time.Millisecond,
+		SSERetry:             1500 * time.Millisecond,
+		SSERewatchDelay:      10 * time.Millisecond,
+	})
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/client-a", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+
+	if frame := readSSEFrame(t, r); len(frame) != 1 || frame[0] != "retry: 1500" {
+		t.Fatalf("unexpected first frame: %q", frame)
+	}
+	if rev := readFeedRevision(t, r); rev != "rev-1" {
+		t.Fatalf("unexpected initial revision: %q", rev)
+	}
+	if frame := readSSEFrame(t, r); len(frame) != 1 || frame[0] != ": ping" {
+		t.Fatalf("expected heartbeat, got %q", frame)
+	}
+
+	// The watch breaks while the entry changes; the handler must catch up after re-watching.
+	first := <-st.watches
+	st.set(entryWithRevision("rev-2"))
+	close(first)
+	if rev := readFeedRevision(t, r); rev != "rev-2" {
+		t.Fatalf("unexpected revision after rewatch: %q", rev)
+	}
+
+	second := <-st.watches
+	second <- clientv3.WatchResponse{Events: []*clientv3.Event{{
+		Type: mvccpb.PUT,
+		Kv:   &mvccpb.KeyValue{Key: []byte("wg-feed/feeds/client-a"), Value: entryWithRevision("rev-3")},
+	}}}
+	if rev := readFeedRevision(t, r); rev != "rev-3" {
+		t.Fatalf("unexpected revision from new watch: %q", rev)
+	}
+}
+
+func TestServeSSE_PatchEvents(t *testing.T) {
+	t.Parallel()
+
+	st := &flakyWatchStore{value: entryWithRevision("rev-1"), watches: make(chan chan clientv3.WatchResponse, 4)}
+	h := NewHandler(st, log.New(io.Discard, "", 0), Options{SSEHeartbeatInterval: time.Hour})
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/client-a", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set(model.PatchHeader, model.PatchMediaType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+
+	readSSEFrame(t, r) // retry
+	// The stream starts with a full feed event.
+	frame := readSSEFrame(t, r)
+	if len(frame) != 2 || frame[0] != "event: feed" {
+		t.Fatalf("unexpected initial frame: %q", frame)
+	}
+	last := []byte(strings.TrimPrefix(frame[1], "data: "))
+
+	watch := <-st.watches
+	changed := strings.Replace(string(entryWithRevision("rev-2")), `"Example"`, `"Changed"`, 1)
+	watch <- clientv3.WatchResponse{Events: []*clientv3.Event{{
+		Type: mvccpb.PUT,
+		Kv:   &mvccpb.KeyValue{Key: []byte("wg-feed/feeds/client-a"), Value: []byte(changed)},
+	}}}
+	frame = readSSEFrame(t, r)
+	if len(frame) != 2 || frame[0] != "event: patch" {
+		t.Fatalf("expected patch event, got %q", frame)
+	}
+	var ev model.PatchEvent
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(frame[1], "data: ")), &ev); err != nil || ev.Validate() != nil {
+		t.Fatalf("invalid patch event %q: %v", frame[1], err)
+	}
+	if ev.BaseRevision != "rev-1" || ev.Revision != "rev-2" {
+		t.Fatalf("unexpected revisions: %+v", ev)
+	}
+	patched, err := jsonpatch.Apply(last, ev.Patch)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	var sr model.SuccessResponse
+	if err := json.Unmarshal(patched, &sr); err != nil || sr.Validate() != nil {
+		t.Fatalf("invalid patched response %s: %v", patched, err)
+	}
+	if sr.Revision != "rev-2" || sr.Data.DisplayInfo.Title != "Changed" {
+		t.Fatalf("unexpected patched response: %s", patched)
+	}
+}
+
+func TestServeSSE_RevokedTokenClosesIdleStream(t *testing.T) {
+	t.Parallel()
+
+	tokenSum := sha256.Sum256([]byte("s3cret"))
+	st := &revStore{
+		values: map[string][]byte{
+			"wg-feed/feeds/client-a":    []byte(testEntryJSON),
+			"wg-feed/policies/client-a": []byte(`{"tokens": [{"id": "ops", "sha256": "` + hex.EncodeToString(tokenSum[:]) + `"}]}`),
+		},
+		rev:           1,
+		policyWatches: make(chan revWatch, 1),
+	}
+	srv := httptest.NewServer(NewHandler(st, log.New(io.Discard, "", 0), Options{SSEHeartbeatInterval: 10 * time.Millisecond}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r := openSSE(t, ctx, srv.URL+"/client-a?token=s3cret")
+	if rev := readFeedRevision(t, r); rev != "rev-1" {
+		t.Fatalf("unexpected initial revision: %q", rev)
+	}
+	if frame := readSSEFrame(t, r); len(frame) != 1 || frame[0] != ": ping" {
+		t.Fatalf("expected heartbeat, got %q", frame)
+	}
+
+	// The feed does not change; the next heartbeat must notice the revocation.
+	w := <-st.policyWatches
+	w.ch <- st.put("wg-feed/policies/client-a", []byte(`{}`))
+	for {
+		if _, err := r.ReadString('\n'); err == io.EOF {
+			return
+		} else if err != nil {
+			t.Fatalf("read stream: %v", err)
+		}
+	}
+}
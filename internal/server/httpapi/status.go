@@ -0,0 +1,36 @@
+package httpapi
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/exeteres/wg-feed/internal/model"
+	"github.com/exeteres/wg-feed/internal/status"
+)
+
+// serveStatusReport stores a client status report posted to the feed path
+// (see model.StatusReport). The request is authorized like a feed request, and
+// the report must name the served document unless it is encrypted.
+func (h *Handler) serveStatusReport(w http.ResponseWriter, r *http.Request, feedPath, key string) {
+	st, ok := h.store.(status.Writer)
+	if !ok || !h.opts.StatusReports {
+		h.writeError(w, http.StatusMethodNotAllowed, "method not allowed", false)
+		return
+	}
+	var report model.StatusReport
+	resp, ok := h.readFeedPost(w, r, feedPath, key, &report)
+	if !ok {
+		return
+	}
+	if id := servedFeedID(resp.body); id != "" && id != report.FeedID {
+		h.writeError(w, http.StatusBadRequest, "invalid request body: feed_id does not match the feed", false)
+		return
+	}
+
+	if err := status.Put(r.Context(), st, h.opts.FeedKeys.ID(feedPath), report, time.Now(), h.opts.StatusReportLimit); err != nil {
+		h.logger.Printf("status report put failed feedPath=%q device=%q err=%v", feedPath, report.DeviceID, err)
+		h.writeError(w, http.StatusInternalServerError, "internal error", true)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,127 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/exeteres/wg-feed/internal/model"
+	"github.com/exeteres/wg-feed/internal/status"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+// reportStore adds the writes of status reports to memStore.
+type reportStore struct {
+	memStore
+}
+
+func (s *reportStore) Put(_ context.Context, key string, value []byte) error {
+	s.values[key] = value
+	return nil
+}
+
+func (s *reportStore) CompareAndDelete(_ context.Context, key string, expected []byte) (bool, error) {
+	if v, ok := s.values[key]; !ok || !bytes.Equal(v, expected) {
+		return false, nil
+	}
+	delete(s.values, key)
+	return true, nil
+}
+
+func (s *reportStore) List(_ context.Context, prefix string) ([]*mvccpb.KeyValue, error) {
+	var kvs []*mvccpb.KeyValue
+	for k, v := range s.values {
+		if strings.HasPrefix(k, prefix) {
+			kvs = append(kvs, &mvccpb.KeyValue{Key: []byte(k), Value: v})
+		}
+	}
+	return kvs, nil
+}
+
+const testStatusReport = `{
+	"version": "wg-feed-00",
+	"device_id": "device-1",
+	"feed_id": "11111111-1111-4111-8111-111111111111",
+	"revision": "rev-1",
+	"tunnels": [{"id": "t1", "applied": true, "enabled": true, "handshake_age_seconds": 12}]
+}`
+
+func postStatusReport(h http.Handler, target, body string) int {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestHandler_StatusReport(t *testing.T) {
+	t.Parallel()
+
+	st := &reportStore{memStore{values: map[string][]byte{
+		"wg-feed/feeds/client-a": []byte(testEntryJSON),
+		"wg-feed/feeds/revoked":  []byte(`{"revision": "r", "revoked": true, "message": "gone"}`),
+	}}}
+
+	if code := postStatusReport(newTestHandler(st), "/client-a", testStatusReport); code != http.StatusMethodNotAllowed {
+		t.Fatalf("reports disabled: status = %d", code)
+	}
+
+	h := NewHandler(st, log.New(io.Discard, "", 0), Options{StatusReports: true})
+	if code := postStatusReport(h, "/client-a", testStatusReport); code != http.StatusNoContent {
+		t.Fatalf("report: status = %d", code)
+	}
+	var rec status.Record
+	if err := json.Unmarshal(st.values[status.Key("device-1", "client-a")], &rec); err != nil {
+		t.Fatalf("decode stored report: %v", err)
+	}
+	if rec.Report.Revision != "rev-1" || len(rec.Report.Tunnels) != 1 || rec.ReceivedAt.IsZero() {
+		t.Fatalf("unexpected stored report: %+v", rec)
+	}
+
+	for target, want := range map[string]int{
+		"/missing":  http.StatusNotFound,
+		"/revoked":  http.StatusGone,
+		"/_setup/x": http.StatusMethodNotAllowed,
+	} {
+		if code := postStatusReport(h, target, testStatusReport); code != want {
+			t.Fatalf("%s: status = %d, want %d", target, code, want)
+		}
+	}
+	if code := postStatusReport(h, "/client-a", `{"version": "wg-feed-00", "device_id": "../x"}`); code != http.StatusBadRequest {
+		t.Fatalf("invalid report: status = %d", code)
+	}
+	otherFeed := strings.Replace(testStatusReport, "11111111-1111-4111-8111-111111111111", "22222222-2222-4222-8222-222222222222", 1)
+	if code := postStatusReport(h, "/client-a", otherFeed); code != http.StatusBadRequest {
+		t.Fatalf("report for another feed: status = %d", code)
+	}
+
+	// Beyond the limit, a new device replaces the least recent one.
+	limited := NewHandler(st, log.New(io.Discard, "", 0), Options{StatusReports: true, StatusReportLimit: 1})
+	if code := postStatusReport(limited, "/client-a", strings.Replace(testStatusReport, "device-1", "device-2", 1)); code != http.StatusNoContent {
+		t.Fatalf("report beyond the limit: status = %d", code)
+	}
+	if _, ok := st.values[status.Key("device-1", "client-a")]; ok {
+		t.Fatalf("report beyond the limit kept the least recent device")
+	}
+	if _, ok := st.values[status.Key("device-2", "client-a")]; !ok {
+		t.Fatalf("report beyond the limit was not stored")
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/client-a", strings.NewReader(testStatusReport))
+	r.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("text/plain: status = %d", w.Code)
+	}
+	var er model.ErrorResponse
+	if err := json.NewDecoder(w.Body).Decode(&er); err != nil || er.Retriable {
+		t.Fatalf("unexpected error response %+v (%v)", er, err)
+	}
+}
@@ -0,0 +1,178 @@
+// Package metrics defines the Prometheus metrics exported by wg-feed-server.
+//
+// Feed paths are bearer secrets, so they never appear in labels; metrics that
+// are per feed use FeedID instead.
+package metrics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the server's collectors and the registry they are exported from.
+// All methods are safe to call on a nil *Metrics, which records nothing.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests       *prometheus.CounterVec
+	sseActive      prometheus.Gauge
+	storeDuration  *prometheus.HistogramVec
+	storeErrors    *prometheus.CounterVec
+	watchDispatch  prometheus.Histogram
+	invalidEntries *prometheus.CounterVec
+	staleResponses prometheus.Counter
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "wg_feed_requests_total",
+			Help: "Feed requests by response mode (json, sse) and HTTP status.",
+		}, []string{"mode", "status"}),
+		sseActive: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "wg_feed_sse_connections",
+			Help: "Currently open SSE streams.",
+		}),
+		storeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "wg_feed_store_get_duration_seconds",
+			Help:    "Latency of feed store reads by key kind (feed, policy).",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"kind"}),
+		storeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "wg_feed_store_errors_total",
+			Help: "Failed feed store operations by operation (get, watch).",
+		}, []string{"op"}),
+		watchDispatch: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "wg_feed_watch_dispatch_duration_seconds",
+			Help:    "Time from receiving a store watch event to handing it to all SSE streams of the feed.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 14),
+		}),
+		invalidEntries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "wg_feed_invalid_entries_total",
+			Help: "Stored feed entries that failed decoding or validation, by hashed feed id.",
+		}, []string{"feed"}),
+		staleResponses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "wg_feed_stale_responses_total",
+			Help: "Responses served from a last-known-good snapshot because the store was unavailable.",
+		}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.sseActive,
+		m.storeDuration,
+		m.storeErrors,
+		m.watchDispatch,
+		m.invalidEntries,
+		m.staleResponses,
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// FeedID returns a short stable identifier for feedPath that does not reveal it.
+func FeedID(feedPath string) string {
+	sum := sha256.Sum256([]byte(feedPath))
+	return hex.EncodeToString(sum[:4])
+}
+
+// RegisterResponseCache exports response cache usage, read from stats on every scrape.
+func (m *Metrics) RegisterResponseCache(stats func() (hits, misses uint64, entries int)) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "wg_feed_response_cache_hits_total",
+			Help: "JSON responses served from the response cache.",
+		}, func() float64 {
+			hits, _, _ := stats()
+			return float64(hits)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "wg_feed_response_cache_misses_total",
+			Help: "JSON responses that had to be read from the store.",
+		}, func() float64 {
+			_, misses, _ := stats()
+			return float64(misses)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "wg_feed_response_cache_entries",
+			Help: "Feeds with a cached JSON response.",
+		}, func() float64 {
+			_, _, entries := stats()
+			return float64(entries)
+		}),
+	)
+}
+
+func (m *Metrics) ObserveRequest(mode string, status int) {
+	if m == nil {
+		return
+	}
+	m.requests.WithLabelValues(mode, strconv.Itoa(status)).Inc()
+}
+
+// SSEOpened counts an open SSE stream; call the returned func when it ends.
+func (m *Metrics) SSEOpened() func() {
+	if m == nil {
+		return func() {}
+	}
+	m.sseActive.Inc()
+	return m.sseActive.Dec
+}
+
+// ObserveStoreGet records a store read of the given key kind (feed, policy).
+func (m *Metrics) ObserveStoreGet(kind string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.storeDuration.WithLabelValues(kind).Observe(d.Seconds())
+	if err != nil {
+		m.storeErrors.WithLabelValues("get").Inc()
+	}
+}
+
+// WatchFailed counts a store watch that ended with an error and has to be re-established.
+func (m *Metrics) WatchFailed() {
+	if m == nil {
+		return
+	}
+	m.storeErrors.WithLabelValues("watch").Inc()
+}
+
+func (m *Metrics) ObserveWatchDispatch(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.watchDispatch.Observe(d.Seconds())
+}
+
+// InvalidEntry counts a stored entry that failed decoding or validation. id is
+// the key component of the entry (its feed path, or its derived key).
+func (m *Metrics) InvalidEntry(id string) {
+	if m == nil {
+		return
+	}
+	m.invalidEntries.WithLabelValues(FeedID(id)).Inc()
+}
+
+func (m *Metrics) StaleResponse() {
+	if m == nil {
+		return
+	}
+	m.staleResponses.Inc()
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	b, err := io.ReadAll(w.Result().Body)
+	if err != nil {
+		t.Fatalf("read metrics: %v", err)
+	}
+	return string(b)
+}
+
+func TestMetrics_NeverExposeFeedPaths(t *testing.T) {
+	t.Parallel()
+
+	const feedPath = "very-secret-feed-path"
+	m := New()
+	m.InvalidEntry(feedPath)
+	m.ObserveStoreGet("feed", time.Millisecond, errors.New("boom"))
+	m.ObserveRequest("json", 304)
+
+	out := scrape(t, m)
+	if strings.Contains(out, feedPath) {
+		t.Fatalf("metrics leak the feed path:\n%s", out)
+	}
+	for _, want := range []string{
+		`wg_feed_invalid_entries_total{feed="` + FeedID(feedPath) + `"} 1`,
+		`wg_feed_store_errors_total{op="get"} 1`,
+		`wg_feed_requests_total{mode="json",status="304"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestMetrics_NilIsNoop(t *testing.T) {
+	t.Parallel()
+
+	var m *Metrics
+	m.ObserveRequest("sse", 200)
+	m.SSEOpened()()
+	m.InvalidEntry("a")
+	m.WatchFailed()
+	m.StaleResponse()
+	m.RegisterResponseCache(func() (uint64, uint64, int) { return 0, 0, 0 })
+}
@@ -0,0 +1,161 @@
+// Package setuplink implements bootstrap links: Setup URLs that are valid for
+// a limited time and/or a limited number of fetches, so that a link sent over
+// chat or email stops working once the client has used it.
+//
+// A link is served at /_setup/<token> and returns the document of its target
+// feed, whose endpoints[] point at the long-lived subscription path. The
+// record of a link is stored under wg-feed/links/<hex SHA-256 of the token>,
+// so the store contents cannot be redeemed on their own.
+package setuplink
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	Prefix = "wg-feed/links/"
+	// PathPrefix is the request path prefix (without the leading slash) of setup links.
+	PathPrefix = "_setup/"
+
+	tokenBytes = 32
+	// redeemAttempts bounds retries of Redeem when it races with concurrent fetches.
+	redeemAttempts = 5
+)
+
+var (
+	ErrNotFound = errors.New("setup link not found")
+	ErrExpired  = errors.New("setup link has expired")
+	ErrUsedUp   = errors.New("setup link has already been used")
+	ErrConflict = errors.New("setup link was redeemed concurrently")
+)
+
+// Store is the subset of feed store operations used by setup links.
+type Store interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	CompareAndPut(ctx context.Context, key string, expected, value []byte) (bool, error)
+}
+
+// Record is the stored state of a setup link.
+type Record struct {
+	// FeedID is the key component of the target feed: its path, or the form
+	// derived by feedkey.Deriver.ID.
+	FeedID    string     `json:"feed_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// MaxUses limits the number of successful fetches; 0 means unlimited.
+	MaxUses int `json:"max_uses,omitempty"`
+	Uses    int `json:"uses"`
+}
+
+// Check reports whether the link can still be redeemed at now.
+func (r Record) Check(now time.Time) error {
+	if r.ExpiresAt != nil && !now.Before(*r.ExpiresAt) {
+		return ErrExpired
+	}
+	if r.MaxUses > 0 && r.Uses >= r.MaxUses {
+		return ErrUsedUp
+	}
+	return nil
+}
+
+// Key returns the store key of the link with token.
+func Key(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return Prefix + hex.EncodeToString(sum[:])
+}
+
+// Create stores a new link to feedID that expires after ttl and allows
+// maxUses fetches (zero disables either limit, but not both) and returns its
+// token.
+func Create(ctx context.Context, st Store, feedID string, ttl time.Duration, maxUses int) (string, Record, error) {
+	if ttl < 0 || maxUses < 0 {
+		return "", Record{}, errors.New("link ttl and uses must be >= 0")
+	}
+	if ttl == 0 && maxUses == 0 {
+		return "", Record{}, errors.New("a setup link needs an expiry or a use limit")
+	}
+
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", Record{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	rec := Record{FeedID: feedID, CreatedAt: now, MaxUses: maxUses}
+	if ttl > 0 {
+		expires := now.Add(ttl)
+		rec.ExpiresAt = &expires
+	}
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return "", Record{}, err
+	}
+	ok, err := st.CompareAndPut(ctx, Key(token), nil, value)
+	if err != nil {
+		return "", Record{}, err
+	}
+	if !ok {
+		return "", Record{}, errors.New("setup link token collision")
+	}
+	return token, rec, nil
+}
+
+// Lookup returns the record of token, or ErrNotFound, ErrExpired or ErrUsedUp.
+func Lookup(ctx context.Context, st Store, token string, now time.Time) (Record, error) {
+	rec, _, err := lookup(ctx, st, token)
+	if err != nil {
+		return Record{}, err
+	}
+	return rec, rec.Check(now)
+}
+
+// Redeem counts one use of token. It fails like Lookup when the link is no
+// longer valid, e.g. because a concurrent fetch used it up.
+func Redeem(ctx context.Context, st Store, token string, now time.Time) (Record, error) {
+	for attempt := 0; attempt < redeemAttempts; attempt++ {
+		rec, current, err := lookup(ctx, st, token)
+		if err != nil {
+			return Record{}, err
+		}
+		if err := rec.Check(now); err != nil {
+			return Record{}, err
+		}
+		rec.Uses++
+		next, err := json.Marshal(rec)
+		if err != nil {
+			return Record{}, err
+		}
+		ok, err := st.CompareAndPut(ctx, Key(token), current, next)
+		if err != nil {
+			return Record{}, err
+		}
+		if ok {
+			return rec, nil
+		}
+	}
+	return Record{}, ErrConflict
+}
+
+func lookup(ctx context.Context, st Store, token string) (Record, []byte, error) {
+	value, found, err := st.Get(ctx, Key(token))
+	if err != nil {
+		return Record{}, nil, err
+	}
+	if !found {
+		return Record{}, nil, ErrNotFound
+	}
+	var rec Record
+	if err := json.Unmarshal(value, &rec); err != nil {
+		return Record{}, nil, fmt.Errorf("decode setup link: %w", err)
+	}
+	return rec, value, nil
+}
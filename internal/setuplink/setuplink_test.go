@@ -0,0 +1,97 @@
+package setuplink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memStore struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func (s *memStore) Get(_ context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	return v, ok, nil
+}
+
+func (s *memStore) CompareAndPut(_ context.Context, key string, expected, value []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, ok := s.values[key]
+	if (expected == nil && ok) || (expected != nil && (!ok || !bytes.Equal(cur, expected))) {
+		return false, nil
+	}
+	s.values[key] = value
+	return true, nil
+}
+
+func TestCreate(t *testing.T) {
+	st := &memStore{values: map[string][]byte{}}
+	ctx := context.Background()
+
+	if _, _, err := Create(ctx, st, "team/a", 0, 0); err == nil {
+		t.Fatalf("expected error for a link without limits")
+	}
+	token, rec, err := Create(ctx, st, "team/a", time.Hour, 2)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if rec.FeedID != "team/a" || rec.ExpiresAt == nil || rec.MaxUses != 2 {
+		t.Fatalf("unexpected record: %+v", rec)
+	}
+	for k := range st.values {
+		if k != Key(token) || strings.Contains(k, token) {
+			t.Fatalf("unexpected key %q", k)
+		}
+	}
+}
+
+func TestRedeemUseLimit(t *testing.T) {
+	st := &memStore{values: map[string][]byte{}}
+	ctx := context.Background()
+	now := time.Now()
+
+	token, _, err := Create(ctx, st, "team/a", 0, 2)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	for i := 1; i <= 2; i++ {
+		rec, err := Redeem(ctx, st, token, now)
+		if err != nil || rec.Uses != i {
+			t.Fatalf("Redeem %d: rec=%+v err=%v", i, rec, err)
+		}
+	}
+	if _, err := Redeem(ctx, st, token, now); !errors.Is(err, ErrUsedUp) {
+		t.Fatalf("expected ErrUsedUp, got %v", err)
+	}
+	if _, err := Lookup(ctx, st, token, now); !errors.Is(err, ErrUsedUp) {
+		t.Fatalf("Lookup: expected ErrUsedUp, got %v", err)
+	}
+	if _, err := Lookup(ctx, st, "unknown", now); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestRedeemExpiry(t *testing.T) {
+	st := &memStore{values: map[string][]byte{}}
+	ctx := context.Background()
+
+	token, rec, err := Create(ctx, st, "team/a", time.Hour, 0)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := Redeem(ctx, st, token, rec.ExpiresAt.Add(-time.Second)); err != nil {
+		t.Fatalf("Redeem before expiry: %v", err)
+	}
+	if _, err := Redeem(ctx, st, token, *rec.ExpiresAt); !errors.Is(err, ErrExpired) {
+		t.Fatalf("expected ErrExpired, got %v", err)
+	}
+}
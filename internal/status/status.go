@@ -0,0 +1,199 @@
+// Package status stores the status reports clients post to a feed's
+// status_url, and evaluates them for the admin API.
+//
+// The latest report of each device is kept under
+// wg-feed/status/<device id>/<feed id>, where feed id is the key component of
+// the feed (its path, or the form derived by feedkey.Deriver.ID). A device
+// that reports again replaces its previous report, so the store holds one
+// record per device and feed, up to a limit per feed.
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/exeteres/wg-feed/internal/feedkey"
+	"github.com/exeteres/wg-feed/internal/model"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+const Prefix = feedkey.StatusPrefix
+
+// Problems reported by Evaluate.
+const (
+	// ProblemStale means the device has not reported within the stale threshold.
+	ProblemStale = "stale"
+	// ProblemOutdated means the device has not applied the feed's current revision.
+	ProblemOutdated = "outdated"
+	// ProblemApplyFailed means a tunnel failed to apply.
+	ProblemApplyFailed = "apply_failed"
+	// ProblemNoHandshake means an applied tunnel has no handshake within the handshake threshold.
+	ProblemNoHandshake = "no_handshake"
+)
+
+// Writer is the store operations used to store reports.
+type Writer interface {
+	Lister
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Put(ctx context.Context, key string, value []byte) error
+	CompareAndDelete(ctx context.Context, key string, expected []byte) (bool, error)
+}
+
+// Lister is the store operation used to list reports.
+type Lister interface {
+	List(ctx context.Context, prefix string) ([]*mvccpb.KeyValue, error)
+}
+
+// Record is the stored form of a report.
+type Record struct {
+	ReceivedAt time.Time          `json:"received_at"`
+	Report     model.StatusReport `json:"report"`
+}
+
+// Device is a stored report as listed by the admin API.
+type Device struct {
+	// Feed is the key component of the feed the report was posted for.
+	Feed       string               `json:"feed"`
+	DeviceID   string               `json:"device_id"`
+	Revision   string               `json:"revision"`
+	ReceivedAt time.Time            `json:"received_at"`
+	Tunnels    []model.TunnelStatus `json:"tunnels"`
+	Problems   []string             `json:"problems,omitempty"`
+}
+
+// Criteria are the thresholds of Evaluate; zero disables a check.
+type Criteria struct {
+	StaleAfter     time.Duration
+	HandshakeAfter time.Duration
+}
+
+func Key(deviceID, feedID string) string {
+	return Prefix + deviceID + "/" + feedID
+}
+
+// Put stores report as the latest one of its device for feedID. With a
+// positive limit, a device reporting for the first time first drops the least
+// recently received reports of the feed, so that at most limit are kept.
+func Put(ctx context.Context, st Writer, feedID string, report model.StatusReport, now time.Time, limit int) error {
+	value, err := json.Marshal(Record{ReceivedAt: now.UTC().Truncate(time.Second), Report: report})
+	if err != nil {
+		return err
+	}
+	key := Key(report.DeviceID, feedID)
+	if limit > 0 {
+		_, exists, err := st.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if err := evict(ctx, st, feedID, limit-1); err != nil {
+				return err
+			}
+		}
+	}
+	return st.Put(ctx, key, value)
+}
+
+// evict deletes the least recently received reports of feedID beyond keep.
+func evict(ctx context.Context, st Writer, feedID string, keep int) error {
+	kvs, err := st.List(ctx, Prefix)
+	if err != nil {
+		return err
+	}
+	type stored struct {
+		kv         *mvccpb.KeyValue
+		receivedAt time.Time
+	}
+	var records []stored
+	for _, kv := range kvs {
+		_, feed, ok := strings.Cut(strings.TrimPrefix(string(kv.Key), Prefix), "/")
+		if !ok || feed != feedID {
+			continue
+		}
+		// Undecodable records sort first and are dropped first.
+		var rec Record
+		_ = json.Unmarshal(kv.Value, &rec)
+		records = append(records, stored{kv: kv, receivedAt: rec.ReceivedAt})
+	}
+	if len(records) <= keep {
+		return nil
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].receivedAt.Before(records[j].receivedAt) })
+	for _, r := range records[:len(records)-keep] {
+		// A record changed meanwhile was reported again and is kept.
+		if _, err := st.CompareAndDelete(ctx, string(r.kv.Key), r.kv.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns the stored reports, for feedID only unless it is empty, ordered
+// by feed and device.
+func List(ctx context.Context, st Lister, feedID string) ([]Device, error) {
+	kvs, err := st.List(ctx, Prefix)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]Device, 0, len(kvs))
+	for _, kv := range kvs {
+		deviceID, feed, ok := strings.Cut(strings.TrimPrefix(string(kv.Key), Prefix), "/")
+		if !ok || (feedID != "" && feed != feedID) {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(kv.Value, &rec); err != nil {
+			return nil, fmt.Errorf("decode status report %s: %w", kv.Key, err)
+		}
+		devices = append(devices, Device{
+			Feed:       feed,
+			DeviceID:   deviceID,
+			Revision:   rec.Report.Revision,
+			ReceivedAt: rec.ReceivedAt,
+			Tunnels:    rec.Report.Tunnels,
+		})
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].Feed != devices[j].Feed {
+			return devices[i].Feed < devices[j].Feed
+		}
+		return devices[i].DeviceID < devices[j].DeviceID
+	})
+	return devices, nil
+}
+
+// Evaluate returns the problems of d at now. currentRevision is the revision
+// the feed is served with; an empty one skips the outdated check.
+func (d Device) Evaluate(now time.Time, c Criteria, currentRevision string) []string {
+	var problems []string
+	if c.StaleAfter > 0 && now.Sub(d.ReceivedAt) > c.StaleAfter {
+		problems = append(problems, ProblemStale)
+	}
+	if currentRevision != "" && d.Revision != currentRevision {
+		problems = append(problems, ProblemOutdated)
+	}
+	failed, noHandshake := false, false
+	for _, t := range d.Tunnels {
+		if !t.Applied {
+			failed = true
+			continue
+		}
+		if c.HandshakeAfter > 0 && t.Enabled {
+			// The age was measured when the report was sent.
+			if age, ok := t.HandshakeAge(); !ok || age+now.Sub(d.ReceivedAt) > c.HandshakeAfter {
+				noHandshake = true
+			}
+		}
+	}
+	if failed {
+		problems = append(problems, ProblemApplyFailed)
+	}
+	if noHandshake {
+		problems = append(problems, ProblemNoHandshake)
+	}
+	return problems
+}
@@ -0,0 +1,138 @@
+package status
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/exeteres/wg-feed/internal/model"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+type memStore struct {
+	values map[string][]byte
+}
+
+func (s *memStore) Get(_ context.Context, key string) ([]byte, bool, error) {
+	v, ok := s.values[key]
+	return v, ok, nil
+}
+
+func (s *memStore) Put(_ context.Context, key string, value []byte) error {
+	s.values[key] = value
+	return nil
+}
+
+func (s *memStore) CompareAndDelete(_ context.Context, key string, expected []byte) (bool, error) {
+	if v, ok := s.values[key]; !ok || !bytes.Equal(v, expected) {
+		return false, nil
+	}
+	delete(s.values, key)
+	return true, nil
+}
+
+func (s *memStore) List(_ context.Context, prefix string) ([]*mvccpb.KeyValue, error) {
+	var kvs []*mvccpb.KeyValue
+	for k, v := range s.values {
+		if strings.HasPrefix(k, prefix) {
+			kvs = append(kvs, &mvccpb.KeyValue{Key: []byte(k), Value: v})
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return bytes.Compare(kvs[i].Key, kvs[j].Key) < 0 })
+	return kvs, nil
+}
+
+func report(deviceID, revision string, tunnels ...model.TunnelStatus) model.StatusReport {
+	return model.StatusReport{
+		Version:  "wg-feed-00",
+		DeviceID: deviceID,
+		FeedID:   "11111111-1111-4111-8111-111111111111",
+		Revision: revision,
+		Tunnels:  tunnels,
+	}
+}
+
+func TestPutAndList(t *testing.T) {
+	st := &memStore{values: map[string][]byte{}}
+	ctx := context.Background()
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, p := range []struct{ feed, device, rev string }{
+		{"team/a", "d2", "r1"},
+		{"team/a", "d1", "r1"},
+		{"team/a/sub", "d1", "r2"},
+		{"team/a", "d1", "r3"}, // replaces the first report of d1
+	} {
+		if err := Put(ctx, st, p.feed, report(p.device, p.rev), now, 0); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+
+	devices, err := List(ctx, st, "team/a")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(devices) != 2 || devices[0].DeviceID != "d1" || devices[0].Revision != "r3" || devices[1].DeviceID != "d2" {
+		t.Fatalf("unexpected devices: %+v", devices)
+	}
+	if all, err := List(ctx, st, ""); err != nil || len(all) != 3 || all[2].Feed != "team/a/sub" {
+		t.Fatalf("unexpected devices: %+v (%v)", all, err)
+	}
+}
+
+func TestPut_Limit(t *testing.T) {
+	st := &memStore{values: map[string][]byte{}}
+	ctx := context.Background()
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	for i, device := range []string{"d1", "d2", "d1", "d3", "d4"} {
+		if err := Put(ctx, st, "team/a", report(device, "r1"), now.Add(time.Duration(i)*time.Minute), 2); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	if err := Put(ctx, st, "team/b", report("d5", "r1"), now, 2); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	devices, err := List(ctx, st, "")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	var got []string
+	for _, d := range devices {
+		got = append(got, d.Feed+"/"+d.DeviceID)
+	}
+	// d2 and then d1, which reported again before d3, were the least recent.
+	if strings.Join(got, ",") != "team/a/d3,team/a/d4,team/b/d5" {
+		t.Fatalf("unexpected devices: %q", got)
+	}
+}
+
+func TestDeviceEvaluate(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	age := func(s int64) *int64 { return &s }
+	c := Criteria{StaleAfter: time.Hour, HandshakeAfter: 5 * time.Minute}
+
+	healthy := Device{Revision: "r1", ReceivedAt: now.Add(-time.Minute), Tunnels: []model.TunnelStatus{
+		{ID: "t1", Applied: true, Enabled: true, HandshakeAgeSeconds: age(30)},
+		{ID: "t2", Applied: true, Enabled: false},
+	}}
+	if problems := healthy.Evaluate(now, c, "r1"); len(problems) != 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+
+	failing := Device{Revision: "r0", ReceivedAt: now.Add(-2 * time.Hour), Tunnels: []model.TunnelStatus{
+		{ID: "t1", Applied: false, Error: "wg-quick up failed"},
+		{ID: "t2", Applied: true, Enabled: true},
+	}}
+	want := []string{ProblemStale, ProblemOutdated, ProblemApplyFailed, ProblemNoHandshake}
+	if problems := failing.Evaluate(now, c, "r1"); strings.Join(problems, ",") != strings.Join(want, ",") {
+		t.Fatalf("problems = %v, want %v", problems, want)
+	}
+	if problems := failing.Evaluate(now, Criteria{}, ""); strings.Join(problems, ",") != ProblemApplyFailed {
+		t.Fatalf("disabled checks: problems = %v", problems)
+	}
+}
@@ -1,15 +1,25 @@
 package upload
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"strings"
+	"time"
 
+	"filippo.io/age"
+
+	"github.com/exeteres/wg-feed/internal/enrollment"
 	"github.com/exeteres/wg-feed/internal/model"
+	"github.com/exeteres/wg-feed/internal/setuplink"
 )
 
 const AgeArmoredPrefix = "-----BEGIN AGE ENCRYPTED FILE-----"
@@ -19,6 +29,18 @@ type ParsedInput struct {
 	Data             map[string]any
 	EncryptedData    string
 	Encrypted        bool
+	// Recipients, when set for a plaintext document, makes the server encrypt
+	// Data to these age recipients at serve time.
+	Recipients []string
+	// WarnAfter, NotAfter and ExpiryWarning set the expiry of the feed (see model.FeedEntry).
+	WarnAfter     *time.Time
+	NotAfter      *time.Time
+	ExpiryWarning string
+	// Sequence is the sequence number of the entry (see history.NextSequence);
+	// 0 omits it. It must be set before Sign.
+	Sequence uint64
+	// Signature, set by Sign, is the detached signature of Data.
+	Signature *model.Signature
 }
 
 func ParseFeedPath(raw string) (string, error) {
@@ -27,9 +49,29 @@ func ParseFeedPath(raw string) (string, error) {
 	if feedPath == "" {
 		return "", errors.New("feedPath must be non-empty")
 	}
+	if strings.HasPrefix(feedPath+"/", setuplink.PathPrefix) {
+		return "", fmt.Errorf("feedPath must not start with %q (reserved for setup links)", setuplink.PathPrefix)
+	}
+	if strings.HasPrefix(feedPath+"/", enrollment.PathPrefix) {
+		return "", fmt.Errorf("feedPath must not start with %q (reserved for enrollment)", enrollment.PathPrefix)
+	}
 	return feedPath, nil
 }
 
+// ParseTimestamp parses an RFC 3339 timestamp; an empty string yields nil.
+func ParseTimestamp(raw string) (*time.Time, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return nil, fmt.Errorf("must be an RFC 3339 timestamp: %w", err)
+	}
+	t = t.UTC()
+	return &t, nil
+}
+
 func ValidateTTLSeconds(ttlSeconds int) error {
 	if ttlSeconds < 0 {
 		return fmt.Errorf("ttl must be >= 0")
@@ -85,6 +127,114 @@ func ParseInput(input string) (ParsedInput, error) {
 	}, nil
 }
 
+// ParseSigningKey parses an Ed25519 private key in PKCS #8 PEM form, as written
+// by "openssl genpkey -algorithm ed25519".
+func ParseSigningKey(pemBytes []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("signing key must be a PEM-encoded PKCS #8 private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse signing key: %w", err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key must be an Ed25519 key")
+	}
+	return priv, nil
+}
+
+// Sign signs the feed document of parsed, with its sequence, with priv. The
+// signer key is added to the revision material, so that a change of key
+// changes the revision.
+func Sign(parsed *ParsedInput, priv ed25519.PrivateKey) error {
+	if parsed.Encrypted {
+		return errors.New("signing requires a plaintext feed document (use recipients to encrypt it)")
+	}
+	sig, err := signDocument(parsed.Data, parsed.Sequence, priv)
+	if err != nil {
+		return err
+	}
+	parsed.Signature = &sig
+	parsed.RevisionMaterial = slices.Concat(parsed.RevisionMaterial, []byte("\x00signer="+sig.PublicKey))
+	return nil
+}
+
+// signDocument signs the feed document data in the form the server serves
+// it, i.e. without members unknown to model.FeedDocument.
+func signDocument(data any, sequence uint64, priv ed25519.PrivateKey) (model.Signature, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return model.Signature{}, fmt.Errorf("encode feed document: %w", err)
+	}
+	var doc model.FeedDocument
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return model.Signature{}, fmt.Errorf("decode feed document: %w", err)
+	}
+	if b, err = json.Marshal(doc); err != nil {
+		return model.Signature{}, fmt.Errorf("encode feed document: %w", err)
+	}
+	return model.SignFeedDocument(priv, b, sequence)
+}
+
+// ErrSigningKeyRequired is returned by Resequence for a signed entry when no
+// signing key is given.
+var ErrSigningKeyRequired = errors.New("entry is signed: the signing key is required to sign it with the new sequence")
+
+// Resequence returns the (opened) feed entry body with its sequence replaced
+// by sequence, e.g. to publish a recorded entry again. A signed entry is
+// signed again with priv. Tombstones and aliases are returned unchanged.
+func Resequence(body []byte, sequence uint64, priv ed25519.PrivateKey) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var entryObj map[string]any
+	if err := dec.Decode(&entryObj); err != nil {
+		return nil, fmt.Errorf("decode feed entry: %w", err)
+	}
+	if entryObj["revoked"] == true || entryObj["alias_of"] != nil {
+		return body, nil
+	}
+
+	entryObj["sequence"] = sequence
+	if _, signed := entryObj["signature"]; signed {
+		if priv == nil {
+			return nil, ErrSigningKeyRequired
+		}
+		if entryObj["data"] == nil {
+			return nil, errors.New("entry is signed but has no plaintext document to sign")
+		}
+		sig, err := signDocument(entryObj["data"], sequence, priv)
+		if err != nil {
+			return nil, err
+		}
+		entryObj["signature"] = sig
+	}
+
+	out, err := json.Marshal(entryObj)
+	if err != nil {
+		return nil, fmt.Errorf("encode feed entry: %w", err)
+	}
+	var entry model.FeedEntry
+	if err := json.Unmarshal(out, &entry); err != nil {
+		return nil, fmt.Errorf("decode feed entry: %w", err)
+	}
+	if err := entry.Validate(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ValidateRecipients checks that every recipient is an age X25519 recipient (age1...).
+func ValidateRecipients(recipients []string) error {
+	for i, r := range recipients {
+		if _, err := age.ParseX25519Recipient(strings.TrimSpace(r)); err != nil {
+			return fmt.Errorf("recipients[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
 func ComputeRevision(material []byte) string {
 	h := sha256.Sum256(material)
 	return hex.EncodeToString(h[:])
@@ -99,6 +249,17 @@ func BuildStoreBodyJSON(ttlSeconds int, parsed ParsedInput) ([]byte, string, err
 		return nil, "", errors.New("revision material must be non-empty")
 	}
 
+	if len(parsed.Recipients) > 0 {
+		if parsed.Encrypted {
+			return nil, "", errors.New("recipients require a plaintext feed document")
+		}
+		if err := ValidateRecipients(parsed.Recipients); err != nil {
+			return nil, "", err
+		}
+	}
+
+	// The revision is always derived from the input, so re-uploading the same
+	// plaintext with server-side encryption keeps the revision stable.
 	revision := ComputeRevision(parsed.RevisionMaterial)
 	entryObj := map[string]any{
 		"revision":       revision,
@@ -108,7 +269,12 @@ func BuildStoreBodyJSON(ttlSeconds int, parsed ParsedInput) ([]byte, string, err
 		"encrypted_data": nil,
 	}
 
-	if parsed.Encrypted {
+	if len(parsed.Recipients) > 0 {
+		entryObj["encrypted"] = true
+		entryObj["data"] = parsed.Data
+		entryObj["recipients"] = parsed.Recipients
+		delete(entryObj, "encrypted_data")
+	} else if parsed.Encrypted {
 		entryObj["encrypted_data"] = parsed.EncryptedData
 		delete(entryObj, "data")
 	} else {
@@ -116,9 +282,124 @@ func BuildStoreBodyJSON(ttlSeconds int, parsed ParsedInput) ([]byte, string, err
 		delete(entryObj, "encrypted_data")
 	}
 
+	// The expiry does not change the stored revision: the served document
+	// only changes once warn_after is reached, and its revision then depends
+	// on the warning (see model.FeedEntry.AtTime).
+	expiring := parsed.WarnAfter != nil || parsed.NotAfter != nil || parsed.ExpiryWarning != ""
+	if parsed.WarnAfter != nil {
+		entryObj["warn_after"] = parsed.WarnAfter
+	}
+	if parsed.NotAfter != nil {
+		entryObj["not_after"] = parsed.NotAfter
+	}
+	if parsed.ExpiryWarning != "" {
+		entryObj["expiry_warning"] = parsed.ExpiryWarning
+	}
+
+	if parsed.Sequence > 0 {
+		entryObj["sequence"] = parsed.Sequence
+	}
+	if parsed.Signature != nil {
+		entryObj["signature"] = parsed.Signature
+	}
+
 	storeBody, err := json.Marshal(entryObj)
 	if err != nil {
 		return nil, "", fmt.Errorf("encode feed entry: %w", err)
 	}
+	if expiring || parsed.Signature != nil {
+		var entry model.FeedEntry
+		if err := json.Unmarshal(storeBody, &entry); err != nil {
+			return nil, "", fmt.Errorf("decode feed entry: %w", err)
+		}
+		if err := entry.Validate(); err != nil {
+			return nil, "", err
+		}
+	}
 	return storeBody, revision, nil
 }
+
+// BuildTombstoneBodyJSON returns the etcd value body of a revoked feed, along with its revision.
+// Requests for the feed then receive a non-retriable error carrying message.
+func BuildTombstoneBodyJSON(message string) ([]byte, string, error) {
+	message = strings.TrimSpace(message)
+	if message == "" {
+		return nil, "", errors.New("revocation message must be non-empty")
+	}
+	entry := model.FeedEntry{
+		Revision: ComputeRevision([]byte("revoked\x00" + message)),
+		Revoked:  true,
+		Message:  message,
+	}
+	if err := entry.Validate(); err != nil {
+		return nil, "", err
+	}
+	storeBody, err := json.Marshal(entry)
+	if err != nil {
+		return nil, "", fmt.Errorf("encode feed entry: %w", err)
+	}
+	return storeBody, entry.Revision, nil
+}
+
+// BuildAliasBodyJSON returns the etcd value body of an alias of the feed with
+// key component targetID, along with its revision. Requests for the alias are
+// answered with the target feed.
+func BuildAliasBodyJSON(targetID string) ([]byte, string, error) {
+	entry := model.FeedEntry{
+		Revision: ComputeRevision([]byte("alias\x00" + targetID)),
+		AliasOf:  targetID,
+	}
+	if err := entry.Validate(); err != nil {
+		return nil, "", err
+	}
+	storeBody, err := json.Marshal(entry)
+	if err != nil {
+		return nil, "", fmt.Errorf("encode feed entry: %w", err)
+	}
+	return storeBody, entry.Revision, nil
+}
+
+// ValidateAliasTarget checks the stored entry of an alias target: it must exist
+// and must not be an alias itself, since aliases are only followed once.
+func ValidateAliasTarget(body []byte, found bool) error {
+	if !found {
+		return errors.New("alias target does not exist")
+	}
+	var e struct {
+		AliasOf string `json:"alias_of"`
+	}
+	if err := json.Unmarshal(body, &e); err != nil {
+		return fmt.Errorf("decode alias target: %w", err)
+	}
+	if e.AliasOf != "" {
+		return errors.New("alias target is an alias itself")
+	}
+	return nil
+}
+
+// BuildPolicyBodyJSON validates an access policy JSON object and returns its etcd value body.
+func BuildPolicyBodyJSON(input string) ([]byte, error) {
+	trimmed := strings.TrimSpace(input)
+	if trimmed == "" {
+		return nil, errors.New("stdin must be non-empty")
+	}
+
+	var policy model.AccessPolicy
+	dec := json.NewDecoder(strings.NewReader(trimmed))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&policy); err != nil {
+		return nil, fmt.Errorf("decode access policy JSON: %w", err)
+	}
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return nil, errors.New("decode access policy JSON: trailing data")
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("validate access policy: %w", err)
+	}
+
+	b, err := json.Marshal(policy)
+	if err != nil {
+		return nil, fmt.Errorf("encode access policy: %w", err)
+	}
+	return b, nil
+}
@@ -1,9 +1,19 @@
 package upload
 
 import (
+	"crypto/ed25519"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"testing"
+	"time"
+
+	"filippo.io/age"
+
+	"github.com/exeteres/wg-feed/internal/model"
 )
 
 func TestParseFeedPath(t *testing.T) {
@@ -18,6 +28,11 @@ func TestParseFeedPath(t *testing.T) {
 	if _, err := ParseFeedPath("   "); err == nil {
 		t.Fatalf("expected error")
 	}
+	for _, raw := range []string{"_setup", "/_setup/abc", "_enroll/abc"} {
+		if _, err := ParseFeedPath(raw); err == nil {
+			t.Fatalf("expected error for reserved path %q", raw)
+		}
+	}
 }
 
 func TestParseInput_Encrypted(t *testing.T) {
@@ -78,6 +93,45 @@ func TestParseInput_JSONValidatesAndCanonicalizes(t *testing.T) {
 	}
 }
 
+func TestBuildStoreBodyJSON_RecipientsKeepPlaintextRevision(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("GenerateX25519Identity: %v", err)
+	}
+	parsed, err := ParseInput(`{"id": "123e4567-e89b-12d3-a456-426614174000", "endpoints": ["https://example.com"], "display_info": {"title":"t"}, "tunnels": []}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, plainRevision, err := BuildStoreBodyJSON(60, parsed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	parsed.Recipients = []string{id.Recipient().String()}
+	body, revision, err := BuildStoreBodyJSON(60, parsed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if revision != plainRevision {
+		t.Fatalf("revision changed: got=%s want=%s", revision, plainRevision)
+	}
+	var entry model.FeedEntry
+	if err := json.Unmarshal(body, &entry); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if err := entry.Validate(); err != nil {
+		t.Fatalf("invalid entry: %v", err)
+	}
+	if !entry.Encrypted || entry.Data == nil || len(entry.Recipients) != 1 {
+		t.Fatalf("unexpected entry: %#v", entry)
+	}
+
+	parsed.Recipients = []string{"not-a-recipient"}
+	if _, _, err := BuildStoreBodyJSON(60, parsed); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
 func TestParseInput_JSONTrailingData(t *testing.T) {
 	_, err := ParseInput(`{"id": "123e4567-e89b-12d3-a456-426614174000", "endpoints": ["https://example.com"], "display_info": {"title":"t"}, "tunnels": []} {}`)
 	if err == nil {
@@ -92,3 +146,211 @@ func TestBuildStoreBodyJSON_TTLMustBeNonNegative(t *testing.T) {
 		t.Fatalf("expected error")
 	}
 }
+
+func TestBuildStoreBodyJSON_Expiry(t *testing.T) {
+	parsed, err := ParseInput(`{"id": "123e4567-e89b-12d3-a456-426614174000", "endpoints": ["https://example.com"], "display_info": {"title":"t"}, "tunnels": []}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, plainRevision, err := BuildStoreBodyJSON(60, parsed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if parsed.WarnAfter, err = ParseTimestamp("2026-01-01T00:00:00+02:00"); err != nil {
+		t.Fatalf("ParseTimestamp: %v", err)
+	}
+	if parsed.NotAfter, err = ParseTimestamp("2026-02-01T00:00:00Z"); err != nil {
+		t.Fatalf("ParseTimestamp: %v", err)
+	}
+	body, revision, err := BuildStoreBodyJSON(60, parsed)
+	if err != nil || revision != plainRevision {
+		t.Fatalf("unexpected result: revision=%s err=%v", revision, err)
+	}
+	var entry model.FeedEntry
+	if err := json.Unmarshal(body, &entry); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if entry.WarnAfter == nil || !entry.WarnAfter.Equal(time.Date(2025, 12, 31, 22, 0, 0, 0, time.UTC)) || entry.NotAfter == nil {
+		t.Fatalf("unexpected expiry: %+v", entry)
+	}
+
+	parsed.WarnAfter, parsed.NotAfter = parsed.NotAfter, parsed.WarnAfter
+	if _, _, err := BuildStoreBodyJSON(60, parsed); err == nil {
+		t.Fatalf("expected error for warn_after after not_after")
+	}
+	if _, err := ParseTimestamp("tomorrow"); err == nil {
+		t.Fatalf("expected error for invalid timestamp")
+	}
+}
+
+func TestBuildStoreBodyJSON_Signed(t *testing.T) {
+	// Unknown members are not served, so they must not be signed either.
+	parsed, err := ParseInput(`{"id": "123e4567-e89b-12d3-a456-426614174000", "endpoints": ["https://example.com"], "display_info": {"title":"t"}, "tunnels": [], "x_note": "dropped"}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, plainRevision, err := BuildStoreBodyJSON(60, parsed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, priv, _ := ed25519.GenerateKey(nil)
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+	key, err := ParseSigningKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatalf("ParseSigningKey: %v", err)
+	}
+	if err := Sign(&parsed, key); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	body, revision, err := BuildStoreBodyJSON(60, parsed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if revision == plainRevision {
+		t.Fatalf("revision did not change with the signature")
+	}
+	var entry model.FeedEntry
+	if err := json.Unmarshal(body, &entry); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	served, err := json.Marshal(entry.Data)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if entry.Signature == nil {
+		t.Fatalf("missing signature: %s", body)
+	}
+	if err := entry.Signature.Verify(served, entry.Sequence); err != nil {
+		t.Fatalf("Verify served document: %v", err)
+	}
+
+	if parsed.WarnAfter, err = ParseTimestamp("2026-01-01T00:00:00Z"); err != nil {
+		t.Fatalf("ParseTimestamp: %v", err)
+	}
+	if _, _, err := BuildStoreBodyJSON(60, parsed); err == nil {
+		t.Fatalf("expected error for a signed document with warn_after")
+	}
+
+	encrypted := ParsedInput{Encrypted: true, EncryptedData: AgeArmoredPrefix, RevisionMaterial: []byte(AgeArmoredPrefix)}
+	if err := Sign(&encrypted, key); err == nil {
+		t.Fatalf("expected error for signing encrypted input")
+	}
+	if _, err := ParseSigningKey([]byte("not a key")); err == nil {
+		t.Fatalf("expected error for invalid signing key")
+	}
+}
+
+func TestResequence(t *testing.T) {
+	parsed, err := ParseInput(`{"id": "123e4567-e89b-12d3-a456-426614174000", "endpoints": ["https://example.com"], "display_info": {"title":"t"}, "tunnels": []}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	parsed.Sequence = 2
+	_, priv, _ := ed25519.GenerateKey(nil)
+	if err := Sign(&parsed, priv); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	body, revision, err := BuildStoreBodyJSON(60, parsed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := Resequence(body, 5, nil); !errors.Is(err, ErrSigningKeyRequired) {
+		t.Fatalf("err=%v, want ErrSigningKeyRequired", err)
+	}
+	out, err := Resequence(body, 5, priv)
+	if err != nil {
+		t.Fatalf("Resequence: %v", err)
+	}
+	var entry model.FeedEntry
+	if err := json.Unmarshal(out, &entry); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if entry.Sequence != 5 || entry.Revision != revision {
+		t.Fatalf("sequence=%d revision=%q, want 5 and %q", entry.Sequence, entry.Revision, revision)
+	}
+	served, err := json.Marshal(entry.Data)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if err := entry.Signature.Verify(served, 5); err != nil {
+		t.Fatalf("Verify resequenced document: %v", err)
+	}
+
+	tombstone, _, err := BuildTombstoneBodyJSON("gone")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out, err := Resequence(tombstone, 5, nil); err != nil || string(out) != string(tombstone) {
+		t.Fatalf("tombstone changed: %s, %v", out, err)
+	}
+}
+
+func TestBuildPolicyBodyJSON(t *testing.T) {
+	sum := sha256.Sum256([]byte("s3cret"))
+	body, err := BuildPolicyBodyJSON(`{"tokens": [{"id": "ops", "sha256": "` + hex.EncodeToString(sum[:]) + `"}]}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(body) == 0 {
+		t.Fatalf("expected policy body")
+	}
+
+	// Unknown fields are rejected so that typos do not silently produce a deny-all policy.
+	if _, err := BuildPolicyBodyJSON(`{"token": []}`); err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, err := BuildPolicyBodyJSON(`{"tokens": [{"id": "ops", "sha256": "s3cret"}]}`); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestBuildTombstoneBodyJSON(t *testing.T) {
+	body, revision, err := BuildTombstoneBodyJSON("  subscription cancelled ")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var entry model.FeedEntry
+	if err := json.Unmarshal(body, &entry); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !entry.Revoked || entry.Message != "subscription cancelled" || entry.Revision != revision || entry.Validate() != nil {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+
+	if _, _, err := BuildTombstoneBodyJSON(" "); err == nil {
+		t.Fatalf("expected error for empty message")
+	}
+}
+
+func TestBuildAliasBodyJSON(t *testing.T) {
+	body, revision, err := BuildAliasBodyJSON("new/client-a")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var entry model.FeedEntry
+	if err := json.Unmarshal(body, &entry); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if entry.AliasOf != "new/client-a" || entry.Revision != revision || entry.Data != nil || entry.Validate() != nil {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+
+	if _, _, err := BuildAliasBodyJSON("/new/client-a"); err == nil {
+		t.Fatalf("expected error for a target with slashes")
+	}
+	if err := ValidateAliasTarget(body, true); err == nil {
+		t.Fatalf("expected error for an alias target that is an alias")
+	}
+	if err := ValidateAliasTarget(nil, false); err == nil {
+		t.Fatalf("expected error for a missing alias target")
+	}
+	if err := ValidateAliasTarget([]byte(`{"revision": "r", "revoked": true, "message": "m"}`), true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}